@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// cannedACLs - the canned ACLs of each provider accepting them.
+var cannedACLs = map[string][]string{
+	providerS3: {"private", "public-read", "public-read-write", "authenticated-read",
+		"aws-exec-read", "bucket-owner-read", "bucket-owner-full-control"},
+	providerGCS: {"private", "public-read", "public-read-write", "authenticated-read",
+		"bucket-owner-read", "bucket-owner-full-control", "project-private"},
+}
+
+// validateACL - returns an error if acl is not a canned ACL of the
+// provider.
+func validateACL(acl string) error {
+	acls, ok := cannedACLs[*flagProvider]
+	if !ok {
+		return fmt.Errorf("Canned ACLs are not supported with provider %s", *flagProvider)
+	}
+	for _, a := range acls {
+		if a == acl {
+			return nil
+		}
+	}
+	sorted := append([]string(nil), acls...)
+	sort.Strings(sorted)
+	return fmt.Errorf("Unknown canned ACL %q for provider %s, one of %s", acl, *flagProvider, strings.Join(sorted, ", "))
+}
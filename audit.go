@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditRecord - a single NDJSON record of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Bucket    string    `json:"bucket,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	UploadID  string    `json:"uploadId,omitempty"`
+	Part      int       `json:"part,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	HostID    string    `json:"hostId,omitempty"`
+	Duration  float64   `json:"durationSeconds"`
+}
+
+// auditLog - an append-only NDJSON file recording every S3 request,
+// shared by all clients of the process.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+var (
+	auditOnce sync.Once
+	auditErr  error
+	audit     *auditLog
+)
+
+// openAuditLog - opens the audit log configured with AUDIT_LOG, returns
+// nil if auditing is not enabled.
+func openAuditLog() (*auditLog, error) {
+	auditOnce.Do(func() {
+		path := os.Getenv("AUDIT_LOG")
+		if path == "" {
+			return
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			auditErr = err
+			return
+		}
+		audit = &auditLog{file: f, enc: json.NewEncoder(f)}
+	})
+	return audit, auditErr
+}
+
+// write - appends a record and syncs it to disk, records are small
+// enough to be written with a single append.
+func (a *auditLog) write(r auditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(r); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// s3Operation - names the S3 API operation of a request.
+func s3Operation(method string, query url.Values, bucket, key string) string {
+	_, uploadID := query["uploadId"]
+	_, uploads := query["uploads"]
+	switch method {
+	case http.MethodPost:
+		switch {
+		case uploads:
+			return "CreateMultipartUpload"
+		case uploadID:
+			return "CompleteMultipartUpload"
+		}
+		if _, ok := query["delete"]; ok {
+			return "DeleteObjects"
+		}
+		if _, ok := query["restore"]; ok {
+			return "RestoreObject"
+		}
+		if _, ok := query["select"]; ok {
+			return "SelectObjectContent"
+		}
+	case http.MethodPut:
+		switch {
+		case uploadID:
+			return "UploadPart"
+		case key == "":
+			return "PutBucket"
+		}
+		return "PutObject"
+	case http.MethodDelete:
+		switch {
+		case uploadID:
+			return "AbortMultipartUpload"
+		case key == "":
+			return "DeleteBucket"
+		}
+		return "DeleteObject"
+	case http.MethodHead:
+		if key == "" {
+			return "HeadBucket"
+		}
+		return "HeadObject"
+	case http.MethodGet:
+		switch {
+		case uploadID:
+			return "ListParts"
+		case uploads:
+			return "ListMultipartUploads"
+		}
+		if _, ok := query["location"]; ok {
+			return "GetBucketLocation"
+		}
+		if _, ok := query["policy"]; ok {
+			return "GetBucketPolicy"
+		}
+		if key == "" {
+			if bucket == "" {
+				return "ListBuckets"
+			}
+			return "ListObjects"
+		}
+		return "GetObject"
+	}
+	return method
+}
+
+// auditTransport - an http.RoundTripper recording every request made to
+// address in the audit log.
+type auditTransport struct {
+	base    http.RoundTripper
+	log     *auditLog
+	address string
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests are path style, or virtual host style on AWS.
+	bucket, key := "", strings.TrimPrefix(req.URL.Path, "/")
+	if host := req.URL.Host; host != t.address && strings.HasSuffix(host, "."+t.address) {
+		bucket = strings.TrimSuffix(host, "."+t.address)
+	} else if i := strings.Index(key, "/"); i >= 0 {
+		bucket, key = key[:i], key[i+1:]
+	} else {
+		bucket, key = key, ""
+	}
+
+	query := req.URL.Query()
+	r := auditRecord{
+		Time:      time.Now().UTC(),
+		Operation: s3Operation(req.Method, query, bucket, key),
+		Method:    req.Method,
+		Host:      req.URL.Host,
+		Bucket:    bucket,
+		Key:       key,
+		UploadID:  query.Get("uploadId"),
+		Bytes:     req.ContentLength,
+	}
+	r.Part, _ = strconv.Atoi(query.Get("partNumber"))
+
+	resp, err := t.base.RoundTrip(req)
+	r.Duration = time.Since(r.Time).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.Status = resp.StatusCode
+		r.RequestID = resp.Header.Get("X-Amz-Request-Id")
+		r.HostID = resp.Header.Get("X-Amz-Id-2")
+		if req.Method == http.MethodGet {
+			r.Bytes = resp.ContentLength
+		}
+	}
+	if r.Bytes < 0 {
+		r.Bytes = 0
+	}
+	// Records not written are printed, not to be lost silently.
+	if wErr := t.log.write(r); wErr != nil {
+		data, _ := json.Marshal(r)
+		fmt.Fprintln(os.Stderr, "audit log write failed", wErr, string(data))
+	}
+	return resp, err
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// azureVersion - the Blob service REST API version requests are made with.
+const azureVersion = "2020-10-02"
+
+// azureBackend - a Backend uploading parts as uncommitted blocks of a
+// block blob, committed with Put Block List on completion. Buckets are
+// containers and objects are blobs.
+type azureBackend struct {
+	endpoint *url.URL
+	account  string
+	// key is the decoded shared key, sas the SAS token used otherwise.
+	key    []byte
+	sas    url.Values
+	client *http.Client
+
+	mu sync.Mutex
+	// Metadata of the uploads in progress, applied on commit.
+	uploads map[string]map[string][]string
+}
+
+// azureEndpoints - returns the endpoints of the storage account set with
+// AZURE_STORAGE_ACCOUNT and either AZURE_STORAGE_KEY or AZURE_STORAGE_SAS.
+// AZURE_BLOB_ENDPOINT overrides the endpoint, e.g. for Azurite.
+func azureEndpoints() (*endpoints, error) {
+	b, err := newAzureBackend()
+	if err != nil {
+		return nil, err
+	}
+	return &endpoints{
+		sites:    []site{{Address: b.endpoint.Host, SSL: b.endpoint.Scheme == "https"}},
+		backends: []Backend{b},
+		policy:   failoverNone,
+		healthy:  []bool{true},
+		inflight: []int{0},
+		limits:   newOpLimits(),
+	}, nil
+}
+
+func newAzureBackend() (*azureBackend, error) {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	if account == "" {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT must be set with provider azure")
+	}
+
+	endpoint := os.Getenv("AZURE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &azureBackend{
+		endpoint: u,
+		account:  account,
+		uploads:  make(map[string]map[string][]string),
+	}
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		if b.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("Invalid AZURE_STORAGE_KEY: %v", err)
+		}
+	} else if sas := os.Getenv("AZURE_STORAGE_SAS"); sas != "" {
+		if b.sas, err = url.ParseQuery(strings.TrimPrefix(sas, "?")); err != nil {
+			return nil, fmt.Errorf("Invalid AZURE_STORAGE_SAS: %v", err)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "no credentials, using anonymous access to", u.Host)
+	}
+
+	transport, err := site{Address: u.Host, SSL: u.Scheme == "https"}.transport()
+	if err != nil {
+		return nil, err
+	}
+	b.client = &http.Client{Transport: transport}
+	return b, nil
+}
+
+// blockID - returns the id of a part's block. Ids must have the same
+// length for all blocks of a blob, and are scoped to the upload so that
+// blocks of abandoned uploads are never committed.
+func blockID(uploadID string, partID int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%06d", uploadID, partID)))
+}
+
+// request - sends a signed request for a blob.
+func (b *azureBackend) request(operation, method, container, blob string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path += "/" + container + "/" + blob
+	u.RawPath = ""
+	for k, v := range b.sas {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", azureVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if b.key != nil {
+		b.sign(req, int64(len(body)))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3ErrorFromResponse(operation, resp)
+	}
+	return resp, nil
+}
+
+// sign - signs req with the Shared Key scheme.
+func (b *azureBackend) sign(req *http.Request, contentLength int64) {
+	length := ""
+	if contentLength > 0 {
+		length = strconv.FormatInt(contentLength, 10)
+	}
+
+	var msHeaders []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk+":"+strings.TrimSpace(req.Header.Get(k)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + b.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for k, v := range query {
+		sort.Strings(v)
+		params = append(params, strings.ToLower(k)+":"+strings.Join(v, ","))
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		resource += "\n" + p
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-Md5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead.
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+
+	h := hmac.New(sha256.New, b.key)
+	h.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+b.account+":"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// NewMultipartUpload - block blobs need no initiation, the upload id
+// only scopes the block ids.
+func (b *azureBackend) NewMultipartUpload(container, blob string, metaData map[string][]string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+
+	b.mu.Lock()
+	b.uploads[uploadID] = metaData
+	b.mu.Unlock()
+	return uploadID, nil
+}
+
+// PutObjectPart - uploads the part as an uncommitted block.
+func (b *azureBackend) PutObjectPart(container, blob, uploadID string, partID int, size int64, data io.Reader, md5Sum, sha256Sum []byte) (minio.ObjectPart, error) {
+	// Requests are retried from the same buffer, read it whole.
+	body := make([]byte, size)
+	if _, err := io.ReadFull(data, body); err != nil {
+		return minio.ObjectPart{}, err
+	}
+
+	id := blockID(uploadID, partID)
+	query := url.Values{"comp": {"block"}, "blockid": {id}}
+	header := http.Header{}
+	if md5Sum != nil {
+		header.Set("Content-Md5", base64.StdEncoding.EncodeToString(md5Sum))
+	}
+	resp, err := b.request("PutBlock", http.MethodPut, container, blob, query, header, body)
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+	resp.Body.Close()
+
+	return minio.ObjectPart{
+		PartNumber:   partID,
+		ETag:         id,
+		Size:         size,
+		LastModified: time.Now().UTC(),
+	}, nil
+}
+
+// CompleteMultipartUpload - commits the blocks in part order along with
+// the metadata of the upload.
+func (b *azureBackend) CompleteMultipartUpload(container, blob, uploadID string, parts []minio.CompletePart) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, part := range parts {
+		body.WriteString("<Latest>" + part.ETag + "</Latest>")
+	}
+	body.WriteString("</BlockList>")
+
+	b.mu.Lock()
+	metaData := b.uploads[uploadID]
+	b.mu.Unlock()
+
+	header := http.Header{}
+	for k, v := range metaData {
+		lk := strings.ToLower(k)
+		switch {
+		case lk == "content-type":
+			header["X-Ms-Blob-Content-Type"] = v
+		case strings.HasPrefix(lk, "x-amz-meta-"):
+			header["X-Ms-Meta-"+strings.TrimPrefix(lk, "x-amz-meta-")] = v
+		}
+	}
+
+	resp, err := b.request("PutBlockList", http.MethodPut, container, blob,
+		url.Values{"comp": {"blocklist"}}, header, body.Bytes())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	b.mu.Lock()
+	delete(b.uploads, uploadID)
+	b.mu.Unlock()
+	return nil
+}
+
+// AbortMultipartUpload - forgets the upload, Azure garbage collects
+// uncommitted blocks after a week.
+func (b *azureBackend) AbortMultipartUpload(container, blob, uploadID string) error {
+	b.mu.Lock()
+	delete(b.uploads, uploadID)
+	b.mu.Unlock()
+	return nil
+}
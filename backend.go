@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Backend - a storage service objects are assembled on from parts. The
+// streaming, chunking, retry and progress machinery of putStream only
+// relies on this interface, which minio.Core implements for S3.
+type Backend interface {
+	// NewMultipartUpload starts an upload and returns its id.
+	NewMultipartUpload(bucket, object string, metaData map[string][]string) (string, error)
+	// PutObjectPart uploads a part, md5Sum and sha256Sum may be nil.
+	PutObjectPart(bucket, object, uploadID string, partID int, size int64, data io.Reader, md5Sum, sha256Sum []byte) (minio.ObjectPart, error)
+	// CompleteMultipartUpload assembles the object from the parts.
+	CompleteMultipartUpload(bucket, object, uploadID string, parts []minio.CompletePart) error
+	// AbortMultipartUpload discards the uploaded parts.
+	AbortMultipartUpload(bucket, object, uploadID string) error
+}
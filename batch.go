@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchItem - a line of a 'put-batch' worklist.
+type batchItem struct {
+	Path string
+	Key  string
+}
+
+// batchSummary - the report of a 'put-batch' run, printed last.
+type batchSummary struct {
+	Total    int     `json:"total"`
+	Uploaded int     `json:"uploaded"`
+	Skipped  int     `json:"skipped"`
+	Failed   int     `json:"failed"`
+	Bytes    int64   `json:"bytes"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// worklistField - returns a path or key of a worklist line. Names with
+// leading or trailing spaces, or any other character, can be given as Go
+// quoted strings.
+func worklistField(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, `"`) {
+		return s, nil
+	}
+	unquoted, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("Invalid quoted name %s", s)
+	}
+	return unquoted, nil
+}
+
+// readWorklist - parses a worklist of local paths, one per line, or of
+// 'path -> key' mappings. Other paths are uploaded under prefix, named
+// after their path relative to the current directory.
+func readWorklist(name, prefix string) ([]batchItem, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []batchItem
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var item batchItem
+		if i := strings.Index(line, " -> "); i >= 0 {
+			if item.Key, err = worklistField(line[i+4:]); err != nil {
+				return nil, err
+			}
+			line = line[:i]
+		}
+		if item.Path, err = worklistField(line); err != nil {
+			return nil, err
+		}
+		if item.Key == "" {
+			item.Key = prefix + strings.TrimPrefix(filepath.ToSlash(filepath.Clean(item.Path)), "/")
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// readDone - returns the keys recorded in the state file of a batch.
+func readDone(name string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		done[scanner.Text()] = true
+	}
+	return done, scanner.Err()
+}
+
+// putFile - uploads a local file.
+func putFile(bucketName, objectName, name string, metaData map[string][]string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return PutStream(bucketName, objectName, f, metaData)
+}
+
+// putBatchMain - implements the 'put-batch -list file' command, which
+// uploads the files of a worklist in parallel. Completed keys are
+// appended to a state file, so an interrupted batch resumes where it
+// stopped when run again.
+func putBatchMain(args []string) error {
+	flags := flag.NewFlagSet("put-batch", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	list := flags.String("list", "", "worklist of paths, or 'path -> key' lines")
+	prefix := flags.String("prefix", "", "prefix of the keys of paths without one")
+	parallel := flags.Int("parallel", 4, "number of objects uploaded at once")
+	state := flags.String("state", "", "file recording completed keys, '<list>.done' by default")
+	autoSanitize := flags.Bool("auto-sanitize-key", false, "replace control, invalid and awkward characters of keys, reporting the changes")
+	flags.Parse(args)
+	if *list == "" || *parallel < 1 || flags.NArg() != 0 {
+		return fmt.Errorf("Usage: put-batch -list file [-bucket name] [-prefix p] [-parallel n] [-state file]")
+	}
+	if *state == "" {
+		*state = *list + ".done"
+	}
+
+	if err := validateBucketName(*bucketName); err != nil {
+		return err
+	}
+	items, err := readWorklist(*list, *prefix)
+	if err != nil {
+		return err
+	}
+	// Every key is checked before the first upload starts.
+	for i := range items {
+		if items[i].Key, err = checkKey(items[i].Key, *autoSanitize); err != nil {
+			return fmt.Errorf("%s: %v", items[i].Path, err)
+		}
+	}
+	done, err := readDone(*state)
+	if err != nil {
+		return err
+	}
+	stateFile, err := os.OpenFile(*state, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer stateFile.Close()
+
+	start := time.Now()
+	summary := batchSummary{Total: len(items)}
+	enc := json.NewEncoder(os.Stdout)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan batchItem)
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				n, err := putFile(*bucketName, item.Key, item.Path, map[string][]string{})
+
+				mu.Lock()
+				result := multiResult{Object: item.Key, Size: n}
+				if err != nil {
+					summary.Failed++
+					result.Error = newErrorDetail(err)
+				} else {
+					summary.Uploaded++
+					summary.Bytes += n
+					fmt.Fprintln(stateFile, item.Key)
+				}
+				enc.Encode(result)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, item := range items {
+		if done[item.Key] {
+			summary.Skipped++
+			continue
+		}
+		work <- item
+	}
+	close(work)
+	wg.Wait()
+
+	summary.Seconds = time.Since(start).Seconds()
+	enc.Encode(summary)
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d objects failed", summary.Failed, summary.Total)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Circuit breaker metrics, keyed by endpoint address.
+var (
+	breakerOpened = expvar.NewMap("breaker_opened")
+	breakerClosed = expvar.NewMap("breaker_closed")
+)
+
+// breaker - tracks the error rate of the most recent requests to an
+// endpoint and opens once it crosses the configured rate.
+type breaker struct {
+	mu       sync.Mutex
+	address  string
+	rate     float64
+	cooldown time.Duration
+
+	// Ring of the most recent request outcomes, true means failed.
+	outcomes []bool
+	next     int
+	count    int
+
+	open      bool
+	openUntil time.Time
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*breaker)
+)
+
+// breakerFor - returns the breaker shared by all clients of an address,
+// nil unless BREAKER_ERROR_RATE is configured.
+func breakerFor(address string) (*breaker, error) {
+	v := os.Getenv("BREAKER_ERROR_RATE")
+	if v == "" {
+		return nil, nil
+	}
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if b, ok := breakers[address]; ok {
+		return b, nil
+	}
+
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("Invalid BREAKER_ERROR_RATE %q", v)
+	}
+
+	window := 20
+	if v = os.Getenv("BREAKER_WINDOW"); v != "" {
+		if window, err = strconv.Atoi(v); err != nil || window < 1 {
+			return nil, fmt.Errorf("Invalid BREAKER_WINDOW %q", v)
+		}
+	}
+
+	cooldown := 30 * time.Second
+	if v = os.Getenv("BREAKER_COOLDOWN"); v != "" {
+		if cooldown, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &breaker{
+		address:  address,
+		rate:     rate,
+		cooldown: cooldown,
+		outcomes: make([]bool, window),
+	}
+	breakers[address] = b
+	return b, nil
+}
+
+// wait - returns how long requests must back off, zero if the breaker
+// is closed or its cooldown has passed and a trial request may proceed.
+func (b *breaker) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return 0
+	}
+	if d := b.openUntil.Sub(time.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// record - records the outcome of a request, opening or closing the breaker.
+func (b *breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		// Requests after the cooldown are trials deciding the state.
+		if time.Now().Before(b.openUntil) {
+			return
+		}
+		if failed {
+			b.openUntil = time.Now().Add(b.cooldown)
+			return
+		}
+		b.open = false
+		b.count = 0
+		b.next = 0
+		breakerClosed.Add(b.address, 1)
+		fmt.Fprintln(os.Stderr, "circuit breaker closed", b.address)
+		return
+	}
+
+	b.outcomes[b.next] = failed
+	b.next = (b.next + 1) % len(b.outcomes)
+	if b.count < len(b.outcomes) {
+		b.count++
+		return
+	}
+
+	failures := 0
+	for _, f := range b.outcomes {
+		if f {
+			failures++
+		}
+	}
+	if float64(failures)/float64(len(b.outcomes)) >= b.rate {
+		b.open = true
+		b.openUntil = time.Now().Add(b.cooldown)
+		breakerOpened.Add(b.address, 1)
+		fmt.Fprintln(os.Stderr, "circuit breaker open", b.address, failures, "of", len(b.outcomes), "requests failed")
+	}
+}
+
+// breakerTransport - an http.RoundTripper backing off all requests while
+// the breaker is open, or sending them to a secondary endpoint instead.
+type breakerTransport struct {
+	base      http.RoundTripper
+	breaker   *breaker
+	secondary string
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.breaker.wait(); wait > 0 {
+		if t.secondary != "" {
+			// Only requests not covering the host in their signature
+			// can be redirected, see site.core.
+			r := new(http.Request)
+			*r = *req
+			r.URL = new(url.URL)
+			*r.URL = *req.URL
+			r.URL.Host = t.secondary
+			r.Host = t.secondary
+			return t.base.RoundTrip(r)
+		}
+		fmt.Fprintln(os.Stderr, "circuit breaker open, backing off", t.breaker.address, wait)
+		time.Sleep(wait)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	t.breaker.record(err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	return resp, err
+}
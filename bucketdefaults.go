@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// bucketDefaultsName - the object holding the defaults of the uploads to
+// a bucket, set by storage admins. It is read from BUCKET_DEFAULTS_BUCKET
+// as '<bucket>/.streams3.yaml' if set, a bucket only admins can write
+// to. Otherwise it is read from the root of the bucket itself, which any
+// writer can replace, so it is only applied if signed in
+// '.streams3.yaml.sig' by the gpg key of BUCKET_DEFAULTS_SIGNER, and
+// ignored without it.
+const bucketDefaultsName = ".streams3.yaml"
+
+// bucketDefaultsTTL - returns how long the defaults of a bucket are
+// cached, BUCKET_DEFAULTS_TTL (default 5m).
+func bucketDefaultsTTL() (time.Duration, error) {
+	v := os.Getenv("BUCKET_DEFAULTS_TTL")
+	if v == "" {
+		return 5 * time.Minute, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("Invalid BUCKET_DEFAULTS_TTL %q", v)
+	}
+	return ttl, nil
+}
+
+// bucketDefaults - the settings of a bucketDefaultsName object, applied
+// to uploads which don't set them:
+//
+//	part_size: 128MiB
+//	sse: aws:kms
+//	sse_kms_key_id: alias/streams
+//	storage_class: STANDARD_IA
+//	tags:
+//	  team: data
+type bucketDefaults struct {
+	PartSize     int64
+	SSE          string
+	SSEKeyID     string
+	StorageClass string
+	Tags         map[string]string
+}
+
+// parseSize - parses a number of bytes with an optional KiB, MiB, GiB or
+// TiB suffix.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 10, 64)
+			return n * u.size, err
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// yamlScalar - returns a YAML scalar without its quotes and comment.
+func yamlScalar(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') {
+		if i := strings.IndexByte(s[1:], s[0]); i >= 0 {
+			return s[1 : i+1]
+		}
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s
+}
+
+// parseBucketDefaults - parses the flat YAML mapping of a defaults
+// object, with tags as the only nested mapping.
+func parseBucketDefaults(data []byte) (bucketDefaults, error) {
+	var d bucketDefaults
+	inTags := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 0; scanner.Scan(); {
+		line++
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		i := strings.Index(trimmed, ":")
+		if i <= 0 {
+			return d, fmt.Errorf("line %d: expected 'key: value'", line)
+		}
+		key, value := yamlScalar(trimmed[:i]), yamlScalar(trimmed[i+1:])
+		nested := text[0] == ' ' || text[0] == '\t'
+		if nested {
+			if !inTags {
+				return d, fmt.Errorf("line %d: unexpected indentation", line)
+			}
+			d.Tags[key] = value
+			continue
+		}
+		inTags = false
+		var err error
+		switch key {
+		case "part_size":
+			d.PartSize, err = parseSize(value)
+		case "sse":
+			d.SSE = value
+		case "sse_kms_key_id":
+			d.SSEKeyID = value
+		case "storage_class":
+			d.StorageClass = value
+		case "tags":
+			if value != "" {
+				return d, fmt.Errorf("line %d: tags must be a mapping", line)
+			}
+			inTags = true
+			d.Tags = make(map[string]string)
+		default:
+			return d, fmt.Errorf("line %d: unknown setting %q", line, key)
+		}
+		if err != nil {
+			return d, fmt.Errorf("line %d: invalid %s %q", line, key, value)
+		}
+	}
+	return d, scanner.Err()
+}
+
+// cachedDefaults - the defaults of a bucket, nil if it has none, and when
+// they were read.
+type cachedDefaults struct {
+	defaults *bucketDefaults
+	read     time.Time
+}
+
+var (
+	defaultsMu    sync.Mutex
+	defaultsCache = make(map[string]cachedDefaults)
+)
+
+// readBucketDefaults - returns the content of the defaults of a bucket,
+// nil if it has none, or none that can be trusted.
+func readBucketDefaults(c minio.Core, bucketName string) ([]byte, error) {
+	if adminBucket := os.Getenv("BUCKET_DEFAULTS_BUCKET"); adminBucket != "" {
+		return getBytes(c, adminBucket, bucketName+"/"+bucketDefaultsName)
+	}
+	signer := os.Getenv("BUCKET_DEFAULTS_SIGNER")
+	if signer == "" {
+		return nil, nil
+	}
+	data, err := getBytes(c, bucketName, bucketDefaultsName)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := getBytes(c, bucketName, bucketDefaultsName+signatureSuffix)
+	if err == nil {
+		err = verifySignedBy(data, sig, signer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s not trusted: %v", bucketDefaultsName, err)
+	}
+	return data, nil
+}
+
+// loadBucketDefaults - returns the defaults of a bucket, fetched again
+// once older than bucketDefaultsTTL, nil if it has none or they can't be
+// read.
+func loadBucketDefaults(c minio.Core, bucketName string) (*bucketDefaults, error) {
+	ttl, err := bucketDefaultsTTL()
+	if err != nil {
+		return nil, err
+	}
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	if cached, ok := defaultsCache[bucketName]; ok && time.Since(cached.read) < ttl {
+		return cached.defaults, nil
+	}
+	data, err := readBucketDefaults(c, bucketName)
+	if err != nil || data == nil {
+		if err = wrapS3Error("GetObject", err); err != nil && !isNoSuchKey(err) {
+			// Writers may not be allowed to read the defaults.
+			fmt.Fprintln(os.Stderr, "defaults of bucket", bucketName, "not read:", err)
+		}
+		defaultsCache[bucketName] = cachedDefaults{read: time.Now()}
+		return nil, nil
+	}
+	d, err := parseBucketDefaults(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s of bucket %s: %v", bucketDefaultsName, bucketName, err)
+	}
+	defaultsCache[bucketName] = cachedDefaults{defaults: &d, read: time.Now()}
+	return &d, nil
+}
+
+// withBucketDefaults - returns o with the defaults of the bucket for the
+// settings o, its metadata and the environment leave unset.
+func withBucketDefaults(c minio.Core, bucketName string, o *Options) (*Options, error) {
+	d, err := loadBucketDefaults(c, bucketName)
+	if err != nil || d == nil {
+		return o, err
+	}
+	merged := *o
+	merged.Metadata = make(map[string][]string, len(o.Metadata)+2)
+	for k, v := range o.Metadata {
+		merged.Metadata[k] = v
+	}
+	if merged.PartSize == 0 && merged.Plan == nil {
+		merged.PartSize = d.PartSize
+	}
+	if d.SSE != "" && merged.SSE == "" && os.Getenv("SSE_KMS_KEY_ID") == "" && merged.Metadata["X-Amz-Server-Side-Encryption"] == nil {
+		merged.SSE, merged.SSEKeyID = d.SSE, d.SSEKeyID
+	}
+	if d.StorageClass != "" && merged.Metadata["X-Amz-Storage-Class"] == nil {
+		merged.Metadata["X-Amz-Storage-Class"] = []string{d.StorageClass}
+	}
+	if len(d.Tags) > 0 {
+		// Tags of the upload take precedence over those of the bucket.
+		tags, err := url.ParseQuery(strings.Join(merged.Metadata["X-Amz-Tagging"], "&"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid X-Amz-Tagging: %v", err)
+		}
+		keys := make([]string, 0, len(d.Tags))
+		for k := range d.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, ok := tags[k]; !ok {
+				tags.Set(k, d.Tags[k])
+			}
+		}
+		merged.Metadata["X-Amz-Tagging"] = []string{tags.Encode()}
+	}
+	if err = merged.Validate(); err != nil {
+		return nil, fmt.Errorf("Defaults of bucket %s: %v", bucketName, err)
+	}
+	return &merged, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Client - uploads streams to the endpoints configured in the
+// environment, reusing its clients and their connections across
+// uploads, unlike PutStream which sets up new ones every time.
+type Client struct {
+	e    *endpoints
+	opts []Option
+}
+
+// NewClient - returns a Client uploading with opts unless overridden by
+// the options of an upload. Its transports keep enough idle connections
+// for the concurrency and warm-up of the options.
+func NewClient(opts ...Option) (*Client, error) {
+	o := NewOptions(opts...)
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	conns := o.Concurrency
+	if conns == 0 {
+		var err error
+		if conns, err = parallelParts(); err != nil {
+			return nil, err
+		}
+	}
+	// One more for the requests initiating and completing uploads.
+	conns++
+	if o.WarmUp > conns {
+		conns = o.WarmUp
+	}
+	e, err := newPooledEndpoints(conns)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{e: e, opts: opts}, nil
+}
+
+// PutStream - same as the PutStream function, with the options of the
+// client and opts.
+func (c *Client) PutStream(bucketName, objectName string, reader io.Reader, opts ...Option) (n int64, err error) {
+	o := NewOptions(append(append([]Option(nil), c.opts...), opts...)...)
+	if err = o.Validate(); err != nil {
+		return 0, err
+	}
+	e := c.e.clone()
+	if o.WarmUp > 0 && e.s3() {
+		warmUp(e.site(), bucketName, o.WarmUp)
+	}
+	return putStreamEndpoints(e, bucketName, objectName, reader, o)
+}
+
+// warmUp - opens n connections to a site with concurrent HEAD requests
+// of the bucket, left idle in its transport for the parts to use.
+// Failures are only reported, the upload reports them again if they
+// persist.
+func warmUp(s site, bucketName string, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := siteRequest(s, "HeadBucket", http.MethodHead, bucketName, "", nil, nil, nil)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "warm up failed", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// skewCodes - error codes of requests refused because of their signing
+// time, which servers otherwise answer with an opaque 403.
+var skewCodes = map[string]bool{
+	"RequestTimeTooSkewed": true,
+	"RequestExpired":       true,
+}
+
+// clockOffset - nanoseconds to add to the local clock to get the time of
+// the server, measured from the Date of a refused request and updated
+// atomically.
+var clockOffset int64
+
+// skewTolerance - requests signed this close to the corrected time are
+// not signed again.
+const skewTolerance = time.Minute
+
+// signingTime - returns the time requests are signed with, the local
+// time corrected by any clock skew measured.
+func signingTime() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&clockOffset)))
+}
+
+// serverOffset - returns how far the clock of the server answering resp
+// is ahead of the local clock, false if resp has no Date.
+func serverOffset(resp *http.Response, received time.Time) (time.Duration, bool) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	// Date has a resolution of a second.
+	return date.Sub(received).Truncate(time.Second), true
+}
+
+// skewCode - returns the error code of a refused request, the body of
+// resp is left in place to be read again.
+func skewCode(resp *http.Response) string {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var errResp struct {
+		Code string `xml:"Code"`
+	}
+	xml.Unmarshal(body, &errResp)
+	return errResp.Code
+}
+
+// signedAt - returns the time req was signed at, false if it is not
+// signed in its headers.
+func signedAt(req *http.Request) (time.Time, bool) {
+	if req.Header.Get("Authorization") == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(sigV4DateFormat, req.Header.Get("X-Amz-Date")); err == nil {
+		return t, true
+	}
+	t, err := http.ParseTime(req.Header.Get("Date"))
+	return t, err == nil
+}
+
+// skewTransport - an http.RoundTripper correcting the clock of requests
+// refused for their signing time. The skew is measured from the Date of
+// the refusal, requests signed with the uncorrected local time, such as
+// those of the minio client, are then signed again with SigV4.
+type skewTransport struct {
+	base  http.RoundTripper
+	creds credentials
+}
+
+// resign - returns a copy of req signed with the corrected time, false
+// if req can't be signed again.
+func (t *skewTransport) resign(req *http.Request) (*http.Request, bool) {
+	at, ok := signedAt(req)
+	if !ok || t.creds.SecretKey == "" {
+		return nil, false
+	}
+	if d := signingTime().Sub(at); -skewTolerance < d && d < skewTolerance {
+		return nil, false
+	}
+	r, ok := resignV4(req, t.creds)
+	if !ok || req.Body == nil || req.Body == http.NoBody {
+		return r, ok
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	r.Body = body
+	return r, true
+}
+
+func (t *skewTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt64(&clockOffset) != 0 {
+		if r, ok := t.resign(req); ok {
+			req = r
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusForbidden || !skewCodes[skewCode(resp)] {
+		return resp, err
+	}
+
+	offset, ok := serverOffset(resp, time.Now())
+	if !ok {
+		fmt.Fprintln(os.Stderr, "request refused for its signing time and the server sent no Date to correct it with, check the clock of this host")
+		return resp, nil
+	}
+	previous := time.Duration(atomic.SwapInt64(&clockOffset, int64(offset)))
+	if d := offset - previous; d <= -skewTolerance || d >= skewTolerance {
+		skew, direction := offset, "behind"
+		if offset < 0 {
+			skew, direction = -offset, "ahead of"
+		}
+		fmt.Fprintf(os.Stderr, "clock skew: the local clock is %s %s %s, signing with the corrected time, check NTP on this host\n",
+			skew, direction, req.URL.Host)
+	}
+
+	// Requests whose body can't be read again are retried by the minio client.
+	r, ok := t.resign(req)
+	if !ok {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// completeRetryPolicy - how CompleteMultipartUpload is retried when the
+// store does not see the upload or its parts yet, set with
+// COMPLETE_RETRIES (default 3) and COMPLETE_RETRY_DELAY (default 1s,
+// doubled on every retry). Separate from the retries of parts.
+func completeRetryPolicy() (retries int, delay time.Duration, err error) {
+	retries, delay = 3, time.Second
+	if v := os.Getenv("COMPLETE_RETRIES"); v != "" {
+		if retries, err = strconv.Atoi(v); err != nil || retries < 0 {
+			return 0, 0, fmt.Errorf("Invalid COMPLETE_RETRIES %q", v)
+		}
+	}
+	if v := os.Getenv("COMPLETE_RETRY_DELAY"); v != "" {
+		if delay, err = time.ParseDuration(v); err != nil || delay <= 0 {
+			return 0, 0, fmt.Errorf("Invalid COMPLETE_RETRY_DELAY %q", v)
+		}
+	}
+	return retries, delay, nil
+}
+
+// isNotYetVisible - returns true if a completion failed because the store
+// does not list the upload or its parts yet, as eventually consistent
+// stores do right after the last part.
+func isNotYetVisible(err error) bool {
+	switch errorCode(err) {
+	case "NoSuchUpload", "NoSuchKey", "InvalidPart", "404":
+		return true
+	}
+	return false
+}
+
+// partsVisible - returns true once every part is listed by the store,
+// and an error if one is listed with another ETag, as completing would
+// then fail or assemble other data.
+func partsVisible(c minio.Core, bucketName, objectName, uploadID string, parts []minio.CompletePart) (bool, error) {
+	listed, err := listedParts(c, bucketName, objectName, uploadID)
+	if err != nil {
+		if isNotYetVisible(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, part := range parts {
+		uploaded, ok := listed[part.PartNumber]
+		if !ok {
+			return false, nil
+		}
+		if strings.Trim(uploaded.ETag, "\"") != strings.Trim(part.ETag, "\"") {
+			return false, fmt.Errorf("Part %d of upload %s is listed with ETag %s, completing with %s", part.PartNumber, uploadID, uploaded.ETag, part.ETag)
+		}
+	}
+	return true, nil
+}
+
+// completedETag - returns the ETag S3 gives the object completed from
+// parts, empty if a part has no MD5 ETag.
+func completedETag(parts []minio.CompletePart) string {
+	h := md5.New()
+	for _, part := range parts {
+		sum, err := hex.DecodeString(strings.Trim(part.ETag, "\""))
+		if err != nil || len(sum) != md5.Size {
+			return ""
+		}
+		h.Write(sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+}
+
+// alreadyCompleted - returns true if the key holds the object completed
+// from parts, as when a completion succeeded but its response was lost
+// and the upload is gone on retry.
+func alreadyCompleted(e *endpoints, bucketName, objectName string, parts []minio.CompletePart) bool {
+	etag := completedETag(parts)
+	if etag == "" {
+		return false
+	}
+	st, err := statObject(e.site(), bucketName, objectName, "")
+	if err != nil {
+		return false
+	}
+	return strings.Trim(st.ETag, "\"") == etag
+}
+
+// completeUpload - completes a multipart upload, retrying as set by
+// completeRetryPolicy while the store does not see the upload or its
+// parts yet. Every retry waits for ListParts to show all the parts.
+func completeUpload(e *endpoints, bucketName, objectName, uploadID string, parts []minio.CompletePart) error {
+	retries, delay, err := completeRetryPolicy()
+	if err != nil {
+		return err
+	}
+	if err = e.lock.check(); err != nil {
+		// Another writer may complete the key, this upload must not.
+		if aErr := e.backend().AbortMultipartUpload(bucketName, objectName, uploadID); aErr != nil {
+			fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+		}
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = e.do(func(b Backend) error {
+			return b.CompleteMultipartUpload(bucketName, objectName, uploadID, parts)
+		})
+		if err == nil || !e.s3() || !isNotYetVisible(err) {
+			return err
+		}
+		if errorCode(err) == "NoSuchUpload" && alreadyCompleted(e, bucketName, objectName, parts) {
+			fmt.Fprintln(os.Stderr, "upload", uploadID, "was already completed")
+			return nil
+		}
+		for {
+			if attempt >= retries {
+				return err
+			}
+			if lErr := e.limits.spendRetry(err); lErr != nil {
+				return lErr
+			}
+			fmt.Fprintf(os.Stderr, "CompleteMultipartUpload of %s failed with %s, retrying in %s\n", uploadID, errorCode(err), delay)
+			time.Sleep(delay)
+			delay *= 2
+			visible, vErr := partsVisible(e.core(), bucketName, objectName, uploadID, parts)
+			if vErr != nil {
+				return vErr
+			}
+			if visible {
+				break
+			}
+			attempt++
+		}
+	}
+}
+
+// streamEnded - returns why the parts listed for an upload are known to
+// hold its whole stream, empty if they aren't: the status of the upload
+// records that its writer read the stream to its end, or the expected
+// size was given.
+func streamEnded(bucketName, uploadID string, listed map[int]minio.ObjectPart, size, expectedSize int64) string {
+	if expectedSize >= 0 {
+		if size == expectedSize {
+			return "expected size"
+		}
+		fmt.Fprintf(os.Stderr, "upload %s holds %d bytes, %d expected\n", uploadID, size, expectedSize)
+		return ""
+	}
+	status, err := loadStatus(bucketName, uploadID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "no status of upload", uploadID+":", err)
+		return ""
+	}
+	if status.UploadID != uploadID || status.State != stateReadComplete || status.Bytes != size || len(status.Journal) != len(listed) {
+		fmt.Fprintf(os.Stderr, "status of upload %s is %s with %d bytes, not %s\n", uploadID, status.State, status.Bytes, stateReadComplete)
+		return ""
+	}
+	for _, part := range status.Journal {
+		if uploaded, ok := listed[part.Number]; !ok || strings.Trim(uploaded.ETag, "\"") != strings.Trim(part.ETag, "\"") {
+			fmt.Fprintf(os.Stderr, "part %d of upload %s differs from its status journal\n", part.Number, uploadID)
+			return ""
+		}
+	}
+	return "status " + stateReadComplete
+}
+
+// checkUnlocked - fails if the lease of a key is held, as its writer may
+// still be uploading.
+func checkUnlocked(s site, bucketName, objectName string) error {
+	held, err := readLease(s, bucketName, lockObjectName(objectName))
+	if isNoSuchKey(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !held.expired() {
+		return fmt.Errorf("%s is locked by %s (pid %d) until %s, its writer may still be uploading", objectName,
+			held.Host, held.PID, held.expiresAt().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// completeMain - implements the 'complete [-bucket name] [-object key]
+// <upload-id>' command, which completes an upload whose uploader is gone,
+// with the parts listed by the server. Only uploads known to hold their
+// whole stream are completed under their key, others are completed as
+// '<object>.partial' like 'salvage' does. Uploads missing a part are left
+// to 'salvage', as completing them would leave a hole in the object.
+func completeMain(args []string) error {
+	flags := flag.NewFlagSet("complete", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket of the upload")
+	objectName := flags.String("object", "", "object of the upload, looked up among the uploads in progress by default")
+	expectedSize := flags.Int64("expected-size", -1, "size of the whole stream, proving that the upload holds all of it")
+	force := flags.Bool("force", false, "complete under the key even without proof that the upload holds the whole stream")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: complete [-bucket name] [-object key] [-expected-size n] [-force] <upload-id>")
+	}
+	uploadID := flags.Arg(0)
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	c := e.core()
+	if *objectName == "" {
+		if *objectName, err = findUpload(c, *bucketName, uploadID); err != nil {
+			return err
+		}
+	}
+	if err = checkUnlocked(e.site(), *bucketName, *objectName); err != nil {
+		return err
+	}
+	listed, err := listedParts(c, *bucketName, *objectName, uploadID)
+	if err != nil {
+		return err
+	}
+	if len(listed) == 0 {
+		return fmt.Errorf("Upload %s has no parts", uploadID)
+	}
+	parts := make([]minio.CompletePart, 0, len(listed))
+	objParts := make([]minio.ObjectPart, 0, len(listed))
+	var size int64
+	for i := 1; i <= len(listed); i++ {
+		part, ok := listed[i]
+		if !ok {
+			return fmt.Errorf("Part %d of upload %s is missing, 'salvage' keeps the parts before it", i, uploadID)
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+		objParts = append(objParts, part)
+		size += part.Size
+	}
+
+	target := *objectName
+	proof := streamEnded(*bucketName, uploadID, listed, size, *expectedSize)
+	switch {
+	case proof != "":
+		fmt.Fprintln(os.Stderr, "upload", uploadID, "holds the whole stream, as per its", proof)
+	case *force:
+		fmt.Fprintln(os.Stderr, "upload", uploadID, "may not hold the whole stream, completing it anyway")
+	default:
+		// A writer dying mid-stream leaves contiguous parts too.
+		fmt.Fprintln(os.Stderr, "upload", uploadID, "may not hold the whole stream, completing it as", *objectName+partialSuffix)
+		if target, err = completePartial(e, *bucketName, *objectName, uploadID, objParts); err != nil {
+			return err
+		}
+	}
+	if target == *objectName {
+		if err = completeUpload(e, *bucketName, *objectName, uploadID, parts); err != nil {
+			return wrapS3Error("CompleteMultipartUpload", err)
+		}
+	}
+	return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"object":   target,
+		"uploadId": uploadID,
+		"parts":    len(parts),
+		"size":     size,
+	})
+}
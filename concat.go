@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// sourceReader - names the reader an error came from, in a
+// concatenation of readers.
+type sourceReader struct {
+	io.Reader
+	index int
+}
+
+func (r sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("Reader %d failed: %v", r.index, err)
+	}
+	return n, err
+}
+
+// PutStreamMulti - same as PutStream, uploading the readers one after
+// the other as a single object, e.g. a header, body and footer produced
+// separately. Parts are filled across the ends of readers, so the parts
+// don't depend on how the stream is split between them.
+func PutStreamMulti(bucketName, objectName string, readers []io.Reader, metaData map[string][]string) (n int64, err error) {
+	if len(readers) == 0 {
+		return 0, fmt.Errorf("No readers to upload")
+	}
+	sources := make([]io.Reader, len(readers))
+	for i, r := range readers {
+		sources[i] = sourceReader{Reader: r, index: i}
+	}
+	return putStreamEnv(bucketName, objectName, io.MultiReader(sources...), metaData, nil, nil)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Credentials given on the command line, before the command.
+var (
+	flagAccessKey = flag.String("access-key", "", "access key, overrides all other credentials")
+	flagSecretKey = flag.String("secret-key", "", "secret key, overrides all other credentials")
+)
+
+// credentials - resolved credentials along with the provider they came from.
+type credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Provider     string
+	// Expiration of temporary credentials, zero if they do not expire.
+	Expiration time.Time
+}
+
+// expiring - returns true if temporary credentials must be refreshed.
+func (c credentials) expiring() bool {
+	return !c.Expiration.IsZero() && time.Until(c.Expiration) < 5*time.Minute
+}
+
+// credentialProvider - one step of the credential resolution chain,
+// returns ok false if it has no credentials to offer.
+type credentialProvider struct {
+	name string
+	fn   func() (creds credentials, ok bool, err error)
+}
+
+// credentialChain - providers in the order they are tried, the first
+// one offering credentials wins. Without any, access is anonymous.
+var credentialChain = []credentialProvider{
+	{"flags", flagCredentials},
+	{"env", envCredentials},
+	{"config-file", configFileCredentials},
+	{"shared-credentials-file", sharedCredentials},
+	{"sts-web-identity", webIdentityCredentials},
+	{"iam", iamCredentials},
+}
+
+var (
+	credentialsMu     sync.Mutex
+	cachedCredentials *credentials
+)
+
+// resolveCredentials - resolves credentials through the chain once per
+// process, temporary credentials are resolved again before they expire.
+func resolveCredentials() (credentials, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	if cachedCredentials != nil && !cachedCredentials.expiring() {
+		return *cachedCredentials, nil
+	}
+
+	for _, p := range credentialChain {
+		creds, ok, err := p.fn()
+		if err != nil {
+			return credentials{}, fmt.Errorf("%s credentials: %v", p.name, err)
+		}
+		if ok {
+			creds.Provider = p.name
+			cachedCredentials = &creds
+			return creds, nil
+		}
+	}
+	cachedCredentials = &credentials{Provider: "anonymous"}
+	return *cachedCredentials, nil
+}
+
+func flagCredentials() (credentials, bool, error) {
+	if *flagAccessKey == "" && *flagSecretKey == "" {
+		return credentials{}, false, nil
+	}
+	return credentials{AccessKey: *flagAccessKey, SecretKey: *flagSecretKey}, true, nil
+}
+
+func envCredentials() (credentials, bool, error) {
+	if v := os.Getenv("ACCESS_KEY"); v != "" || os.Getenv("SECRET_KEY") != "" {
+		return credentials{AccessKey: v, SecretKey: os.Getenv("SECRET_KEY")}, true, nil
+	}
+	if v := os.Getenv("AWS_ACCESS_KEY_ID"); v != "" {
+		return credentials{
+			AccessKey:    v,
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, true, nil
+	}
+	return credentials{}, false, nil
+}
+
+// configFile - returns the path of the tool's own config file, set with
+// STREAMS3_CONFIG and defaulting to ~/.streams3/config.json.
+func configFile() string {
+	if v := os.Getenv("STREAMS3_CONFIG"); v != "" {
+		return v
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".streams3", "config.json")
+}
+
+func configFileCredentials() (credentials, bool, error) {
+	path := configFile()
+	if path == "" {
+		return credentials{}, false, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return credentials{}, false, nil
+	} else if err != nil {
+		return credentials{}, false, err
+	}
+
+	var config struct {
+		AccessKey    string `json:"accessKey"`
+		SecretKey    string `json:"secretKey"`
+		SessionToken string `json:"sessionToken"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return credentials{}, false, fmt.Errorf("%s: %v", path, err)
+	}
+	if config.AccessKey == "" {
+		return credentials{}, false, nil
+	}
+	return credentials{
+		AccessKey:    config.AccessKey,
+		SecretKey:    config.SecretKey,
+		SessionToken: config.SessionToken,
+	}, true, nil
+}
+
+// sharedCredentials - reads the AWS_PROFILE profile, or 'default', from
+// the shared AWS credentials file.
+func sharedCredentials() (credentials, bool, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return credentials{}, false, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return credentials{}, false, nil
+	} else if err != nil {
+		return credentials{}, false, err
+	}
+	defer f.Close()
+
+	var creds credentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKey = value
+		case "aws_secret_access_key":
+			creds.SecretKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return credentials{}, false, err
+	}
+	return creds, creds.AccessKey != "", nil
+}
+
+// webIdentityCredentials - exchanges the token in AWS_WEB_IDENTITY_TOKEN_FILE
+// for temporary credentials of AWS_ROLE_ARN, against AWS_STS_ENDPOINT
+// which also allows using MinIO's STS.
+func webIdentityCredentials() (credentials, bool, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if tokenFile == "" {
+		return credentials{}, false, nil
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return credentials{}, false, err
+	}
+
+	endpoint := os.Getenv("AWS_STS_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://sts.amazonaws.com"
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("streams3-%d", time.Now().Unix())
+	}
+
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", os.Getenv("AWS_ROLE_ARN"))
+	form.Set("RoleSessionName", sessionName)
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return credentials{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return credentials{}, false, fmt.Errorf("AssumeRoleWithWebIdentity: %s: %s", resp.Status, body)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return credentials{}, false, err
+	}
+	return credentials{
+		AccessKey:    result.Credentials.AccessKeyID,
+		SecretKey:    result.Credentials.SecretAccessKey,
+		SessionToken: result.Credentials.SessionToken,
+		Expiration:   result.Credentials.Expiration,
+	}, true, nil
+}
+
+// imdsEndpoint - the EC2 instance metadata service.
+const imdsEndpoint = "http://169.254.169.254"
+
+// imdsProbeTimeout - how long the metadata service has to answer the
+// first request, it answers within milliseconds on EC2.
+const imdsProbeTimeout = 300 * time.Millisecond
+
+// imdsAbsentFile - returns the file recording that the metadata service
+// could not be reached, so that runs off EC2 skip probing it for an hour.
+func imdsAbsentFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "streams3", "imds-absent")
+}
+
+// iamCredentials - fetches the instance role credentials from the ECS
+// container endpoint, or from the EC2 instance metadata service.
+func iamCredentials() (credentials, bool, error) {
+	// Not running on AWS must not slow down the fall through to anonymous,
+	// the metadata service is probed with a shorter timeout, set
+	// AWS_EC2_METADATA_DISABLED=true to skip it.
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	var credsURL string
+	var header http.Header
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		credsURL = "http://169.254.170.2" + uri
+	} else {
+		if os.Getenv("AWS_EC2_METADATA_DISABLED") == "true" {
+			return credentials{}, false, nil
+		}
+		absent := imdsAbsentFile()
+		if info, err := os.Stat(absent); err == nil && time.Since(info.ModTime()) < time.Hour {
+			fmt.Fprintln(os.Stderr, "instance metadata service unreachable recently, skipping it, remove", absent, "to probe it again")
+			return credentials{}, false, nil
+		}
+		req, err := http.NewRequest(http.MethodPut, imdsEndpoint+"/latest/api/token", nil)
+		if err != nil {
+			return credentials{}, false, err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		resp, err := (&http.Client{Timeout: imdsProbeTimeout}).Do(req)
+		if err != nil {
+			// Timeouts may only be a slow or busy instance, the service is
+			// known absent only once the connection is refused.
+			if absent != "" && imdsUnreachable(err) && os.MkdirAll(filepath.Dir(absent), 0700) == nil {
+				ioutil.WriteFile(absent, nil, 0600)
+			}
+			return credentials{}, false, nil
+		}
+		token, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return credentials{}, false, nil
+		}
+		header = http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+
+		role, err := imdsGet(client, imdsEndpoint+"/latest/meta-data/iam/security-credentials/", header)
+		if err != nil || role == "" {
+			return credentials{}, false, nil
+		}
+		credsURL = imdsEndpoint + "/latest/meta-data/iam/security-credentials/" + strings.SplitN(role, "\n", 2)[0]
+	}
+
+	body, err := imdsGet(client, credsURL, header)
+	if err != nil {
+		return credentials{}, false, err
+	}
+	var result struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err = json.Unmarshal([]byte(body), &result); err != nil {
+		return credentials{}, false, err
+	}
+	return credentials{
+		AccessKey:    result.AccessKeyID,
+		SecretKey:    result.SecretAccessKey,
+		SessionToken: result.Token,
+		Expiration:   result.Expiration,
+	}, true, nil
+}
+
+// imdsUnreachable - returns true if err shows that nothing listens at
+// the metadata service address.
+func imdsUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH)
+}
+
+// imdsGet - returns the body of a metadata service GET request.
+func imdsGet(client *http.Client, u string, header http.Header) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return string(body), nil
+}
+
+// checkAuthMain - implements the 'whoami' and 'check-auth' commands,
+// reporting which credential provider was selected and verifying the
+// credentials against a bucket.
+func checkAuthMain(args []string) error {
+	flags := flag.NewFlagSet("check-auth", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to verify access to")
+	flags.Parse(args)
+
+	creds, err := resolveCredentials()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Provider:   %s\n", creds.Provider)
+	if creds.AccessKey != "" {
+		masked := creds.AccessKey
+		if len(masked) > 4 {
+			masked = masked[:4] + strings.Repeat("*", len(masked)-4)
+		}
+		fmt.Printf("Access key: %s\n", masked)
+	}
+	if creds.SessionToken != "" {
+		fmt.Printf("Session:    temporary\n")
+	}
+	if !creds.Expiration.IsZero() {
+		fmt.Printf("Expires:    %s\n", creds.Expiration.Format(time.RFC3339))
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	found, err := c.BucketExists(*bucketName)
+	if err != nil {
+		return wrapS3Error("HeadBucket", err)
+	}
+	if !found {
+		return fmt.Errorf("Bucket %s does not exist", *bucketName)
+	}
+	fmt.Printf("Bucket:     %s accessible\n", *bucketName)
+	return nil
+}
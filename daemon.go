@@ -0,0 +1,483 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errTransferCanceled - returned by the source of canceled transfers.
+var errTransferCanceled = errors.New("Transfer canceled")
+
+// Transfer states reported by the daemon.
+const (
+	transferRunning   = "running"
+	transferPaused    = "paused"
+	transferCompleted = "completed"
+	transferFailed    = "failed"
+	transferCanceled  = "canceled"
+)
+
+// transferRetention - how long finished transfers can still be looked up.
+const transferRetention = time.Hour
+
+// transferRequest - the body of POST /transfers.
+type transferRequest struct {
+	// Source is where the stream is read from, one of http(s)://host/path,
+	// file:///path, unix:///path/to/socket, tcp://host:port or fd://N for a
+	// descriptor inherited by the daemon, as allowed by sourcePolicy.
+	Source   string            `json:"source"`
+	Bucket   string            `json:"bucket"`
+	Object   string            `json:"object"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// transferStatus - a transfer as served by the daemon.
+type transferStatus struct {
+	ID       string    `json:"id"`
+	Source   string    `json:"source"`
+	Bucket   string    `json:"bucket"`
+	Object   string    `json:"object"`
+	State    string    `json:"state"`
+	UploadID string    `json:"uploadId,omitempty"`
+	Read     int64     `json:"bytesRead"`
+	Uploaded int64     `json:"bytesUploaded"`
+	Parts    int       `json:"parts"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// daemonTransfer - an upload run by the daemon. Its source is read through
+// it, which blocks reads while paused and fails them once canceled.
+type daemonTransfer struct {
+	src io.ReadCloser
+	// object - the object being uploaded, rotated ones included.
+	object string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	status   transferStatus
+	paused   bool
+	canceled bool
+}
+
+func (t *daemonTransfer) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	for t.paused && !t.canceled {
+		t.cond.Wait()
+	}
+	canceled := t.canceled
+	t.mu.Unlock()
+	if canceled {
+		return 0, errTransferCanceled
+	}
+	n, err := t.src.Read(p)
+	t.mu.Lock()
+	t.status.Read += int64(n)
+	if t.canceled {
+		err = errTransferCanceled
+	}
+	t.mu.Unlock()
+	return n, err
+}
+
+// progress - records the progress events of the upload.
+func (t *daemonTransfer) progress(ev ProgressEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.UploadID = ev.UploadID
+	t.object = ev.Object
+	switch ev.Type {
+	case PartCompleted:
+		t.status.Parts++
+		t.status.Uploaded = ev.Bytes
+	case Completed:
+		t.status.Uploaded = ev.Bytes
+	}
+}
+
+func (t *daemonTransfer) snapshot() transferStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// control - pauses, resumes or cancels the transfer.
+func (t *daemonTransfer) control(action string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status.State != transferRunning && t.status.State != transferPaused {
+		return fmt.Errorf("Transfer %s is %s", t.status.ID, t.status.State)
+	}
+	switch action {
+	case "pause":
+		t.paused = true
+		t.status.State = transferPaused
+	case "resume":
+		t.paused = false
+		t.status.State = transferRunning
+	case "cancel":
+		t.canceled = true
+		// Unblocks reads waiting on the source.
+		t.src.Close()
+	default:
+		return fmt.Errorf("Unknown action %q, expected pause, resume or cancel", action)
+	}
+	t.cond.Broadcast()
+	return nil
+}
+
+// sourcePolicy - the sources clients may have the daemon upload, as they
+// are read and uploaded with the credentials of the daemon.
+type sourcePolicy struct {
+	// schemes - the allowed schemes, file and unix by default.
+	schemes map[string]bool
+	// dirs - the directories file:// and unix:// paths must be below.
+	dirs []string
+	// hosts - the hosts http(s):// and tcp:// sources may connect to.
+	hosts map[string]bool
+}
+
+// newSourcePolicy - parses the comma separated lists of the daemon flags.
+func newSourcePolicy(schemes, dirs, hosts string) (*sourcePolicy, error) {
+	p := &sourcePolicy{schemes: make(map[string]bool), hosts: make(map[string]bool)}
+	for _, scheme := range strings.Split(schemes, ",") {
+		switch scheme = strings.TrimSpace(scheme); scheme {
+		case "":
+		case "http", "https", "file", "unix", "tcp", "fd":
+			p.schemes[scheme] = true
+		default:
+			return nil, fmt.Errorf("Unknown source scheme %q", scheme)
+		}
+	}
+	for _, dir := range strings.Split(dirs, ",") {
+		if dir = strings.TrimSpace(dir); dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err == nil {
+			abs, err = filepath.EvalSymlinks(abs)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid source directory %q: %v", dir, err)
+		}
+		p.dirs = append(p.dirs, abs)
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			p.hosts[strings.ToLower(host)] = true
+		}
+	}
+	return p, nil
+}
+
+// checkPath - returns the path of a file:// or unix:// source once its
+// links are resolved, if it is below one of the allowed directories.
+func (p *sourcePolicy) checkPath(name string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(name))
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range p.dirs {
+		if !outside(dir, resolved) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("Source %s is not below an allowed directory, see -source-dirs", name)
+}
+
+// checkHost - fails for http(s):// and tcp:// sources to hosts not
+// allowed.
+func (p *sourcePolicy) checkHost(host string) error {
+	if !p.hosts[strings.ToLower(host)] {
+		return fmt.Errorf("Source host %s is not allowed, see -source-hosts", host)
+	}
+	return nil
+}
+
+// refuseLinkLocal - fails connections to link-local addresses, those of
+// the metadata services of cloud providers, whatever the names allowed
+// resolve to.
+func refuseLinkLocal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("Connections to %s are not allowed", host)
+	}
+	return nil
+}
+
+// sourceDialer - dials http(s):// and tcp:// sources.
+var sourceDialer = &net.Dialer{Timeout: 30 * time.Second, Control: refuseLinkLocal}
+
+// sourceClient - fetches http(s):// sources, without following redirects
+// to other hosts than allowed.
+var sourceClient = &http.Client{
+	Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DialContext: sourceDialer.DialContext},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return errors.New("Redirects of sources are not followed")
+	},
+}
+
+// openTransferSource - opens the source of a transfer, if allowed by p.
+func openTransferSource(p *sourcePolicy, source string) (io.ReadCloser, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid source %q: %v", source, err)
+	}
+	if !p.schemes[u.Scheme] {
+		return nil, fmt.Errorf("Source scheme %q is not allowed, see -sources", u.Scheme)
+	}
+	switch u.Scheme {
+	case "http", "https", "tcp":
+		if err = p.checkHost(u.Hostname()); err != nil {
+			return nil, err
+		}
+	case "file", "unix":
+		if u.Path, err = p.checkPath(u.Path); err != nil {
+			return nil, err
+		}
+	}
+	switch u.Scheme {
+	case "http", "https":
+		resp, err := sourceClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Source %s returned %s", source, resp.Status)
+		}
+		return resp.Body, nil
+	case "file":
+		return os.Open(u.Path)
+	case "unix":
+		return net.Dial("unix", u.Path)
+	case "tcp":
+		return sourceDialer.Dial("tcp", u.Host)
+	case "fd":
+		fd, err := strconv.Atoi(u.Host)
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("Invalid descriptor in %q", source)
+		}
+		return os.NewFile(uintptr(fd), source), nil
+	}
+	return nil, fmt.Errorf("Unknown source %q, expected http(s)://, file://, unix://, tcp:// or fd://", source)
+}
+
+// daemon - the 'daemon' command, running uploads on request.
+type daemon struct {
+	bucketName string
+	token      string
+	sources    *sourcePolicy
+
+	mu        sync.Mutex
+	transfers map[string]*daemonTransfer
+}
+
+// start - opens the source of a request and uploads it in the background.
+func (d *daemon) start(req transferRequest) (*daemonTransfer, error) {
+	if req.Bucket == "" {
+		req.Bucket = d.bucketName
+	}
+	if req.Object == "" || req.Source == "" {
+		return nil, errors.New("A source and an object are required")
+	}
+	if err := validateKey(req.Object); err != nil {
+		return nil, err
+	}
+	src, err := openTransferSource(d.sources, req.Source)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	t := &daemonTransfer{src: src}
+	t.cond = sync.NewCond(&t.mu)
+	t.status = transferStatus{
+		ID:      hex.EncodeToString(id),
+		Source:  req.Source,
+		Bucket:  req.Bucket,
+		Object:  req.Object,
+		State:   transferRunning,
+		Started: time.Now().UTC(),
+	}
+	metaData := map[string][]string{}
+	for k, v := range req.Metadata {
+		metaData[k] = []string{v}
+	}
+
+	d.mu.Lock()
+	d.prune()
+	d.transfers[t.status.ID] = t
+	d.mu.Unlock()
+
+	go func() {
+		_, err := PutStreamWithProgress(req.Bucket, req.Object, t, metaData, t.progress)
+		src.Close()
+		t.mu.Lock()
+		uploadID, object := t.status.UploadID, t.object
+		t.mu.Unlock()
+		if err != nil && uploadID != "" {
+			// Sources can't be read again, so the parts of canceled and
+			// failed transfers are of no use.
+			if aErr := abortUpload(req.Bucket, object, uploadID); aErr != nil {
+				fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+			}
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.status.Finished = time.Now().UTC()
+		switch {
+		case t.canceled:
+			t.status.State = transferCanceled
+		case err != nil:
+			t.status.State = transferFailed
+			t.status.Error = err.Error()
+		default:
+			t.status.State = transferCompleted
+		}
+		fmt.Fprintln(os.Stderr, "transfer", t.status.ID, "to", t.status.Object, t.status.State)
+	}()
+	return t, nil
+}
+
+// prune - forgets the transfers finished for longer than
+// transferRetention, with d.mu held.
+func (d *daemon) prune() {
+	for id, t := range d.transfers {
+		if finished := t.snapshot().Finished; !finished.IsZero() && time.Since(finished) > transferRetention {
+			delete(d.transfers, id)
+		}
+	}
+}
+
+func (d *daemon) list() []transferStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune()
+	statuses := make([]transferStatus, 0, len(d.transfers))
+	for _, t := range d.transfers {
+		statuses = append(statuses, t.snapshot())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Started.Before(statuses[j].Started) })
+	return statuses
+}
+
+func (d *daemon) get(id string) *daemonTransfer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.transfers[id]
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ServeHTTP - serves the control API:
+//
+//	POST /transfers                 start a transfer, see transferRequest
+//	GET  /transfers                 list the transfers
+//	GET  /transfers/{id}            the progress of a transfer
+//	POST /transfers/{id}/pause      stop reading the source
+//	POST /transfers/{id}/resume     read the source again
+//	POST /transfers/{id}/cancel     abort the upload
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(d.token)) != 1 {
+		httpError(w, http.StatusUnauthorized, errors.New("Missing or wrong token"))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "transfers" || len(parts) > 3 {
+		httpError(w, http.StatusNotFound, errors.New("Unknown path"))
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, d.list())
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		var req transferRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		t, err := d.start(req)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, t.snapshot())
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		t := d.get(parts[1])
+		if t == nil {
+			httpError(w, http.StatusNotFound, errors.New("Unknown transfer"))
+			return
+		}
+		writeJSON(w, http.StatusOK, t.snapshot())
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		t := d.get(parts[1])
+		if t == nil {
+			httpError(w, http.StatusNotFound, errors.New("Unknown transfer"))
+			return
+		}
+		if err := t.control(parts[2]); err != nil {
+			httpError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, t.snapshot())
+	default:
+		httpError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+// daemonMain - implements the 'daemon' command, which serves a REST API
+// to start uploads from URLs, sockets or inherited descriptors, follow
+// their progress, pause, resume and cancel them. Clients must present
+// the token, and may only name the sources allowed by the flags.
+func daemonMain(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8081", "address to listen on")
+	bucketName := flags.String("bucket", "stream-test", "bucket of transfers not naming one")
+	token := flags.String("token", os.Getenv("DAEMON_TOKEN"), "bearer token required from clients, DAEMON_TOKEN by default")
+	schemes := flags.String("sources", "file,unix", "comma separated source schemes allowed, of http, https, file, unix, tcp and fd")
+	dirs := flags.String("source-dirs", "", "comma separated directories file:// and unix:// sources must be below")
+	hosts := flags.String("source-hosts", "", "comma separated hosts http(s):// and tcp:// sources may connect to")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: daemon [-listen addr] [-bucket name] [-token token] [-sources schemes] [-source-dirs dirs] [-source-hosts hosts]")
+	}
+	if *token == "" {
+		return fmt.Errorf("A token is required, set -token or DAEMON_TOKEN")
+	}
+	sources, err := newSourcePolicy(*schemes, *dirs, *hosts)
+	if err != nil {
+		return err
+	}
+
+	d := &daemon{bucketName: *bucketName, token: *token, sources: sources, transfers: make(map[string]*daemonTransfer)}
+	fmt.Fprintln(os.Stderr, "serving the control API on", *listen)
+	return http.ListenAndServe(*listen, d)
+}
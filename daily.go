@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// dailyMarker - the completeness marker of an hour, listing the objects
+// a host uploaded during it.
+type dailyMarker struct {
+	Hour    time.Time     `json:"hour"`
+	Host    string        `json:"host"`
+	Objects []dailyObject `json:"objects"`
+	Bytes   int64         `json:"bytes"`
+}
+
+// dailyObject - an object listed in a dailyMarker.
+type dailyObject struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// dailyLayout - names the objects of 'put -daily' after the hour they
+// start in, 'prefix/YYYY/MM/DD/HH/host-NNNNNN.ext', and marks every hour
+// complete once its last object is uploaded.
+type dailyLayout struct {
+	c      minio.Core
+	prefix string
+	ext    string
+	host   string
+	loc    *time.Location
+
+	hour   time.Time
+	marker dailyMarker
+	// ending is set once the hour is over, until its last object is
+	// uploaded.
+	ending bool
+}
+
+func newDailyLayout(c minio.Core, objectName, tz string) (*dailyLayout, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown time zone %q: %v", tz, err)
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	ext := path.Ext(objectName)
+	return &dailyLayout{
+		c:      c,
+		prefix: strings.TrimSuffix(objectName, ext),
+		ext:    ext,
+		host:   host,
+		loc:    loc,
+	}, nil
+}
+
+// dir - returns the prefix of the objects of the current hour.
+func (d *dailyLayout) dir() string {
+	return d.prefix + d.hour.Format("/2006/01/02/15/")
+}
+
+// name - returns the name of the seq-th object of the hour.
+func (d *dailyLayout) name(seq int) string {
+	return fmt.Sprintf("%s%s-%06d%s", d.dir(), d.host, seq, d.ext)
+}
+
+// next - returns when the current hour ends.
+func (d *dailyLayout) next() time.Time {
+	return d.hour.Add(time.Hour)
+}
+
+// startHour - moves to the hour of now, returning the last sequence
+// number already used by this host in it, so that a restarted upload
+// doesn't overwrite the objects of the previous run.
+func (d *dailyLayout) startHour(bucketName string, now time.Time) (int, error) {
+	t := now.In(d.loc)
+	d.hour = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, d.loc)
+	d.marker = dailyMarker{Hour: d.hour, Host: d.host, Objects: []dailyObject{}}
+	d.ending = false
+
+	seq := 0
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	prefix := d.dir() + d.host + "-"
+	for objInfo := range d.c.Client.ListObjects(bucketName, prefix, false, doneCh) {
+		if objInfo.Err != nil {
+			return 0, objInfo.Err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(objInfo.Key, prefix), d.ext))
+		if err == nil && n > seq {
+			seq = n
+		}
+	}
+	return seq, nil
+}
+
+// add - records an object uploaded during the hour.
+func (d *dailyLayout) add(name string, size int64) {
+	d.marker.Objects = append(d.marker.Objects, dailyObject{Key: name, Size: size})
+	d.marker.Bytes += size
+}
+
+// markComplete - writes the completeness marker of the hour.
+func (d *dailyLayout) markComplete(bucketName string) error {
+	name := d.dir() + "_COMPLETE." + d.host + ".json"
+	if err := putJSON(d.c, bucketName, name, d.marker); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "hour", d.hour.Format("2006-01-02 15h"), "complete,", len(d.marker.Objects), "objects")
+	return nil
+}
+
+// endHour - marks the hour over complete and moves to the current one.
+func (r *rotator) endHour() error {
+	if err := r.daily.markComplete(r.bucketName); err != nil {
+		return err
+	}
+	seq, err := r.daily.startHour(r.bucketName, time.Now())
+	if err != nil {
+		return err
+	}
+	r.seq = seq
+	return nil
+}
+
+// hourUp - ends the hour, once the object being uploaded is complete.
+// Objects are cut right away at a record boundary or else after the
+// current record.
+func (r *rotator) hourUp() error {
+	r.daily.ending = true
+	if r.cur == nil {
+		return r.endHour()
+	}
+	return r.timeUp()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+)
+
+// debugCommands - the long running commands which serve the debug
+// listener set with DEBUG_ADDR, put for streams such as logs piped
+// into it for days.
+var debugCommands = map[string]bool{
+	"put":            true,
+	"serve":          true,
+	"watch":          true,
+	"queue-worker":   true,
+	"consume-kafka":  true,
+	"verify-restore": true,
+	"mount":          true,
+	"sync":           true,
+	"supervise":      true,
+	"daemon":         true,
+}
+
+// startDebugListener - serves net/http/pprof and a snapshot trigger on
+// DEBUG_ADDR, which must be a loopback address as profiles expose the
+// process memory. Does nothing if DEBUG_ADDR is unset.
+func startDebugListener() error {
+	addr := os.Getenv("DEBUG_ADDR")
+	if addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Invalid DEBUG_ADDR %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("DEBUG_ADDR %q must be a loopback address", addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/snapshot", snapshotHandler)
+	fmt.Fprintln(os.Stderr, "debug listener on", l.Addr())
+	go http.Serve(l, mux)
+	return nil
+}
+
+// snapshotHandler - on POST, writes a goroutine dump and a heap profile
+// to DEBUG_DIR, by default the temporary directory, and replies with
+// their names.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST to take a snapshot", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := os.Getenv("DEBUG_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	pid := os.Getpid()
+
+	write := func(kind string, fn func(f *os.File) error) (string, error) {
+		name := filepath.Join(dir, fmt.Sprintf("streams3-%d-%s.%s", pid, stamp, kind))
+		f, err := os.Create(name)
+		if err != nil {
+			return "", err
+		}
+		err = fn(f)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		return name, err
+	}
+	goroutines, err := write("goroutines.txt", func(f *os.File) error {
+		return runtimepprof.Lookup("goroutine").WriteTo(f, 2)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	heap, err := write("heap.pprof", func(f *os.File) error {
+		// Collect first, so the profile shows live memory only.
+		runtime.GC()
+		return runtimepprof.WriteHeapProfile(f)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(w, "%s\n%s\ngoroutines: %d heap: %d MiB in use, %d MiB from the OS\n",
+		goroutines, heap, runtime.NumGoroutine(), m.HeapInuse/(1024*1024), m.Sys/(1024*1024))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsRefresh - returns the interval endpoints are resolved again at, set
+// with DNS_REFRESH, 0 if connections are kept whatever their address.
+func dnsRefresh() (time.Duration, error) {
+	v := os.Getenv("DNS_REFRESH")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("Invalid DNS_REFRESH %q, expected a duration of at least 1s", v)
+	}
+	return d, nil
+}
+
+// fallbackDelay - returns how long a dial waits for the preferred address
+// family before racing the other one, set with DIAL_FALLBACK_DELAY.
+func fallbackDelay() (time.Duration, error) {
+	v := os.Getenv("DIAL_FALLBACK_DELAY")
+	if v == "" {
+		// The default of net.Dialer.
+		return 300 * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid DIAL_FALLBACK_DELAY %q", v)
+	}
+	return d, nil
+}
+
+// resolvingDialer - dials both address families of a host, racing them
+// as net.Dialer does (RFC 6555), and resolves the hosts it dialed again
+// periodically. Connections to addresses no longer returned are stale,
+// and recycled by the resolvingTransport using them.
+type resolvingDialer struct {
+	dialer  net.Dialer
+	refresh time.Duration
+
+	mu    sync.Mutex
+	addrs map[string][]string
+}
+
+var (
+	dialerOnce sync.Once
+	dialerErr  error
+	sharedDial *resolvingDialer
+)
+
+// sharedDialer - returns the resolvingDialer of the process, nil unless
+// DNS_REFRESH or DIAL_FALLBACK_DELAY is set.
+func sharedDialer() (*resolvingDialer, error) {
+	dialerOnce.Do(func() {
+		refresh, err := dnsRefresh()
+		if err != nil || (refresh == 0 && os.Getenv("DIAL_FALLBACK_DELAY") == "") {
+			dialerErr = err
+			return
+		}
+		delay, err := fallbackDelay()
+		if err != nil {
+			dialerErr = err
+			return
+		}
+		sharedDial = &resolvingDialer{
+			dialer: net.Dialer{
+				Timeout:       30 * time.Second,
+				KeepAlive:     30 * time.Second,
+				FallbackDelay: delay,
+			},
+			refresh: refresh,
+			addrs:   make(map[string][]string),
+		}
+		if refresh > 0 {
+			go sharedDial.resolveLoop()
+		}
+	})
+	return sharedDial, dialerErr
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil || d.refresh == 0 {
+		// Addresses don't change, or are not resolved again.
+		return conn, nil
+	}
+	d.mu.Lock()
+	_, known := d.addrs[host]
+	d.mu.Unlock()
+	if !known {
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			addrs = []string{ip}
+		}
+		sort.Strings(addrs)
+		d.mu.Lock()
+		if _, known = d.addrs[host]; !known {
+			d.addrs[host] = addrs
+		}
+		d.mu.Unlock()
+	}
+	return conn, nil
+}
+
+// resolveLoop - resolves the hosts dialed so far every refresh interval.
+func (d *resolvingDialer) resolveLoop() {
+	for range time.Tick(d.refresh) {
+		d.mu.Lock()
+		hosts := make([]string, 0, len(d.addrs))
+		for host := range d.addrs {
+			hosts = append(hosts, host)
+		}
+		d.mu.Unlock()
+
+		for _, host := range hosts {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			cancel()
+			if err != nil || len(addrs) == 0 {
+				// Keep the connections rather than fail on a flaky resolver.
+				fmt.Fprintln(os.Stderr, "resolving", host, "again failed:", err)
+				continue
+			}
+			d.mu.Lock()
+			old := d.addrs[host]
+			if overlaps(old, addrs) {
+				// Hosts answering with a rotating subset of their
+				// addresses have not moved, all of them stay current.
+				addrs = append(addrs, old...)
+			} else {
+				fmt.Fprintf(os.Stderr, "addresses of %s changed from %s to %s\n", host,
+					strings.Join(old, ","), strings.Join(addrs, ","))
+			}
+			d.addrs[host] = uniqueSorted(addrs)
+			d.mu.Unlock()
+		}
+	}
+}
+
+// overlaps - returns true if a and b have an address in common.
+func overlaps(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// uniqueSorted - returns addrs sorted, without duplicates.
+func uniqueSorted(addrs []string) []string {
+	sort.Strings(addrs)
+	out := addrs[:0]
+	for i, addr := range addrs {
+		if i == 0 || addr != addrs[i-1] {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// stale - returns true if conn is open to an address host no longer
+// resolves to.
+func (d *resolvingDialer) stale(host string, conn net.Conn) bool {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || net.ParseIP(host) != nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addrs, known := d.addrs[host]
+	if !known {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr == ip {
+			return false
+		}
+	}
+	return true
+}
+
+// resolvingTransport - an http.RoundTripper closing the connection of a
+// request once it is released, if it is stale, so that the following
+// requests are sent over new connections to the current addresses.
+// Other connections are left alone.
+type resolvingTransport struct {
+	base   *http.Transport
+	dialer *resolvingDialer
+}
+
+func (t *resolvingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &releasedBody{ReadCloser: resp.Body, release: func() {
+		if conn != nil && t.dialer.stale(req.URL.Hostname(), conn) {
+			conn.Close()
+		}
+	}}
+	return resp, nil
+}
+
+// releasedBody - calls release once the body is closed, and with it
+// its connection released.
+type releasedBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+var (
+	baseOnce      sync.Once
+	baseTransport http.RoundTripper
+)
+
+// newBaseTransport - returns the transport requests to a site are sent
+// over, verifying certificates against serverName if not empty and
+// keeping up to conns idle connections if not 0. With DNS_REFRESH,
+// connections are recycled when their host moves to new addresses.
+func newBaseTransport(serverName string, conns int) (http.RoundTripper, error) {
+	d, err := sharedDialer()
+	if err != nil {
+		return nil, err
+	}
+	if serverName == "" && conns == 0 {
+		if d == nil {
+			return http.DefaultTransport, nil
+		}
+		// A single transport, so connections are shared by uploads.
+		baseOnce.Do(func() {
+			baseTransport = dialTransport(d, "", 0)
+		})
+		return baseTransport, nil
+	}
+	return dialTransport(d, serverName, conns), nil
+}
+
+// dialTransport - returns a new transport dialing with d if not nil.
+func dialTransport(d *resolvingDialer, serverName string, conns int) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if serverName != "" {
+		t.TLSClientConfig = &tls.Config{ServerName: serverName}
+	}
+	if conns > 0 {
+		t.MaxIdleConnsPerHost = conns
+	}
+	if d == nil {
+		return t
+	}
+	t.DialContext = d.DialContext
+	if d.refresh == 0 {
+		return t
+	}
+	return &resolvingTransport{base: t, dialer: d}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// dockerClient - a minimal client of the Docker Engine API on its unix
+// socket, set with DOCKER_HOST (default unix:///var/run/docker.sock).
+type dockerClient struct {
+	client *http.Client
+}
+
+func newDockerClient() (*dockerClient, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	if !strings.HasPrefix(host, "unix://") {
+		return nil, fmt.Errorf("Unsupported DOCKER_HOST %q, only unix sockets are", host)
+	}
+	socket := strings.TrimPrefix(host, "unix://")
+	return &dockerClient{client: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}, nil
+}
+
+// do - sends an API request, body is marshalled as JSON if not nil.
+func (d *dockerClient) do(method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://docker"+path+"?"+query.Encode(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		json.Unmarshal(data, &apiErr)
+		return nil, fmt.Errorf("Docker %s %s: %s: %s", method, path, resp.Status, apiErr.Message)
+	}
+	return resp, nil
+}
+
+// archive - returns a tar stream of path inside a container, which
+// does not need to be running.
+func (d *dockerClient) archive(container, path string) (io.ReadCloser, error) {
+	resp, err := d.do(http.MethodGet, "/containers/"+url.PathEscape(container)+"/archive",
+		url.Values{"path": {path}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// volumeContainer - creates a stopped container with the volume mounted
+// read-only at /volume, to be archived and then removed.
+func (d *dockerClient) volumeContainer(volume, image string) (string, error) {
+	resp, err := d.do(http.MethodPost, "/containers/create", url.Values{}, map[string]interface{}{
+		"Image":      image,
+		"Cmd":        []string{"true"},
+		"HostConfig": map[string]interface{}{"Binds": []string{volume + ":/volume:ro"}},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// remove - removes a container.
+func (d *dockerClient) remove(container string) error {
+	resp, err := d.do(http.MethodDelete, "/containers/"+url.PathEscape(container), url.Values{"force": {"1"}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// snapshotDockerMain - implements the 'snapshot-docker' command, which
+// streams a tar of a volume or a container path through the Docker API
+// into an object, without touching the local disk.
+func snapshotDockerMain(args []string) error {
+	flags := flag.NewFlagSet("snapshot-docker", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	objectName := flags.String("object", "", "object name, defaults to '<source>/<time>.tar.gz'")
+	volume := flags.String("volume", "", "volume to snapshot")
+	container := flags.String("container", "", "container to snapshot a path of")
+	path := flags.String("path", "/", "path inside the container")
+	image := flags.String("helper-image", "busybox", "image of the helper container mounting volumes")
+	compress := flags.Bool("compress", true, "gzip compress the snapshot")
+	flags.Parse(args)
+	if (*volume == "") == (*container == "") || flags.NArg() != 0 {
+		return fmt.Errorf("Usage: snapshot-docker [-bucket name] [-object name] (-volume name | -container id [-path p])")
+	}
+
+	d, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+
+	source, archivePath := *container, *path
+	metaData := map[string][]string{}
+	if *volume != "" {
+		if source, err = d.volumeContainer(*volume, *image); err != nil {
+			return err
+		}
+		defer func() {
+			if rErr := d.remove(source); rErr != nil {
+				fmt.Fprintln(os.Stderr, "helper container left behind", source, rErr)
+			}
+		}()
+		archivePath = "/volume/."
+		metaData["X-Amz-Meta-Docker-Volume"] = []string{*volume}
+	} else {
+		metaData["X-Amz-Meta-Docker-Container"] = []string{*container}
+		metaData["X-Amz-Meta-Docker-Path"] = []string{*path}
+	}
+
+	key, err := encryptionKey()
+	if err != nil {
+		return err
+	}
+	t := transforms{compress: *compress, key: key}
+	if *objectName == "" {
+		name := *volume
+		if name == "" {
+			name = *container
+		}
+		*objectName = name + "/" + time.Now().UTC().Format("20060102T150405Z") + ".tar"
+		if t.compress {
+			*objectName += ".gz"
+		}
+		if t.key != nil {
+			*objectName += ".enc"
+		}
+	}
+
+	tarStream, err := d.archive(source, archivePath)
+	if err != nil {
+		return err
+	}
+	defer tarStream.Close()
+	reader, err := t.apply(tarStream, metaData)
+	if err != nil {
+		return err
+	}
+
+	n, err := PutStream(*bucketName, *objectName, reader, metaData)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "uploaded", n, "bytes to", *bucketName+"/"+*objectName)
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// drillResult - the outcome of a restore drill, printed as a JSON line
+// and posted to the webhook.
+type drillResult struct {
+	Object   string       `json:"object"`
+	Bytes    int64        `json:"bytes"`
+	Seconds  float64      `json:"seconds"`
+	Success  bool         `json:"success"`
+	Error    *errorDetail `json:"error,omitempty"`
+	Finished time.Time    `json:"finished"`
+}
+
+// restoreDrill - restores the latest backup below prefix, undoing its
+// transforms, into the validation command or else /dev/null.
+func restoreDrill(c minio.Core, bucketName, prefix, decompress, command string) (string, int64, error) {
+	objectName, err := resolveLatest(c, bucketName, prefix)
+	if err != nil {
+		return "", 0, err
+	}
+	reader, objInfo, err := c.GetObject(bucketName, objectName, minio.NewGetReqHeaders())
+	if err != nil {
+		return objectName, 0, wrapS3Error("GetObject", err)
+	}
+	defer reader.Close()
+
+	source, err := undoTransforms(reader, objInfo.Metadata)
+	if err != nil {
+		return objectName, 0, err
+	}
+	// Objects compressed on upload were decompressed with the other
+	// transforms already.
+	if objInfo.Metadata.Get("X-Amz-Meta-Compression") != "" {
+		decompress = ""
+	}
+	switch decompress {
+	case "":
+	case "auto":
+		if source, err = autoDecompress(source, objInfo.Metadata.Get("Content-Encoding")); err != nil {
+			return objectName, 0, err
+		}
+	default:
+		if source, err = decompressReader(source, decompress); err != nil {
+			return objectName, 0, err
+		}
+	}
+
+	// Without transforms a short read fails the drill as well.
+	raw := source == io.Reader(reader)
+
+	if command == "" {
+		n, err := io.Copy(ioutil.Discard, source)
+		if err == nil && raw && n != objInfo.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		return objectName, n, err
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return objectName, 0, err
+	}
+	if err = cmd.Start(); err != nil {
+		return objectName, 0, err
+	}
+	n, err := io.Copy(stdin, source)
+	stdin.Close()
+	if err == nil && raw && n != objInfo.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if wErr := cmd.Wait(); wErr != nil {
+		err = fmt.Errorf("Validation command failed: %v", wErr)
+	}
+	return objectName, n, err
+}
+
+// writeDrillMetrics - writes the result as Prometheus text exposition
+// format, for the node exporter textfile collector. The file is replaced
+// atomically so a scrape never sees half of it.
+func writeDrillMetrics(file string, r drillResult) error {
+	success := 0
+	if r.Success {
+		success = 1
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP streams3_restore_drill_success Whether the last restore drill succeeded.\n")
+	fmt.Fprintf(&buf, "# TYPE streams3_restore_drill_success gauge\n")
+	fmt.Fprintf(&buf, "streams3_restore_drill_success %d\n", success)
+	fmt.Fprintf(&buf, "# HELP streams3_restore_drill_bytes Bytes restored by the last restore drill.\n")
+	fmt.Fprintf(&buf, "# TYPE streams3_restore_drill_bytes gauge\n")
+	fmt.Fprintf(&buf, "streams3_restore_drill_bytes %d\n", r.Bytes)
+	fmt.Fprintf(&buf, "# HELP streams3_restore_drill_seconds Duration of the last restore drill.\n")
+	fmt.Fprintf(&buf, "# TYPE streams3_restore_drill_seconds gauge\n")
+	fmt.Fprintf(&buf, "streams3_restore_drill_seconds %g\n", r.Seconds)
+	fmt.Fprintf(&buf, "# HELP streams3_restore_drill_timestamp_seconds Completion time of the last restore drill.\n")
+	fmt.Fprintf(&buf, "# TYPE streams3_restore_drill_timestamp_seconds gauge\n")
+	fmt.Fprintf(&buf, "streams3_restore_drill_timestamp_seconds %d\n", r.Finished.Unix())
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".drill")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(buf.Bytes()); err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// postDrillResult - posts the result as JSON to a webhook.
+func postDrillResult(url string, r drillResult) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// verifyRestoreMain - implements the 'verify-restore [-bucket name]
+// [-exec cmd] [-interval d] <prefix>' command, a restore drill of the
+// latest backup below prefix, once or periodically.
+func verifyRestoreMain(args []string) error {
+	flags := flag.NewFlagSet("verify-restore", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket holding the backups")
+	decompress := flags.String("decompress", "auto", "decompress: auto, gzip, zstd, bzip2, xz, or empty for none")
+	command := flags.String("exec", "", "validation command reading the restored stream on stdin, e.g. 'pg_restore --list'")
+	interval := flags.Duration("interval", 0, "repeat the drill at this interval, 0 runs it once")
+	metrics := flags.String("metrics", "", "Prometheus textfile to write the result to")
+	webhook := flags.String("webhook", "", "URL to post the JSON result to")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: verify-restore [-bucket name] [-exec cmd] [-interval d] [-metrics file] [-webhook url] <prefix>")
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		start := time.Now()
+		objectName, n, err := restoreDrill(c, *bucketName, flags.Arg(0), *decompress, *command)
+		result := drillResult{
+			Object:   objectName,
+			Bytes:    n,
+			Seconds:  time.Since(start).Seconds(),
+			Success:  err == nil,
+			Finished: time.Now().UTC(),
+		}
+		if err != nil {
+			result.Error = newErrorDetail(err)
+		}
+		enc.Encode(result)
+
+		// Reporting failures are logged, the drill result is what counts.
+		if *metrics != "" {
+			if mErr := writeDrillMetrics(*metrics, result); mErr != nil {
+				fmt.Fprintln(os.Stderr, "Writing metrics failed", mErr)
+			}
+		}
+		if *webhook != "" {
+			if wErr := postDrillResult(*webhook, result); wErr != nil {
+				fmt.Fprintln(os.Stderr, "Posting result failed", wErr)
+			}
+		}
+
+		if *interval == 0 {
+			return err
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	minio "github.com/minio/minio-go"
+)
+
+// duUsage - the storage used below a sub-prefix.
+type duUsage struct {
+	Objects         int64
+	Bytes           int64
+	Noncurrent      int64
+	NoncurrentBytes int64
+	Uploads         int64
+	UploadBytes     int64
+}
+
+// duTree - usage aggregated by sub-prefix, up to a depth below a prefix.
+type duTree struct {
+	prefix string
+	depth  int
+	usage  map[string]*duUsage
+}
+
+// group - returns the usage of the sub-prefix holding key, '.' being
+// the objects directly below the prefix.
+func (t *duTree) group(key string) *duUsage {
+	rest := strings.TrimPrefix(key, t.prefix)
+	parts := strings.Split(rest, "/")
+	name := "."
+	if len(parts) > 1 && t.depth > 0 {
+		n := t.depth
+		if n > len(parts)-1 {
+			n = len(parts) - 1
+		}
+		name = t.prefix + strings.Join(parts[:n], "/") + "/"
+	}
+	u, ok := t.usage[name]
+	if !ok {
+		u = &duUsage{}
+		t.usage[name] = u
+	}
+	return u
+}
+
+// addObjects - adds the current objects.
+func (t *duTree) addObjects(c minio.Core, bucketName string) error {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for objInfo := range c.Client.ListObjects(bucketName, t.prefix, true, doneCh) {
+		if objInfo.Err != nil {
+			return objInfo.Err
+		}
+		if isInternalObject(objInfo.Key) {
+			continue
+		}
+		u := t.group(objInfo.Key)
+		u.Objects++
+		u.Bytes += objInfo.Size
+	}
+	return nil
+}
+
+// addNoncurrent - adds the noncurrent versions.
+func (t *duTree) addNoncurrent(s site, bucketName string) error {
+	keyMarker, versionMarker := "", ""
+	for {
+		result, err := listObjectVersions(s, bucketName, t.prefix, "", keyMarker, versionMarker)
+		if err != nil {
+			return err
+		}
+		for _, v := range result.Versions {
+			if v.IsLatest || isInternalObject(v.Key) {
+				continue
+			}
+			u := t.group(v.Key)
+			u.Noncurrent++
+			u.NoncurrentBytes += v.Size
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		keyMarker, versionMarker = result.NextKeyMarker, result.NextVersionIDMarker
+	}
+}
+
+// addUploads - adds the parts of incomplete multipart uploads.
+func (t *duTree) addUploads(c minio.Core, bucketName string) error {
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		result, err := c.ListMultipartUploads(bucketName, t.prefix, keyMarker, uploadIDMarker, "", 1000)
+		if err != nil {
+			return wrapS3Error("ListMultipartUploads", err)
+		}
+		for _, upload := range result.Uploads {
+			_, size, err := countParts(c, bucketName, upload.Key, upload.UploadID)
+			if err != nil {
+				return err
+			}
+			u := t.group(upload.Key)
+			u.Uploads++
+			u.UploadBytes += size
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+}
+
+// humanBytes - formats a byte count with binary units.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// duMain - implements the 'du s3://bucket/prefix' command, which sums
+// the objects and bytes stored below each sub-prefix.
+func duMain(args []string) error {
+	flags := flag.NewFlagSet("du", flag.ExitOnError)
+	depth := flags.Int("depth", 1, "number of sub-prefix levels summed separately")
+	versions := flags.Bool("versions", false, "also count noncurrent versions")
+	uploads := flags.Bool("uploads", false, "also count parts of incomplete multipart uploads")
+	human := flags.Bool("h", false, "print sizes with units")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *depth < 0 {
+		return fmt.Errorf("Usage: du [-depth n] [-versions] [-uploads] [-h] s3://bucket/prefix")
+	}
+	bucketName, prefix, err := parseS3Prefix(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	t := &duTree{prefix: prefix, depth: *depth, usage: make(map[string]*duUsage)}
+	if err = t.addObjects(e.core(), bucketName); err != nil {
+		return err
+	}
+	if *versions {
+		if err = t.addNoncurrent(e.site(), bucketName); err != nil {
+			return err
+		}
+	}
+	if *uploads {
+		if err = t.addUploads(e.core(), bucketName); err != nil {
+			return err
+		}
+	}
+
+	size := func(n int64) string {
+		if *human {
+			return humanBytes(n)
+		}
+		return fmt.Sprint(n)
+	}
+	names := make([]string, 0, len(t.usage))
+	for name := range t.usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := "BYTES\tOBJECTS"
+	if *versions {
+		header += "\tNONCURRENT\tNONCURRENT BYTES"
+	}
+	if *uploads {
+		header += "\tUPLOADS\tUPLOAD BYTES"
+	}
+	fmt.Fprintln(w, header+"\tPREFIX")
+	var total duUsage
+	row := func(u *duUsage, name string) {
+		line := size(u.Bytes) + "\t" + fmt.Sprint(u.Objects)
+		if *versions {
+			line += "\t" + fmt.Sprint(u.Noncurrent) + "\t" + size(u.NoncurrentBytes)
+		}
+		if *uploads {
+			line += "\t" + fmt.Sprint(u.Uploads) + "\t" + size(u.UploadBytes)
+		}
+		fmt.Fprintln(w, line+"\t"+name)
+	}
+	for _, name := range names {
+		u := t.usage[name]
+		row(u, name)
+		total.Objects += u.Objects
+		total.Bytes += u.Bytes
+		total.Noncurrent += u.Noncurrent
+		total.NoncurrentBytes += u.NoncurrentBytes
+		total.Uploads += u.Uploads
+		total.UploadBytes += u.UploadBytes
+	}
+	row(&total, "total")
+	return w.Flush()
+}
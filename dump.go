@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// dumpTool - how to dump one kind of database.
+type dumpTool struct {
+	name string
+	// command returns the dump command of a database, extra holds the
+	// arguments given after '--'.
+	command func(database string, extra []string) *exec.Cmd
+	// serverVersion returns the command printing the server version.
+	serverVersion func(database string) *exec.Cmd
+}
+
+var dumpTools = map[string]dumpTool{
+	"dump-pg": {
+		name: "pg_dump",
+		command: func(database string, extra []string) *exec.Cmd {
+			// Connection settings come from the PG* environment.
+			args := []string{"--format=plain", "--no-password", "--clean", "--if-exists", "--quote-all-identifiers"}
+			return exec.Command("pg_dump", append(append(args, extra...), database)...)
+		},
+		serverVersion: func(database string) *exec.Cmd {
+			return exec.Command("psql", "--no-password", "-Atc", "SHOW server_version", database)
+		},
+	},
+	"dump-mysql": {
+		name: "mysqldump",
+		command: func(database string, extra []string) *exec.Cmd {
+			// A consistent snapshot without locking, streamed row by row.
+			args := []string{"--single-transaction", "--quick", "--routines", "--triggers", "--events", "--hex-blob"}
+			return exec.Command("mysqldump", append(append(args, extra...), database)...)
+		},
+		serverVersion: func(database string) *exec.Cmd {
+			return exec.Command("mysql", "-N", "-e", "SELECT VERSION()", database)
+		},
+	},
+}
+
+// commandOutput - returns the trimmed first line printed by cmd, empty
+// if it fails.
+func commandOutput(cmd *exec.Cmd) string {
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+}
+
+// dumpMain - implements the 'dump-pg' and 'dump-mysql' commands, which
+// stream a database dump through compression and, with ENCRYPTION_KEY
+// set, encryption into an object.
+func dumpMain(command string, args []string) error {
+	tool := dumpTools[command]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	objectName := flags.String("object", "", "object name, defaults to '<database>/<time>.sql.gz'")
+	compress := flags.Bool("compress", true, "gzip compress the dump")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: %s [-bucket name] [-object name] <database> [-- %s args]", command, tool.name)
+	}
+	database := flags.Arg(0)
+	extra := flags.Args()[1:]
+	if len(extra) > 0 && extra[0] == "--" {
+		extra = extra[1:]
+	}
+
+	key, err := encryptionKey()
+	if err != nil {
+		return err
+	}
+	t := transforms{compress: *compress, key: key}
+
+	if *objectName == "" {
+		*objectName = database + "/" + time.Now().UTC().Format("20060102T150405Z") + ".sql"
+		if t.compress {
+			*objectName += ".gz"
+		}
+		if t.key != nil {
+			*objectName += ".enc"
+		}
+	}
+
+	// Metadata is sent when the upload starts, before the dump.
+	metaData := map[string][]string{
+		"X-Amz-Meta-Dump-Tool":     {tool.name},
+		"X-Amz-Meta-Dump-Database": {database},
+	}
+	if v := commandOutput(exec.Command(tool.name, "--version")); v != "" {
+		metaData["X-Amz-Meta-Dump-Tool-Version"] = []string{v}
+	}
+	if v := commandOutput(tool.serverVersion(database)); v != "" {
+		metaData["X-Amz-Meta-Dump-Server-Version"] = []string{v}
+	}
+
+	cmd := tool.command(database, extra)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	// A failing dump fails the stream, so the upload is never completed.
+	reader, err := t.apply(&cmdReader{ReadCloser: stdout, cmd: cmd}, metaData)
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	n, err := PutStream(*bucketName, *objectName, reader, metaData)
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "uploaded", n, "bytes to", *bucketName+"/"+*objectName)
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Failover policies, chosen with FAILOVER_POLICY.
+const (
+	// Do not fail over, errors are returned as is.
+	failoverNone = "none"
+	// Continue the same multipart upload on the next endpoint.
+	failoverResume = "resume"
+	// Abort and upload again from the start on the next endpoint,
+	// only possible for sources implementing io.Seeker.
+	failoverRestart = "restart"
+)
+
+// Load balancing modes, chosen with LOAD_BALANCE.
+const (
+	balanceRoundRobin  = "round-robin"
+	balanceLeastLoaded = "least-loaded"
+)
+
+// endpoints - a prioritized list of endpoints for the same logical storage,
+// or with LOAD_BALANCE a pool of gateway nodes requests are spread across.
+type endpoints struct {
+	mu       sync.Mutex
+	sites    []site
+	cores    []minio.Core
+	backends []Backend
+	current  int
+	policy   string
+
+	// Load balancing state, per node.
+	balance  string
+	healthy  []bool
+	inflight []int
+	next     int
+
+	stopHealth chan struct{}
+
+	// Set by the Options of an upload, defaults if zero.
+	partSize     int64
+	parallel     int
+	expectSHA256 string
+	sizeHint     *sizeHint
+	// full is set once an upload reached the part limit with
+	// partLimitRotate, the stream going on in the next upload.
+	full bool
+	// rotated, if set with partLimitRotate, records each upload of a
+	// stream that was cut into several, with its sha256.
+	rotated func(objectName string, n int64, took time.Duration, sum string) error
+	// lock is the lock of the key uploaded to, checked before completing.
+	lock *objectLock
+	// limits are the deadline and retry budget of the upload.
+	limits *opLimits
+}
+
+// s3 - returns true if the endpoints are S3 compatible, other providers
+// only offer the Backend interface.
+func (e *endpoints) s3() bool {
+	return e.cores != nil
+}
+
+// newEndpoints - instantiates clients for every endpoint in S3_ADDRESS,
+// which may be a comma separated list in order of priority.
+func newEndpoints() (*endpoints, error) {
+	return newPooledEndpoints(0)
+}
+
+// newPooledEndpoints - same as newEndpoints, giving every site its own
+// transport keeping up to conns idle connections if conns is not 0.
+func newPooledEndpoints(conns int) (*endpoints, error) {
+	switch {
+	case isAzure():
+		return azureEndpoints()
+	case isFile():
+		return fileEndpoints()
+	}
+
+	sites, err := parseSites(os.Getenv("S3_ADDRESS"))
+	if err != nil {
+		return nil, err
+	}
+
+	e := &endpoints{
+		policy:  failoverResume,
+		balance: os.Getenv("LOAD_BALANCE"),
+		limits:  newOpLimits(),
+	}
+	if v := os.Getenv("FAILOVER_POLICY"); v != "" {
+		e.policy = v
+	}
+	switch e.policy {
+	case failoverNone, failoverResume, failoverRestart:
+	default:
+		return nil, fmt.Errorf("Unknown FAILOVER_POLICY %q", e.policy)
+	}
+
+	switch e.balance {
+	case "":
+	case balanceRoundRobin, balanceLeastLoaded:
+		if sites, err = resolveNodes(sites); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown LOAD_BALANCE %q", e.balance)
+	}
+
+	e.sites = sites
+	e.cores = make([]minio.Core, len(sites))
+	e.backends = make([]Backend, len(sites))
+	e.healthy = make([]bool, len(sites))
+	e.inflight = make([]int, len(sites))
+	for i, s := range sites {
+		if conns > 0 {
+			if s.base, err = newBaseTransport(s.ServerName, conns); err != nil {
+				return nil, err
+			}
+			e.sites[i] = s
+		}
+		if e.cores[i], err = s.core(); err != nil {
+			return nil, err
+		}
+		e.backends[i] = e.cores[i]
+		e.healthy[i] = true
+	}
+	return e, nil
+}
+
+// resolveNodes - expands every site whose host name resolves to several
+// addresses into one site per address.
+func resolveNodes(sites []site) ([]site, error) {
+	var nodes []site
+	for _, s := range sites {
+		host, port, err := net.SplitHostPort(s.Address)
+		if err != nil {
+			host, port = s.Address, ""
+		}
+		if net.ParseIP(host) != nil {
+			nodes = append(nodes, s)
+			continue
+		}
+
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) < 2 {
+			nodes = append(nodes, s)
+			continue
+		}
+		for _, addr := range addrs {
+			node := s
+			node.Address = addr
+			if port != "" {
+				node.Address = net.JoinHostPort(addr, port)
+			}
+			// Certificates are still verified against the name.
+			node.ServerName = host
+			nodes = append(nodes, node)
+		}
+		fmt.Fprintln(os.Stderr, "resolved", host, "to", len(addrs), "nodes")
+	}
+	return nodes, nil
+}
+
+// singleEndpoint - wraps a single client, which never fails over.
+func singleEndpoint(c minio.Core) *endpoints {
+	return &endpoints{
+		sites:    []site{{}},
+		cores:    []minio.Core{c},
+		backends: []Backend{c},
+		policy:   failoverNone,
+		healthy:  []bool{true},
+		inflight: []int{0},
+		limits:   newOpLimits(),
+	}
+}
+
+// parallelParts - returns the number of parts uploaded concurrently,
+// configured with PARALLEL_PARTS.
+func parallelParts() (int, error) {
+	v := os.Getenv("PARALLEL_PARTS")
+	if v == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid PARALLEL_PARTS %q", v)
+	}
+	return n, nil
+}
+
+// clone - returns endpoints sharing the clients of e, for another upload.
+func (e *endpoints) clone() *endpoints {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c := &endpoints{
+		sites:    e.sites,
+		cores:    e.cores,
+		backends: e.backends,
+		policy:   e.policy,
+		balance:  e.balance,
+		healthy:  make([]bool, len(e.sites)),
+		inflight: make([]int, len(e.sites)),
+		limits:   newOpLimits(),
+	}
+	for i := range c.healthy {
+		c.healthy[i] = true
+	}
+	return c
+}
+
+// parallelParts - returns the number of parts uploaded concurrently, the
+// concurrency of the upload options or PARALLEL_PARTS.
+func (e *endpoints) parallelParts() (int, error) {
+	if e.parallel > 0 {
+		return e.parallel, nil
+	}
+	return parallelParts()
+}
+
+// partInfo - same as optimalPartInfo, with the part size of the upload
+// options if set.
+func (e *endpoints) partInfo(size int64) (totalPartsCount int, partSize, lastPartSize int64, err error) {
+	if e.partSize <= 0 {
+		return optimalPartInfo(size)
+	}
+	if size < 0 {
+		return maxPartsCount, e.partSize, e.partSize, nil
+	}
+	totalPartsCount = int((size + e.partSize - 1) / e.partSize)
+	if totalPartsCount > maxPartsCount {
+		return 0, 0, 0, fmt.Errorf("Part size %d needs %d parts for %d bytes, at most %d are allowed", e.partSize, totalPartsCount, size, maxPartsCount)
+	}
+	if totalPartsCount == 0 {
+		totalPartsCount = 1
+	}
+	return totalPartsCount, e.partSize, size - int64(totalPartsCount-1)*e.partSize, nil
+}
+
+// core - returns the client for the current endpoint.
+func (e *endpoints) core() minio.Core {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cores[e.current]
+}
+
+// backend - returns the backend of the current endpoint.
+func (e *endpoints) backend() Backend {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.backends[e.current]
+}
+
+// site - returns the current endpoint.
+func (e *endpoints) site() site {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sites[e.current]
+}
+
+// acquire - picks the endpoint for a request, returns -1 if there is no
+// healthy node left.
+func (e *endpoints) acquire() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	i := -1
+	switch e.balance {
+	case balanceRoundRobin:
+		for n := 0; n < len(e.cores); n++ {
+			j := (e.next + n) % len(e.cores)
+			if e.healthy[j] {
+				i = j
+				break
+			}
+		}
+		e.next = (i + 1) % len(e.cores)
+	case balanceLeastLoaded:
+		for j := range e.cores {
+			if e.healthy[j] && (i < 0 || e.inflight[j] < e.inflight[i]) {
+				i = j
+			}
+		}
+	default:
+		i = e.current
+	}
+	if i >= 0 {
+		e.inflight[i]++
+	}
+	return i
+}
+
+// release - returns an endpoint picked by acquire, nodes which turned
+// out to be unreachable are dropped until their health check passes.
+func (e *endpoints) release(i int, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.inflight[i]--
+	if e.balance != "" && err != nil && isUnreachable(err) && e.healthy[i] {
+		fmt.Fprintln(os.Stderr, "node unreachable, dropping", e.sites[i].Address, err)
+		e.healthy[i] = false
+	}
+}
+
+// failover - moves to the next endpoint, returns false if there is none
+// left or the policy does not allow failing over.
+func (e *endpoints) failover(err error) bool {
+	if e.policy == failoverNone || !isUnreachable(err) {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.balance != "" {
+		// Unreachable nodes were dropped on release.
+		for _, ok := range e.healthy {
+			if ok {
+				return true
+			}
+		}
+		return false
+	}
+	if e.current+1 >= len(e.backends) {
+		return false
+	}
+	fmt.Fprintln(os.Stderr, "endpoint unreachable, failing over", e.sites[e.current].Address, err)
+	e.current++
+	fmt.Fprintln(os.Stderr, "using endpoint", e.sites[e.current].Address)
+	return true
+}
+
+// do - runs op against an endpoint, with the resume policy op is retried
+// on the next endpoints while they are unreachable. Nothing is started
+// past the deadline, and retries are taken from the retry budget.
+func (e *endpoints) do(op func(b Backend) error) error {
+	return e.doFailover(op, e.policy == failoverResume)
+}
+
+// initiate - same as do for initiating an upload, which is retried on
+// the next endpoints with the restart policy too, as there is nothing
+// to restart yet.
+func (e *endpoints) initiate(op func(b Backend) error) error {
+	return e.doFailover(op, true)
+}
+
+// doFailover - runs op, retrying it on the next endpoints if failover.
+func (e *endpoints) doFailover(op func(b Backend) error, failover bool) error {
+	if err := e.limits.checkDeadline(); err != nil {
+		return err
+	}
+	for {
+		i := e.acquire()
+		if i < 0 {
+			return fmt.Errorf("No healthy nodes left")
+		}
+		err := op(e.backends[i])
+		e.release(i, err)
+		if err == nil || !failover || !e.failover(err) {
+			return err
+		}
+		if err = e.limits.spendRetry(err); err != nil {
+			return err
+		}
+	}
+}
+
+// startHealthChecks - with load balancing, probes every node each
+// HEALTH_INTERVAL (default 10s) and marks it healthy or not.
+func (e *endpoints) startHealthChecks(bucketName string) error {
+	if e.balance == "" || !e.s3() {
+		return nil
+	}
+
+	interval := 10 * time.Second
+	if v := os.Getenv("HEALTH_INTERVAL"); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil {
+			return err
+		}
+	}
+
+	e.stopHealth = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stopHealth:
+				return
+			case <-ticker.C:
+			}
+			for i, c := range e.cores {
+				_, err := c.BucketExists(bucketName)
+				e.mu.Lock()
+				if ok := err == nil; ok != e.healthy[i] {
+					fmt.Fprintln(os.Stderr, "node health changed", e.sites[i].Address, "healthy:", ok)
+					e.healthy[i] = ok
+				}
+				e.mu.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+// stopHealthChecks - stops the health checks started for an upload.
+func (e *endpoints) stopHealthChecks() {
+	if e.stopHealth != nil {
+		close(e.stopHealth)
+		e.stopHealth = nil
+	}
+}
+
+// canRestart - returns true if a failed upload of reader may be
+// restarted from the start on the next endpoint.
+func (e *endpoints) canRestart(reader io.Reader, err error) bool {
+	if e.policy != failoverRestart {
+		return false
+	}
+	if _, ok := reader.(io.Seeker); !ok {
+		return false
+	}
+	return e.failover(err)
+}
+
+// isUnreachable - returns true if the endpoint could not be reached, or
+// reported it is unable to serve requests.
+func isUnreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	switch errorCode(err) {
+	case "ServiceUnavailable", "InternalError", "ServerBusy", "OperationTimedOut":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	minio "github.com/minio/minio-go"
+)
+
+// S3Error - an error returned by an S3 operation, carrying the details
+// storage vendors ask for in support tickets.
+type S3Error struct {
+	Operation string
+	Code      string
+	Message   string
+	Bucket    string
+	Key       string
+	Region    string
+	RequestID string
+	HostID    string
+
+	// Err is the original error.
+	Err error
+}
+
+func (e *S3Error) Error() string {
+	msg := fmt.Sprintf("%s: %s: %s", e.Operation, e.Code, e.Message)
+	if e.Bucket != "" {
+		msg += fmt.Sprintf(" (bucket %s", e.Bucket)
+		if e.Key != "" {
+			msg += ", key " + e.Key
+		}
+		msg += ")"
+	}
+	if e.RequestID != "" {
+		msg += ", request id " + e.RequestID
+	}
+	if e.HostID != "" {
+		msg += ", host id " + e.HostID
+	}
+	return msg
+}
+
+func (e *S3Error) Unwrap() error { return e.Err }
+
+// wrapS3Error - wraps S3 error responses of an operation into an S3Error,
+// other errors are returned unchanged.
+func wrapS3Error(operation string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) {
+		return err
+	}
+	resp := minio.ToErrorResponse(err)
+	if resp.Code == "" {
+		return err
+	}
+	return &S3Error{
+		Operation: operation,
+		Code:      resp.Code,
+		Message:   resp.Message,
+		Bucket:    resp.BucketName,
+		Key:       resp.Key,
+		Region:    resp.Region,
+		RequestID: resp.RequestID,
+		HostID:    resp.HostID,
+		Err:       err,
+	}
+}
+
+// errorCode - returns the S3 error code of err, empty if err is not an
+// S3 error response.
+func errorCode(err error) string {
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) {
+		return s3Err.Code
+	}
+	return minio.ToErrorResponse(err).Code
+}
+
+// errorDetail - the S3 error details included in JSON output.
+type errorDetail struct {
+	Message   string `json:"message"`
+	Operation string `json:"operation,omitempty"`
+	Code      string `json:"code,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	HostID    string `json:"hostId,omitempty"`
+}
+
+// newErrorDetail - returns the JSON error details for err, nil if err is nil.
+func newErrorDetail(err error) *errorDetail {
+	if err == nil {
+		return nil
+	}
+	d := &errorDetail{Message: err.Error()}
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) {
+		d.Operation = s3Err.Operation
+		d.Code = s3Err.Code
+		d.RequestID = s3Err.RequestID
+		d.HostID = s3Err.HostID
+	}
+	return d
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checksumAlgos - the S3 additional checksum algorithms, by the name
+// used in their x-amz-checksum-* header.
+var checksumAlgos = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+// streamPartSize - returns the part size of streamed uploads, whose
+// size is unknown.
+func streamPartSize() int64 {
+	_, partSize, _, _ := optimalPartInfo(-1)
+	return partSize
+}
+
+// partDigest - digests of a stream, whole and cut into parts.
+type partDigest struct {
+	name  string
+	whole hash.Hash
+	part  hash.Hash
+	parts []byte
+}
+
+// digestParts - reads reader to the end, returning its ETag and the
+// given checksums as S3 reports them, of the whole stream and composite
+// of its parts. A partSize of zero computes single PUT values, which
+// have no composite checksums. A growLimit other than zero grows the
+// parts as PART_LIMIT_POLICY=grow does.
+func digestParts(reader io.Reader, partSize, growLimit int64, algos []string) (etag string, whole, composite map[string]string, err error) {
+	digests := []*partDigest{{name: "md5", whole: md5.New(), part: md5.New()}}
+	for _, name := range algos {
+		newHash, ok := checksumAlgos[name]
+		if !ok {
+			return "", nil, nil, fmt.Errorf("Unknown checksum algorithm %q", name)
+		}
+		digests = append(digests, &partDigest{name: name, whole: newHash(), part: newHash()})
+	}
+	writers := make([]io.Writer, 0, 2*len(digests))
+	for _, d := range digests {
+		writers = append(writers, d.whole, d.part)
+	}
+	w := io.MultiWriter(writers...)
+
+	parts := 0
+	for {
+		var n int64
+		if partSize > 0 {
+			size := partSize
+			if growLimit > 0 {
+				size = grownPartSize(partSize, parts+1, growLimit)
+			}
+			n, err = io.CopyN(w, reader, size)
+		} else {
+			n, err = io.Copy(w, reader)
+		}
+		if n > 0 || parts == 0 {
+			parts++
+			for _, d := range digests {
+				d.parts = d.part.Sum(d.parts)
+				d.part.Reset()
+			}
+		}
+		if err == io.EOF || (partSize <= 0 && err == nil) {
+			break
+		}
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	whole = make(map[string]string)
+	composite = make(map[string]string)
+	for _, d := range digests {
+		if d.name == "md5" {
+			etag = hex.EncodeToString(d.whole.Sum(nil))
+			if partSize > 0 {
+				h := md5.New()
+				h.Write(d.parts)
+				etag = hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(parts)
+			}
+			continue
+		}
+		whole[d.name] = base64.StdEncoding.EncodeToString(d.whole.Sum(nil))
+		if partSize > 0 {
+			h := checksumAlgos[d.name]()
+			h.Write(d.parts)
+			composite[d.name] = base64.StdEncoding.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(parts)
+		}
+	}
+	return etag, whole, composite, nil
+}
+
+// MultipartETag - returns the ETag S3 gives an object uploaded from
+// reader in parts of partSize, or in a single PUT if partSize is zero.
+func MultipartETag(reader io.Reader, partSize int64) (string, error) {
+	etag, _, _, err := digestParts(reader, partSize, 0, nil)
+	return etag, err
+}
+
+// etagMain - implements the 'etag [-part-size N] <file>' command.
+func etagMain(args []string) error {
+	flags := flag.NewFlagSet("etag", flag.ExitOnError)
+	partSize := flags.Int64("part-size", streamPartSize(), "part size in bytes, 0 for a single PUT")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: etag [-part-size N] <file>")
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	etag, err := MultipartETag(f, *partSize)
+	if err != nil {
+		return err
+	}
+	fmt.Println(etag)
+	return nil
+}
+
+// remotePartSize - returns the size of the first part of a multipart
+// object, which is the part size of all parts but the last.
+func remotePartSize(s site, bucketName, objectName, versionID string) (int64, error) {
+	query := url.Values{"partNumber": {"1"}}
+	if versionID != "" {
+		query.Set("versionId", versionID)
+	}
+	resp, err := siteRequest(s, "HeadObject", http.MethodHead, bucketName, objectName, query, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+}
+
+// compareResult - the outcome of 'compare', printed as JSON.
+type compareResult struct {
+	File      string                  `json:"file"`
+	Object    string                  `json:"object"`
+	Size      [2]int64                `json:"size"`
+	PartSize  int64                   `json:"partSize,omitempty"`
+	ETag      *compareValue           `json:"etag,omitempty"`
+	Checksums map[string]compareValue `json:"checksums,omitempty"`
+	Note      string                  `json:"note,omitempty"`
+	Match     bool                    `json:"match"`
+}
+
+// compareValue - a local and remote value, and whether they match.
+type compareValue struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	Match  bool   `json:"match"`
+}
+
+// compareMain - implements the 'compare <file> s3://bucket/key' command,
+// which checks a local file against an object from its size, ETag and
+// checksums, without downloading it.
+func compareMain(args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	partSize := flags.Int64("part-size", 0, "part size of the upload, found from the object if 0")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: compare [-part-size N] <file> s3://bucket/key")
+	}
+	bucketName, objectName, err := parseObjectURL(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	st, err := statObject(e.site(), bucketName, objectName, "")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	result := compareResult{File: flags.Arg(0), Object: bucketName + "/" + objectName, Size: [2]int64{info.Size(), st.Size}}
+	if info.Size() != st.Size {
+		result.Note = "sizes differ"
+		return printCompare(result)
+	}
+
+	multipart := strings.Contains(st.ETag, "-")
+	if multipart && *partSize == 0 {
+		if *partSize, err = remotePartSize(e.site(), bucketName, objectName, ""); err != nil {
+			return err
+		}
+	}
+	if !multipart {
+		*partSize = 0
+	}
+	result.PartSize = *partSize
+	// Parts grown by the upload are found from the first one.
+	var growLimit int64
+	if v := st.UserMetadata["part-growth-limit"]; multipart && v != "" {
+		if growLimit, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("Invalid part growth limit %q of %s/%s", v, bucketName, objectName)
+		}
+	}
+
+	var algos []string
+	for name := range st.Checksums {
+		if _, ok := checksumAlgos[name]; ok {
+			algos = append(algos, name)
+		}
+	}
+	etag, whole, composite, err := digestParts(f, *partSize, growLimit, algos)
+	if err != nil {
+		return err
+	}
+
+	// Objects encrypted by the server or by us have no MD5 ETags.
+	transformed := st.UserMetadata["encryption"] != "" || st.UserMetadata["compression"] != ""
+	sse := st.SSE[""]
+	switch {
+	case transformed:
+		result.Note = "object was transformed on upload, its ETag is not of the file"
+	case sse == "aws:kms" || st.SSE["customer-algorithm"] != "":
+		result.Note = "ETags of " + sse + " encrypted objects are not MD5 based"
+	default:
+		result.ETag = &compareValue{Local: etag, Remote: st.ETag, Match: etag == st.ETag}
+	}
+	result.Match = result.ETag == nil || result.ETag.Match
+	for name, local := range whole {
+		// Full object checksums of multipart uploads have no part count.
+		if strings.Contains(st.Checksums[name], "-") {
+			local = composite[name]
+		}
+		v := compareValue{Local: local, Remote: st.Checksums[name], Match: local == st.Checksums[name]}
+		if result.Checksums == nil {
+			result.Checksums = make(map[string]compareValue)
+		}
+		result.Checksums[name] = v
+		result.Match = result.Match && v.Match
+	}
+	if result.ETag == nil && result.Checksums == nil {
+		result.Match = false
+		result.Note += ", and it has no checksums"
+	}
+	return printCompare(result)
+}
+
+// printCompare - prints the result, failing if the file differs.
+func printCompare(result compareResult) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		return err
+	}
+	if !result.Match {
+		return fmt.Errorf("%s differs from %s", result.File, result.Object)
+	}
+	return nil
+}
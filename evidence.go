@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// evidenceFile - a file of an evidence bundle, as listed in its manifest.
+type evidenceFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// evidenceManifest - the manifest of an evidence bundle, signed with a
+// detached signature stored next to it.
+type evidenceManifest struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	VersionID    string `json:"versionId,omitempty"`
+	ETag         string `json:"etag"`
+	ETagVerified bool   `json:"etagVerified"`
+	// ChecksumsVerified - the checksums of the object found to match
+	// its content, such as sha256.
+	ChecksumsVerified []string       `json:"checksumsVerified,omitempty"`
+	ExportedAt        time.Time      `json:"exportedAt"`
+	Host              string         `json:"host"`
+	Version           string         `json:"toolVersion"`
+	Files             []evidenceFile `json:"files"`
+}
+
+// Names of the files of an evidence bundle, besides the object itself.
+const (
+	evidenceMetadata     = "metadata.json"
+	evidenceVersions     = "versions.json"
+	evidenceAudit        = "audit.ndjson"
+	evidenceManifestName = "MANIFEST.json"
+)
+
+// evidenceWriter - writes the files of an evidence bundle to a tar
+// stream, recording them for the manifest.
+type evidenceWriter struct {
+	tw    *tar.Writer
+	files []evidenceFile
+}
+
+// add - writes a file of size bytes read from r.
+func (w *evidenceWriter) add(name string, size int64, r io.Reader) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0444,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(w.tw, io.TeeReader(io.LimitReader(r, size), h))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("Wrote %d bytes of %s, expected %d", n, name, size)
+	}
+	w.files = append(w.files, evidenceFile{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))})
+	return nil
+}
+
+// addJSON - writes v as an indented JSON file.
+func (w *evidenceWriter) addJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	return w.add(name, int64(len(data)), bytes.NewReader(data))
+}
+
+// objectVersions - returns the versions and delete markers of a key.
+func objectVersions(s site, bucketName, objectName string) ([]objectVersion, error) {
+	var versions []objectVersion
+	keyMarker, versionMarker := "", ""
+	for {
+		result, err := listObjectVersions(s, bucketName, objectName, "", keyMarker, versionMarker)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range result.Versions {
+			if v.Key == objectName {
+				versions = append(versions, v)
+			}
+		}
+		for _, v := range result.DeleteMarkers {
+			if v.Key == objectName {
+				v.deleteMarker = true
+				versions = append(versions, v)
+			}
+		}
+		if !result.IsTruncated {
+			return versions, nil
+		}
+		keyMarker, versionMarker = result.NextKeyMarker, result.NextVersionIDMarker
+	}
+}
+
+// auditEntries - returns the lines of an audit log about an object.
+func auditEntries(name, bucketName, objectName string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r auditRecord
+		if json.Unmarshal(scanner.Bytes(), &r) != nil {
+			continue
+		}
+		if r.Bucket == bucketName && r.Key == objectName {
+			entries = append(entries, scanner.Bytes()...)
+			entries = append(entries, '\n')
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// exportEvidence - writes the evidence bundle of an object version to out.
+func exportEvidence(out io.Writer, s site, bucketName, objectName, versionID, auditLog, signKey string) (*evidenceManifest, error) {
+	st, err := statObject(s, bucketName, objectName, versionID)
+	if err != nil {
+		return nil, err
+	}
+	// The version described is the version exported, even if a newer one
+	// is written meanwhile. Unversioned buckets have no version to ask
+	// for, the ETag fails the download if the object was overwritten.
+	query := url.Values{}
+	if st.VersionID != "" {
+		query.Set("versionId", st.VersionID)
+	}
+	header := http.Header{"If-Match": {"\"" + st.ETag + "\""}}
+	resp, err := siteRequest(s, "GetObject", http.MethodGet, bucketName, objectName, query, header, nil)
+	if errorCode(err) == "PreconditionFailed" {
+		return nil, fmt.Errorf("%s/%s was overwritten while exporting it", bucketName, objectName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Multipart ETags and checksums are digests of the parts.
+	var partSize, growLimit int64
+	if strings.Contains(st.ETag, "-") {
+		if partSize, err = remotePartSize(s, bucketName, objectName, st.VersionID); err != nil {
+			return nil, err
+		}
+		if v := st.UserMetadata["part-growth-limit"]; v != "" {
+			if growLimit, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("Invalid part growth limit %q of %s/%s", v, bucketName, objectName)
+			}
+		}
+	}
+	var algos []string
+	for name := range st.Checksums {
+		if _, ok := checksumAlgos[name]; ok {
+			algos = append(algos, name)
+		}
+	}
+	sort.Strings(algos)
+
+	versions, err := objectVersions(s, bucketName, objectName)
+	if err != nil {
+		// Buckets may not allow listing versions to the exporter.
+		fmt.Fprintln(os.Stderr, "versions not exported:", err)
+		versions = nil
+	}
+
+	w := &evidenceWriter{tw: tar.NewWriter(out)}
+	type digests struct {
+		etag             string
+		whole, composite map[string]string
+		err              error
+	}
+	pr, pw := io.Pipe()
+	digestCh := make(chan digests, 1)
+	go func() {
+		var d digests
+		d.etag, d.whole, d.composite, d.err = digestParts(pr, partSize, growLimit, algos)
+		pr.CloseWithError(d.err)
+		digestCh <- d
+	}()
+	err = w.add("object/"+path.Base(objectName), st.Size, io.TeeReader(resp.Body, pw))
+	pw.CloseWithError(err)
+	d := <-digestCh
+	if err != nil {
+		return nil, err
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	objectSHA256 := w.files[len(w.files)-1].SHA256
+	if err = w.addJSON(evidenceMetadata, st); err != nil {
+		return nil, err
+	}
+	type versionEntry struct {
+		VersionID    string    `json:"versionId"`
+		IsLatest     bool      `json:"isLatest"`
+		DeleteMarker bool      `json:"deleteMarker,omitempty"`
+		LastModified time.Time `json:"lastModified"`
+		ETag         string    `json:"etag,omitempty"`
+		Size         int64     `json:"size"`
+	}
+	entries := []versionEntry{}
+	for _, v := range versions {
+		entries = append(entries, versionEntry{
+			VersionID:    v.VersionID,
+			IsLatest:     v.IsLatest,
+			DeleteMarker: v.deleteMarker,
+			LastModified: v.LastModified,
+			ETag:         strings.Trim(v.ETag, "\""),
+			Size:         v.Size,
+		})
+	}
+	if err = w.addJSON(evidenceVersions, entries); err != nil {
+		return nil, err
+	}
+	if auditLog != "" {
+		audit, err := auditEntries(auditLog, bucketName, objectName)
+		if err != nil {
+			return nil, err
+		}
+		if err = w.add(evidenceAudit, int64(len(audit)), bytes.NewReader(audit)); err != nil {
+			return nil, err
+		}
+	}
+
+	host, _ := os.Hostname()
+	m := &evidenceManifest{
+		Bucket:     bucketName,
+		Key:        objectName,
+		VersionID:  st.VersionID,
+		ETag:       st.ETag,
+		ExportedAt: time.Now().UTC(),
+		Host:       host,
+		Version:    toolVersion,
+		Files:      w.files,
+	}
+	// ETags of objects encrypted with KMS or customer keys are not MD5
+	// based, their checksums verify them.
+	m.ETagVerified = st.ETag == d.etag
+	sse := st.SSE["algorithm"]
+	if !m.ETagVerified && sse != "aws:kms" && sse != "aws:kms:dsse" && st.SSE["customer-algorithm"] == "" {
+		return nil, fmt.Errorf("%s/%s has ETag %s, its content %s", bucketName, objectName, st.ETag, d.etag)
+	}
+	for _, name := range algos {
+		local := d.whole[name]
+		// Full object checksums of multipart uploads have no part count.
+		if strings.Contains(st.Checksums[name], "-") {
+			local = d.composite[name]
+		}
+		if local != st.Checksums[name] {
+			return nil, fmt.Errorf("%s/%s has %s checksum %s, its content %s", bucketName, objectName, name, st.Checksums[name], local)
+		}
+		m.ChecksumsVerified = append(m.ChecksumsVerified, name)
+	}
+	// Objects pushed by sync carry the SHA-256 of the file.
+	transformed := st.UserMetadata["encryption"] != "" || st.UserMetadata["compression"] != ""
+	if sum := st.UserMetadata["sha256"]; sum != "" && !transformed {
+		if sum != objectSHA256 {
+			return nil, fmt.Errorf("%s/%s has SHA-256 metadata %s, its content %s", bucketName, objectName, sum, objectSHA256)
+		}
+		m.ChecksumsVerified = append(m.ChecksumsVerified, "metadata-sha256")
+	}
+	if !m.ETagVerified && len(m.ChecksumsVerified) == 0 {
+		fmt.Fprintln(os.Stderr, "content of", bucketName+"/"+objectName, "not verified, it has no checksums")
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	manifest = append(manifest, '\n')
+
+	sig, err := startSigner(signKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(ioutil.Discard, sig.reader(bytes.NewReader(manifest))); err != nil {
+		sig.kill()
+		return nil, err
+	}
+	signature, err := sig.finish()
+	if err != nil {
+		return nil, err
+	}
+	if err = w.add(evidenceManifestName, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return nil, err
+	}
+	if err = w.add(evidenceManifestName+".asc", int64(len(signature)), bytes.NewReader(signature)); err != nil {
+		return nil, err
+	}
+	return m, w.tw.Close()
+}
+
+// exportEvidenceMain - implements the 'export-evidence -out bundle.tar
+// -sign-key id s3://bucket/key' command, which exports an object with its
+// metadata, versions and audit log entries into a tarball whose manifest
+// of checksums is signed, for chain of custody handoffs.
+func exportEvidenceMain(args []string) error {
+	flags := flag.NewFlagSet("export-evidence", flag.ExitOnError)
+	versionID := flags.String("version-id", "", "version to export, the current one by default")
+	out := flags.String("out", "", "tarball to write")
+	auditLog := flags.String("audit-log", os.Getenv("AUDIT_LOG"), "audit log to include the entries about the object of, AUDIT_LOG by default")
+	signKey := flags.String("sign-key", "", "gpg key signing the manifest")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *out == "" || *signKey == "" {
+		return fmt.Errorf("Usage: export-evidence -out bundle.tar -sign-key id [-version-id id] [-audit-log file] s3://bucket/key")
+	}
+	bucketName, objectName, err := parseObjectURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+
+	// Partial bundles are never left under the final name.
+	tmp := *out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	m, err := exportEvidence(f, e.site(), bucketName, objectName, *versionID, *auditLog, *signKey)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, *out)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
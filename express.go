@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expressSuffix - suffix of S3 Express One Zone directory bucket names,
+// which look like 'name--use1-az4--x-s3'.
+const expressSuffix = "--x-s3"
+
+// expressZone - returns the availability zone id of a directory bucket,
+// and false for general purpose buckets.
+func expressZone(bucketName string) (string, bool) {
+	if !strings.HasSuffix(bucketName, expressSuffix) {
+		return "", false
+	}
+	name := strings.TrimSuffix(bucketName, expressSuffix)
+	i := strings.LastIndex(name, "--")
+	if i <= 0 || i+2 == len(name) {
+		return "", false
+	}
+	return name[i+2:], true
+}
+
+// isExpressBucket - returns true for directory buckets.
+func isExpressBucket(bucketName string) bool {
+	_, ok := expressZone(bucketName)
+	return ok
+}
+
+// expressEndpoint - returns the zonal endpoint serving directory buckets
+// of a zone, buckets are addressed as virtual hosts below it.
+func expressEndpoint(zone, region string) string {
+	return "s3express-" + zone + "." + region + ".amazonaws.com"
+}
+
+// expressDirections - the directions of the region codes of zone ids.
+var expressDirections = map[string]string{
+	"e": "east", "w": "west", "n": "north", "s": "south", "c": "central",
+	"ne": "northeast", "nw": "northwest", "se": "southeast", "sw": "southwest",
+}
+
+// expressRegion - returns the region of a zone id, such as us-east-1 for
+// use1-az4, and false if it doesn't look like one.
+func expressRegion(zone string) (string, bool) {
+	code := zone
+	if i := strings.Index(zone, "-"); i > 0 {
+		code = zone[:i]
+	}
+	digits := strings.IndexAny(code, "0123456789")
+	if digits < 3 {
+		return "", false
+	}
+	direction, ok := expressDirections[code[2:digits]]
+	if !ok {
+		return "", false
+	}
+	return code[:2] + "-" + direction + "-" + code[digits:], true
+}
+
+// expressTransport - an http.RoundTripper sending requests for directory
+// buckets to their zonal endpoint, signed with session credentials from
+// CreateSession. Other requests are passed through untouched. Buckets
+// are signed for the region of their zone, region is used for zones
+// whose region is not known.
+type expressTransport struct {
+	base   http.RoundTripper
+	creds  credentials
+	region string
+
+	mu       sync.Mutex
+	sessions map[string]credentials
+}
+
+// expressBucket - returns the bucket and key of a path style or virtual
+// host request.
+func expressBucket(req *http.Request) (bucketName, objectName string) {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	// Directory bucket names never contain dots.
+	if i := strings.Index(host, "."); i > 0 {
+		if _, ok := expressZone(host[:i]); ok {
+			return host[:i], path
+		}
+	}
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+func (t *expressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bucketName, objectName := expressBucket(req)
+	zone, ok := expressZone(bucketName)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	region, ok := expressRegion(zone)
+	if !ok {
+		region = t.region
+	}
+
+	// The minio client looks up the bucket region first, directory
+	// buckets always live in the region of their zone.
+	if _, ok := req.URL.Query()["location"]; ok && objectName == "" && req.Method == http.MethodGet {
+		body := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+			`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` + region + `</LocationConstraint>`
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/xml"}},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	session, err := t.session(bucketName, zone, region)
+	if err != nil {
+		return nil, err
+	}
+
+	r := req.Clone(req.Context())
+	host := bucketName + "." + expressEndpoint(zone, region)
+	r.URL.Scheme = "https"
+	r.URL.Host = host
+	r.Host = host
+	r.URL.Path = "/" + objectName
+	r.URL.RawPath = s3EscapePath(r.URL.Path)
+	r.Header.Del("X-Amz-Security-Token")
+	r.Header.Set("X-Amz-S3session-Token", session.SessionToken)
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" || payloadHash == streamingPayload {
+		payloadHash = unsignedPayload
+	}
+	signV4Service(r, credentials{AccessKey: session.AccessKey, SecretKey: session.SecretKey},
+		region, "s3express", signingTime(), payloadHash)
+	return t.base.RoundTrip(r)
+}
+
+// session - returns the cached session credentials of a bucket, creating
+// a new session shortly before they expire.
+func (t *expressTransport) session(bucketName, zone, region string) (credentials, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.sessions[bucketName]; ok && time.Until(s.Expiration) > time.Minute {
+		return s, nil
+	}
+
+	creds := t.creds
+	if creds.expiring() {
+		refreshed, err := resolveCredentials()
+		if err != nil {
+			return credentials{}, err
+		}
+		creds = refreshed
+	}
+
+	s, err := createSession(t.base, creds, region, bucketName, zone)
+	if err != nil {
+		return credentials{}, err
+	}
+	if t.sessions == nil {
+		t.sessions = make(map[string]credentials)
+	}
+	t.sessions[bucketName] = s
+	return s, nil
+}
+
+// createSession - requests short lived session credentials for a
+// directory bucket.
+func createSession(transport http.RoundTripper, creds credentials, region, bucketName, zone string) (credentials, error) {
+	if creds.AccessKey == "" {
+		return credentials{}, fmt.Errorf("Directory bucket %s requires credentials", bucketName)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+bucketName+"."+expressEndpoint(zone, region)+"/?session", nil)
+	if err != nil {
+		return credentials{}, err
+	}
+	signV4Service(req, creds, region, "s3express", signingTime(), emptySHA256)
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return credentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return credentials{}, s3ErrorFromResponse("CreateSession", resp)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"Credentials"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return credentials{}, err
+	}
+	return credentials{
+		AccessKey:    result.Credentials.AccessKeyID,
+		SecretKey:    result.Credentials.SecretAccessKey,
+		SessionToken: result.Credentials.SessionToken,
+		Provider:     "s3express",
+		Expiration:   result.Credentials.Expiration,
+	}, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lag policies of QUORUM_LAG_POLICY, applied to a site whose spool is
+// full.
+const (
+	// lagBlock - the stream waits for the site, as without spools.
+	lagBlock = "block"
+	// lagDrop - the site is dropped, and repaired later if the quorum
+	// is met.
+	lagDrop = "drop"
+	// lagFail - the upload fails.
+	lagFail = "fail"
+)
+
+// errSiteBehind - returned by writes to the spool of a site too far
+// behind the stream.
+var errSiteBehind = errors.New("Site fell too far behind the stream")
+
+// fanoutConfig - how the stream is handed to the sites of a quorum
+// write, configured with QUORUM_SPOOL, QUORUM_SPOOL_DIR, QUORUM_RATES
+// and QUORUM_LAG_POLICY.
+type fanoutConfig struct {
+	// spool is how many bytes a site may fall behind, 0 for none.
+	spool  int64
+	dir    string
+	policy string
+	// rates are the bytes per second of the sites limited, by address.
+	rates map[string]int64
+}
+
+func fanoutFromEnv() (fanoutConfig, error) {
+	f := fanoutConfig{
+		dir:    os.Getenv("QUORUM_SPOOL_DIR"),
+		policy: lagBlock,
+		rates:  make(map[string]int64),
+	}
+	if v := os.Getenv("QUORUM_SPOOL"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("Invalid QUORUM_SPOOL %q, expected a number of bytes", v)
+		}
+		f.spool = n
+	}
+	if v := os.Getenv("QUORUM_LAG_POLICY"); v != "" {
+		switch v {
+		case lagBlock, lagDrop, lagFail:
+			f.policy = v
+		default:
+			return f, fmt.Errorf("Invalid QUORUM_LAG_POLICY %q, expected block, drop or fail", v)
+		}
+		if f.spool == 0 && v != lagBlock {
+			return f, fmt.Errorf("QUORUM_LAG_POLICY %s requires QUORUM_SPOOL", v)
+		}
+	}
+	for _, entry := range strings.Split(os.Getenv("QUORUM_RATES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return f, fmt.Errorf("Invalid QUORUM_RATES entry %q, expected 'address=bytes-per-second'", entry)
+		}
+		rate, err := strconv.ParseInt(entry[i+1:], 10, 64)
+		if err != nil || rate <= 0 {
+			return f, fmt.Errorf("Invalid rate in QUORUM_RATES entry %q", entry)
+		}
+		f.rates[entry[:i]] = rate
+	}
+	return f, nil
+}
+
+// fanoutWriter - the end of a site's stream written by the quorumWriter.
+type fanoutWriter interface {
+	io.Writer
+	CloseWithError(err error) error
+}
+
+// fanoutReader - the end of a site's stream read by its upload.
+type fanoutReader interface {
+	io.Reader
+	CloseWithError(err error) error
+}
+
+// pipe - returns the stream of a site, through a spool if configured,
+// and read at the rate of the site if limited.
+func (f fanoutConfig) pipe(address string) (fanoutReader, fanoutWriter, error) {
+	var r fanoutReader
+	var w fanoutWriter
+	if f.spool == 0 {
+		r, w = io.Pipe()
+	} else {
+		var err error
+		if r, w, err = spoolPipe(address, f.dir, f.spool, f.policy); err != nil {
+			return nil, nil, err
+		}
+	}
+	if rate := f.rates[address]; rate > 0 {
+		r = &rateReader{fanoutReader: r, rate: rate}
+	}
+	return r, w, nil
+}
+
+// siteSpool - a ring buffer in a temporary file, letting a site fall up
+// to its size behind the stream.
+type siteSpool struct {
+	address string
+	policy  string
+	size    int64
+	f       *os.File
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written int64
+	read    int64
+	maxLag  int64
+	// closeErr is io.EOF once the stream ended.
+	closeErr error
+	// readErr is set once the upload of the site ended.
+	readErr error
+}
+
+// spoolReader and spoolWriter - the ends of a siteSpool.
+type spoolReader struct{ s *siteSpool }
+type spoolWriter struct{ s *siteSpool }
+
+// spoolPipe - returns the ends of a new siteSpool of size bytes in dir,
+// the temporary directory if empty.
+func spoolPipe(address, dir string, size int64, policy string) (*spoolReader, *spoolWriter, error) {
+	f, err := ioutil.TempFile(dir, "streams3-spool")
+	if err != nil {
+		return nil, nil, err
+	}
+	// Unlinked right away, the file is removed even if we crash.
+	os.Remove(f.Name())
+	s := &siteSpool{address: address, policy: policy, size: size, f: f}
+	s.cond = sync.NewCond(&s.mu)
+	return &spoolReader{s}, &spoolWriter{s}, nil
+}
+
+// ringAt - calls fn for the one or two sections of the file holding
+// len(p) bytes at offset off of the stream.
+func (s *siteSpool) ringAt(p []byte, off int64, fn func([]byte, int64) (int, error)) error {
+	pos := off % s.size
+	first := int64(len(p))
+	if pos+first > s.size {
+		first = s.size - pos
+	}
+	if _, err := fn(p[:first], pos); err != nil {
+		return err
+	}
+	if first < int64(len(p)) {
+		_, err := fn(p[first:], 0)
+		return err
+	}
+	return nil
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	s := w.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > s.size {
+			chunk = chunk[:s.size]
+		}
+		for s.readErr == nil && s.written-s.read+int64(len(chunk)) > s.size {
+			if s.policy != lagBlock {
+				return n, errSiteBehind
+			}
+			s.cond.Wait()
+		}
+		if s.readErr != nil {
+			return n, s.readErr
+		}
+		if err := s.ringAt(chunk, s.written, s.f.WriteAt); err != nil {
+			return n, err
+		}
+		s.written += int64(len(chunk))
+		if lag := s.written - s.read; lag > s.maxLag {
+			s.maxLag = lag
+		}
+		s.cond.Broadcast()
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// CloseWithError - ends the stream of the site, which fails with err if
+// not nil once the spool is read.
+func (w *spoolWriter) CloseWithError(err error) error {
+	s := w.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		err = io.EOF
+	}
+	if s.closeErr == nil {
+		s.closeErr = err
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	s := r.s
+	s.mu.Lock()
+	for s.read == s.written && s.closeErr == nil && s.readErr == nil {
+		s.cond.Wait()
+	}
+	if s.readErr != nil {
+		s.mu.Unlock()
+		return 0, s.readErr
+	}
+	if s.read == s.written {
+		err := s.closeErr
+		s.mu.Unlock()
+		r.release(err)
+		return 0, err
+	}
+	if avail := s.written - s.read; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	off := s.read
+	s.mu.Unlock()
+
+	// The bytes read are not overwritten until read is moved past them.
+	if err := s.ringAt(p, off, s.f.ReadAt); err != nil {
+		r.CloseWithError(err)
+		return 0, err
+	}
+
+	s.mu.Lock()
+	s.read += int64(len(p))
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return len(p), nil
+}
+
+// CloseWithError - ends the upload of the site, failing writes to the
+// spool with err.
+func (r *spoolReader) CloseWithError(err error) error {
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	r.release(err)
+	return nil
+}
+
+// release - ends reading the spool, removing its file.
+func (r *spoolReader) release(err error) {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readErr != nil {
+		return
+	}
+	s.readErr = err
+	s.cond.Broadcast()
+	s.f.Close()
+	if s.maxLag > 0 {
+		fmt.Fprintf(os.Stderr, "site %s fell up to %d bytes behind the stream\n", s.address, s.maxLag)
+	}
+}
+
+// rateReader - reads at most rate bytes per second on average.
+type rateReader struct {
+	fanoutReader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	// Small reads, so that the rate is kept over short periods too.
+	if max := r.rate / 4; max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := r.fanoutReader.Read(p)
+	r.n += int64(n)
+	due := time.Duration(float64(r.n) / float64(r.rate) * float64(time.Second))
+	if ahead := due - time.Since(r.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+	return n, err
+}
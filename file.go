@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// fileUploadsDir - directory below the root holding the parts of
+// uploads in progress.
+const fileUploadsDir = ".uploads"
+
+// fileBackend - a Backend writing parts to a local directory and
+// completing uploads by concatenating them into 'root/bucket/object'.
+// Metadata is not kept.
+type fileBackend struct {
+	root string
+}
+
+// fileEndpoints - returns the endpoints of '-provider file:///path'.
+func fileEndpoints() (*endpoints, error) {
+	u, err := url.Parse(*flagProvider)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("Provider %s has no path", *flagProvider)
+	}
+	if err = os.MkdirAll(u.Path, 0755); err != nil {
+		return nil, err
+	}
+	return &endpoints{
+		sites:    []site{{Address: u.Path}},
+		backends: []Backend{&fileBackend{root: u.Path}},
+		policy:   failoverNone,
+		healthy:  []bool{true},
+		inflight: []int{0},
+		limits:   newOpLimits(),
+	}, nil
+}
+
+// uploadDir - returns the directory holding the parts of an upload,
+// refusing ids not made by NewMultipartUpload.
+func (f *fileBackend) uploadDir(uploadID string) (string, error) {
+	if id, err := hex.DecodeString(uploadID); err != nil || len(id) != 8 {
+		return "", fmt.Errorf("Invalid upload id %q", uploadID)
+	}
+	return filepath.Join(f.root, fileUploadsDir, uploadID), nil
+}
+
+// objectPath - returns the path of an object, refusing names which
+// would escape the root or its bucket.
+func (f *fileBackend) objectPath(bucketName, objectName string) (string, error) {
+	if err := validateBucketName(bucketName); err != nil {
+		return "", err
+	}
+	if bucketName == fileUploadsDir {
+		return "", fmt.Errorf("Invalid bucket name %q: reserved for uploads", bucketName)
+	}
+	p := filepath.Join(f.root, bucketName, filepath.FromSlash(objectName))
+	if !strings.HasPrefix(p, filepath.Join(f.root, bucketName)+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid object name %q", objectName)
+	}
+	return p, nil
+}
+
+func (f *fileBackend) NewMultipartUpload(bucketName, objectName string, metaData map[string][]string) (string, error) {
+	if _, err := f.objectPath(bucketName, objectName); err != nil {
+		return "", err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+	return uploadID, os.MkdirAll(filepath.Join(f.root, fileUploadsDir, uploadID), 0755)
+}
+
+func (f *fileBackend) PutObjectPart(bucketName, objectName, uploadID string, partID int, size int64, data io.Reader, md5Sum, sha256Sum []byte) (minio.ObjectPart, error) {
+	dir, err := f.uploadDir(uploadID)
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+	file, err := os.Create(filepath.Join(dir, fmt.Sprintf("%06d", partID)))
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(file, h), data)
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+	if n != size {
+		return minio.ObjectPart{}, fmt.Errorf("Part %d has %d bytes, expected %d", partID, n, size)
+	}
+	sum := h.Sum(nil)
+	if md5Sum != nil && !bytes.Equal(md5Sum, sum) {
+		return minio.ObjectPart{}, fmt.Errorf("Part %d md5 mismatch", partID)
+	}
+	if err = file.Sync(); err != nil {
+		return minio.ObjectPart{}, err
+	}
+
+	return minio.ObjectPart{
+		PartNumber:   partID,
+		ETag:         hex.EncodeToString(sum),
+		Size:         n,
+		LastModified: time.Now().UTC(),
+	}, nil
+}
+
+// CompleteMultipartUpload - concatenates the parts into a temporary
+// file renamed into place, so readers never see a partial object.
+func (f *fileBackend) CompleteMultipartUpload(bucketName, objectName, uploadID string, parts []minio.CompletePart) error {
+	p, err := f.objectPath(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	dir, err := f.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	tmpFile := filepath.Join(dir, "object")
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	for _, part := range parts {
+		in, err := os.Open(filepath.Join(dir, fmt.Sprintf("%06d", part.PartNumber)))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpFile, p); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (f *fileBackend) AbortMultipartUpload(bucketName, objectName, uploadID string) error {
+	dir, err := f.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
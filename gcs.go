@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// gcsEndpoint - the XML API endpoint of Google Cloud Storage, used when
+// S3_ADDRESS is not set with '-provider gcs'.
+const gcsEndpoint = "storage.googleapis.com"
+
+// gcsChunkSize - size of resumable upload chunks, GCS requires a
+// multiple of 256KiB for all chunks but the last.
+const gcsChunkSize = 1024 * 1024 * 16
+
+// gcsResumable - returns true if uploads must use the resumable upload
+// protocol, set with GCS_RESUMABLE. Otherwise it is only used when the
+// bucket does not support XML API multipart uploads.
+func gcsResumable() bool {
+	return os.Getenv("GCS_RESUMABLE") > ""
+}
+
+// gcsMetadata - translates S3 headers GCS does not understand to their
+// x-goog equivalents, dropping those without one.
+func gcsMetadata(metaData map[string][]string) map[string][]string {
+	if v, ok := metaData["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"]; ok {
+		metaData["X-Goog-Encryption-Kms-Key-Name"] = v
+		delete(metaData, "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+		delete(metaData, "X-Amz-Server-Side-Encryption")
+	}
+	if v, ok := metaData["X-Amz-Acl"]; ok {
+		metaData["X-Goog-Acl"] = v
+		delete(metaData, "X-Amz-Acl")
+	}
+	if _, ok := metaData["X-Amz-Server-Side-Encryption-Context"]; ok {
+		fmt.Fprintln(os.Stderr, "SSE_KMS_CONTEXT is not supported by GCS, ignoring")
+		delete(metaData, "X-Amz-Server-Side-Encryption-Context")
+	}
+	return metaData
+}
+
+// putStreamResumable - uploads the stream with a GCS resumable upload,
+// in chunks of gcsChunkSize. The session URI authorizes the chunks, so
+// only the initiation is signed.
+func putStreamResumable(s site, bucketName, objectName string, reader io.Reader, metaData map[string][]string, progress ProgressFunc) (n int64, uploadID string, err error) {
+	transport, err := s.transport()
+	if err != nil {
+		return 0, "", err
+	}
+	client := &http.Client{
+		Transport: transport,
+		// 308 answers mean 'Resume Incomplete', not a redirect.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.objectURL(bucketName, objectName, nil).String(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	for k, v := range metaData {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	req.Header.Set("X-Goog-Resumable", "start")
+	if !s.anonymous() {
+		signV4(req, credentials{AccessKey: s.AccessKey, SecretKey: s.SecretKey}, "auto", signingTime(), emptySHA256)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		err = s3ErrorFromResponse("ResumableUploadStart", resp)
+		fmt.Fprintln(os.Stderr, "ResumableUploadStart failed", err)
+		return 0, "", err
+	}
+	session, err := resp.Location()
+	if err != nil {
+		return 0, "", err
+	}
+	uploadID = session.Query().Get("upload_id")
+
+	emit := func(ev ProgressEvent) {
+		ev.Time = time.Now()
+		ev.Bucket = bucketName
+		ev.Object = objectName
+		ev.UploadID = uploadID
+		progress(ev)
+	}
+	emit(ProgressEvent{Type: UploadStarted})
+
+	buf := make([]byte, gcsChunkSize)
+	for partNumber := 1; ; partNumber++ {
+		read, rErr := io.ReadFull(reader, buf)
+		last := rErr == io.EOF || rErr == io.ErrUnexpectedEOF
+		if rErr != nil && !last {
+			return n, uploadID, rErr
+		}
+
+		// The total is only known with the last chunk, which may be
+		// empty when the stream ends on a chunk boundary.
+		total := "*"
+		if last {
+			total = strconv.FormatInt(n+int64(read), 10)
+		}
+		contentRange := "bytes */" + total
+		if read > 0 {
+			contentRange = fmt.Sprintf("bytes %d-%d/%s", n, n+int64(read)-1, total)
+		}
+
+		emit(ProgressEvent{Type: PartStarted, PartNumber: partNumber, PartSize: int64(read), PartOffset: n})
+		if err = gcsPutChunk(client, session.String(), contentRange, buf[:read], last); err != nil {
+			fmt.Fprintln(os.Stderr, "ResumableUploadChunk failed", err)
+			return n, uploadID, err
+		}
+		n += int64(read)
+		emit(ProgressEvent{Type: PartCompleted, PartNumber: partNumber, PartSize: int64(read), PartOffset: n - int64(read), Bytes: n})
+		if last {
+			break
+		}
+	}
+
+	emit(ProgressEvent{Type: Completed, Bytes: n})
+	return n, uploadID, nil
+}
+
+// gcsPutChunk - uploads a chunk of a resumable upload. GCS answers
+// intermediate chunks with 308 and the last one with 200 or 201.
+func gcsPutChunk(client *http.Client, sessionURI, contentRange string, chunk []byte, last bool) error {
+	req, err := http.NewRequest(http.MethodPut, sessionURI, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case !last && resp.StatusCode == http.StatusPermanentRedirect:
+		return nil
+	case last && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated):
+		return nil
+	}
+	return s3ErrorFromResponse("ResumableUploadChunk", resp)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// putMain - implements the 'put [-bucket name] [-source spec] <object>'
+// command, which uploads stdin or the given source.
+func putMain(args []string) error {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	source := flags.String("source", "-", "file or sftp:// URL to upload, '-' for stdin")
+	indexEvery := flags.Int64("index-every", 0, "index the offset of every Nth line into a sidecar object")
+	indexTimeField := flags.String("index-time-field", "", "index NDJSON records whenever this RFC3339 field enters a new time bucket")
+	indexBucket := flags.Duration("index-time-bucket", time.Minute, "time bucket of -index-time-field")
+	rotateBytes := flags.Int64("rotate-bytes", 0, "rotate to a new '<object>.NNNNNN' after this many bytes")
+	rotateEvery := flags.Duration("rotate-every", 0, "rotate to a new '<object>.NNNNNN' after this long")
+	recordDelimiter := flags.String("record-delimiter", "", "only rotate right after this delimiter, e.g. '\\n'")
+	daily := flags.Bool("daily", false, "rotate every hour to 'prefix/YYYY/MM/DD/HH/host-NNNNNN.ext', <object> being 'prefix.ext', marking hours complete")
+	dailyTZ := flags.String("daily-tz", "UTC", "time zone of the hours of -daily")
+	filter := flags.String("filter", "", "only upload lines matching this regexp")
+	drop := flags.String("drop", "", "drop lines matching this regexp")
+	sample := flags.Float64("sample", 1, "fraction of lines uploaded, after filtering")
+	redact := flags.String("redact", "", "redact comma separated builtin patterns: email, credit-card, token")
+	redactRules := flags.String("redact-rules", "", "JSON file of redaction rules with a 'pattern' or a '$.json.path'")
+	toParquet := flags.String("to-parquet", "", "convert ndjson or csv records to Parquet before upload")
+	parquetSchema := flags.String("parquet-schema", "", "Parquet columns as 'name:type,...', types boolean, int64, double or string, inferred if empty")
+	parquetRows := flags.Int("parquet-rows", 100000, "records per Parquet row group")
+	posix := flags.Bool("posix", false, "preserve mtime, permissions, ownership and xattrs of a local -source")
+	planIn := flags.String("plan", "", "JSON part plan to cut the stream into, for reproducible parts and ETag")
+	planOut := flags.String("plan-out", "", "save the part plan followed to this JSON file")
+	profileReport := flags.Bool("profile-report", false, "print read, hash and upload timings and the bottleneck stage")
+	signKey := flags.String("sign-key", "", "upload a detached gpg signature made with this key as '<object>.sig'")
+	autoSanitize := flags.Bool("auto-sanitize-key", false, "replace control, invalid and awkward characters of the key, reporting the changes")
+	acl := flags.String("acl", "", "canned ACL of the object, such as bucket-owner-full-control for cross-account delivery")
+	waitReplication := flags.Bool("wait-replication", false, "wait until the bucket replication of the object is COMPLETED")
+	replicationPoll := flags.Duration("replication-poll", 5*time.Second, "interval between checks of -wait-replication")
+	replicationTimeout := flags.Duration("replication-timeout", 30*time.Minute, "fail -wait-replication after this long, 0 to wait forever")
+	expectSHA256 := flags.String("expect-sha256", "", "hex sha256 of the stream given by its producer, the upload is aborted if it differs")
+	expectedSize := flags.Int64("expected-size", 0, "size hint of the stream, to plan parts for and check against the bucket quota")
+	sizeTolerance := flags.Float64("size-tolerance", 0.1, "fraction of -expected-size the stream may deviate by")
+	sizeDeviation := flags.String("size-deviation", SizeDeviationWarn, "when the stream deviates from -expected-size: warn or fail")
+	withSidecar := flags.Bool("sidecar", false, "upload the provenance of the object, source, transforms and timings, as '<object>"+sidecarSuffix+"'")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: put [-bucket name] [-source spec] <object>")
+	}
+	if err := validateBucketName(*bucketName); err != nil {
+		return err
+	}
+	objectName, err := checkKey(flags.Arg(0), *autoSanitize)
+	if err != nil {
+		return err
+	}
+
+	if *acl != "" {
+		if err := validateACL(*acl); err != nil {
+			return err
+		}
+	}
+	// Settings of the upload checked by the streamer itself.
+	checks := []Option{
+		WithExpectedSHA256(*expectSHA256),
+		WithExpectedSize(*expectedSize, *sizeTolerance, *sizeDeviation),
+	}
+	if err := NewOptions(checks...).Validate(); err != nil {
+		return err
+	}
+	// The producer digests the source, not what the transforms make of it.
+	if *expectSHA256 != "" && (*filter != "" || *drop != "" || *sample < 1 || *redact != "" || *redactRules != "" || *toParquet != "") {
+		return fmt.Errorf("-expect-sha256 can't be combined with -filter, -drop, -sample, -redact, -redact-rules or -to-parquet")
+	}
+	checked := *expectSHA256 != "" || *expectedSize > 0 || *withSidecar
+	// The transforms applied to the source, for the sidecar.
+	var chain []string
+
+	metaData := map[string][]string{}
+	if *posix {
+		if !isLocalPath(*source) {
+			return fmt.Errorf("-posix needs a local -source file")
+		}
+		info, err := os.Stat(*source)
+		if err != nil {
+			return err
+		}
+		metaData = posixMetadata(*source, info)
+	}
+	if *acl != "" {
+		metaData["X-Amz-Acl"] = []string{*acl}
+	}
+
+	reader, err := openSource(*source)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var records io.Reader = reader
+	if *filter != "" || *drop != "" || *sample < 1 {
+		f := recordFilter{sample: *sample}
+		if *filter != "" {
+			if f.keep, err = regexp.Compile(*filter); err != nil {
+				return err
+			}
+		}
+		if *drop != "" {
+			if f.drop, err = regexp.Compile(*drop); err != nil {
+				return err
+			}
+		}
+		records = f.apply(reader)
+		chain = append(chain, "filter")
+	}
+	if *redact != "" || *redactRules != "" {
+		r, err := newRedactor(*redact, *redactRules)
+		if err != nil {
+			return err
+		}
+		records = r.apply(records)
+		chain = append(chain, "redact")
+		defer func() {
+			fmt.Fprintln(os.Stderr, r.redactions(), "values redacted")
+		}()
+	}
+
+	if *toParquet != "" {
+		if *rotateBytes > 0 || *rotateEvery > 0 || *daily || *indexEvery > 0 || *indexTimeField != "" {
+			return fmt.Errorf("-to-parquet can't be combined with rotation or indexing")
+		}
+		var fields []parquetField
+		if *parquetSchema != "" {
+			if fields, err = parseParquetSchema(*parquetSchema); err != nil {
+				return err
+			}
+		}
+		records = parquetReader(records, *toParquet, fields, *parquetRows)
+		chain = append(chain, "parquet:"+*toParquet)
+		metaData["Content-Type"] = []string{parquetContentType}
+	}
+
+	if *rotateBytes > 0 || *rotateEvery > 0 || *daily {
+		if *waitReplication || checked {
+			return fmt.Errorf("-wait-replication, -expect-sha256, -expected-size and -sidecar can't be combined with rotation")
+		}
+		if *daily && *rotateEvery > 0 {
+			return fmt.Errorf("-daily rotates every hour, it can't be combined with -rotate-every")
+		}
+		if *planIn != "" || *planOut != "" || *profileReport {
+			return fmt.Errorf("Part plans and profiles can't be combined with rotation")
+		}
+		// Rotated objects are uploaded by the rotator, without an index
+		// or signature of their own.
+		if *indexEvery > 0 || *indexTimeField != "" || *signKey != "" {
+			return fmt.Errorf("-index-every, -index-time-field and -sign-key can't be combined with rotation")
+		}
+		delimiter, err := strconv.Unquote(`"` + *recordDelimiter + `"`)
+		if err != nil {
+			return fmt.Errorf("Invalid record delimiter %q", *recordDelimiter)
+		}
+		r := &rotator{
+			bucketName: *bucketName,
+			objectName: objectName,
+			delimiter:  []byte(delimiter),
+			maxBytes:   *rotateBytes,
+			maxAge:     *rotateEvery,
+			metaData:   metaData,
+		}
+		if *daily {
+			c, err := newCore()
+			if err != nil {
+				return err
+			}
+			if r.daily, err = newDailyLayout(c, objectName, *dailyTZ); err != nil {
+				return err
+			}
+		}
+		return r.run(records)
+	}
+
+	upload := records
+	var index *recordIndex
+	if *indexEvery > 0 || *indexTimeField != "" {
+		index = &recordIndex{
+			Object:    objectName,
+			Every:     *indexEvery,
+			TimeField: *indexTimeField,
+			bucket:    *indexBucket,
+		}
+		if index.TimeField != "" {
+			index.Bucket = index.bucket.String()
+		}
+		upload = newIndexingReader(records, index)
+		chain = append(chain, "index")
+	}
+
+	var sig *signer
+	if *signKey != "" {
+		if sig, err = startSigner(*signKey); err != nil {
+			return err
+		}
+		upload = sig.reader(upload)
+		chain = append(chain, "sign")
+	}
+
+	var sidecar *uploadSidecar
+	if *withSidecar {
+		if sidecar, upload, err = newUploadSidecar(*bucketName, objectName, *source, upload); err != nil {
+			return err
+		}
+		sidecar.Transforms = append(sidecar.Transforms, chain...)
+	}
+	// The version waited for is the one this upload completed.
+	var completed ProgressEvent
+	var watchCompleted ProgressFunc
+	if *waitReplication {
+		watchCompleted = func(ev ProgressEvent) {
+			if ev.Type == Completed {
+				completed = ev
+			}
+		}
+	}
+	if p := multiProgress(sidecar.progressFunc(), watchCompleted); p != nil {
+		checks = append(checks, WithProgress(p))
+	}
+
+	put := PutStream
+	if os.Getenv("QUORUM_SITES") != "" {
+		if *waitReplication || checked {
+			return fmt.Errorf("-wait-replication, -expect-sha256, -expected-size and -sidecar are not supported with QUORUM_SITES")
+		}
+		put = PutStreamQuorum
+	} else if checked || *waitReplication {
+		put = func(bucketName, objectName string, reader io.Reader, metaData map[string][]string) (int64, error) {
+			return PutStreamWithOptions(bucketName, objectName, reader, append(checks, WithMetadata(metaData))...)
+		}
+	}
+	if *planIn != "" || *planOut != "" || *profileReport {
+		if os.Getenv("QUORUM_SITES") != "" {
+			return fmt.Errorf("Part plans and profiles are not supported with QUORUM_SITES")
+		}
+		var plan PartPlan
+		if *planIn != "" {
+			if plan, err = readPlan(*planIn); err != nil {
+				return err
+			}
+		}
+		var prof *profiler
+		var progress ProgressFunc
+		if *profileReport {
+			prof = newProfiler()
+			progress = prof.progress
+		}
+		put = func(bucketName, objectName string, reader io.Reader, metaData map[string][]string) (int64, error) {
+			var recorder planRecorder
+			o := NewOptions(append(checks, WithMetadata(metaData), WithProgress(multiProgress(recorder.progress, progress, sidecar.progressFunc(), watchCompleted)), WithPlan(plan))...)
+			n, err := putStreamOptions(bucketName, objectName, reader, o)
+			if prof != nil {
+				parallel, _ := parallelParts()
+				prof.report(os.Stderr, parallel)
+			}
+			if err == nil && *planOut != "" {
+				err = writePlan(*planOut, recorder.result())
+			}
+			return n, err
+		}
+	}
+	if _, err = put(*bucketName, objectName, upload, metaData); err != nil {
+		if sig != nil {
+			sig.kill()
+		}
+		return err
+	}
+	if *waitReplication {
+		e, err := newEndpoints()
+		if err != nil {
+			return err
+		}
+		if !e.s3() {
+			return fmt.Errorf("Not supported with provider %s", *flagProvider)
+		}
+		versionID, err := uploadedVersion(e.site(), *bucketName, objectName, completed.ETag)
+		if err != nil {
+			return err
+		}
+		if err = waitReplicated(e.site(), *bucketName, objectName, versionID, *replicationPoll, *replicationTimeout); err != nil {
+			return err
+		}
+	}
+	if index == nil && sig == nil && sidecar == nil {
+		return nil
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	if sidecar != nil {
+		if err = sidecar.save(c, metaData); err != nil {
+			return err
+		}
+	}
+	if sig != nil {
+		signature, err := sig.finish()
+		if err != nil {
+			return err
+		}
+		if err = putBytes(c, *bucketName, objectName+signatureSuffix, signature, "application/pgp-signature"); err != nil {
+			return err
+		}
+	}
+	if index == nil {
+		return nil
+	}
+	return putJSON(c, *bucketName, objectName+indexSuffix, index)
+}
+
+// getMain - implements the 'get [-bucket name] [-dest spec] <object>'
+// command, which streams the object to stdout or the given destination.
+func getMain(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to download from")
+	dest := flags.String("dest", "-", "file or sftp:// URL to write to, '-' for stdout")
+	decrypt := flags.Bool("decrypt", false, "decrypt objects encrypted with ENCRYPTION_KEY")
+	decompress := flags.String("decompress", "", "decompress: auto, gzip, zstd, bzip2 or xz")
+	posix := flags.Bool("posix", false, "restore preserved mtime, permissions, ownership and xattrs on a local -dest")
+	latest := flags.String("latest", "", "stream the latest backup below this prefix instead of a named object")
+	restoreTier := flags.String("restore-tier", "", "restore archived objects with this tier: Standard, Bulk or Expedited")
+	restoreDays := flags.Int("restore-days", 1, "days to keep the restored copy of an archived object")
+	restorePoll := flags.Duration("restore-poll", time.Minute, "interval between checks of a restore in progress")
+	noWait := flags.Bool("no-wait", false, "only start the restore of an archived object, don't wait for it")
+	verify := flags.Bool("verify", false, "verify the content against the gpg signature in '<object>.sig'")
+	flags.Parse(args)
+	if (*latest == "" && flags.NArg() != 1) || (*latest != "" && flags.NArg() != 0) {
+		return fmt.Errorf("Usage: get [-bucket name] [-dest spec] <object> | -latest prefix")
+	}
+	if *posix && !isLocalPath(*dest) {
+		return fmt.Errorf("-posix needs a local -dest file")
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	objectName := flags.Arg(0)
+	if *latest != "" {
+		if objectName, err = resolveLatest(c, *bucketName, *latest); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "latest backup is", objectName)
+	}
+
+	reader, objInfo, err := c.GetObject(*bucketName, objectName, minio.NewGetReqHeaders())
+	if err = wrapS3Error("GetObject", err); isArchived(err) && *restoreTier != "" {
+		e, eErr := newEndpoints()
+		if eErr != nil {
+			return eErr
+		}
+		if *noWait {
+			if err = restoreObject(e.site(), *bucketName, objectName, *restoreTier, *restoreDays); err != nil {
+				return err
+			}
+			return fmt.Errorf("Restore of %s/%s started, get it again once restored", *bucketName, objectName)
+		}
+		if err = waitRestored(e.site(), *bucketName, objectName, *restoreTier, *restoreDays, *restorePoll); err != nil {
+			return err
+		}
+		reader, objInfo, err = c.GetObject(*bucketName, objectName, minio.NewGetReqHeaders())
+		err = wrapS3Error("GetObject", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Holes of sparse objects are left unwritten in local files, and
+	// written as zeros anywhere else.
+	sparse := objInfo.Metadata.Get("X-Amz-Meta-Sparse-Size") != ""
+	if sparse && isLocalPath(*dest) && !*decrypt && *decompress == "" && !*verify {
+		f, err := os.Create(*dest)
+		if err != nil {
+			return err
+		}
+		_, err = writeSparse(f, reader, objInfo.Metadata)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err == nil && *posix {
+			err = restoreAttributes(*dest, objInfo.Metadata)
+		}
+		return err
+	}
+
+	// Signatures are made over the uploaded stream, so it is verified
+	// before any transform.
+	var source io.Reader = reader
+	var v *verifier
+	if *verify {
+		if v, err = startVerifier(c, *bucketName, objectName); err != nil {
+			return err
+		}
+		source = v.reader(source)
+	}
+
+	source, size, err := expandSparse(source, objInfo.Metadata, objInfo.Size)
+	if err != nil {
+		return err
+	}
+	// The size of the object is checked before it is decrypted.
+	read := &transfer{}
+	source = countingReader{source, read}
+	if *decrypt {
+		key, err := encryptionKey()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return fmt.Errorf("ENCRYPTION_KEY must be set to decrypt")
+		}
+		if source, err = decryptReader(source, key); err != nil {
+			return err
+		}
+	}
+	switch *decompress {
+	case "":
+	case "auto":
+		// The content encoding of encrypted objects is not recorded.
+		encoding := objInfo.Metadata.Get("Content-Encoding")
+		if *decrypt {
+			encoding = ""
+		}
+		if source, err = autoDecompress(source, encoding); err != nil {
+			return err
+		}
+	default:
+		if source, err = decompressReader(source, *decompress); err != nil {
+			return err
+		}
+	}
+
+	writer, err := openDest(*dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, source)
+	if cErr := writer.Close(); err == nil {
+		err = cErr
+	}
+	if v != nil {
+		// Data has been written by now, the error tells it can't be trusted.
+		if vErr := v.finish(); err == nil {
+			err = vErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if *decompress == "" && read.bytes != size {
+		return io.ErrUnexpectedEOF
+	}
+	if *posix {
+		return restoreAttributes(*dest, objInfo.Metadata)
+	}
+	return nil
+}
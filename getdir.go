@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// outside - returns true if name is not below root.
+func outside(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// makeParents - creates the directories of name below root, failing on
+// any which exists and isn't a directory, symlinks included, so that a
+// link downloaded earlier can't send later files out of root.
+func makeParents(root, name string) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	dir := filepath.Dir(name)
+	if outside(root, dir) {
+		return fmt.Errorf("%s is outside %s", name, root)
+	}
+	rel, _ := filepath.Rel(root, dir)
+	if rel == "." {
+		return nil
+	}
+	dir = root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, elem)
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			continue
+		} else if !os.IsExist(err) {
+			return err
+		}
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// getFile - downloads an object to a local file below root through a
+// temporary file, and returns its metadata. Hard links are left to the
+// caller, as their target may not be downloaded yet. Symlinks pointing
+// out of root are refused, the metadata being anyone's who can write
+// to the bucket.
+func getFile(c minio.Core, bucketName, objectName, root, name string) (minio.ObjectInfo, error) {
+	reader, objInfo, err := c.GetObject(bucketName, objectName, minio.NewGetReqHeaders())
+	if err != nil {
+		return objInfo, wrapS3Error("GetObject", err)
+	}
+	defer reader.Close()
+
+	if target := metaValue(objInfo.Metadata, "X-Amz-Meta-Symlink-Target"); target != "" {
+		if filepath.IsAbs(target) || outside(root, filepath.Join(filepath.Dir(name), target)) {
+			return objInfo, fmt.Errorf("Symlink to %s leads out of %s", target, root)
+		}
+		os.Remove(name)
+		return objInfo, os.Symlink(target, name)
+	}
+	if objInfo.Metadata.Get("X-Amz-Meta-Hardlink-Target") != "" {
+		return objInfo, nil
+	}
+
+	// Never through a link left at the temporary name.
+	tmp := name + ".tmp"
+	os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return objInfo, err
+	}
+	var n int64
+	if objInfo.Metadata.Get("X-Amz-Meta-Sparse-Size") != "" {
+		n, err = writeSparse(f, reader, objInfo.Metadata)
+	} else {
+		n, err = io.Copy(f, reader)
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil && n != objInfo.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return objInfo, err
+}
+
+// getDirMain - implements the 'get-dir s3://bucket/prefix <dir>'
+// command, which downloads the objects below a prefix into a directory,
+// recreating the structure and links uploaded with 'put-dir'.
+func getDirMain(args []string) error {
+	flags := flag.NewFlagSet("get-dir", flag.ExitOnError)
+	posix := flags.Bool("posix", false, "restore preserved mtime, permissions, ownership and xattrs")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: get-dir [-posix] s3://bucket/prefix <dir>")
+	}
+	bucketName, prefix, err := parseS3URL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	root := flags.Arg(1)
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+
+	// Cleaned keys can't escape the directory.
+	localName := func(key string) string {
+		rel := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(key, prefix)), "/")
+		return filepath.Join(root, filepath.FromSlash(rel))
+	}
+
+	var failed, total int
+	// Hard links are made once all their targets are downloaded.
+	links := make(map[string]string)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for objInfo := range c.Client.ListObjects(bucketName, prefix, true, doneCh) {
+		if objInfo.Err != nil {
+			return objInfo.Err
+		}
+		if isInternalObject(objInfo.Key) || strings.HasSuffix(objInfo.Key, "/") {
+			continue
+		}
+		name := localName(objInfo.Key)
+		total++
+
+		err := makeParents(root, name)
+		var info minio.ObjectInfo
+		if err == nil {
+			info, err = getFile(c, bucketName, objInfo.Key, root, name)
+		}
+		if target := metaValue(info.Metadata, "X-Amz-Meta-Hardlink-Target"); err == nil && target != "" {
+			links[name] = localName(target)
+			continue
+		}
+		if err == nil && *posix {
+			err = restoreAttributes(name, info.Metadata)
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, objInfo.Key, "failed:", err)
+			continue
+		}
+		fmt.Println(name)
+	}
+	for name, target := range links {
+		os.Remove(name)
+		err := makeParents(root, target)
+		if err == nil {
+			err = os.Link(target, name)
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, name, "failed:", err)
+			continue
+		}
+		fmt.Println(name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects failed", failed, total)
+	}
+	return nil
+}
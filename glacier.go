@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// restoreRequest - the body of a RestoreObject request.
+type restoreRequest struct {
+	XMLName xml.Name `xml:"RestoreRequest"`
+	Days    int      `xml:"Days"`
+	Tier    string   `xml:"GlacierJobParameters>Tier"`
+}
+
+// isArchived - returns true if the error means the object must be
+// restored from an archive storage class before it can be read.
+func isArchived(err error) bool {
+	return errorCode(err) == "InvalidObjectState"
+}
+
+// restoreObject - asks for a temporary copy of an archived object for
+// days, retrieved with tier. A restore already in progress is not an
+// error.
+func restoreObject(s site, bucketName, objectName, tier string, days int) error {
+	switch tier {
+	case "Standard", "Bulk", "Expedited":
+	default:
+		return fmt.Errorf("Unknown restore tier %q, use Standard, Bulk or Expedited", tier)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(restoreRequest{Days: days, Tier: tier}); err != nil {
+		return err
+	}
+	md5Sum := md5.Sum(buf.Bytes())
+	header := http.Header{
+		"Content-Type": {"application/xml"},
+		"Content-Md5":  {base64.StdEncoding.EncodeToString(md5Sum[:])},
+	}
+	resp, err := siteRequest(s, "RestoreObject", http.MethodPost, bucketName, objectName, url.Values{"restore": {""}}, header, buf.Bytes())
+	if errorCode(err) == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// restored - returns true once the restored copy of an object can be
+// read, as told by its x-amz-restore header.
+func restored(s site, bucketName, objectName string) (bool, error) {
+	st, err := statObject(s, bucketName, objectName, "")
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(st.Restore, `ongoing-request="false"`), nil
+}
+
+// waitRestored - restores an archived object and waits, polling every
+// interval, until it can be read.
+func waitRestored(s site, bucketName, objectName, tier string, days int, interval time.Duration) error {
+	if err := restoreObject(s, bucketName, objectName, tier, days); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Restoring %s/%s with tier %s\n", bucketName, objectName, tier)
+	start := time.Now()
+	for {
+		done, err := restored(s, bucketName, objectName)
+		if err != nil || done {
+			if done {
+				fmt.Fprintf(os.Stderr, "Restored %s/%s after %s\n", bucketName, objectName, time.Since(start).Round(time.Second))
+			}
+			return err
+		}
+		time.Sleep(interval)
+	}
+}
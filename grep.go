@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	minio "github.com/minio/minio-go"
+)
+
+// grepObject - prints the lines of an object matching re as
+// 'key:offset:line', offsets being into the decoded stream. Objects
+// uploaded with transforms are decoded as 'get' would, others are
+// decompressed as their Content-Encoding or magic bytes tell.
+func grepObject(c minio.Core, bucketName, objectName string, re *regexp.Regexp, namesOnly bool, out *sync.Mutex) (int, error) {
+	reader, objInfo, err := c.GetObject(bucketName, objectName, minio.NewGetReqHeaders())
+	if err != nil {
+		return 0, wrapS3Error("GetObject", err)
+	}
+	defer reader.Close()
+
+	var source io.Reader
+	if objInfo.Metadata.Get("X-Amz-Meta-Encryption") != "" || objInfo.Metadata.Get("X-Amz-Meta-Compression") != "" {
+		source, err = undoTransforms(reader, objInfo.Metadata)
+	} else {
+		source, err = autoDecompress(reader, objInfo.Metadata.Get("Content-Encoding"))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReaderSize(source, 64*1024)
+	var offset int64
+	var matches int
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 && re.Match(bytes.TrimRight(line, "\r\n")) {
+			matches++
+			out.Lock()
+			if namesOnly {
+				fmt.Println(objectName)
+			} else {
+				fmt.Printf("%s:%d:%s\n", objectName, offset, bytes.TrimRight(line, "\r\n"))
+			}
+			out.Unlock()
+			if namesOnly {
+				return matches, nil
+			}
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			return matches, nil
+		}
+		if err != nil {
+			return matches, err
+		}
+	}
+}
+
+// grepMain - implements the 'grep <pattern> s3://bucket/prefix'
+// command, which searches the objects below a prefix in parallel.
+func grepMain(args []string) error {
+	flags := flag.NewFlagSet("grep", flag.ExitOnError)
+	ignoreCase := flags.Bool("i", false, "match case insensitively")
+	namesOnly := flags.Bool("l", false, "only print the names of matching objects")
+	parallel := flags.Int("parallel", 4, "number of objects searched at once")
+	flags.Parse(args)
+	if flags.NArg() != 2 || *parallel < 1 {
+		return fmt.Errorf("Usage: grep [-i] [-l] [-parallel n] <pattern> s3://bucket/prefix")
+	}
+	pattern := flags.Arg(0)
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	// Single keys are searched as prefixes of themselves.
+	bucketName, prefix, err := parseS3Prefix(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+
+	var out, mu sync.Mutex
+	var failed int
+	var wg sync.WaitGroup
+	work := make(chan string)
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objectName := range work {
+				if _, err := grepObject(c, bucketName, objectName, re, *namesOnly, &out); err != nil {
+					fmt.Fprintln(os.Stderr, objectName+":", err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	doneCh := make(chan struct{})
+	var listErr error
+	for objInfo := range c.Client.ListObjects(bucketName, prefix, true, doneCh) {
+		if objInfo.Err != nil {
+			listErr = objInfo.Err
+			break
+		}
+		if isInternalObject(objInfo.Key) || strings.HasSuffix(objInfo.Key, indexSuffix) || strings.HasSuffix(objInfo.Key, "/") {
+			continue
+		}
+		work <- objInfo.Key
+	}
+	close(doneCh)
+	close(work)
+	wg.Wait()
+
+	if listErr != nil {
+		return listErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be searched", failed)
+	}
+	return nil
+}
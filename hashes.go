@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HashProvider - a hash algorithm which can be calculated on uploaded parts.
+type HashProvider interface {
+	// Name of the algorithm, as used in HASH_ALGORITHMS.
+	Name() string
+	// New returns a new hash.Hash computing the checksum.
+	New() hash.Hash
+}
+
+// hashFunc - adapts a hash constructor to a HashProvider.
+type hashFunc struct {
+	name string
+	fn   func() hash.Hash
+}
+
+func (h hashFunc) Name() string   { return h.name }
+func (h hashFunc) New() hash.Hash { return h.fn() }
+
+var (
+	hashProvidersMu sync.RWMutex
+	hashProviders   = make(map[string]HashProvider)
+)
+
+// md5Default - whether md5 is calculated when HASH_ALGORITHMS is not set,
+// turned off for BoringCrypto builds.
+var md5Default = true
+
+// RegisterHashProvider - makes a hash algorithm available by its name,
+// registering an existing name replaces the previous provider.
+func RegisterHashProvider(p HashProvider) {
+	hashProvidersMu.Lock()
+	defer hashProvidersMu.Unlock()
+	hashProviders[p.Name()] = p
+}
+
+func init() {
+	RegisterHashProvider(hashFunc{"md5", md5.New})
+	RegisterHashProvider(hashFunc{"sha256", sha256.New})
+	// crc32c is not sent by this client, so it can only be chosen along
+	// with md5 or sha256, which verify the parts.
+	RegisterHashProvider(hashFunc{"crc32c", func() hash.Hash {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}})
+}
+
+// md5Disabled - returns true if md5 must not be calculated.
+func md5Disabled() bool {
+	if os.Getenv("DISABLE_MD5") > "" {
+		return true
+	}
+	if v := os.Getenv("HASH_ALGORITHMS"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if strings.TrimSpace(name) == "md5" {
+				return false
+			}
+		}
+		return true
+	}
+	return !md5Default
+}
+
+// partHashAlgos - returns new instances of the hash algorithms chosen by
+// HASH_ALGORITHMS (comma separated, defaults to 'md5,sha256'). md5 may be
+// disabled with DISABLE_MD5, in which case SigV4 is used for integrity.
+func partHashAlgos() (map[string]hash.Hash, error) {
+	names := []string{"sha256"}
+	if v := os.Getenv("HASH_ALGORITHMS"); v != "" {
+		names = strings.Split(v, ",")
+	} else if md5Default {
+		names = append(names, "md5")
+	}
+
+	hashProvidersMu.RLock()
+	defer hashProvidersMu.RUnlock()
+
+	hashAlgos := make(map[string]hash.Hash)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "md5" && md5Disabled() {
+			continue
+		}
+		p, ok := hashProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown hash algorithm %q", name)
+		}
+		hashAlgos[name] = p.New()
+	}
+	// Parts are only verified on the wire with Content-MD5 or the SigV4
+	// payload hash, other algorithms are not sent.
+	if hashAlgos["sha256"] == nil && hashAlgos["md5"] == nil {
+		return nil, fmt.Errorf("HASH_ALGORITHMS %q leaves parts unverified, include sha256 or md5", os.Getenv("HASH_ALGORITHMS"))
+	}
+	return hashAlgos, nil
+}
+
+// parallelHash - returns true if the hashes of a part are computed
+// concurrently, set with PARALLEL_HASH. md5 and sha256 are each bound to
+// a single core, which fast local sources can outrun.
+func parallelHash() bool {
+	return os.Getenv("PARALLEL_HASH") > ""
+}
+
+var (
+	hashWorkersOnce sync.Once
+	hashWorkers     chan struct{}
+)
+
+// hashSlots - returns the semaphore throttling concurrent hashing to
+// HASH_WORKERS, by default the number of CPUs, across all parts.
+func hashSlots() chan struct{} {
+	hashWorkersOnce.Do(func() {
+		n, err := strconv.Atoi(os.Getenv("HASH_WORKERS"))
+		if err != nil || n < 1 {
+			n = runtime.NumCPU()
+		}
+		hashWorkers = make(chan struct{}, n)
+	})
+	return hashWorkers
+}
+
+// errDataFault - returned by hashBytes when reading data faulted, as
+// mappings of files truncated meanwhile do.
+var errDataFault = errors.New("Memory hashed became unreadable")
+
+// hashBytes - calculates the chosen hashes of data, each on its own
+// goroutine. Faults reading data, which may be a file mapping, fail
+// with errDataFault instead of crashing.
+func hashBytes(hashAlgorithms map[string]hash.Hash, hashSums map[string][]byte, data []byte) error {
+	slots := hashSlots()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var err error
+	for k, v := range hashAlgorithms {
+		wg.Add(1)
+		go func(k string, v hash.Hash) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+			defer func() {
+				if recover() != nil {
+					mu.Lock()
+					err = errDataFault
+					mu.Unlock()
+				}
+			}()
+			v.Write(data)
+			sum := v.Sum(nil)
+			mu.Lock()
+			hashSums[k] = sum
+			mu.Unlock()
+		}(k, v)
+	}
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package main
+
+import "crypto/boring"
+
+// BoringCrypto builds do not calculate md5 unless explicitly asked for.
+func init() {
+	if boring.Enabled() {
+		md5Default = false
+	}
+}
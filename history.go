@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// historyPrefix - prefix under which upload records are stored one per
+// object.
+const historyPrefix = ".history/"
+
+// historyObject - name of the NDJSON history of a prefix, as written
+// before it was sharded by day, still read.
+const historyObject = ".history.ndjson"
+
+// historyShardPrefix - prefix of the daily shards of the NDJSON history
+// of a prefix, '.history-YYYYMMDD.ndjson', each rewritten by the uploads
+// of its day only.
+const historyShardPrefix = ".history-"
+
+// History modes, chosen with HISTORY.
+const (
+	historyRecords = "prefix"
+	historyNDJSON  = "ndjson"
+)
+
+// toolVersion - the version recorded in the upload history, set at build
+// time with '-ldflags -X main.toolVersion=...'.
+var toolVersion = "dev"
+
+// historyRecord - a completed upload.
+type historyRecord struct {
+	Object    string    `json:"object"`
+	Size      int64     `json:"size"`
+	Seconds   float64   `json:"seconds"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Host      string    `json:"host"`
+	Version   string    `json:"version"`
+	Completed time.Time `json:"completed"`
+}
+
+// historyMode - returns the history mode set with HISTORY, empty if
+// uploads are not recorded.
+func historyMode() (string, error) {
+	switch m := os.Getenv("HISTORY"); m {
+	case "", historyRecords, historyNDJSON:
+		return m, nil
+	default:
+		return "", fmt.Errorf("Unknown HISTORY %q", m)
+	}
+}
+
+func newHistoryRecord(objectName string, size int64, elapsed time.Duration, sum string) historyRecord {
+	host, _ := os.Hostname()
+	return historyRecord{
+		Object:    objectName,
+		Size:      size,
+		Seconds:   elapsed.Seconds(),
+		SHA256:    sum,
+		Host:      host,
+		Version:   toolVersion,
+		Completed: time.Now().UTC(),
+	}
+}
+
+// historyNDJSONName - returns the shard of the NDJSON history of the
+// prefix holding objectName for uploads completed at t.
+func historyNDJSONName(objectName string, t time.Time) string {
+	return prefixDir(objectName) + historyShardPrefix + t.UTC().Format("20060102") + ".ndjson"
+}
+
+// isHistoryNDJSON - returns true if objectName is a shard of an NDJSON
+// history, or one written before sharding.
+func isHistoryNDJSON(objectName string) bool {
+	base := path.Base(objectName)
+	return base == historyObject || strings.HasPrefix(base, historyShardPrefix) && strings.HasSuffix(base, ".ndjson")
+}
+
+// appendHistory - records an upload, either as its own object below
+// historyPrefix or appended to the NDJSON history of its prefix. The
+// shard of the day is rewritten on every upload, so concurrent uploads
+// to the same prefix may lose each other's records.
+func appendHistory(c minio.Core, bucketName, mode string, record historyRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if mode == historyRecords {
+		suffix := make([]byte, 4)
+		if _, err = rand.Read(suffix); err != nil {
+			return err
+		}
+		// Names sort by completion time.
+		name := historyPrefix + record.Completed.Format("2006/01/02/150405.000000000Z") + "-" + hex.EncodeToString(suffix) + ".json"
+		return putBytes(c, bucketName, name, line, "application/json")
+	}
+
+	name := historyNDJSONName(record.Object, record.Completed)
+	data, err := getBytes(c, bucketName, name)
+	if err != nil && !isNoSuchKey(err) {
+		return err
+	}
+	return putBytes(c, bucketName, name, append(data, line...), "application/x-ndjson")
+}
+
+// historyMain - implements the 'history' command, which prints recorded
+// uploads, the newest last.
+func historyMain(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket of the history")
+	prefix := flags.String("prefix", "", "only print uploads of objects below this prefix")
+	since := flags.Duration("since", 0, "only print uploads completed within this long")
+	ndjson := flags.Bool("ndjson", false, "read the NDJSON history of -prefix instead of the records below .history/")
+	asJSON := flags.Bool("json", false, "print NDJSON")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: history [-bucket name] [-prefix p] [-since d] [-ndjson] [-json]")
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	var cutoff time.Time
+	if *since > 0 {
+		cutoff = time.Now().Add(-*since)
+	}
+
+	var records []historyRecord
+	keep := func(r historyRecord) {
+		if strings.HasPrefix(r.Object, *prefix) && !r.Completed.Before(cutoff) {
+			records = append(records, r)
+		}
+	}
+	if *ndjson {
+		dir := ""
+		if p := strings.TrimSuffix(*prefix, "/"); p != "" {
+			dir = p + "/"
+		}
+		// Shards of days before the cutoff are not read.
+		startAfter := ""
+		if !cutoff.IsZero() {
+			startAfter = dir + historyShardPrefix + cutoff.UTC().Format("20060102")
+		}
+		names := []string{dir + historyObject}
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		for objInfo := range c.Client.ListObjects(*bucketName, dir+historyShardPrefix, false, doneCh) {
+			if objInfo.Err != nil {
+				return objInfo.Err
+			}
+			if objInfo.Key >= startAfter && isHistoryNDJSON(objInfo.Key) {
+				names = append(names, objInfo.Key)
+			}
+		}
+		for _, name := range names {
+			data, err := getBytes(c, *bucketName, name)
+			if isNoSuchKey(err) {
+				continue
+			}
+			if err != nil {
+				return wrapS3Error("GetObject", err)
+			}
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				var r historyRecord
+				if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+					return fmt.Errorf("History %s unreadable: %v", name, err)
+				}
+				keep(r)
+			}
+		}
+	} else {
+		// Days before the cutoff are not read.
+		startAfter := ""
+		if !cutoff.IsZero() {
+			startAfter = historyPrefix + cutoff.UTC().Format("2006/01/02/")
+		}
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		for objInfo := range c.Client.ListObjects(*bucketName, historyPrefix, true, doneCh) {
+			if objInfo.Err != nil {
+				return objInfo.Err
+			}
+			if objInfo.Key < startAfter {
+				continue
+			}
+			var r historyRecord
+			if err = getJSON(c, *bucketName, objInfo.Key, &r); err != nil {
+				return err
+			}
+			keep(r)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			enc.Encode(r)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPLETED\tSIZE\tSECONDS\tHOST\tVERSION\tSHA256\tOBJECT")
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%s\t%s\t%s\t%s\n", r.Completed.Format(time.RFC3339),
+			r.Size, r.Seconds, r.Host, r.Version, r.SHA256, r.Object)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// imageMapSuffix - suffix of the object holding the zero map of an
+// image, next to it.
+const imageMapSuffix = ".imgmap"
+
+// imageAlign - alignment of O_DIRECT buffers and block sizes.
+const imageAlign = 4096
+
+// imageMap - the layout of an image object: only the data regions of
+// the device are uploaded, in order, the rest being zeros.
+type imageMap struct {
+	Size      int64  `json:"size"`
+	BlockSize int64  `json:"blockSize"`
+	Regions   string `json:"regions"`
+}
+
+// alignedBuffer - returns a buffer of size bytes aligned for O_DIRECT.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+imageAlign)
+	skip := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (imageAlign - 1)); rem != 0 {
+		skip = imageAlign - rem
+	}
+	return buf[skip : skip+size]
+}
+
+// imageReader - reads a device block by block, passing on the blocks
+// visit returns true for.
+type imageReader struct {
+	f       *os.File
+	buf     []byte
+	pending []byte
+	offset  int64
+	visit   func(offset int64, block []byte) bool
+	// read and skipped are updated atomically, for progress.
+	read    int64
+	skipped int64
+	eof     bool
+}
+
+func newImageReader(f *os.File, blockSize int64, visit func(offset int64, block []byte) bool) *imageReader {
+	return &imageReader{f: f, buf: alignedBuffer(int(blockSize)), visit: visit}
+}
+
+// zeroSkipper - returns a visit function passing on the blocks which are
+// not all zeros, and the regions they were at.
+func zeroSkipper(blockSize int64) (func(offset int64, block []byte) bool, *[][2]int64) {
+	zeros := make([]byte, blockSize)
+	var regions [][2]int64
+	return func(offset int64, block []byte) bool {
+		if bytes.Equal(block, zeros[:len(block)]) {
+			return false
+		}
+		n := int64(len(block))
+		if last := len(regions) - 1; last >= 0 && regions[last][0]+regions[last][1] == offset {
+			regions[last][1] += n
+		} else {
+			regions = append(regions, [2]int64{offset, n})
+		}
+		return true
+	}, &regions
+}
+
+func (r *imageReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.f, r.buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		block := r.buf[:n]
+		atomic.AddInt64(&r.read, int64(n))
+		if n > 0 && r.visit(r.offset, block) {
+			r.pending = block
+		} else {
+			atomic.AddInt64(&r.skipped, int64(n))
+		}
+		r.offset += int64(n)
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// reportProgress - prints the progress of r against size on stderr every
+// second, until stopCh is closed.
+func reportProgress(r *imageReader, size int64, stopCh chan struct{}) {
+	started := time.Now()
+	print := func() {
+		n := atomic.LoadInt64(&r.read)
+		fmt.Fprintf(os.Stderr, "\r%s %d/%d MiB, %.2f MiB/s, %d MiB skipped", progressBar(n, size, 30),
+			n/(1024*1024), size/(1024*1024), rate(n, time.Since(started)), atomic.LoadInt64(&r.skipped)/(1024*1024))
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			print()
+			fmt.Fprintln(os.Stderr)
+			return
+		case <-ticker.C:
+			print()
+		}
+	}
+}
+
+// openDevice - opens a device for imaging, returning its size.
+func openDevice(device string) (*os.File, int64, error) {
+	f, err := openDirect(device)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Block devices report no size in their stat, but can seek to it.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// uploadImage - uploads the blocks of r passed on by its visit function,
+// showing progress against the device size.
+func uploadImage(r *imageReader, size int64, bucketName, objectName string) error {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		reportProgress(r, size, stopCh)
+	}()
+	_, err := PutStream(bucketName, objectName, r, map[string][]string{
+		"Content-Type": {"application/octet-stream"},
+	})
+	close(stopCh)
+	<-doneCh
+	if err == nil && r.offset != size {
+		err = fmt.Errorf("Read %d bytes of the device, expected %d", r.offset, size)
+	}
+	return err
+}
+
+// imageDevice - uploads the blocks of a device which are not all zeros,
+// followed by its zero map.
+func imageDevice(device, bucketName, objectName string, blockSize int64) error {
+	f, size, err := openDevice(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	visit, regions := zeroSkipper(blockSize)
+	if err = uploadImage(newImageReader(f, blockSize, visit), size, bucketName, objectName); err != nil {
+		return err
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	return putJSON(c, bucketName, objectName+imageMapSuffix, imageMap{
+		Size:      size,
+		BlockSize: blockSize,
+		Regions:   formatRegions(*regions),
+	})
+}
+
+// openImageDest - opens the destination of a restore of size bytes. On
+// devices, which may hold old data, zeros must be written out; regular
+// files are emptied, so that no old data is left in the holes, then
+// extended to size.
+func openImageDest(dest string, size int64) (f *os.File, device bool, err error) {
+	if f, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE, 0644); err != nil {
+		return nil, false, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	device = !info.Mode().IsRegular()
+	if device {
+		end, err := f.Seek(0, io.SeekEnd)
+		if err == nil && end < size {
+			err = fmt.Errorf("%s has %d bytes, the image needs %d", dest, end, size)
+		}
+		if err != nil {
+			f.Close()
+			return nil, false, err
+		}
+		return f, device, nil
+	}
+	if err = f.Truncate(0); err == nil {
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	return f, device, nil
+}
+
+// zeroWriter - returns a function writing zeros to a device, and doing
+// nothing on regular files whose holes read as zeros.
+func zeroWriter(f *os.File, device bool, blockSize int64) func(off, length int64) error {
+	zeros := make([]byte, blockSize)
+	return func(off, length int64) error {
+		if !device || length <= 0 {
+			return nil
+		}
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		for length > 0 {
+			n := int64(len(zeros))
+			if n > length {
+				n = length
+			}
+			if _, err := f.Write(zeros[:n]); err != nil {
+				return err
+			}
+			length -= n
+		}
+		return nil
+	}
+}
+
+// restoreImage - writes an image to a device or file. Incremental images
+// are restored from their block map, '<key>' for the latest run or
+// '<key>.<run>' for an earlier one.
+func restoreImage(bucketName, objectName, dest string) error {
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	blocks, err := getBlockMap(c, bucketName, objectName+blockMapSuffix)
+	if err != nil {
+		return err
+	}
+	if blocks != nil {
+		return restoreIncremental(c, bucketName, blocks, dest)
+	}
+
+	var m imageMap
+	if err = getJSON(c, bucketName, objectName+imageMapSuffix, &m); err != nil {
+		return err
+	}
+	regions, err := parseRegions(m.Regions)
+	if err != nil {
+		return err
+	}
+
+	f, device, err := openImageDest(dest, m.Size)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader, closer, err := openObject(bucketName, objectName, nil)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	writeZeros := zeroWriter(f, device, m.BlockSize)
+
+	var offset int64
+	for _, r := range regions {
+		if err = writeZeros(offset, r[0]-offset); err != nil {
+			return err
+		}
+		if _, err = f.Seek(r[0], io.SeekStart); err != nil {
+			return err
+		}
+		n, err := io.Copy(f, io.LimitReader(reader, r[1]))
+		if err != nil {
+			return err
+		}
+		if n != r[1] {
+			return io.ErrUnexpectedEOF
+		}
+		offset = r[0] + r[1]
+	}
+	if err = writeZeros(offset, m.Size-offset); err != nil {
+		return err
+	}
+	// Anything left over means the map does not describe the object.
+	if n, _ := io.Copy(ioutil.Discard, reader); n > 0 {
+		return fmt.Errorf("Image %s/%s is longer than its map", bucketName, objectName)
+	}
+	return f.Sync()
+}
+
+// imageMain - implements the 'image [-incremental] <device> s3://bucket/key'
+// and 'image -restore s3://bucket/key <device>' commands.
+func imageMain(args []string) error {
+	flags := flag.NewFlagSet("image", flag.ExitOnError)
+	restore := flags.Bool("restore", false, "restore an image to a device or file")
+	blockSize := flags.Int64("block-size", 1024*1024, "size of the blocks checked for zeros, a multiple of 4096")
+	incremental := flags.Bool("incremental", false, "only upload the blocks changed since the previous run")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: image [-block-size N] [-incremental] <device> s3://bucket/key | image -restore s3://bucket/key <device>")
+	}
+	if *blockSize <= 0 || *blockSize%imageAlign != 0 {
+		return fmt.Errorf("Block size must be a multiple of %d", imageAlign)
+	}
+
+	if *restore {
+		bucketName, objectName, err := parseObjectURL(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		return restoreImage(bucketName, objectName, flags.Arg(1))
+	}
+	if strings.HasPrefix(flags.Arg(0), "s3://") {
+		return fmt.Errorf("Use -restore to write an image to a device")
+	}
+	bucketName, objectName, err := parseObjectURL(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *incremental {
+		return imageIncremental(flags.Arg(0), bucketName, objectName, *blockSize)
+	}
+	return imageDevice(flags.Arg(0), bucketName, objectName, *blockSize)
+}
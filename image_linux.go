@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect - opens a device or file for reading around the page
+// cache, falling back to cached reads where O_DIRECT is not supported.
+func openDirect(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err == nil {
+		return f, nil
+	}
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EINVAL {
+		return os.Open(name)
+	}
+	return nil, err
+}
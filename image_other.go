@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// openDirect - O_DIRECT is only used on Linux.
+func openDirect(name string) (*os.File, error) {
+	return os.Open(name)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// blockMapSuffix - suffix of the block map of an incremental image run,
+// '<key>.blockmap' being the map of the latest run.
+const blockMapSuffix = ".blockmap"
+
+// blockMap - the blocks of an incremental image, each held by the data
+// object of the run which last saw it change. Data objects of earlier
+// runs must be kept for as long as a map refers to them.
+type blockMap struct {
+	Size      int64      `json:"size"`
+	BlockSize int64      `json:"blockSize"`
+	Created   time.Time  `json:"created"`
+	Objects   []string   `json:"objects"`
+	Blocks    []blockRef `json:"blocks"`
+}
+
+// blockRef - where the data of a block is, zero blocks have no hash.
+type blockRef struct {
+	Hash   string `json:"h,omitempty"`
+	Object int    `json:"o,omitempty"`
+	Offset int64  `json:"off,omitempty"`
+}
+
+// putBlockMap - saves a block map as gzip compressed JSON, maps of large
+// devices holding millions of blocks.
+func putBlockMap(c minio.Core, bucketName, objectName string, m *blockMap) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(m); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return putObjectBytes(c, bucketName, objectName, buf.Bytes(), map[string][]string{
+		"Content-Type": {"application/json"},
+		// Not a Content-Encoding, which clients would silently undo.
+		"X-Amz-Meta-Compression": {"gzip"},
+	})
+}
+
+// getBlockMap - reads a block map, nil if there is none.
+func getBlockMap(c minio.Core, bucketName, objectName string) (*blockMap, error) {
+	data, err := getBytes(c, bucketName, objectName)
+	if isNoSuchKey(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var m blockMap
+	if err = json.NewDecoder(zr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("Invalid block map %s: %v", objectName, err)
+	}
+	return &m, nil
+}
+
+// imageIncremental - uploads the blocks of a device which changed since
+// the previous run as '<key>.<run>', and the updated block map as
+// '<key>.<run>.blockmap' and '<key>.blockmap'. Without a previous run,
+// or with another block size, all blocks but zero ones are uploaded.
+func imageIncremental(device, bucketName, objectName string, blockSize int64) error {
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	prev, err := getBlockMap(c, bucketName, objectName+blockMapSuffix)
+	if err != nil {
+		return err
+	}
+	if prev != nil && prev.BlockSize != blockSize {
+		fmt.Fprintln(os.Stderr, "block size changed from", prev.BlockSize, "uploading all blocks")
+		prev = nil
+	}
+
+	f, size, err := openDevice(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	run := time.Now().UTC()
+	runObject := objectName + "." + run.Format("20060102T150405Z")
+	m := &blockMap{Size: size, BlockSize: blockSize, Created: run, Objects: []string{runObject}}
+	// Objects of the previous map, by their index in the new one.
+	remap := make(map[int]int)
+	zeros := make([]byte, blockSize)
+	var dataOffset, changed int64
+	visit := func(offset int64, block []byte) bool {
+		if bytes.Equal(block, zeros[:len(block)]) {
+			m.Blocks = append(m.Blocks, blockRef{})
+			return false
+		}
+		sum := sha256.Sum256(block)
+		hash := hex.EncodeToString(sum[:])
+		i := len(m.Blocks)
+		if prev != nil && i < len(prev.Blocks) && prev.Blocks[i].Hash == hash {
+			ref := prev.Blocks[i]
+			o, ok := remap[ref.Object]
+			if !ok {
+				o = len(m.Objects)
+				m.Objects = append(m.Objects, prev.Objects[ref.Object])
+				remap[ref.Object] = o
+			}
+			m.Blocks = append(m.Blocks, blockRef{Hash: hash, Object: o, Offset: ref.Offset})
+			return false
+		}
+		m.Blocks = append(m.Blocks, blockRef{Hash: hash, Object: 0, Offset: dataOffset})
+		dataOffset += int64(len(block))
+		changed++
+		return true
+	}
+	if err = uploadImage(newImageReader(f, blockSize, visit), size, bucketName, runObject); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d blocks changed\n", changed, len(m.Blocks))
+
+	if err = putBlockMap(c, bucketName, runObject+blockMapSuffix, m); err != nil {
+		return err
+	}
+	return putBlockMap(c, bucketName, objectName+blockMapSuffix, m)
+}
+
+// restoreIncremental - writes the blocks of a block map to a device or
+// file, with one ranged GET per run of blocks stored together.
+func restoreIncremental(c minio.Core, bucketName string, m *blockMap, dest string) error {
+	f, device, err := openImageDest(dest, m.Size)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writeZeros := zeroWriter(f, device, m.BlockSize)
+
+	blockLen := func(i int) int64 {
+		if rest := m.Size - int64(i)*m.BlockSize; rest < m.BlockSize {
+			return rest
+		}
+		return m.BlockSize
+	}
+	for i := 0; i < len(m.Blocks); {
+		ref := m.Blocks[i]
+		offset := int64(i) * m.BlockSize
+		if ref.Hash == "" {
+			if err = writeZeros(offset, blockLen(i)); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+
+		// Extend the run while the next block follows in the same object.
+		j, length := i+1, blockLen(i)
+		for j < len(m.Blocks) && m.Blocks[j].Hash != "" && m.Blocks[j].Object == ref.Object &&
+			m.Blocks[j].Offset == ref.Offset+length {
+			length += blockLen(j)
+			j++
+		}
+
+		reqHeaders := minio.NewGetReqHeaders()
+		if err = reqHeaders.SetRange(ref.Offset, ref.Offset+length-1); err != nil {
+			return err
+		}
+		reader, _, err := c.GetObject(bucketName, m.Objects[ref.Object], reqHeaders)
+		if err != nil {
+			return wrapS3Error("GetObject", err)
+		}
+		if _, err = f.Seek(offset, io.SeekStart); err == nil {
+			var n int64
+			n, err = io.Copy(f, io.LimitReader(reader, length))
+			if err == nil && n != length {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		i = j
+	}
+	return f.Sync()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// indexSuffix - suffix of the sidecar object holding the index of an
+// object, read by consumers fetching byte ranges.
+const indexSuffix = ".index.json"
+
+// indexEntry - the byte offset a record starts at.
+type indexEntry struct {
+	Record int64      `json:"record"`
+	Offset int64      `json:"offset"`
+	Time   *time.Time `json:"time,omitempty"`
+}
+
+// recordIndex - a sparse index of the records of a line oriented object.
+type recordIndex struct {
+	Object    string        `json:"object"`
+	Every     int64         `json:"every,omitempty"`
+	TimeField string        `json:"timeField,omitempty"`
+	Bucket    string        `json:"timeBucket,omitempty"`
+	Records   int64         `json:"records"`
+	Size      int64         `json:"size"`
+	Entries   []indexEntry  `json:"entries"`
+	bucket    time.Duration // parsed Bucket
+}
+
+// indexingReader - indexes newline delimited records as they are read,
+// every 'Every' records and, for NDJSON with a time field, whenever the
+// record time moves to another time bucket.
+type indexingReader struct {
+	io.Reader
+	index *recordIndex
+
+	offset      int64 // of the next byte read
+	recordStart int64
+	line        []byte // the current record, only kept for time fields
+	lastBucket  time.Time
+}
+
+func newIndexingReader(reader io.Reader, index *recordIndex) *indexingReader {
+	return &indexingReader{Reader: reader, index: index}
+}
+
+func (r *indexingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	data := p[:n]
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if r.index.TimeField != "" {
+				r.line = append(r.line, data...)
+			}
+			r.offset += int64(len(data))
+			break
+		}
+		if r.index.TimeField != "" {
+			r.line = append(r.line, data[:i]...)
+		}
+		r.offset += int64(i + 1)
+		r.endRecord()
+		data = data[i+1:]
+	}
+	if err == io.EOF && r.offset > r.recordStart {
+		// The last record has no trailing newline.
+		r.endRecord()
+	}
+	r.index.Size = r.offset
+	return n, err
+}
+
+// endRecord - indexes the record just read.
+func (r *indexingReader) endRecord() {
+	idx := r.index
+	entry := indexEntry{Record: idx.Records, Offset: r.recordStart}
+	add := idx.Every > 0 && idx.Records%idx.Every == 0
+
+	if idx.TimeField != "" {
+		var record map[string]interface{}
+		if json.Unmarshal(r.line, &record) == nil {
+			if s, ok := record[idx.TimeField].(string); ok {
+				if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+					if b := t.Truncate(idx.bucket); !b.Equal(r.lastBucket) {
+						r.lastBucket = b
+						entry.Time = &t
+						add = true
+					}
+				}
+			}
+		}
+		r.line = r.line[:0]
+	}
+
+	if add {
+		idx.Entries = append(idx.Entries, entry)
+	}
+	idx.Records++
+	r.recordStart = r.offset
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// parseObjectURL - splits 's3://bucket/key' into its bucket and key.
+func parseObjectURL(s string) (bucketName, objectName string, err error) {
+	if !strings.HasPrefix(s, "s3://") {
+		return "", "", fmt.Errorf("Expected s3://bucket/key, got %q", s)
+	}
+	s = strings.TrimPrefix(s, "s3://")
+	i := strings.Index(s, "/")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("Expected s3://bucket/key, got s3://%s", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+// openObject - opens an object, or the given range of it. Objects with a
+// Content-Encoding are decompressed, but never ranged as offsets into
+// them are meaningless.
+func openObject(bucketName, objectName string, setRange func(minio.RequestHeaders) error) (io.Reader, io.Closer, error) {
+	c, err := newCore()
+	if err != nil {
+		return nil, nil, err
+	}
+	objInfo, err := c.StatObject(bucketName, objectName)
+	if err != nil {
+		return nil, nil, wrapS3Error("StatObject", err)
+	}
+	encoding := objInfo.Metadata.Get("Content-Encoding")
+
+	reqHeaders := minio.NewGetReqHeaders()
+	if setRange != nil && encoding == "" && objInfo.Size > 0 {
+		if err = setRange(reqHeaders); err != nil {
+			return nil, nil, err
+		}
+	}
+	reader, _, err := c.GetObject(bucketName, objectName, reqHeaders)
+	if err != nil {
+		return nil, nil, wrapS3Error("GetObject", err)
+	}
+	source, err := decompressReader(reader, encoding)
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	return source, reader, nil
+}
+
+// catMain - implements the 'cat s3://bucket/key' command.
+func catMain(args []string) error {
+	flags := flag.NewFlagSet("cat", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: cat s3://bucket/key")
+	}
+	bucketName, objectName, err := parseObjectURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	source, closer, err := openObject(bucketName, objectName, nil)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	_, err = io.Copy(os.Stdout, source)
+	return err
+}
+
+// headMain - implements the 'head -c N s3://bucket/key' command, which
+// only fetches the first N bytes of unencoded objects.
+func headMain(args []string) error {
+	flags := flag.NewFlagSet("head", flag.ExitOnError)
+	count := flags.Int64("c", 1024, "number of bytes to print")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *count <= 0 {
+		return fmt.Errorf("Usage: head [-c N] s3://bucket/key")
+	}
+	bucketName, objectName, err := parseObjectURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	source, closer, err := openObject(bucketName, objectName, func(h minio.RequestHeaders) error {
+		return h.SetRange(0, *count-1)
+	})
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	_, err = io.Copy(os.Stdout, io.LimitReader(source, *count))
+	return err
+}
+
+// tailMain - implements the 'tail -c N s3://bucket/key' command, which
+// only fetches the last N bytes of unencoded objects. Encoded objects
+// are streamed whole, keeping the last N bytes.
+func tailMain(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	count := flags.Int64("c", 1024, "number of bytes to print")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *count <= 0 {
+		return fmt.Errorf("Usage: tail [-c N] s3://bucket/key")
+	}
+	bucketName, objectName, err := parseObjectURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	source, closer, err := openObject(bucketName, objectName, func(h minio.RequestHeaders) error {
+		// A suffix range, 'bytes=-N'.
+		return h.SetRange(0, -*count)
+	})
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	// Keep the last count bytes, twice as many buffered at most.
+	var tail []byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := source.Read(buf)
+		tail = append(tail, buf[:n]...)
+		if int64(len(tail)) > 2**count {
+			tail = append(tail[:0], tail[int64(len(tail))-*count:]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if int64(len(tail)) > *count {
+		tail = tail[int64(len(tail))-*count:]
+	}
+	_, err = os.Stdout.Write(tail)
+	return err
+}
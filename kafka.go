@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// kafkaPrefix - prefix under which committed consumer offsets are stored.
+const kafkaPrefix = ".kafka/"
+
+// kafkaOffset - the committed offset of a consumer group on a partition,
+// the next record to consume.
+type kafkaOffset struct {
+	Group     string    `json:"group"`
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Object    string    `json:"object"`
+	Committed time.Time `json:"committed"`
+}
+
+// kafkaRecord - a record as printed by 'kcat -J'.
+type kafkaRecord struct {
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Key       string `json:"key"`
+	Payload   string `json:"payload"`
+
+	// line is the raw JSON envelope.
+	line []byte
+}
+
+// kafkaSink - the settings of the 'consume-kafka' command.
+type kafkaSink struct {
+	c         minio.Core
+	brokers   string
+	topic     string
+	group     string
+	bucket    string
+	prefix    string
+	format    string
+	delimiter string
+	maxBytes  int64
+	maxAge    time.Duration
+}
+
+// kafkaOffsetName - returns the name of the object holding the offset
+// of a group on a partition.
+func (k *kafkaSink) kafkaOffsetName(partition int) string {
+	return fmt.Sprintf("%s%s/%s/%d.json", kafkaPrefix, k.group, k.topic, partition)
+}
+
+// kcat - returns a kcat command with the brokers set.
+func (k *kafkaSink) kcat(args ...string) *exec.Cmd {
+	cmd := exec.Command("kcat", append([]string{"-b", k.brokers}, args...)...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// partitions - lists the partitions of the topic.
+func (k *kafkaSink) partitions() ([]int, error) {
+	out, err := k.kcat("-L", "-J", "-t", k.topic).Output()
+	if err != nil {
+		return nil, fmt.Errorf("kcat -L failed: %v", err)
+	}
+	var metadata struct {
+		Topics []struct {
+			Topic      string `json:"topic"`
+			Partitions []struct {
+				Partition int `json:"partition"`
+			} `json:"partitions"`
+		} `json:"topics"`
+	}
+	if err = json.Unmarshal(out, &metadata); err != nil {
+		return nil, err
+	}
+	var partitions []int
+	for _, t := range metadata.Topics {
+		if t.Topic != k.topic {
+			continue
+		}
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.Partition)
+		}
+	}
+	if len(partitions) == 0 {
+		return nil, fmt.Errorf("Topic %s has no partitions", k.topic)
+	}
+	return partitions, nil
+}
+
+// committedOffset - returns the next offset to consume, 'beginning' if
+// the group never committed on the partition.
+func (k *kafkaSink) committedOffset(partition int) (string, error) {
+	var offset kafkaOffset
+	if err := getJSON(k.c, k.bucket, k.kafkaOffsetName(partition), &offset); err != nil {
+		if isNoSuchKey(err) {
+			return "beginning", nil
+		}
+		return "", err
+	}
+	return strconv.FormatInt(offset.Offset, 10), nil
+}
+
+// consume - lands the records of a partition as rotated objects until
+// kcat exits. Offsets are committed only once an object is complete, so
+// records are delivered at least once.
+func (k *kafkaSink) consume(partition int) error {
+	start, err := k.committedOffset(partition)
+	if err != nil {
+		return err
+	}
+	cmd := k.kcat("-C", "-J", "-u", "-t", k.topic, "-p", strconv.Itoa(partition), "-o", start)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	records := make(chan kafkaRecord)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(records)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var r kafkaRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				readErr <- err
+				return
+			}
+			r.line = append([]byte(nil), scanner.Bytes()...)
+			records <- r
+		}
+		readErr <- scanner.Err()
+	}()
+
+	var obj *kafkaObject
+	var rotate <-chan time.Time
+	for {
+		select {
+		case r, ok := <-records:
+			if !ok {
+				if err = obj.complete(); err == nil {
+					err = <-readErr
+				}
+				if wErr := cmd.Wait(); err == nil && wErr != nil {
+					err = fmt.Errorf("kcat failed: %v", wErr)
+				}
+				return err
+			}
+			if obj == nil {
+				obj = k.newObject(partition, r.Offset)
+				rotate = time.After(k.maxAge)
+			}
+			if err = obj.write(r); err != nil {
+				cmd.Process.Kill()
+				return err
+			}
+			if obj.size < k.maxBytes {
+				continue
+			}
+		case <-rotate:
+		}
+
+		if err = obj.complete(); err != nil {
+			cmd.Process.Kill()
+			return err
+		}
+		obj, rotate = nil, nil
+	}
+}
+
+// kafkaObject - a rolling object being streamed.
+type kafkaObject struct {
+	k         *kafkaSink
+	partition int
+	name      string
+	first     int64
+	last      int64
+	size      int64
+	pw        *io.PipeWriter
+	done      chan error
+}
+
+// newObject - starts streaming a new object from the record at offset.
+func (k *kafkaSink) newObject(partition int, offset int64) *kafkaObject {
+	pr, pw := io.Pipe()
+	// Names sort by time and offset.
+	name := fmt.Sprintf("%s%s/partition=%d/%s-%020d", k.prefix, k.topic, partition,
+		time.Now().UTC().Format("20060102T150405Z"), offset)
+	o := &kafkaObject{k: k, partition: partition, name: name, first: offset, pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := PutStream(k.bucket, name, pr, map[string][]string{
+			"X-Amz-Meta-Kafka-Topic":        {k.topic},
+			"X-Amz-Meta-Kafka-Partition":    {strconv.Itoa(partition)},
+			"X-Amz-Meta-Kafka-First-Offset": {strconv.FormatInt(offset, 10)},
+		})
+		pr.CloseWithError(err)
+		o.done <- err
+	}()
+	return o
+}
+
+// write - appends a record in the configured format.
+func (o *kafkaObject) write(r kafkaRecord) error {
+	data := []byte(r.Payload)
+	if o.k.format == "json" {
+		data = r.line
+	}
+	n, err := o.pw.Write(append(data, o.k.delimiter...))
+	o.size += int64(n)
+	o.last = r.Offset
+	return err
+}
+
+// complete - finishes the upload and commits the offset after the last
+// record. A nil object has nothing to complete.
+func (o *kafkaObject) complete() error {
+	if o == nil {
+		return nil
+	}
+	o.pw.Close()
+	if err := <-o.done; err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "partition", o.partition, "offsets", o.first, "to", o.last, "uploaded")
+	return putJSON(o.k.c, o.k.bucket, o.k.kafkaOffsetName(o.partition), kafkaOffset{
+		Group:     o.k.group,
+		Topic:     o.k.topic,
+		Partition: o.partition,
+		Offset:    o.last + 1,
+		Object:    o.name,
+		Committed: time.Now().UTC(),
+	})
+}
+
+// consumeKafkaMain - implements the 'consume-kafka' command, which
+// archives a topic into objects rotated by size and age. Records are
+// consumed with kcat, one process per partition.
+func consumeKafkaMain(args []string) error {
+	flags := flag.NewFlagSet("consume-kafka", flag.ExitOnError)
+	k := &kafkaSink{}
+	flags.StringVar(&k.brokers, "brokers", "localhost:9092", "comma separated list of brokers")
+	flags.StringVar(&k.topic, "topic", "", "topic to consume")
+	flags.StringVar(&k.group, "group", "streams3", "consumer group offsets are committed for")
+	flags.StringVar(&k.bucket, "bucket", "stream-test", "bucket to upload to")
+	flags.StringVar(&k.prefix, "prefix", "", "prefix of the object names")
+	flags.StringVar(&k.format, "format", "raw", "record format: raw payloads or json envelopes")
+	flags.StringVar(&k.delimiter, "delimiter", "\n", "delimiter appended to every record")
+	flags.Int64Var(&k.maxBytes, "max-bytes", 1024*1024*1024, "rotate objects after this many bytes")
+	flags.DurationVar(&k.maxAge, "max-age", 5*time.Minute, "rotate objects after this long")
+	flags.Parse(args)
+	if k.topic == "" || flags.NArg() != 0 {
+		return fmt.Errorf("Usage: consume-kafka -topic name [-brokers list] [-group name] [-bucket name]")
+	}
+	if k.format != "raw" && k.format != "json" {
+		return fmt.Errorf("Unknown format %q", k.format)
+	}
+	// Allow escapes such as '\x00' on the command line.
+	if d, err := strconv.Unquote(`"` + k.delimiter + `"`); err == nil {
+		k.delimiter = d
+	}
+	if k.prefix != "" && !strings.HasSuffix(k.prefix, "/") {
+		k.prefix += "/"
+	}
+
+	var err error
+	if k.c, err = newCore(); err != nil {
+		return err
+	}
+	partitions, err := k.partitions()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(partitions))
+	for i, p := range partitions {
+		wg.Add(1)
+		go func(i, p int) {
+			defer wg.Done()
+			errs[i] = k.consume(p)
+		}(i, p)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
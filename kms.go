@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// envMetadata - returns a copy of metaData with the headers configured
+// in the environment added, to be sent on multipart initiation. Server
+// side encryption set in metaData is kept.
+func envMetadata(metaData map[string][]string) map[string][]string {
+	m := make(map[string][]string, len(metaData))
+	for k, v := range metaData {
+		m[k] = v
+	}
+	if keyID := os.Getenv("SSE_KMS_KEY_ID"); keyID != "" && m["X-Amz-Server-Side-Encryption"] == nil {
+		m["X-Amz-Server-Side-Encryption"] = []string{"aws:kms"}
+		m["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = []string{keyID}
+		if ctx := os.Getenv("SSE_KMS_CONTEXT"); ctx != "" {
+			// Base64 encoded JSON, as S3 expects it.
+			m["X-Amz-Server-Side-Encryption-Context"] = []string{ctx}
+		}
+	}
+	if isGCS() {
+		m = gcsMetadata(m)
+	}
+	return m
+}
+
+// isKMSError - returns true if err was caused by the KMS key, either
+// missing grants or an unusable key.
+func isKMSError(err error) bool {
+	code := errorCode(err)
+	if strings.HasPrefix(code, "KMS.") {
+		return true
+	}
+	var s3Err *S3Error
+	if code == "AccessDenied" && errors.As(err, &s3Err) {
+		return strings.Contains(strings.ToLower(s3Err.Message), "kms")
+	}
+	return false
+}
+
+// kmsPreflight - verifies the credentials can use the SSE-KMS key before
+// streaming. Multipart uploads need kms:GenerateDataKey on initiation
+// and kms:Decrypt on completion, so a tiny probe object is uploaded
+// through the whole multipart cycle and removed again. The probe has a
+// random key below preflightPrefix, never that of an object.
+func kmsPreflight(c minio.Core, bucketName, objectName string, metaData map[string][]string) error {
+	keyID := os.Getenv("SSE_KMS_KEY_ID")
+	if keyID == "" {
+		return nil
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	probeName := preflightPrefix + hex.EncodeToString(suffix)
+
+	kmsErr := func(operation, permission string, err error) error {
+		err = wrapS3Error(operation, err)
+		if isKMSError(err) {
+			return fmt.Errorf("KMS key %s unusable, %s is required: %v", keyID, permission, err)
+		}
+		return err
+	}
+
+	uploadID, err := c.NewMultipartUpload(bucketName, probeName, metaData)
+	if err != nil {
+		return kmsErr("NewMultipartUpload", "kms:GenerateDataKey", err)
+	}
+
+	data := []byte{0}
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	objPart, err := c.PutObjectPart(bucketName, probeName, uploadID, 1, int64(len(data)),
+		bytes.NewReader(data), md5Sum[:], sha256Sum[:])
+	if err == nil {
+		err = c.CompleteMultipartUpload(bucketName, probeName, uploadID, []minio.CompletePart{
+			{PartNumber: objPart.PartNumber, ETag: objPart.ETag},
+		})
+		if err != nil {
+			err = kmsErr("CompleteMultipartUpload", "kms:Decrypt", err)
+		}
+	} else {
+		err = kmsErr("PutObjectPart", "kms:GenerateDataKey", err)
+	}
+	if err != nil {
+		if aErr := c.AbortMultipartUpload(bucketName, probeName, uploadID); aErr != nil {
+			fmt.Fprintln(os.Stderr, "preflight probe upload left behind", probeName, uploadID)
+		}
+		return err
+	}
+
+	if err = c.RemoveObject(bucketName, probeName); err != nil {
+		// Writers may not be allowed to delete, the probe is one byte.
+		fmt.Fprintln(os.Stderr, "preflight probe object left behind", probeName, err)
+	}
+	return nil
+}
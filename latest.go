@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// latestObject - name of the pointer to the latest upload of a prefix.
+const latestObject = "LATEST"
+
+// catalogDir - directory of the restore point catalog of a prefix.
+const catalogDir = ".catalog/"
+
+// restorePoint - a completed backup, as stored in LATEST and the catalog.
+type restorePoint struct {
+	Object    string    `json:"object"`
+	Size      int64     `json:"size"`
+	Completed time.Time `json:"completed"`
+}
+
+// latestPointers - returns true if LATEST pointers are maintained, as
+// set with LATEST.
+func latestPointers() bool {
+	return os.Getenv("LATEST") != ""
+}
+
+// prefixDir - returns the directory of objectName, with a trailing
+// slash, empty at the top of the bucket.
+func prefixDir(objectName string) string {
+	if dir := path.Dir(objectName); dir != "." {
+		return dir + "/"
+	}
+	return ""
+}
+
+// updateLatest - adds an upload to the catalog of its prefix and points
+// LATEST at it. The catalog entry is written first, so LATEST never
+// names a backup the catalog lacks.
+func updateLatest(c minio.Core, bucketName, objectName string, size int64) error {
+	dir := prefixDir(objectName)
+	point := restorePoint{Object: objectName, Size: size, Completed: time.Now().UTC()}
+	entry := dir + catalogDir + point.Completed.Format("20060102T150405.000000000Z") + "-" + path.Base(objectName) + ".json"
+	if err := putJSON(c, bucketName, entry, point); err != nil {
+		return err
+	}
+	return putJSON(c, bucketName, dir+latestObject, point)
+}
+
+// isSidecar - returns true if name, relative to its prefix, is a
+// directory or one of the objects written along with backups rather
+// than a backup.
+func isSidecar(name string) bool {
+	switch name {
+	case latestObject, manifestName(name, manifestSHA256SUMS), manifestName(name, manifestCSV), manifestName(name, manifestJSON):
+		return true
+	}
+	return strings.HasSuffix(name, "/") ||
+		strings.HasSuffix(name, indexSuffix) ||
+		strings.HasSuffix(name, signatureSuffix) ||
+		strings.HasSuffix(name, sidecarSuffix)
+}
+
+// resolveLatest - returns the latest backup below prefix, as pointed at
+// by LATEST or else the most recently modified object.
+func resolveLatest(c minio.Core, bucketName, prefix string) (string, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var point restorePoint
+	err := getJSON(c, bucketName, prefix+latestObject, &point)
+	if err == nil {
+		return point.Object, nil
+	}
+	if !isNoSuchKey(err) {
+		return "", err
+	}
+
+	var latest minio.ObjectInfo
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for objInfo := range c.Client.ListObjects(bucketName, prefix, false, doneCh) {
+		if objInfo.Err != nil {
+			return "", objInfo.Err
+		}
+		if isInternalObject(objInfo.Key) || isSidecar(strings.TrimPrefix(objInfo.Key, prefix)) {
+			continue
+		}
+		if objInfo.LastModified.After(latest.LastModified) {
+			latest = objInfo
+		}
+	}
+	if latest.Key == "" {
+		return "", fmt.Errorf("No backup below %s/%s", bucketName, prefix)
+	}
+	return latest.Key, nil
+}
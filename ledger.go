@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// ledgerPrefix - prefix under which ledger objects are stored in the bucket.
+const ledgerPrefix = ".ledger/"
+
+// ledgerEntry - records a successful upload made under an idempotency key.
+type ledgerEntry struct {
+	Key       string    `json:"key"`
+	Bucket    string    `json:"bucket"`
+	Object    string    `json:"object"`
+	UploadID  string    `json:"uploadId"`
+	ETag      string    `json:"etag"`
+	Size      int64     `json:"size"`
+	Completed time.Time `json:"completed"`
+}
+
+// ledgerKey - returns the ledger key of an idempotency key, keys are
+// hashed so that any caller supplied value is a valid object name.
+func ledgerKey(idempotencyKey string) string {
+	sum := sha256.Sum256([]byte(idempotencyKey))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// ledgerStore - returns where the ledger of a bucket is kept, the objects
+// below ledgerPrefix unless STATE_STORE is set.
+func ledgerStore(c minio.Core, bucketName string) (StateStore, error) {
+	return stateNamespace("ledger/"+bucketName, objectStore{c: c, bucketName: bucketName, prefix: ledgerPrefix})
+}
+
+// readLedger - reads the ledger entry for an idempotency key, returns
+// nil entry if no upload has been recorded yet.
+func readLedger(c minio.Core, bucketName, idempotencyKey string) (*ledgerEntry, error) {
+	store, err := ledgerStore(c, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	entry := &ledgerEntry{}
+	found, err := getStateJSON(store, ledgerKey(idempotencyKey), entry)
+	if err != nil {
+		return nil, err
+	}
+	// Uploads recorded before STATE_STORE was set are in the bucket.
+	if _, inBucket := store.(objectStore); !found && !inBucket {
+		bucketStore := objectStore{c: c, bucketName: bucketName, prefix: ledgerPrefix}
+		found, err = getStateJSON(bucketStore, ledgerKey(idempotencyKey), entry)
+	}
+	if err != nil || !found {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// writeLedger - records a completed upload under an idempotency key.
+func writeLedger(c minio.Core, bucketName, idempotencyKey, objectName, uploadID string, size int64) error {
+	store, err := ledgerStore(c, bucketName)
+	if err != nil {
+		return err
+	}
+	// Save the final ETag along with the entry, so that callers can
+	// verify the object they get back.
+	objInfo, err := c.StatObject(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+
+	return putStateJSON(store, ledgerKey(idempotencyKey), ledgerEntry{
+		Key:       idempotencyKey,
+		Bucket:    bucketName,
+		Object:    objectName,
+		UploadID:  uploadID,
+		ETag:      objInfo.ETag,
+		Size:      size,
+		Completed: time.Now().UTC(),
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	flagDeadline    = flag.Duration("deadline", 0, "fail an upload once it has run this long, 0 for no deadline")
+	flagRetryBudget = flag.Int64("retry-budget", -1, "retries allowed over an upload, -1 for no limit")
+)
+
+// opLimits - the deadline and retry budget of an operation, counted
+// from its start. Every upload has its own, so that concurrent uploads
+// of a process don't spend each other's.
+type opLimits struct {
+	start time.Time
+	// retries made so far, updated atomically.
+	retries int64
+}
+
+// newOpLimits - starts counting the limits of an operation.
+func newOpLimits() *opLimits {
+	return &opLimits{start: time.Now()}
+}
+
+// limitError - the operation ran out of time or retries. Multipart
+// uploads are left in place rather than aborted, so that they can be
+// resumed from the status file or listed with 'ls -uploads'.
+type limitError struct {
+	reason string
+	// Err is the error that would have been retried, if any.
+	Err error
+}
+
+func (e *limitError) Error() string {
+	if e.Err != nil {
+		return e.reason + ", last error: " + e.Err.Error()
+	}
+	return e.reason
+}
+
+func (e *limitError) Unwrap() error { return e.Err }
+
+// checkDeadline - returns a limitError once the deadline has passed.
+func (l *opLimits) checkDeadline() error {
+	if *flagDeadline > 0 && time.Since(l.start) > *flagDeadline {
+		return &limitError{reason: fmt.Sprintf("Deadline of %s exceeded", *flagDeadline)}
+	}
+	return nil
+}
+
+// spendRetry - accounts for a retry of err, returning a limitError
+// instead if the deadline has passed or the retry budget is spent.
+func (l *opLimits) spendRetry(err error) error {
+	if dErr := l.checkDeadline(); dErr != nil {
+		dErr.(*limitError).Err = err
+		return dErr
+	}
+	if n := atomic.AddInt64(&l.retries, 1); *flagRetryBudget >= 0 && n > *flagRetryBudget {
+		return &limitError{reason: fmt.Sprintf("Retry budget of %d spent", *flagRetryBudget), Err: err}
+	}
+	return nil
+}
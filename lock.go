@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockPrefix - prefix under which the leases of locked keys are stored.
+const lockPrefix = ".locks/"
+
+// lease - the content of a lock object, renewed by its holder until the
+// upload is done. Leases not renewed within TTLSeconds of their last
+// write may be taken over, as per the clock of the server, so that the
+// clocks of the hosts don't matter. Expires is informative.
+type lease struct {
+	Object     string    `json:"object"`
+	Host       string    `json:"host"`
+	PID        int       `json:"pid"`
+	Acquired   time.Time `json:"acquired"`
+	Expires    time.Time `json:"expires"`
+	TTLSeconds int64     `json:"ttlSeconds"`
+}
+
+// heldLease - a lease as read, with its ETag and the times of the server.
+type heldLease struct {
+	lease
+	etag     string
+	modified time.Time
+	now      time.Time
+}
+
+// expiresAt - returns when the lease expires, in the time of the server.
+func (h heldLease) expiresAt() time.Time {
+	if h.TTLSeconds == 0 || h.modified.IsZero() {
+		return h.Expires
+	}
+	return h.modified.Add(time.Duration(h.TTLSeconds) * time.Second)
+}
+
+// expired - returns true if the lease was not renewed in time.
+func (h heldLease) expired() bool {
+	return h.now.After(h.expiresAt())
+}
+
+// lockTTL - returns the lease duration set with LOCK_TTL, 0 if uploads
+// are not locked.
+func lockTTL() (time.Duration, error) {
+	v := os.Getenv("LOCK_TTL")
+	if v == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl < 3*time.Second {
+		return 0, fmt.Errorf("Invalid LOCK_TTL %q, expected a duration of at least 3s", v)
+	}
+	return ttl, nil
+}
+
+// lockObjectName - returns the lock object of a key, hashed so that locks
+// of keys below a prefix don't show up in its listings.
+func lockObjectName(objectName string) string {
+	sum := sha256.Sum256([]byte(objectName))
+	return lockPrefix + hex.EncodeToString(sum[:]) + ".json"
+}
+
+// objectLock - a held lock, renewed in the background.
+type objectLock struct {
+	s          site
+	bucketName string
+	name       string
+	lease      lease
+	ttl        time.Duration
+
+	mu     sync.Mutex
+	etag   string
+	lost   error
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// putLease - writes a lease on the condition given as If-None-Match or
+// If-Match header, returning its ETag.
+func putLease(s site, bucketName, name string, l lease, condition http.Header) (string, error) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	for k, v := range condition {
+		header[k] = v
+	}
+	resp, err := siteRequest(s, "PutObject", http.MethodPut, bucketName, name, nil, header, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// readLease - returns the current lease of a lock.
+func readLease(s site, bucketName, name string) (heldLease, error) {
+	var h heldLease
+	resp, err := siteRequest(s, "GetObject", http.MethodGet, bucketName, name, nil, nil, nil)
+	if err != nil {
+		return h, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return h, err
+	}
+	if err = json.Unmarshal(data, &h.lease); err != nil {
+		return h, fmt.Errorf("Lease %s unreadable: %v", name, err)
+	}
+	h.etag = resp.Header.Get("ETag")
+	h.modified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if h.now, err = http.ParseTime(resp.Header.Get("Date")); err != nil {
+		h.now = time.Now()
+	}
+	return h, nil
+}
+
+// acquireLock - locks a key against concurrent writers with a lease
+// object created with If-None-Match, waiting up to LOCK_WAIT for the
+// current holder. Leases that expired are taken over with If-Match, so
+// that only one of several waiters gets them. Returns nil if LOCK_TTL is
+// not set.
+func acquireLock(s site, bucketName, objectName string) (*objectLock, error) {
+	ttl, err := lockTTL()
+	if err != nil || ttl == 0 {
+		return nil, err
+	}
+	var wait time.Duration
+	if v := os.Getenv("LOCK_WAIT"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("Invalid LOCK_WAIT %q", v)
+		}
+	}
+
+	host, _ := os.Hostname()
+	name := lockObjectName(objectName)
+	deadline := time.Now().Add(wait)
+	for {
+		now := time.Now().UTC()
+		l := lease{Object: objectName, Host: host, PID: os.Getpid(), Acquired: now, Expires: now.Add(ttl), TTLSeconds: int64(ttl / time.Second)}
+		etag, err := putLease(s, bucketName, name, l, http.Header{"If-None-Match": {"*"}})
+		if err == nil {
+			return startLock(s, bucketName, name, l, ttl, etag), nil
+		}
+		if errorCode(err) != "PreconditionFailed" {
+			return nil, err
+		}
+
+		held, err := readLease(s, bucketName, name)
+		if isNoSuchKey(err) {
+			// Released meanwhile.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if held.expired() {
+			fmt.Fprintf(os.Stderr, "taking over the lock of %s held by %s (pid %d), expired %s ago\n",
+				objectName, held.Host, held.PID, held.now.Sub(held.expiresAt()).Truncate(time.Second))
+			etag, err = putLease(s, bucketName, name, l, http.Header{"If-Match": {held.etag}})
+			if err == nil {
+				return startLock(s, bucketName, name, l, ttl, etag), nil
+			}
+			if errorCode(err) != "PreconditionFailed" {
+				return nil, err
+			}
+			// Another waiter took it over first.
+			continue
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s is locked by %s (pid %d) since %s, until %s", objectName,
+				held.Host, held.PID, held.Acquired.Format(time.RFC3339), held.expiresAt().Format(time.RFC3339))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func startLock(s site, bucketName, name string, l lease, ttl time.Duration, etag string) *objectLock {
+	lock := &objectLock{
+		s:          s,
+		bucketName: bucketName,
+		name:       name,
+		lease:      l,
+		ttl:        ttl,
+		etag:       etag,
+		stopCh:     make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	go lock.renew()
+	return lock
+}
+
+// renew - extends the lease every third of its duration, until released
+// or lost to a writer that took it over.
+func (lock *objectLock) renew() {
+	defer close(lock.doneCh)
+	ticker := time.NewTicker(lock.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stopCh:
+			return
+		case <-ticker.C:
+		}
+		lock.mu.Lock()
+		l := lock.lease
+		l.Expires = time.Now().UTC().Add(lock.ttl)
+		etag, err := putLease(lock.s, lock.bucketName, lock.name, l, http.Header{"If-Match": {lock.etag}})
+		if err == nil {
+			lock.lease, lock.etag = l, etag
+		} else if errorCode(err) == "PreconditionFailed" {
+			lock.lost = fmt.Errorf("Lock of %s lost, another writer took it over", l.Object)
+		} else {
+			// Renewed again at the next tick, before the lease expires.
+			fmt.Fprintln(os.Stderr, "lock renewal failed", err)
+		}
+		lost := lock.lost
+		lock.mu.Unlock()
+		if lost != nil {
+			fmt.Fprintln(os.Stderr, lost)
+			return
+		}
+	}
+}
+
+// check - returns an error if the lease was lost or expired, read again
+// so that an upload is never completed after another writer took the
+// lock over. Nil locks are never lost.
+func (lock *objectLock) check() error {
+	if lock == nil {
+		return nil
+	}
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	return lock.verify()
+}
+
+// verify - same as check, with lock.mu held.
+func (lock *objectLock) verify() error {
+	if lock.lost != nil {
+		return lock.lost
+	}
+	held, err := readLease(lock.s, lock.bucketName, lock.name)
+	if err != nil && !isNoSuchKey(err) {
+		return err
+	}
+	if err != nil || strings.Trim(held.etag, "\"") != strings.Trim(lock.etag, "\"") {
+		lock.lost = fmt.Errorf("Lock of %s lost, another writer took it over", lock.lease.Object)
+	} else if held.expired() {
+		lock.lost = fmt.Errorf("Lock of %s expired, it may be taken over", lock.lease.Object)
+	}
+	return lock.lost
+}
+
+// release - stops renewing and deletes the lease, returning an error if
+// it was lost meanwhile, as the key may have been written concurrently.
+func (lock *objectLock) release() error {
+	close(lock.stopCh)
+	<-lock.doneCh
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	// Only delete the lease still ours.
+	if err := lock.verify(); err != nil {
+		return err
+	}
+	resp, err := siteRequest(lock.s, "DeleteObject", http.MethodDelete, lock.bucketName, lock.name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
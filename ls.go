@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// objectVersion - a version or delete marker of ListObjectVersions.
+type objectVersion struct {
+	Key          string    `xml:"Key"`
+	VersionID    string    `xml:"VersionId"`
+	IsLatest     bool      `xml:"IsLatest"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+	deleteMarker bool
+}
+
+// listVersionsResult - a page of ListObjectVersions.
+type listVersionsResult struct {
+	IsTruncated         bool            `xml:"IsTruncated"`
+	NextKeyMarker       string          `xml:"NextKeyMarker"`
+	NextVersionIDMarker string          `xml:"NextVersionIdMarker"`
+	Versions            []objectVersion `xml:"Version"`
+	DeleteMarkers       []objectVersion `xml:"DeleteMarker"`
+	CommonPrefixes      []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// listObjectVersions - lists a page of object versions, which the minio
+// client has no call for.
+func listObjectVersions(s site, bucketName, prefix, delimiter, keyMarker, versionMarker string) (listVersionsResult, error) {
+	query := url.Values{"versions": {""}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if keyMarker != "" {
+		query.Set("key-marker", keyMarker)
+		query.Set("version-id-marker", versionMarker)
+	}
+	var result listVersionsResult
+	resp, err := siteRequest(s, "ListObjectVersions", http.MethodGet, bucketName, "", query, nil, nil)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+// lsObjects - prints the objects below a prefix, and the common prefixes
+// when not recursive.
+func lsObjects(w *tabwriter.Writer, c minio.Core, bucketName, prefix, delimiter string) error {
+	marker := ""
+	for {
+		result, err := c.ListObjects(bucketName, prefix, marker, delimiter, 1000)
+		if err != nil {
+			return wrapS3Error("ListObjects", err)
+		}
+		for _, p := range result.CommonPrefixes {
+			fmt.Fprintf(w, "\t\t\tPRE\t%s\n", p.Prefix)
+		}
+		for _, objInfo := range result.Contents {
+			if isInternalObject(objInfo.Key) {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", objInfo.LastModified.UTC().Format(time.RFC3339),
+				objInfo.Size, objInfo.StorageClass, strings.Trim(objInfo.ETag, "\""), objInfo.Key)
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		marker = result.NextMarker
+		if marker == "" && len(result.Contents) > 0 {
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+	}
+}
+
+// lsVersions - prints the versions and delete markers below a prefix.
+func lsVersions(w *tabwriter.Writer, s site, bucketName, prefix, delimiter string) error {
+	keyMarker, versionMarker := "", ""
+	for {
+		result, err := listObjectVersions(s, bucketName, prefix, delimiter, keyMarker, versionMarker)
+		if err != nil {
+			return err
+		}
+		for _, p := range result.CommonPrefixes {
+			fmt.Fprintf(w, "\t\t\t\tPRE\t%s\n", p.Prefix)
+		}
+		for _, v := range result.DeleteMarkers {
+			v.deleteMarker = true
+			result.Versions = append(result.Versions, v)
+		}
+		for _, v := range result.Versions {
+			if isInternalObject(v.Key) {
+				continue
+			}
+			state := ""
+			switch {
+			case v.deleteMarker:
+				state = "delete-marker"
+			case v.IsLatest:
+				state = "latest"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", v.LastModified.UTC().Format(time.RFC3339),
+				v.Size, v.StorageClass, strings.Trim(v.ETag, "\""), v.VersionID, state, v.Key)
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		keyMarker, versionMarker = result.NextKeyMarker, result.NextVersionIDMarker
+	}
+}
+
+// countParts - returns the number and total size of the parts uploaded
+// so far.
+func countParts(c minio.Core, bucketName, objectName, uploadID string) (int, int64, error) {
+	var count int
+	var size int64
+	marker := 0
+	for {
+		result, err := c.ListObjectParts(bucketName, objectName, uploadID, marker, 1000)
+		if err != nil {
+			return 0, 0, wrapS3Error("ListObjectParts", err)
+		}
+		for _, part := range result.ObjectParts {
+			count++
+			size += part.Size
+		}
+		if !result.IsTruncated {
+			return count, size, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// lsUploads - prints the multipart uploads in progress below a prefix.
+func lsUploads(w *tabwriter.Writer, c minio.Core, bucketName, prefix string) error {
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		result, err := c.ListMultipartUploads(bucketName, prefix, keyMarker, uploadIDMarker, "", 1000)
+		if err != nil {
+			return wrapS3Error("ListMultipartUploads", err)
+		}
+		for _, upload := range result.Uploads {
+			parts, size, err := countParts(c, bucketName, upload.Key, upload.UploadID)
+			if err != nil {
+				return err
+			}
+			age := time.Since(upload.Initiated).Truncate(time.Second)
+			fmt.Fprintf(w, "%s\t%s\t%d parts\t%d\t%s\t%s\n", upload.Initiated.UTC().Format(time.RFC3339),
+				age, parts, size, upload.UploadID, upload.Key)
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+}
+
+// lsMain - implements the 'ls s3://bucket/prefix' command, which lists
+// objects, their versions, or the multipart uploads in progress.
+func lsMain(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	recursive := flags.Bool("recursive", false, "list all objects below the prefix, not only one level")
+	versions := flags.Bool("versions", false, "list object versions and delete markers")
+	uploads := flags.Bool("uploads", false, "list multipart uploads in progress with their age and parts")
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*versions && *uploads) {
+		return fmt.Errorf("Usage: ls [-recursive] [-versions | -uploads] s3://bucket/prefix")
+	}
+	bucketName, prefix, err := parseS3Prefix(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	delimiter := "/"
+	if *recursive {
+		delimiter = ""
+	}
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	switch {
+	case *versions:
+		err = lsVersions(w, e.site(), bucketName, prefix, delimiter)
+	case *uploads:
+		err = lsUploads(w, e.core(), bucketName, prefix)
+	default:
+		err = lsObjects(w, e.core(), bucketName, prefix, delimiter)
+	}
+	if fErr := w.Flush(); err == nil {
+		err = fErr
+	}
+	return err
+}
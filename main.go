@@ -2,15 +2,18 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
-	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
+	"flag"
 	"fmt"
 	"hash"
 	"io"
 	"math"
 	"os"
 	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	minio "github.com/minio/minio-go"
 )
@@ -62,6 +65,17 @@ type completeMultipartUpload struct {
 	Parts   []minio.CompletePart `xml:"Part"`
 }
 
+// partJob - a part read from the stream, waiting to be uploaded.
+type partJob struct {
+	number   int
+	offset   int64
+	size     int64
+	buffer   *bytes.Buffer
+	hashSums map[string][]byte
+	readTime time.Duration
+	hashTime time.Duration
+}
+
 // hashCopyN - Calculates chosen hashes up to partSize amount of bytes.
 func hashCopyN(hashAlgorithms map[string]hash.Hash, hashSums map[string][]byte, writer io.Writer, reader io.Reader, partSize int64) (size int64, err error) {
 	hashWriter := writer
@@ -74,7 +88,7 @@ func hashCopyN(hashAlgorithms map[string]hash.Hash, hashSums map[string][]byte,
 	if err != nil {
 		// If not EOF return error right here.
 		if err != io.EOF {
-			fmt.Println("io.EOF failed")
+			fmt.Fprintln(os.Stderr, "io.EOF failed")
 			return 0, err
 		}
 	}
@@ -85,53 +99,475 @@ func hashCopyN(hashAlgorithms map[string]hash.Hash, hashSums map[string][]byte,
 	return size, err
 }
 
+// newCore - instantiates a new minio core client from the environment.
+func newCore() (c minio.Core, err error) {
+	e, err := newEndpoints()
+	if err != nil {
+		return c, err
+	}
+	if !e.s3() {
+		return c, fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	return e.core(), nil
+}
+
 // PutStream uploads files bigger than 64MiB, and also supports special case where size is unknown i.e '-1'.
+//
+// If IDEMPOTENCY_KEY is set in the environment, a previous successful
+// upload recorded under the same key is returned instead of uploading
+// the stream again.
 func PutStream(bucketName, objectName string, reader io.Reader, metaData map[string][]string) (n int64, err error) {
-	ssl := false
+	return putStreamEnv(bucketName, objectName, reader, metaData, nil, nil)
+}
+
+// putStreamEnv - uploads the stream to the endpoints configured in the
+// environment, reporting progress to fn which may be nil. A non-nil plan
+// sets the part boundaries.
+func putStreamEnv(bucketName, objectName string, reader io.Reader, metaData map[string][]string, fn ProgressFunc, plan PartPlan) (n int64, err error) {
+	return putStreamOptions(bucketName, objectName, reader, &Options{Metadata: metaData, Progress: fn, Plan: plan})
+}
 
-	if os.Getenv("SSL") > "" {
-		fmt.Println("SSL true")
-		ssl = true
+// putStreamOptions - same as putStreamEnv, with the settings of o taking
+// precedence over the environment.
+func putStreamOptions(bucketName, objectName string, reader io.Reader, o *Options) (n int64, err error) {
+	e, err := newEndpoints()
+	if err != nil {
+		return 0, err
 	}
+	return putStreamEndpoints(e, bucketName, objectName, reader, o)
+}
 
-	var c minio.Core
+// putStreamEndpoints - same as putStreamOptions, uploading to e.
+func putStreamEndpoints(e *endpoints, bucketName, objectName string, reader io.Reader, o *Options) (n int64, err error) {
+	if e.s3() {
+		// Storage admins may set defaults for all writers of the bucket.
+		if o, err = withBucketDefaults(e.core(), bucketName, o); err != nil {
+			return 0, err
+		}
+	}
+	e.partSize, e.parallel, e.expectSHA256 = o.PartSize, o.Concurrency, o.ExpectSHA256
+	e.sizeHint = newSizeHint(o)
+	fn, plan := o.Progress, o.Plan
+
+	metaData := envMetadata(o.sseMetadata())
+	if e.s3() && !useV4() && metaData["X-Amz-Server-Side-Encryption"] != nil && metaData["X-Amz-Server-Side-Encryption"][0] == "aws:kms" {
+		// Clients are signed alike, before the settings of uploads are known.
+		return 0, fmt.Errorf("SSE-KMS requests must be signed with SigV4, set S3_SIGNATURE=v4")
+	}
+	if !e.s3() {
+		// Preflights, status objects and the ledger are S3 objects.
+		n, _, err = putStream(e, bucketName, objectName, reader, metaData, fn, plan)
+		return n, err
+	}
 
-	// Instantiate new minio core client object.
-	client, err := minio.NewV2(
-		os.Getenv("S3_ADDRESS"),
-		os.Getenv("ACCESS_KEY"),
-		os.Getenv("SECRET_KEY"),
-		ssl,
-	)
+	// Fail fast, before reading any of the stream.
+	if os.Getenv("PREFLIGHT") > "" {
+		if err = preflight(e.core(), bucketName, objectName, metaData); err != nil {
+			return 0, err
+		}
+	}
+	if err = kmsPreflight(e.core(), bucketName, objectName, metaData); err != nil {
+		return 0, err
+	}
+	if e.sizeHint != nil {
+		if err = checkQuota(e.site(), bucketName, e.sizeHint.expected); err != nil {
+			return 0, err
+		}
+	}
+
+	// Concurrent writers of the key wait or fail here.
+	lock, err := acquireLock(e.site(), bucketName, objectName)
+	if err != nil {
+		return 0, err
+	}
+	if lock != nil {
+		e.lock = lock
+		defer func() {
+			if lErr := lock.release(); err == nil {
+				err = lErr
+			}
+		}()
+	}
+
+	format, err := manifestFormat()
+	if err != nil {
+		return 0, err
+	}
+	history, err := historyMode()
 	if err != nil {
-		fmt.Println("minio.NewCore failed", err)
 		return 0, err
 	}
+	if format != "" || history != "" {
+		record := func(name string, size int64, took time.Duration, sum string) error {
+			if format != "" {
+				if sum == "" {
+					fmt.Fprintln(os.Stderr, "parts were read again, not recording", name, "in the manifest")
+				} else if err := updateManifest(e.core(), bucketName, name, format, size, sum); err != nil {
+					return err
+				}
+			}
+			if history != "" {
+				return appendHistory(e.core(), bucketName, history, newHistoryRecord(name, size, took, sum))
+			}
+			return nil
+		}
+		// Each upload of a rotated stream is recorded on its own.
+		rotations := 0
+		if policy, pErr := partLimitPolicy(); pErr == nil && policy == partLimitRotate {
+			e.rotated = func(name string, size int64, took time.Duration, sum string) error {
+				rotations++
+				return record(name, size, took, sum)
+			}
+		}
+		var digest *hashingReader
+		if digest, reader, err = newHashingSource(reader); err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		defer func() {
+			// Uploads skipped by the ledger read nothing.
+			if err != nil || rotations > 0 || digest.n != n {
+				return
+			}
+			err = record(objectName, n, time.Since(start), digest.sum())
+		}()
+	}
+
+	// Uploads skipped by the ledger are not the latest.
+	var skipped bool
+	if latestPointers() {
+		defer func() {
+			if err == nil && !skipped {
+				err = updateLatest(e.core(), bucketName, objectName, n)
+			}
+		}()
+	}
+
+	progress := fn
+	if status := newStatusWriter(e.core(), bucketName, objectName, reader); status != nil {
+		defer func() { status.finish(err) }()
+		progress = multiProgress(status.progress, fn)
+	}
+
+	idempotencyKey := os.Getenv("IDEMPOTENCY_KEY")
+	if idempotencyKey == "" {
+		n, _, err = putStream(e, bucketName, objectName, reader, metaData, progress, plan)
+		return n, err
+	}
+
+	// Look for a prior successful upload under the same key.
+	entry, err := readLedger(e.core(), bucketName, idempotencyKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "readLedger failed", err)
+		return 0, err
+	}
+	if entry != nil {
+		if entry.Object != objectName {
+			return 0, fmt.Errorf("Idempotency key %q already used for object %q", idempotencyKey, entry.Object)
+		}
+		fmt.Fprintln(os.Stderr, "upload already completed, skipping", entry.UploadID)
+		skipped = true
+		return entry.Size, nil
+	}
+
+	n, uploadID, err := putStream(e, bucketName, objectName, reader, metaData, progress, plan)
+	if err != nil {
+		return n, err
+	}
+
+	if err = writeLedger(e.core(), bucketName, idempotencyKey, objectName, uploadID, n); err != nil {
+		fmt.Fprintln(os.Stderr, "writeLedger failed", err)
+		return n, err
+	}
+	return n, nil
+}
+
+// putStream - uploads the stream to the given endpoints, returns the
+// uploaded size and the upload id used. With the restart failover
+// policy, seekable streams are uploaded again on the next endpoint.
+// Progress is reported to fn, which may be nil. A non-nil plan sets the
+// part boundaries.
+func putStream(e *endpoints, bucketName, objectName string, reader io.Reader, metaData map[string][]string, fn ProgressFunc, plan PartPlan) (n int64, uploadID string, err error) {
+	if metaData, err = templateMetadata(bucketName, objectName, jobMetadata(metaData)); err != nil {
+		return 0, "", err
+	}
+	metaData = encodeMetadata(metaData)
+	var start int64
+	if seeker, ok := reader.(io.Seeker); ok {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return 0, "", err
+		}
+	}
+
+	if err = e.startHealthChecks(bucketName); err != nil {
+		return 0, "", err
+	}
+	defer e.stopHealthChecks()
+
+	progress := serialProgress(fn)
+	for {
+		n, uploadID, err = putStreamProtocol(e, bucketName, objectName, reader, sourceSize(reader)-start, metaData, progress, plan)
+		if err == nil {
+			return n, uploadID, nil
+		}
+		restart := uploadID != "" && e.canRestart(reader, err)
+		if restart {
+			if lErr := e.limits.spendRetry(err); lErr != nil {
+				err, restart = lErr, false
+			}
+		}
+		if !restart {
+			if _, ok := err.(*limitError); ok && uploadID != "" {
+				fmt.Fprintln(os.Stderr, "upload", uploadID, "of", objectName, "left in place to be resumed")
+			}
+			progress(ProgressEvent{
+				Type:     Aborted,
+				Time:     time.Now(),
+				Bucket:   bucketName,
+				Object:   objectName,
+				UploadID: uploadID,
+				Bytes:    n,
+				Err:      err,
+			})
+			return n, uploadID, err
+		}
+
+		// Same logical storage, so the abandoned upload can be aborted
+		// through the next endpoint.
+		if aErr := e.backend().AbortMultipartUpload(bucketName, objectName, uploadID); aErr != nil {
+			fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+		}
+		if _, err = reader.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+			return 0, uploadID, err
+		}
+		fmt.Fprintln(os.Stderr, "restarting upload from the start")
+	}
+}
+
+// abortUpload - aborts a multipart upload through the endpoints of the
+// environment.
+func abortUpload(bucketName, objectName, uploadID string) error {
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	return e.backend().AbortMultipartUpload(bucketName, objectName, uploadID)
+}
+
+// putStreamProtocol - uploads the stream with the protocol suiting the
+// provider and the source, size is negative if unknown. Explicit plans
+// are only followed by plain multipart uploads.
+func putStreamProtocol(e *endpoints, bucketName, objectName string, reader io.Reader, size int64, metaData map[string][]string, progress ProgressFunc, plan PartPlan) (n int64, uploadID string, err error) {
+	s := e.site()
+	// Only multipart uploads can be held back until scanned or their
+	// digest and size verified, and only parts read in order can be.
+	held := os.Getenv("SCAN_URL") != "" || e.expectSHA256 != "" || e.sizeHint != nil
+	// Sources readable at any offset need no buffers.
+	_, _, readerAt := readerAtSource(reader)
+	readerAt = readerAt && size > 0 && !held
+	if plan != nil {
+		if readerAt {
+			return putStreamAt(e, bucketName, objectName, reader, size, metaData, progress, plan)
+		}
+		return putStreamOnce(e, bucketName, objectName, reader, metaData, progress, plan)
+	}
+	if isGCS() && !held {
+		// Clients of a single core have no site to talk to directly.
+		if gcsResumable() && s.Address != "" {
+			return putStreamResumable(s, bucketName, objectName, reader, metaData, progress)
+		}
+		n, uploadID, err = putStreamOnce(e, bucketName, objectName, reader, metaData, progress, nil)
+		if err != nil && uploadID == "" && s.Address != "" && errorCode(err) == "NotImplemented" {
+			// Nothing was read from the stream yet.
+			fmt.Fprintln(os.Stderr, "multipart uploads not supported, using a resumable upload")
+			return putStreamResumable(s, bucketName, objectName, reader, metaData, progress)
+		}
+		return n, uploadID, err
+	}
+	// Streams of unknown size are only signed in chunks when their parts
+	// are not grown or rotated at the part limit.
+	policy, _ := partLimitPolicy()
+	chunked := size > 0 || (size < 0 && policy == partLimitFail)
+	if e.s3() && !held && chunked && streamingSignature() && !s.anonymous() && !isExpressBucket(bucketName) {
+		return putStreamStreaming(e, bucketName, objectName, reader, size, metaData, progress)
+	}
+	if readerAt {
+		return putStreamAt(e, bucketName, objectName, reader, size, metaData, progress, nil)
+	}
+	return putStreamOnce(e, bucketName, objectName, reader, metaData, progress, nil)
+}
+
+// putStreamOnce - uploads the stream with a single multipart upload, in
+// the parts of plan if not nil. With PART_LIMIT_POLICY=rotate, streams
+// longer than the part limit continue in further uploads, n is then the
+// size of all of them and uploadID that of the last one.
+func putStreamOnce(e *endpoints, bucketName, objectName string, reader io.Reader, metaData map[string][]string, progress ProgressFunc, plan PartPlan) (n int64, uploadID string, err error) {
+	limitPolicy, err := partLimitPolicy()
+	if err != nil {
+		return 0, "", err
+	}
+	if plan == nil && limitPolicy == partLimitGrow {
+		// The parts can't be found from the first one, as with others.
+		parallel, err := e.parallelParts()
+		if err != nil {
+			return 0, "", err
+		}
+		limit, err := partGrowLimit(parallel)
+		if err != nil {
+			return 0, "", err
+		}
+		grown := make(map[string][]string, len(metaData)+1)
+		for k, v := range metaData {
+			grown[k] = v
+		}
+		grown[partGrowthMeta] = []string{strconv.FormatInt(limit, 10)}
+		metaData = grown
+	}
 
-	c.Client = client
-	fmt.Println("minio.NewCore OK")
+	for seq := 1; ; seq++ {
+		name := rotatedName(objectName, seq)
+		// Get the upload id of a previously partially uploaded object or initiate a new multipart upload
+		err = e.initiate(func(b Backend) (err error) {
+			uploadID, err = b.NewMultipartUpload(bucketName, name, metaData)
+			return err
+		})
+		if err != nil {
+			err = wrapS3Error("NewMultipartUpload", err)
+			fmt.Fprintln(os.Stderr, "NewMultipartUpload failed", err)
+			return n, "", err
+		}
 
+		// Fills in the common fields of progress events.
+		emit := func(ev ProgressEvent) {
+			ev.Time = time.Now()
+			ev.Bucket = bucketName
+			ev.Object = name
+			ev.UploadID = uploadID
+			progress(ev)
+		}
+		emit(ProgressEvent{Type: UploadStarted})
+		started := time.Now()
+		source := reader
+		var digest *hashingReader
+		if e.rotated != nil {
+			digest = newHashingReader(reader)
+			source = digest
+		}
+		var size int64
+		e.full = false
+		size, uploadID, err = putParts(e, bucketName, name, uploadID, source, progress, plan, nil)
+		n += size
+		if err != nil {
+			return n, uploadID, err
+		}
+
+		// The rest of the stream, if any, is read past the digest of
+		// this upload.
+		more := false
+		if e.full {
+			var b [1]byte
+			nr, rErr := io.ReadFull(reader, b[:])
+			if nr == 1 {
+				reader, more = io.MultiReader(bytes.NewReader(b[:]), reader), true
+			} else if rErr != io.EOF {
+				return n, uploadID, rErr
+			}
+		}
+		if digest != nil && (more || seq > 1) {
+			if err = e.rotated(name, size, time.Since(started), digest.sum()); err != nil {
+				return n, uploadID, err
+			}
+		}
+		if !more {
+			return n, uploadID, nil
+		}
+		fmt.Fprintln(os.Stderr, name, "reached the part limit, the stream continues in", rotatedName(objectName, seq+1))
+	}
+}
+
+// resumePoint - the parts of an interrupted upload found intact, which
+// the upload continues after.
+type resumePoint struct {
+	parts  map[int]minio.ObjectPart
+	next   int
+	offset int64
+}
+
+// putParts - uploads the stream as the parts of an initiated multipart
+// upload and completes it. A non-nil from continues an interrupted
+// upload, reader then starts at from.offset.
+func putParts(e *endpoints, bucketName, objectName, uploadID string, reader io.Reader, progress ProgressFunc, plan PartPlan, from *resumePoint) (int64, string, error) {
 	// Total data read and written to server. should be equal to 'size' at the end of the call.
 	var totalUploadedSize int64
 
 	// Complete multipart upload.
 	var complMultipartUpload completeMultipartUpload
 
-	// Get the upload id of a previously partially uploaded object or initiate a new multipart upload
-	uploadID, err := c.NewMultipartUpload(bucketName, objectName, metaData)
+	wd, err := startWatchdog(uploadID)
 	if err != nil {
-		fmt.Println("NewMultipartUpload failed", err)
-		return 0, err
+		return 0, uploadID, err
+	}
+	defer wd.stop()
+
+	// Fills in the common fields of progress events.
+	emit := func(ev ProgressEvent) {
+		ev.Time = time.Now()
+		ev.Bucket = bucketName
+		ev.Object = objectName
+		ev.UploadID = uploadID
+		wd.observe(ev)
+		progress(ev)
+	}
+
+	// Parts are scanned in order as they are read, so the scanner sees
+	// the whole stream before the upload is completed.
+	scan, err := newScanSession(objectName)
+	if err != nil {
+		return 0, uploadID, err
+	}
+	if scan != nil {
+		defer scan.close()
+	}
+
+	// The digest given by the producer is checked before completing.
+	var digest *hashingReader
+	if e.expectSHA256 != "" {
+		if from != nil {
+			return 0, uploadID, fmt.Errorf("The expected digest can't be verified when resuming an upload")
+		}
+		digest = newHashingReader(reader)
+		reader = digest
 	}
 
 	size := int64(-1)
 
-	// Calculate the optimal parts info for a given size.
-	totalPartsCount, partSize, _, err := optimalPartInfo(size)
+	// Calculate the optimal parts info for a given size, or the size
+	// expected.
+	totalPartsCount, partSize, _, err := e.partInfo(e.sizeHint.planned(size))
 	if err != nil {
-		fmt.Println("optimalPartInfo failed")
+		fmt.Fprintln(os.Stderr, "optimalPartInfo failed")
 
-		return 0, err
+		return 0, uploadID, err
+	}
+	// The stream may be longer than planned, up to the most parts an
+	// upload has.
+	totalPartsCount = maxPartsCount
+	if plan != nil {
+		totalPartsCount = len(plan)
+	}
+	limitPolicy, err := partLimitPolicy()
+	if err != nil {
+		return 0, uploadID, err
+	}
+	basePartSize := partSize
+
+	parallel, err := e.parallelParts()
+	if err != nil {
+		return 0, uploadID, err
+	}
+	growLimit, err := partGrowLimit(parallel)
+	if err != nil {
+		return 0, uploadID, err
 	}
 
 	// Initialize parts uploaded map.
@@ -139,71 +575,260 @@ func PutStream(bucketName, objectName string, reader io.Reader, metaData map[str
 
 	// Part number always starts with '1'.
 	partNumber := 1
+	var offset int64
+	var eof bool
+	// Uploads that must never be completed, nor resumed, are aborted.
+	var discard bool
+	if from != nil {
+		for number, part := range from.parts {
+			partsInfo[number] = part
+		}
+		partNumber, offset = from.next, from.offset
+		totalUploadedSize = from.offset
+	}
+
+	// Parts are read while up to 'parallel' previous parts are uploading,
+	// each of them holding on to one of the temporary buffers.
+	freeBuffers := make(chan *bytes.Buffer, parallel+1)
+	for i := 0; i < parallel+1; i++ {
+		freeBuffers <- new(bytes.Buffer)
+	}
+
+	var (
+		mu        sync.Mutex
+		uploadErr error
+		wg        sync.WaitGroup
+
+		// Time spent in each stage, summed over the parts.
+		readTime, hashTime, uploadTime time.Duration
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr
+	}
 
-	// Initialize a temporary buffer.
-	tmpBuffer := new(bytes.Buffer)
+	jobs := make(chan partJob)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				// Proceed to upload the part.
+				var objPart minio.ObjectPart
+				var partUploadTime time.Duration
+				err := failed()
+				if err == nil {
+					uploadStart := time.Now()
+					emit(ProgressEvent{Type: PartStarted, PartNumber: job.number, PartSize: job.size, PartOffset: job.offset})
+					var attempt int
+					var lastErr error
+					err = e.do(func(b Backend) error {
+						if attempt++; attempt > 1 {
+							emit(ProgressEvent{Type: Retry, PartNumber: job.number, PartSize: job.size, PartOffset: job.offset, Err: lastErr})
+						}
+						// Parts are retried from the start of the buffer, again
+						// if the watchdog restarted them.
+						for {
+							generation := requestWatch.current(uploadID)
+							objPart, lastErr = b.PutObjectPart(bucketName, objectName, uploadID, job.number,
+								job.size, bytes.NewReader(job.buffer.Bytes()), job.hashSums["md5"], job.hashSums["sha256"])
+							if lastErr == nil || !requestWatch.cancelledSince(uploadID, generation) {
+								return lastErr
+							}
+							if lErr := e.limits.spendRetry(lastErr); lErr != nil {
+								return lErr
+							}
+							emit(ProgressEvent{Type: Retry, PartNumber: job.number, PartSize: job.size, PartOffset: job.offset, Err: lastErr})
+						}
+					})
+					partUploadTime = time.Since(uploadStart)
+				}
+
+				// Reset the temporary buffer.
+				job.buffer.Reset()
+				freeBuffers <- job.buffer
+
+				mu.Lock()
+				if err != nil {
+					if uploadErr == nil {
+						uploadErr = wrapS3Error("PutObjectPart", err)
+						fmt.Fprintln(os.Stderr, "PutObjectPart failed", uploadErr)
+					}
+					mu.Unlock()
+					continue
+				}
+
+				// Save successfully uploaded part metadata.
+				partsInfo[job.number] = objPart
+
+				// Save successfully uploaded size.
+				totalUploadedSize += job.size
+				uploaded := totalUploadedSize
+				readTime += job.readTime
+				hashTime += job.hashTime
+				uploadTime += partUploadTime
+				mu.Unlock()
+
+				emit(ProgressEvent{Type: PartCompleted, PartNumber: job.number, PartSize: job.size, PartOffset: job.offset, Bytes: uploaded,
+					ReadTime: job.readTime, HashTime: job.hashTime, UploadTime: partUploadTime,
+					ETag: objPart.ETag, SHA256: hex.EncodeToString(job.hashSums["sha256"])})
+			}
+		}()
+	}
 
-	for partNumber <= totalPartsCount {
+	for partNumber <= totalPartsCount && failed() == nil {
+		if err = e.limits.checkDeadline(); err != nil {
+			break
+		}
 		// Choose hash algorithms to be calculated by hashCopyN, avoid sha256
 		// with non-v4 signature request or HTTPS connection
 		hashSums := make(map[string][]byte)
-		hashAlgos := make(map[string]hash.Hash)
-		hashAlgos["md5"] = md5.New()
-		hashAlgos["sha256"] = sha256.New()
-
-		// Calculates hash sums while copying partSize bytes into tmpBuffer.
-		prtSize, rErr := hashCopyN(hashAlgos, hashSums, tmpBuffer, reader, partSize)
-		if rErr != nil && rErr != io.EOF {
-			fmt.Println("io.EOF failed")
-
-			return 0, rErr
+		hashAlgos, hErr := partHashAlgos()
+		if hErr != nil {
+			err = hErr
+			break
 		}
 
-		// Proceed to upload the part.
-		var objPart minio.ObjectPart
-		objPart, err = c.PutObjectPart(bucketName, objectName, uploadID, partNumber,
-			prtSize, tmpBuffer, hashSums["md5"], hashSums["sha256"])
-		if err != nil {
-			fmt.Println("PutObjectPart failed")
-
-			// Reset the temporary buffer upon any error.
-			tmpBuffer.Reset()
-			return totalUploadedSize, err
+		if plan != nil {
+			partSize = plan[partNumber-1].Size
+		} else if limitPolicy == partLimitGrow {
+			partSize = grownPartSize(basePartSize, partNumber, growLimit)
+		}
+		if plan == nil && partNumber == maxPartsCount*9/10 {
+			fmt.Fprintf(os.Stderr, "warning: %s is at part %d of at most %d, of %d bytes\n", objectName, partNumber, maxPartsCount, partSize)
 		}
 
-		// Save successfully uploaded part metadata.
-		partsInfo[partNumber] = objPart
+		// Calculates hash sums while copying partSize bytes into a temporary
+		// buffer, or after reading it with parallel hashing.
+		tmpBuffer := <-freeBuffers
+		var prtSize int64
+		var rErr error
+		var partReadTime, partHashTime time.Duration
+		readStart := time.Now()
+		if parallelHash() {
+			prtSize, rErr = io.CopyN(tmpBuffer, reader, partSize)
+			partReadTime = time.Since(readStart)
+			if rErr == nil || rErr == io.EOF {
+				hashBytes(hashAlgos, hashSums, tmpBuffer.Bytes())
+			}
+			partHashTime = time.Since(readStart) - partReadTime
+		} else {
+			timed := &timedReader{r: reader}
+			prtSize, rErr = hashCopyN(hashAlgos, hashSums, tmpBuffer, timed, partSize)
+			partReadTime = timed.took
+			partHashTime = time.Since(readStart) - partReadTime
+		}
+		if rErr != nil && rErr != io.EOF {
+			fmt.Fprintln(os.Stderr, "io.EOF failed")
 
-		// Reset the temporary buffer.
-		tmpBuffer.Reset()
+			err = rErr
+			break
+		}
+		if plan != nil && prtSize != partSize {
+			err = fmt.Errorf("Stream ends at offset %d, within planned part %d", offset+prtSize, partNumber)
+			break
+		}
+		if err = e.sizeHint.over(offset + prtSize); err != nil {
+			break
+		}
+		if scan != nil {
+			if err = scan.write(tmpBuffer.Bytes()); err != nil {
+				// The rest of the stream could not be scanned.
+				err = fmt.Errorf("Content scanner failed: %v", err)
+				discard = true
+				break
+			}
+		}
 
-		// Save successfully uploaded size.
-		totalUploadedSize += prtSize
+		jobs <- partJob{
+			number:   partNumber,
+			offset:   offset,
+			size:     prtSize,
+			buffer:   tmpBuffer,
+			hashSums: hashSums,
+			readTime: partReadTime,
+			hashTime: partHashTime,
+		}
 
 		// Increment part number.
 		partNumber++
+		offset += prtSize
 
 		// For unknown size, Read EOF we break away.
 		// We do not have to upload till totalPartsCount.
 		if size < 0 && rErr == io.EOF {
+			eof = true
 			break
 		}
 	}
 
+	// Streams longer than the most parts an upload has must not be
+	// completed with their start only. Rotated streams go on in the
+	// next upload, which looks for the rest.
+	if plan == nil && !eof && err == nil && failed() == nil {
+		if limitPolicy == partLimitRotate && digest == nil && e.sizeHint == nil && from == nil {
+			e.full = true
+		} else {
+			var b [1]byte
+			if nr, rErr := io.ReadFull(reader, b[:]); nr == 1 {
+				err = fmt.Errorf("Stream is longer than %d parts, the most an upload has, of up to %d bytes: set a larger part size, or PART_LIMIT_POLICY=grow or rotate", maxPartsCount, partSize)
+				discard = true
+			} else if rErr != io.EOF {
+				err = rErr
+			}
+		}
+	}
+
+	// The stream must end with the plan.
+	if plan != nil && err == nil && failed() == nil {
+		var b [1]byte
+		if _, rErr := io.ReadFull(reader, b[:]); rErr == nil {
+			err = fmt.Errorf("Stream is longer than the planned %d bytes", offset)
+		}
+	}
+
+	// Wait for the parts in flight.
+	close(jobs)
+	wg.Wait()
+	if discard {
+		if aErr := e.backend().AbortMultipartUpload(bucketName, objectName, uploadID); aErr != nil {
+			fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+		}
+	}
+	if err != nil {
+		return 0, uploadID, err
+	}
+	if err = failed(); err != nil {
+		return totalUploadedSize, uploadID, err
+	}
+
 	// Verify if we uploaded all the data.
 	if size > 0 {
 		if totalUploadedSize != size {
-			return totalUploadedSize, io.ErrUnexpectedEOF
+			return totalUploadedSize, uploadID, io.ErrUnexpectedEOF
 		}
 	}
 
 	// Loop over total uploaded parts to save them in
 	// Parts array before completing the multipart request.
+	var listed map[int]minio.ObjectPart
 	for i := 1; i < partNumber; i++ {
 		part, ok := partsInfo[i]
+		if !ok && listed == nil && e.s3() {
+			// Parts missing in the map are looked up on the server.
+			if listed, err = listedParts(e.core(), bucketName, objectName, uploadID); err != nil {
+				return 0, uploadID, err
+			}
+		}
+		if !ok {
+			if part, ok = listed[i]; ok {
+				fmt.Fprintln(os.Stderr, "part", i, "recovered from ListParts")
+			}
+		}
 		if !ok {
-			fmt.Println("partsInfo failed")
-			return 0, fmt.Errorf("Missing part number %d", i)
+			fmt.Fprintln(os.Stderr, "partsInfo failed")
+			return 0, uploadID, fmt.Errorf("Missing part number %d", i)
 		}
 		complMultipartUpload.Parts = append(complMultipartUpload.Parts,
 			minio.CompletePart{
@@ -212,14 +837,160 @@ func PutStream(bucketName, objectName string, reader io.Reader, metaData map[str
 			})
 	}
 
+	if scan != nil {
+		if err = scan.result(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			// Flagged content, or content not scanned whole, must never
+			// become visible.
+			if aErr := e.backend().AbortMultipartUpload(bucketName, objectName, uploadID); aErr != nil {
+				fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+			}
+			return totalUploadedSize, uploadID, err
+		}
+	}
+
+	if err = e.sizeHint.check(totalUploadedSize); err != nil {
+		if aErr := e.backend().AbortMultipartUpload(bucketName, objectName, uploadID); aErr != nil {
+			fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+		}
+		return totalUploadedSize, uploadID, err
+	}
+	if digest != nil {
+		if sum := digest.sum(); sum != e.expectSHA256 {
+			// Mismatched data must never become visible.
+			if aErr := e.backend().AbortMultipartUpload(bucketName, objectName, uploadID); aErr != nil {
+				fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+			}
+			return totalUploadedSize, uploadID, fmt.Errorf("Stream has sha256 %s, the producer expected %s, upload aborted", sum, e.expectSHA256)
+		}
+	}
+
+	emit(ProgressEvent{Type: ReadCompleted, Bytes: totalUploadedSize})
+
 	// Sort all completed parts.
 	sort.Sort(completedParts(complMultipartUpload.Parts))
-	err = c.CompleteMultipartUpload(bucketName, objectName, uploadID, complMultipartUpload.Parts)
+	err = completeUpload(e, bucketName, objectName, uploadID, complMultipartUpload.Parts)
+	if err != nil {
+		err = wrapS3Error("CompleteMultipartUpload", err)
+		fmt.Fprintln(os.Stderr, "CompleteMultipartUpload failed", err)
+	} else {
+		emit(ProgressEvent{Type: Completed, Bytes: totalUploadedSize, ETag: completedETag(complMultipartUpload.Parts),
+			ReadTime: readTime, HashTime: hashTime, UploadTime: uploadTime})
+	}
 
 	// Return final size.
-	return totalUploadedSize, err
+	return totalUploadedSize, uploadID, err
 }
 
 func main() {
-	PutStream("stream-test", "your-object", os.Stdin, map[string][]string{})
+	flag.Parse()
+
+	// Without a command, stdin is uploaded as before.
+	args := []string{"put", "your-object"}
+	if flag.NArg() > 0 {
+		args = flag.Args()
+	}
+
+	// Long running commands can be diagnosed in place.
+	if debugCommands[args[0]] {
+		if err := startDebugListener(); err != nil {
+			fmt.Fprintln(os.Stderr, args[0], "failed", err)
+			os.Exit(1)
+		}
+	}
+
+	var err error
+	switch args[0] {
+	case "put":
+		err = putMain(args[1:])
+	case "watch":
+		err = watchMain(args[1:])
+	case "sync":
+		err = syncMain(args[1:])
+	case "put-dir":
+		err = putDirMain(args[1:])
+	case "put-batch":
+		err = putBatchMain(args[1:])
+	case "put-multi":
+		err = putMultiMain(args[1:])
+	case "consume-kafka":
+		err = consumeKafkaMain(args[1:])
+	case "dump-pg", "dump-mysql":
+		err = dumpMain(args[0], args[1:])
+	case "snapshot-docker":
+		err = snapshotDockerMain(args[1:])
+	case "send-snapshot":
+		err = sendSnapshotMain(args[1:])
+	case "recv-snapshot":
+		err = recvSnapshotMain(args[1:])
+	case "enqueue":
+		err = enqueueMain(args[1:])
+	case "queue-worker":
+		err = queueWorkerMain(args[1:])
+	case "serve":
+		err = serveMain(args[1:])
+	case "verify-manifest":
+		err = verifyManifestMain(args[1:])
+	case "verify-restore":
+		err = verifyRestoreMain(args[1:])
+	case "export-evidence":
+		err = exportEvidenceMain(args[1:])
+	case "supervise":
+		err = superviseMain(args[1:])
+	case "daemon":
+		err = daemonMain(args[1:])
+	case "resume":
+		err = resumeMain(args[1:])
+	case "salvage":
+		err = salvageMain(args[1:])
+	case "complete":
+		err = completeMain(args[1:])
+	case "history":
+		err = historyMain(args[1:])
+	case "etag":
+		err = etagMain(args[1:])
+	case "compare":
+		err = compareMain(args[1:])
+	case "stat":
+		err = statMain(args[1:])
+	case "rm":
+		err = rmMain(args[1:])
+	case "du":
+		err = duMain(args[1:])
+	case "ls":
+		err = lsMain(args[1:])
+	case "select":
+		err = selectMain(args[1:])
+	case "grep":
+		err = grepMain(args[1:])
+	case "cat":
+		err = catMain(args[1:])
+	case "head":
+		err = headMain(args[1:])
+	case "tail":
+		err = tailMain(args[1:])
+	case "image":
+		err = imageMain(args[1:])
+	case "mount":
+		err = mountMain(args[1:])
+	case "get-dir":
+		err = getDirMain(args[1:])
+	case "get":
+		err = getMain(args[1:])
+	case "repair":
+		err = repairMain(args[1:])
+	case "status":
+		err = statusMain(args[1:])
+	case "preflight":
+		err = preflightMain(args[1:])
+	case "whoami", "check-auth":
+		err = checkAuthMain(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command", args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, args[0], "failed", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Manifest formats, chosen with MANIFEST.
+const (
+	manifestSHA256SUMS = "sha256sums"
+	manifestCSV        = "csv"
+	manifestJSON       = "json"
+)
+
+// manifestEntry - the digest of an object, keys are relative to the
+// prefix of the manifest.
+type manifestEntry struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifestFormat - returns the manifest format set with MANIFEST, empty
+// if uploads are not recorded in a manifest.
+func manifestFormat() (string, error) {
+	switch f := os.Getenv("MANIFEST"); f {
+	case "", manifestSHA256SUMS, manifestCSV, manifestJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("Unknown MANIFEST %q", f)
+	}
+}
+
+// manifestName - returns the manifest object of the prefix holding
+// objectName.
+func manifestName(objectName, format string) string {
+	name := "SHA256SUMS"
+	switch format {
+	case manifestCSV:
+		name = "MANIFEST.csv"
+	case manifestJSON:
+		name = "MANIFEST.json"
+	}
+	if dir := path.Dir(objectName); dir != "." {
+		return dir + "/" + name
+	}
+	return name
+}
+
+// parseManifest - parses a manifest, sizes are -1 in SHA256SUMS files
+// which do not record them.
+func parseManifest(format string, data []byte) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	switch format {
+	case manifestJSON:
+		err := json.Unmarshal(data, &entries)
+		return entries, err
+	case manifestCSV:
+		records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, r := range records {
+			if i == 0 || len(r) != 3 {
+				continue // header
+			}
+			size, err := strconv.ParseInt(r[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, manifestEntry{Key: r[0], Size: size, SHA256: r[2]})
+		}
+		return entries, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// '<digest>  <name>', as sha256sum prints.
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) == 2 {
+			entries = append(entries, manifestEntry{Key: fields[1], Size: -1, SHA256: fields[0]})
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// formatManifest - returns the manifest of entries sorted by key.
+func formatManifest(format string, entries []manifestEntry) ([]byte, error) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	var b bytes.Buffer
+	switch format {
+	case manifestJSON:
+		return json.MarshalIndent(entries, "", "  ")
+	case manifestCSV:
+		w := csv.NewWriter(&b)
+		w.Write([]string{"key", "size", "sha256"})
+		for _, e := range entries {
+			w.Write([]string{e.Key, strconv.FormatInt(e.Size, 10), e.SHA256})
+		}
+		w.Flush()
+		return b.Bytes(), w.Error()
+	}
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s  %s\n", e.SHA256, e.Key)
+	}
+	return b.Bytes(), nil
+}
+
+// updateManifest - adds or replaces the entry of an object in the
+// manifest of its prefix. Concurrent uploads to the same prefix may lose
+// each other's updates.
+func updateManifest(c minio.Core, bucketName, objectName, format string, size int64, sum string) error {
+	name := manifestName(objectName, format)
+	var entries []manifestEntry
+	data, err := getBytes(c, bucketName, name)
+	if err == nil {
+		if entries, err = parseManifest(format, data); err != nil {
+			return fmt.Errorf("Manifest %s unreadable: %v", name, err)
+		}
+	} else if !isNoSuchKey(err) {
+		return err
+	}
+
+	entry := manifestEntry{Key: path.Base(objectName), Size: size, SHA256: sum}
+	replaced := false
+	for i := range entries {
+		if entries[i].Key == entry.Key {
+			entries[i], replaced = entry, true
+		}
+	}
+	if !replaced {
+		entries = append(entries, entry)
+	}
+
+	if data, err = formatManifest(format, entries); err != nil {
+		return err
+	}
+	return putBytes(c, bucketName, name, data, "text/plain")
+}
+
+// hashingReader - computes the sha256 of everything read.
+type hashingReader struct {
+	io.Reader
+	h     hash.Hash
+	n     int64
+	valid bool
+}
+
+func newHashingReader(reader io.Reader) *hashingReader {
+	return &hashingReader{Reader: reader, h: sha256.New(), valid: true}
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// sum - returns the hex digest, empty if the stream was not read once
+// from start to end.
+func (r *hashingReader) sum() string {
+	if !r.valid {
+		return ""
+	}
+	return hex.EncodeToString(r.h.Sum(nil))
+}
+
+// hashingReadSeeker - a hashingReader keeping the source seekable, so
+// uploads can still be restarted from the start.
+type hashingReadSeeker struct {
+	*hashingReader
+	seeker io.Seeker
+	start  int64
+}
+
+// newHashingSource - wraps reader, keeping it seekable if it is.
+func newHashingSource(reader io.Reader) (*hashingReader, io.Reader, error) {
+	r := newHashingReader(reader)
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return r, r, nil
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, &hashingReadSeeker{hashingReader: r, seeker: seeker, start: start}, nil
+}
+
+func (r *hashingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.seeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	switch {
+	case pos == r.start:
+		r.h.Reset()
+		r.n = 0
+		r.valid = true
+	case pos != r.start+r.n:
+		// Bytes read again cannot be taken out of the hash.
+		r.valid = false
+	}
+	return pos, nil
+}
+
+// verifyManifestMain - implements the 'verify-manifest' command, which
+// downloads every object of a manifest and checks its size and digest.
+func verifyManifestMain(args []string) error {
+	flags := flag.NewFlagSet("verify-manifest", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket holding the manifest")
+	format := flags.String("format", manifestSHA256SUMS, "manifest format: sha256sums, csv or json")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: verify-manifest [-bucket name] [-format f] <prefix>")
+	}
+	prefix := strings.TrimSuffix(flags.Arg(0), "/")
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	name := manifestName(prefix+"/x", *format)
+	if prefix == "" {
+		name = manifestName("x", *format)
+	}
+	data, err := getBytes(c, *bucketName, name)
+	if err != nil {
+		return wrapS3Error("GetObject", err)
+	}
+	entries, err := parseManifest(*format, data)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, e := range entries {
+		objectName := e.Key
+		if prefix != "" {
+			objectName = prefix + "/" + e.Key
+		}
+		if err := verifyObject(c, *bucketName, objectName, e); err != nil {
+			failed++
+			fmt.Printf("%s: FAILED %v\n", objectName, err)
+			continue
+		}
+		fmt.Printf("%s: OK\n", objectName)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects failed verification", failed, len(entries))
+	}
+	return nil
+}
+
+// verifyObject - checks an object against its manifest entry.
+func verifyObject(c minio.Core, bucketName, objectName string, e manifestEntry) error {
+	reader, _, err := c.GetObject(bucketName, objectName, minio.NewGetReqHeaders())
+	if err != nil {
+		return wrapS3Error("GetObject", err)
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, reader)
+	if err != nil {
+		return err
+	}
+	if e.Size >= 0 && n != e.Size {
+		return fmt.Errorf("size %d, expected %d", n, e.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != e.SHA256 {
+		return fmt.Errorf("sha256 %s, expected %s", sum, e.SHA256)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// isHeaderSafe - returns true if v can be sent as a header value as is.
+// Headers are ASCII, servers mangle or refuse other bytes.
+func isHeaderSafe(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e {
+			return false
+		}
+	}
+	// Values looking encoded already are encoded again, so that they
+	// read back unchanged.
+	return !strings.HasPrefix(v, "=?")
+}
+
+// encodeMetaValue - returns v as an RFC 2047 encoded word if it is not
+// header safe, as AWS does for the metadata it returns.
+func encodeMetaValue(v string) string {
+	if isHeaderSafe(v) {
+		return v
+	}
+	// The mime package leaves some of these, such as tabs, unencoded.
+	return "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(v)) + "?="
+}
+
+// decodeMetaValue - returns v with RFC 2047 encoded words decoded,
+// values that don't decode are returned unchanged.
+func decodeMetaValue(v string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return decoded
+}
+
+// encodeMetadata - returns a copy of metaData with the values of user
+// metadata encoded, such as the non ASCII file names of link targets.
+func encodeMetadata(metaData map[string][]string) map[string][]string {
+	encoded := make(map[string][]string, len(metaData))
+	for k, values := range metaData {
+		if !strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			encoded[k] = values
+			continue
+		}
+		encoded[k] = make([]string, len(values))
+		for i, v := range values {
+			encoded[k][i] = encodeMetaValue(v)
+		}
+	}
+	return encoded
+}
+
+// metaValue - returns the decoded value of the user metadata name of an
+// object, such as 'X-Amz-Meta-Symlink-Target'.
+func metaValue(h http.Header, name string) string {
+	return decodeMetaValue(h.Get(name))
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+// isPrintableASCII - reports whether v can be sent as a header value.
+func isPrintableASCII(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMetaValueRoundTrip(t *testing.T) {
+	for _, v := range []string{"plain", "naïve.txt", "tab\there", "=?UTF-8?B?eA==?=", "日本語/リンク"} {
+		encoded := encodeMetaValue(v)
+		if !isPrintableASCII(encoded) {
+			t.Errorf("encodeMetaValue(%q) = %q, not printable ASCII", v, encoded)
+		}
+		if decoded := decodeMetaValue(encoded); decoded != v {
+			t.Errorf("decodeMetaValue(encodeMetaValue(%q)) = %q", v, decoded)
+		}
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	metaData := map[string][]string{
+		"Content-Type":               {"text/plain"},
+		"X-Amz-Meta-Symlink-Target":  {"café/menu.txt"},
+		"X-Amz-Meta-Hardlink-Target": {"plain.txt"},
+	}
+	encoded := encodeMetadata(metaData)
+	if got := encoded["Content-Type"][0]; got != "text/plain" {
+		t.Errorf("Content-Type = %q, want it unchanged", got)
+	}
+	if got := encoded["X-Amz-Meta-Hardlink-Target"][0]; got != "plain.txt" {
+		t.Errorf("ASCII target = %q, want it unchanged", got)
+	}
+	got := encoded["X-Amz-Meta-Symlink-Target"][0]
+	if !isPrintableASCII(got) || decodeMetaValue(got) != "café/menu.txt" {
+		t.Errorf("non ASCII target encoded as %q", got)
+	}
+	if metaData["X-Amz-Meta-Symlink-Target"][0] != "café/menu.txt" {
+		t.Errorf("encodeMetadata changed its argument")
+	}
+}
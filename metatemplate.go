@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// metadataConfig - the metadata every upload is enriched with, set in
+// the config file:
+//
+//	{
+//	  "metadataFacts": true,
+//	  "metadataTemplates": {"pipeline": "{{env \"PIPELINE\"}}/{{.Hostname}}"}
+//	}
+//
+// Facts are the host, its OS and kernel, the tool version and the git
+// SHA of the producer, from PRODUCER_GIT_SHA. Templates are Go templates
+// of metadataFields, each becoming an x-amz-meta-<name>. Metadata set by
+// the upload itself is kept.
+type metadataConfig struct {
+	Facts     bool              `json:"metadataFacts"`
+	Templates map[string]string `json:"metadataTemplates"`
+}
+
+// metadataFields - the data of metadata templates.
+type metadataFields struct {
+	Hostname string
+	OS       string
+	Arch     string
+	Kernel   string
+	Version  string
+	Bucket   string
+	Object   string
+	Time     time.Time
+}
+
+var (
+	metaConfigOnce sync.Once
+	metaConfigErr  error
+	metaConfig     metadataConfig
+	metaTemplates  map[string]*template.Template
+)
+
+// loadMetadataConfig - reads the metadata settings of the config file
+// once, none if there is no config file.
+func loadMetadataConfig() error {
+	metaConfigOnce.Do(func() {
+		path := configFile()
+		if path == "" {
+			return
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return
+		} else if err != nil {
+			metaConfigErr = err
+			return
+		}
+		if err = json.Unmarshal(data, &metaConfig); err != nil {
+			metaConfigErr = fmt.Errorf("%s: %v", path, err)
+			return
+		}
+		metaTemplates = make(map[string]*template.Template, len(metaConfig.Templates))
+		funcs := template.FuncMap{"env": os.Getenv}
+		for name, text := range metaConfig.Templates {
+			if !isHeaderSafe(name) || strings.ContainsAny(name, " :") {
+				metaConfigErr = fmt.Errorf("%s: invalid metadata name %q", path, name)
+				return
+			}
+			t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+			if err != nil {
+				metaConfigErr = fmt.Errorf("%s: metadata template %s: %v", path, name, err)
+				return
+			}
+			metaTemplates[name] = t
+		}
+	})
+	return metaConfigErr
+}
+
+// kernelRelease - returns the kernel release of the host, empty if
+// unknown.
+func kernelRelease() string {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// templateMetadata - returns metaData enriched with the host facts and
+// the templated values of the config file.
+func templateMetadata(bucketName, objectName string, metaData map[string][]string) (map[string][]string, error) {
+	if err := loadMetadataConfig(); err != nil {
+		return nil, err
+	}
+	if !metaConfig.Facts && len(metaTemplates) == 0 {
+		return metaData, nil
+	}
+	hostname, _ := os.Hostname()
+	fields := metadataFields{
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Kernel:   kernelRelease(),
+		Version:  toolVersion,
+		Bucket:   bucketName,
+		Object:   objectName,
+		Time:     time.Now().UTC(),
+	}
+
+	enriched := make(map[string][]string, len(metaData)+len(metaTemplates)+5)
+	for k, v := range metaData {
+		enriched[k] = v
+	}
+	add := func(name, value string) {
+		key := http.CanonicalHeaderKey("X-Amz-Meta-" + name)
+		if _, ok := enriched[key]; !ok && value != "" {
+			enriched[key] = []string{value}
+		}
+	}
+	for name, t := range metaTemplates {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, fields); err != nil {
+			return nil, fmt.Errorf("Metadata template %s: %v", name, err)
+		}
+		add(name, buf.String())
+	}
+	if metaConfig.Facts {
+		add("Host", fields.Hostname)
+		add("Os", fields.OS+"/"+fields.Arch)
+		add("Kernel", fields.Kernel)
+		add("Tool-Version", fields.Version)
+		add("Producer-Git-Sha", os.Getenv("PRODUCER_GIT_SHA"))
+	}
+	return enriched, nil
+}
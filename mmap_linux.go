@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapRegion - maps length bytes of f from offset for reading, returning
+// them and a function unmapping them.
+func mmapRegion(f *os.File, offset, length int64) ([]byte, func() error, error) {
+	page := int64(os.Getpagesize())
+	start := offset &^ (page - 1)
+	data, err := syscall.Mmap(int(f.Fd()), start, int(offset-start+length), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Read ahead, hashing walks the region once from the start.
+	syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+	syscall.Madvise(data, syscall.MADV_WILLNEED)
+	return data[offset-start:], func() error { return syscall.Munmap(data) }, nil
+}
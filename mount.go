@@ -0,0 +1,289 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	minio "github.com/minio/minio-go"
+)
+
+// mountListTTL - how long directory listings are reused.
+const mountListTTL = 30 * time.Second
+
+// blockKey - a block of an object version.
+type blockKey struct {
+	object string
+	etag   string
+	index  int64
+}
+
+// blockCache - an LRU cache of fixed size object blocks, fetched with
+// ranged GETs.
+type blockCache struct {
+	c          minio.Core
+	bucketName string
+	blockSize  int64
+	maxBlocks  int
+
+	mu     sync.Mutex
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// block - returns a block of an object of the given size, fetching it
+// on a miss.
+func (b *blockCache) block(objectName, etag string, size, index int64) ([]byte, error) {
+	key := blockKey{objectName, etag, index}
+	b.mu.Lock()
+	if e, ok := b.blocks[key]; ok {
+		b.lru.MoveToFront(e)
+		b.mu.Unlock()
+		return e.Value.(*cachedBlock).data, nil
+	}
+	b.mu.Unlock()
+
+	start := index * b.blockSize
+	end := start + b.blockSize
+	if end > size {
+		end = size
+	}
+	reqHeaders := minio.NewGetReqHeaders()
+	if err := reqHeaders.SetRange(start, end-1); err != nil {
+		return nil, err
+	}
+	reader, _, err := b.c.GetObject(b.bucketName, objectName, reqHeaders)
+	if err != nil {
+		return nil, wrapS3Error("GetObject", err)
+	}
+	defer reader.Close()
+	data := make([]byte, end-start)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.blocks[key]; !ok {
+		b.blocks[key] = b.lru.PushFront(&cachedBlock{key: key, data: data})
+		for b.lru.Len() > b.maxBlocks {
+			e := b.lru.Back()
+			b.lru.Remove(e)
+			delete(b.blocks, e.Value.(*cachedBlock).key)
+		}
+	}
+	return data, nil
+}
+
+// readAt - reads the bytes of an object at off through the cache.
+func (b *blockCache) readAt(objectName, etag string, size int64, p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && off < size {
+		data, err := b.block(objectName, etag, size, off/b.blockSize)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], data[off%b.blockSize:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// bucketFS - a read-only file system of the objects below a prefix,
+// '/' separating directories.
+type bucketFS struct {
+	c          minio.Core
+	bucketName string
+	prefix     string
+	cache      *blockCache
+
+	mu       sync.Mutex
+	listings map[string]*dirListing
+}
+
+// dirListing - the entries of a directory as listed at a time.
+type dirListing struct {
+	listed  time.Time
+	dirs    map[string]bool
+	objects map[string]minio.ObjectInfo
+}
+
+func (f *bucketFS) Root() (fs.Node, error) {
+	return &dirNode{fs: f, prefix: f.prefix}, nil
+}
+
+// list - returns the entries below a prefix.
+func (f *bucketFS) list(prefix string) (*dirListing, error) {
+	f.mu.Lock()
+	l, ok := f.listings[prefix]
+	f.mu.Unlock()
+	if ok && time.Since(l.listed) < mountListTTL {
+		return l, nil
+	}
+
+	l = &dirListing{listed: time.Now(), dirs: make(map[string]bool), objects: make(map[string]minio.ObjectInfo)}
+	marker := ""
+	for {
+		result, err := f.c.ListObjects(f.bucketName, prefix, marker, "/", 1000)
+		if err != nil {
+			return nil, wrapS3Error("ListObjects", err)
+		}
+		for _, p := range result.CommonPrefixes {
+			if name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); name != "" {
+				l.dirs[name] = true
+			}
+		}
+		for _, objInfo := range result.Contents {
+			if name := strings.TrimPrefix(objInfo.Key, prefix); name != "" && !isInternalObject(objInfo.Key) {
+				l.objects[name] = objInfo
+			}
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextMarker
+		if marker == "" && len(result.Contents) > 0 {
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+	}
+
+	f.mu.Lock()
+	f.listings[prefix] = l
+	f.mu.Unlock()
+	return l, nil
+}
+
+// dirNode - a directory, the objects below a prefix.
+type dirNode struct {
+	fs     *bucketFS
+	prefix string
+}
+
+func (d *dirNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (d *dirNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	l, err := d.fs.list(d.prefix)
+	if err != nil {
+		return nil, err
+	}
+	if l.dirs[name] {
+		return &dirNode{fs: d.fs, prefix: d.prefix + name + "/"}, nil
+	}
+	if objInfo, ok := l.objects[name]; ok {
+		return &fileNode{fs: d.fs, objInfo: objInfo}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *dirNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	l, err := d.fs.list(d.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for name := range l.dirs {
+		entries = append(entries, fuse.Dirent{Type: fuse.DT_Dir, Name: name})
+	}
+	for name := range l.objects {
+		entries = append(entries, fuse.Dirent{Type: fuse.DT_File, Name: name})
+	}
+	return entries, nil
+}
+
+// fileNode - a file, the content of an object.
+type fileNode struct {
+	fs      *bucketFS
+	objInfo minio.ObjectInfo
+}
+
+func (n *fileNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = 0444
+	attr.Size = uint64(n.objInfo.Size)
+	attr.Mtime = n.objInfo.LastModified
+	return nil
+}
+
+func (n *fileNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	m, err := n.fs.cache.readAt(n.objInfo.Key, n.objInfo.ETag, n.objInfo.Size, buf, req.Offset)
+	resp.Data = buf[:m]
+	return err
+}
+
+// mountMain - implements the 'mount s3://bucket/prefix <dir>' command,
+// which exposes the objects below a prefix as a read-only file system
+// until interrupted. Files are read with ranged GETs through a block
+// cache, so readers never download whole objects.
+func mountMain(args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	blockSize := flags.Int64("block-size", 1024*1024, "size of the blocks fetched and cached")
+	cacheBlocks := flags.Int("cache-blocks", 256, "number of blocks cached in memory")
+	flags.Parse(args)
+	if flags.NArg() != 2 || *blockSize <= 0 || *cacheBlocks <= 0 {
+		return fmt.Errorf("Usage: mount [-block-size n] [-cache-blocks n] s3://bucket/prefix <dir>")
+	}
+	bucketName, prefix, err := parseS3URL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	dir := flags.Arg(1)
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	filesys := &bucketFS{
+		c:          c,
+		bucketName: bucketName,
+		prefix:     prefix,
+		listings:   make(map[string]*dirListing),
+		cache: &blockCache{
+			c:          c,
+			bucketName: bucketName,
+			blockSize:  *blockSize,
+			maxBlocks:  *cacheBlocks,
+			lru:        list.New(),
+			blocks:     make(map[blockKey]*list.Element),
+		},
+	}
+
+	conn, err := fuse.Mount(dir, fuse.FSName("streams3"), fuse.Subtype("streams3"), fuse.ReadOnly())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		if err := fuse.Unmount(dir); err != nil {
+			fmt.Fprintln(os.Stderr, "unmount failed:", err)
+		}
+	}()
+
+	fmt.Fprintln(os.Stderr, "mounted", flags.Arg(0), "on", dir)
+	return fs.Serve(conn, filesys)
+}
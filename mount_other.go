@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "errors"
+
+// mountMain - FUSE is not available on this platform.
+func mountMain(args []string) error {
+	return errors.New("mount is not supported on this platform")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// PAX record prefixes carrying object metadata in 'put-multi' streams.
+const (
+	paxMetaPrefix  = "STREAMS3.meta."
+	paxContentType = "STREAMS3.content-type"
+	// paxSHA256 - the hex sha256 of the file given by the producer, the
+	// object is not completed if the content differs.
+	paxSHA256 = "STREAMS3.sha256"
+)
+
+// multiResult - the outcome of one object of a 'put-multi' stream,
+// printed as a JSON line on stdout.
+type multiResult struct {
+	Object string       `json:"object"`
+	Size   int64        `json:"size"`
+	Error  *errorDetail `json:"error,omitempty"`
+}
+
+// tarMetadata - returns the metadata carried in the PAX records of a tar
+// header, 'STREAMS3.meta.<name>' records become x-amz-meta-<name>.
+func tarMetadata(hdr *tar.Header) map[string][]string {
+	metaData := map[string][]string{}
+	for k, v := range hdr.PAXRecords {
+		switch {
+		case k == paxContentType:
+			metaData["Content-Type"] = []string{v}
+		case strings.HasPrefix(k, paxMetaPrefix):
+			metaData["X-Amz-Meta-"+strings.TrimPrefix(k, paxMetaPrefix)] = []string{v}
+		}
+	}
+	return metaData
+}
+
+// putMultiMain - implements the 'put-multi [-bucket name] [-prefix p]'
+// command. stdin carries a tar stream, every regular file in it is
+// uploaded as a separate object named after its path.
+func putMultiMain(args []string) error {
+	flags := flag.NewFlagSet("put-multi", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	prefix := flags.String("prefix", "", "prefix prepended to object names")
+	keepGoing := flags.Bool("keep-going", false, "continue with the next object after a failure")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: put-multi [-bucket name] [-prefix p] [-keep-going] < stream.tar")
+	}
+
+	quorum := os.Getenv("QUORUM_SITES") != ""
+	put := PutStream
+	if quorum {
+		put = PutStreamQuorum
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	tr := tar.NewReader(os.Stdin)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+
+		objectName := *prefix + strings.TrimPrefix(path.Clean(hdr.Name), "/")
+		metaData := tarMetadata(hdr)
+		if hdr.Typeflag == tar.TypeLink {
+			// Hard links reference the object of their first path.
+			metaData["X-Amz-Meta-Hardlink-Target"] = []string{*prefix + strings.TrimPrefix(path.Clean(hdr.Linkname), "/")}
+			hdr.Size = 0
+		}
+		// Old tars may carry names in legacy encodings, which can't be keys.
+		var n int64
+		err = validateKey(objectName)
+		if sum := hdr.PAXRecords[paxSHA256]; err == nil && sum != "" {
+			if quorum {
+				err = fmt.Errorf("%s records are not supported with QUORUM_SITES", paxSHA256)
+			} else {
+				n, err = PutStreamWithOptions(*bucketName, objectName, tr, WithMetadata(metaData), WithExpectedSHA256(sum))
+			}
+		} else if err == nil {
+			n, err = put(*bucketName, objectName, tr, metaData)
+		}
+		if err == nil && n != hdr.Size {
+			err = fmt.Errorf("Uploaded %d bytes of %s, expected %d", n, objectName, hdr.Size)
+		}
+
+		result := multiResult{Object: objectName, Size: n}
+		if err != nil {
+			failed++
+			result.Error = newErrorDetail(err)
+		}
+		enc.Encode(result)
+		if err != nil && !*keepGoing {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d objects failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxKeyLength - the longest key in bytes S3 and GCS accept, Azure counts
+// characters instead.
+const maxKeyLength = 1024
+
+// avoidKeyChars - characters S3 advises against in keys, as clients and
+// URLs handle them inconsistently.
+const avoidKeyChars = "\\{}^%`[]\"<>~#|"
+
+// legacyNames - returns true if LEGACY_NAMES is set, allowing the S3
+// bucket names us-east-1 accepted before March 2018, and keys with
+// control characters, which S3 stores but XML 1.0 listings can't carry.
+func legacyNames() bool {
+	return os.Getenv("LEGACY_NAMES") > ""
+}
+
+// validateBucketName - returns an error explaining why name is not a
+// valid bucket, or container, of the provider.
+func validateBucketName(name string) error {
+	invalid := func(format string, a ...interface{}) error {
+		return fmt.Errorf("Invalid bucket name %q: %s", name, fmt.Sprintf(format, a...))
+	}
+	if isFile() {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+			return invalid("must be a single directory name")
+		}
+		return nil
+	}
+	if legacyNames() && !isAzure() && !isGCS() {
+		if len(name) < 1 || len(name) > 255 {
+			return invalid("must be 1 to 255 characters long")
+		}
+		for _, c := range name {
+			switch {
+			case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			case c == '.', c == '-', c == '_':
+			default:
+				return invalid("must not contain %q", c)
+			}
+		}
+		return nil
+	}
+
+	maxLength := 63
+	if isGCS() && strings.Contains(name, ".") {
+		maxLength = 222
+	}
+	if len(name) < 3 || len(name) > maxLength {
+		return invalid("must be 3 to %d characters long", maxLength)
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-':
+		case c == '.' && !isAzure():
+		case c == '_' && isGCS():
+		case 'A' <= c && c <= 'Z':
+			return invalid("must be lowercase")
+		default:
+			return invalid("must not contain %q", c)
+		}
+	}
+	first, last := name[0], name[len(name)-1]
+	if !isAlnum(first) || !isAlnum(last) {
+		return invalid("must start and end with a letter or digit")
+	}
+
+	switch {
+	case isAzure():
+		if strings.Contains(name, "--") {
+			return invalid("must not contain consecutive hyphens")
+		}
+	case isGCS():
+		for _, part := range strings.Split(name, ".") {
+			if len(part) > 63 {
+				return invalid("dot separated parts must be at most 63 characters long")
+			}
+		}
+		if strings.HasPrefix(name, "goog") || strings.Contains(name, "google") {
+			return invalid("must not start with 'goog' or contain 'google'")
+		}
+	default:
+		if strings.Contains(name, "..") {
+			return invalid("must not contain consecutive dots")
+		}
+		if net.ParseIP(name) != nil {
+			return invalid("must not be formatted as an IP address")
+		}
+		if strings.HasPrefix(name, "xn--") || strings.HasPrefix(name, "sthree-") {
+			return invalid("must not start with 'xn--' or 'sthree-'")
+		}
+		if strings.HasSuffix(name, "-s3alias") || strings.HasSuffix(name, "--ol-s3") {
+			return invalid("must not end with '-s3alias' or '--ol-s3'")
+		}
+	}
+	return nil
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+}
+
+// validateKey - returns an error explaining why key can't be stored
+// as is with the provider.
+func validateKey(key string) error {
+	invalid := func(format string, a ...interface{}) error {
+		return fmt.Errorf("Invalid object key %q: %s", key, fmt.Sprintf(format, a...))
+	}
+	if key == "" {
+		return invalid("must not be empty")
+	}
+	if !utf8.ValidString(key) {
+		return invalid("must be valid UTF-8")
+	}
+	length := len(key)
+	if isAzure() {
+		length = utf8.RuneCountInString(key)
+	}
+	if length > maxKeyLength {
+		return invalid("is %d long, at most %d allowed", length, maxKeyLength)
+	}
+	for _, c := range key {
+		// Listings are XML 1.0, which can't carry most control characters.
+		if unicode.IsControl(c) && !legacyNames() {
+			return invalid("must not contain control character %U", c)
+		}
+	}
+
+	switch {
+	case isFile():
+		for _, part := range strings.Split(key, "/") {
+			if part == "" || part == "." || part == ".." {
+				return invalid("must not have empty, '.' or '..' path segments")
+			}
+		}
+	case isAzure():
+		if strings.HasSuffix(key, ".") || strings.HasSuffix(key, "/") {
+			return invalid("must not end with '.' or '/'")
+		}
+		if strings.Count(key, "/") >= 254 {
+			return invalid("must have fewer than 254 path segments")
+		}
+	case isGCS():
+		if key == "." || key == ".." {
+			return invalid("must not be '.' or '..'")
+		}
+		if strings.HasPrefix(key, ".well-known/acme-challenge/") {
+			return invalid("must not start with '.well-known/acme-challenge/'")
+		}
+	}
+	return nil
+}
+
+// sanitizeKey - returns key with the characters that make it invalid or
+// awkward to handle replaced, and a description of every change.
+func sanitizeKey(key string) (string, []string) {
+	var changes []string
+	var b strings.Builder
+	for i, w := 0, 0; i < len(key); i += w {
+		c, size := utf8.DecodeRuneInString(key[i:])
+		w = size
+		switch {
+		case c == utf8.RuneError && size == 1:
+			changes = append(changes, fmt.Sprintf("invalid UTF-8 byte 0x%02x at %d replaced with '_'", key[i], i))
+			b.WriteByte('_')
+		case unicode.IsControl(c):
+			changes = append(changes, fmt.Sprintf("control character %U at %d replaced with '_'", c, i))
+			b.WriteByte('_')
+		case c == '\\':
+			changes = append(changes, fmt.Sprintf("'\\' at %d replaced with '/'", i))
+			b.WriteByte('/')
+		case strings.ContainsRune(avoidKeyChars, c):
+			changes = append(changes, fmt.Sprintf("%q at %d replaced with '_'", c, i))
+			b.WriteByte('_')
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	sanitized := b.String()
+	var parts []string
+	for _, part := range strings.Split(sanitized, "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if joined := strings.Join(parts, "/"); joined != sanitized {
+		changes = append(changes, "empty, '.' and '..' path segments removed")
+		sanitized = joined
+	}
+	if trimmed := strings.TrimRight(sanitized, "."); isAzure() && trimmed != sanitized {
+		changes = append(changes, "trailing dots removed")
+		sanitized = trimmed
+	}
+	if len(sanitized) > maxKeyLength {
+		cut := maxKeyLength
+		for cut > 0 && !utf8.RuneStart(sanitized[cut]) {
+			cut--
+		}
+		changes = append(changes, fmt.Sprintf("truncated from %d to %d bytes", len(sanitized), cut))
+		sanitized = sanitized[:cut]
+	}
+	return sanitized, changes
+}
+
+// checkKey - validates key before an upload starts. With sanitize, keys
+// are normalized instead, the changes reported on stderr.
+func checkKey(key string, sanitize bool) (string, error) {
+	if sanitize {
+		sanitized, changes := sanitizeKey(key)
+		if len(changes) > 0 {
+			fmt.Fprintf(os.Stderr, "key %q sanitized to %q: %s\n", key, sanitized, strings.Join(changes, ", "))
+		}
+		key = sanitized
+	}
+	return key, validateKey(key)
+}
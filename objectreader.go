@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+
+	minio "github.com/minio/minio-go"
+)
+
+// ObjectReader - an io.ReadCloser downloading an object.
+type ObjectReader struct {
+	body io.ReadCloser
+	read int64
+	// Info describes the object read.
+	Info minio.ObjectInfo
+}
+
+// NewObjectReader - starts downloading an object.
+func NewObjectReader(bucketName, objectName string) (*ObjectReader, error) {
+	c, err := newCore()
+	if err != nil {
+		return nil, err
+	}
+	body, objInfo, err := c.GetObject(bucketName, objectName, minio.NewGetReqHeaders())
+	if err != nil {
+		return nil, wrapS3Error("GetObject", err)
+	}
+	return &ObjectReader{body: body, Info: objInfo}, nil
+}
+
+// Read - reads the content of the object, failing with
+// io.ErrUnexpectedEOF if it ends short of its size.
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+	if err == io.EOF {
+		err = r.checkSize()
+	}
+	return n, err
+}
+
+// checkSize - returns io.EOF if all of the object was read,
+// io.ErrUnexpectedEOF otherwise.
+func (r *ObjectReader) checkSize() error {
+	if r.Info.Size >= 0 && r.read != r.Info.Size {
+		return io.ErrUnexpectedEOF
+	}
+	return io.EOF
+}
+
+// Close - stops the download.
+func (r *ObjectReader) Close() error {
+	return r.body.Close()
+}
+
+// WriteTo - writes the rest of the object to w, in transfers of
+// copyBufferSize, or through the ReadFrom of an ObjectWriter so that
+// copies between objects are not buffered twice.
+func (r *ObjectReader) WriteTo(w io.Writer) (n int64, err error) {
+	if ow, ok := w.(*ObjectWriter); ok {
+		n, err = ow.ReadFrom(r.body)
+		r.read += n
+		if err == nil && r.checkSize() != io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	buf := make([]byte, copyBufferSize)
+	for {
+		nr, rErr := readFull(r.body, buf)
+		r.read += int64(nr)
+		if nr > 0 {
+			nw, wErr := w.Write(buf[:nr])
+			n += int64(nw)
+			if wErr != nil {
+				return n, wErr
+			}
+			if nw != nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if rErr == io.EOF {
+			if r.checkSize() != io.EOF {
+				return n, io.ErrUnexpectedEOF
+			}
+			return n, nil
+		}
+		if rErr != nil {
+			return n, rErr
+		}
+	}
+}
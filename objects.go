@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+
+	minio "github.com/minio/minio-go"
+)
+
+// isNoSuchKey - returns true if the error means the object does not exist.
+func isNoSuchKey(err error) bool {
+	return errorCode(err) == "NoSuchKey"
+}
+
+// putJSON - saves v as a small JSON object.
+func putJSON(c minio.Core, bucketName, objectName string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return putBytes(c, bucketName, objectName, data, "application/json")
+}
+
+// putBytes - saves data as a small object.
+func putBytes(c minio.Core, bucketName, objectName string, data []byte, contentType string) error {
+	return putObjectBytes(c, bucketName, objectName, data, map[string][]string{
+		"Content-Type": {contentType},
+	})
+}
+
+// putObjectBytes - saves data as a small object with metadata, encoded
+// as putStream encodes it.
+func putObjectBytes(c minio.Core, bucketName, objectName string, data []byte, metaData map[string][]string) error {
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	_, err := c.PutObject(bucketName, objectName, int64(len(data)),
+		bytes.NewReader(data), md5Sum[:], sha256Sum[:], encodeMetadata(metaData))
+	return err
+}
+
+// getJSON - reads a small JSON object into v.
+func getJSON(c minio.Core, bucketName, objectName string, v interface{}) error {
+	data, err := getBytes(c, bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// getBytes - reads a small object.
+func getBytes(c minio.Core, bucketName, objectName string) ([]byte, error) {
+	reader, _, err := c.GetObject(bucketName, objectName, minio.NewGetReqHeaders())
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
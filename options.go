@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Server side encryption algorithms of WithSSE.
+const (
+	SSES3  = "AES256"
+	SSEKMS = "aws:kms"
+)
+
+// Options - the settings of an upload, set with the With* functions.
+// Settings left unset fall back to the environment, e.g. PARALLEL_PARTS
+// and SSE_KMS_KEY_ID.
+type Options struct {
+	// PartSize of multipart uploads, chosen from the size if 0.
+	PartSize int64
+	// Concurrency is the number of parts uploaded at once.
+	Concurrency int
+	// SSE is the server side encryption algorithm, SSES3 or SSEKMS,
+	// with the KMS key SSEKeyID.
+	SSE      string
+	SSEKeyID string
+	Metadata map[string][]string
+	Progress ProgressFunc
+	Plan     PartPlan
+	// WarmUp is the number of connections a Client opens before
+	// uploading, so that the first parts don't wait for handshakes.
+	WarmUp int
+	// ExpectSHA256 is the hex digest of the stream given by its
+	// producer, the upload is aborted instead of completed if the stream
+	// read differs.
+	ExpectSHA256 string
+	// ExpectedSize is the size a stream of unknown size is expected to
+	// have, which the parts are planned for and the bucket quota is
+	// checked against. Streams deviating from it by more than the
+	// fraction SizeTolerance are reported as set by SizeDeviation,
+	// SizeDeviationWarn or SizeDeviationFail.
+	ExpectedSize  int64
+	SizeTolerance float64
+	SizeDeviation string
+}
+
+// Option - sets a setting of Options.
+type Option func(*Options)
+
+// WithPartSize - uploads parts of size bytes.
+func WithPartSize(size int64) Option {
+	return func(o *Options) { o.PartSize = size }
+}
+
+// WithConcurrency - uploads n parts at once.
+func WithConcurrency(n int) Option {
+	return func(o *Options) { o.Concurrency = n }
+}
+
+// WithSSE - encrypts the object at rest with algorithm, SSES3 or SSEKMS.
+// keyID is the KMS key, empty for the default key of the account.
+func WithSSE(algorithm, keyID string) Option {
+	return func(o *Options) { o.SSE, o.SSEKeyID = algorithm, keyID }
+}
+
+// WithMetadata - sends metaData on upload, e.g. Content-Type or
+// X-Amz-Meta-* headers.
+func WithMetadata(metaData map[string][]string) Option {
+	return func(o *Options) { o.Metadata = metaData }
+}
+
+// WithProgress - reports the progress of the upload to fn.
+func WithProgress(fn ProgressFunc) Option {
+	return func(o *Options) { o.Progress = fn }
+}
+
+// WithPlan - cuts the stream into the parts of plan, see PutStreamWithPlan.
+func WithPlan(plan PartPlan) Option {
+	return func(o *Options) { o.Plan = plan }
+}
+
+// WithWarmUp - opens n connections before uploading, with a Client.
+func WithWarmUp(n int) Option {
+	return func(o *Options) { o.WarmUp = n }
+}
+
+// WithExpectedSHA256 - completes the upload only if the stream read has
+// the sha256 digest sum, in hex.
+func WithExpectedSHA256(sum string) Option {
+	return func(o *Options) { o.ExpectSHA256 = strings.ToLower(sum) }
+}
+
+// WithExpectedSize - plans the upload for a stream of size bytes, within
+// tolerance, a fraction of size. Streams deviating more are reported as
+// set by deviation, SizeDeviationWarn or SizeDeviationFail.
+func WithExpectedSize(size int64, tolerance float64, deviation string) Option {
+	return func(o *Options) { o.ExpectedSize, o.SizeTolerance, o.SizeDeviation = size, tolerance, deviation }
+}
+
+// NewOptions - returns the Options set by opts.
+func NewOptions(opts ...Option) *Options {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Validate - returns all the errors of the settings at once, nil if
+// there are none.
+func (o *Options) Validate() error {
+	var errs []string
+	if o.PartSize != 0 && (o.PartSize < 5*1024*1024 || o.PartSize > 5*1024*1024*1024) {
+		errs = append(errs, fmt.Sprintf("part size %d is not between 5MiB and 5GiB", o.PartSize))
+	}
+	if o.PartSize != 0 && o.Plan != nil {
+		errs = append(errs, "a part size and a plan are exclusive")
+	}
+	if o.Concurrency < 0 {
+		errs = append(errs, fmt.Sprintf("concurrency %d is negative", o.Concurrency))
+	}
+	if o.WarmUp < 0 {
+		errs = append(errs, fmt.Sprintf("warm up of %d connections is negative", o.WarmUp))
+	}
+	if o.ExpectSHA256 != "" {
+		if sum, err := hex.DecodeString(o.ExpectSHA256); err != nil || len(sum) != sha256.Size {
+			errs = append(errs, fmt.Sprintf("expected digest %q is not a hex sha256", o.ExpectSHA256))
+		}
+	}
+	if o.ExpectedSize < 0 {
+		errs = append(errs, fmt.Sprintf("expected size %d is negative", o.ExpectedSize))
+	}
+	if o.SizeTolerance < 0 {
+		errs = append(errs, fmt.Sprintf("size tolerance %g is negative", o.SizeTolerance))
+	}
+	switch o.SizeDeviation {
+	case "", SizeDeviationWarn, SizeDeviationFail:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown size deviation policy %q, expected %s or %s", o.SizeDeviation, SizeDeviationWarn, SizeDeviationFail))
+	}
+	switch o.SSE {
+	case "", SSES3:
+		if o.SSEKeyID != "" {
+			errs = append(errs, "a KMS key needs "+SSEKMS+" encryption")
+		}
+	case SSEKMS:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown encryption %q, expected %s or %s", o.SSE, SSES3, SSEKMS))
+	}
+	for k := range o.Metadata {
+		if !isHeaderSafe(k) || strings.ContainsAny(k, " :") {
+			errs = append(errs, fmt.Sprintf("invalid metadata name %q", k))
+		}
+	}
+	if o.Plan != nil {
+		if err := o.Plan.validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid options: %s", strings.Join(errs, "; "))
+}
+
+// sseMetadata - returns the metadata of the upload, with the headers of
+// its encryption.
+func (o *Options) sseMetadata() map[string][]string {
+	if o.SSE == "" {
+		return o.Metadata
+	}
+	m := make(map[string][]string, len(o.Metadata)+2)
+	for k, v := range o.Metadata {
+		m[k] = v
+	}
+	m["X-Amz-Server-Side-Encryption"] = []string{o.SSE}
+	if o.SSEKeyID != "" {
+		m["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = []string{o.SSEKeyID}
+	}
+	return m
+}
+
+// PutStreamWithOptions - same as PutStream, with the settings of opts.
+func PutStreamWithOptions(bucketName, objectName string, reader io.Reader, opts ...Option) (n int64, err error) {
+	o := NewOptions(opts...)
+	if err = o.Validate(); err != nil {
+		return 0, err
+	}
+	return putStreamOptions(bucketName, objectName, reader, o)
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Parquet physical types, as far as conversions produce them.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Parquet enum values written into the file metadata.
+const (
+	parquetOptional    = 1
+	parquetUTF8        = 0
+	parquetPlain       = 0
+	parquetRLE         = 3
+	parquetGzip        = 2
+	parquetDataPage    = 0
+	parquetMagic       = "PAR1"
+	parquetContentType = "application/vnd.apache.parquet"
+)
+
+// parquetTypes - the column types of -parquet-schema, by name.
+var parquetTypes = map[string]int32{
+	"boolean": parquetBoolean,
+	"int64":   parquetInt64,
+	"double":  parquetDouble,
+	"string":  parquetByteArray,
+}
+
+// parquetField - a column of the converted file.
+type parquetField struct {
+	name string
+	typ  int32
+}
+
+// parseParquetSchema - parses 'name:type,...', types being boolean,
+// int64, double or string.
+func parseParquetSchema(s string) ([]parquetField, error) {
+	var fields []parquetField
+	for _, f := range strings.Split(s, ",") {
+		i := strings.LastIndex(f, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid schema field %q, expected name:type", f)
+		}
+		typ, ok := parquetTypes[strings.ToLower(f[i+1:])]
+		if !ok {
+			return nil, fmt.Errorf("Unknown type of schema field %q, use boolean, int64, double or string", f)
+		}
+		fields = append(fields, parquetField{name: strings.TrimSpace(f[:i]), typ: typ})
+	}
+	return fields, nil
+}
+
+// thriftWriter - writes the Thrift compact protocol, as far as Parquet
+// metadata needs it.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// last is the last field id written of each open struct.
+	last []int16
+}
+
+// Thrift compact protocol type codes.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.buf.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+// begin and end - open and close a struct, top level or list element.
+func (t *thriftWriter) begin() { t.last = append(t.last, 0) }
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.elemStr(s)
+}
+
+// structField - opens a struct valued field, closed with end.
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// list - starts a list field of n elements, written with the elem
+// functions or begin and end.
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.varint(uint64(n))
+	}
+}
+
+func (t *thriftWriter) elemI32(v int32) { t.varint(zigzag(int64(v))) }
+func (t *thriftWriter) elemStr(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// parquetColumn - a column, buffering the values of a row group.
+type parquetColumn struct {
+	parquetField
+	defined []bool
+	bools   []bool
+	values  bytes.Buffer
+}
+
+// add - appends a decoded JSON value, numbers being json.Numbers.
+func (c *parquetColumn) add(v interface{}) error {
+	if v == nil {
+		c.defined = append(c.defined, false)
+		return nil
+	}
+	switch c.typ {
+	case parquetBoolean:
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("Column %s: %v is not a boolean", c.name, v)
+		}
+		c.bools = append(c.bools, b)
+	case parquetInt64:
+		n, _ := v.(json.Number)
+		i, err := n.Int64()
+		if err != nil {
+			return fmt.Errorf("Column %s: %v is not an int64", c.name, v)
+		}
+		binary.Write(&c.values, binary.LittleEndian, i)
+	case parquetDouble:
+		n, _ := v.(json.Number)
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("Column %s: %v is not a double", c.name, v)
+		}
+		binary.Write(&c.values, binary.LittleEndian, math.Float64bits(f))
+	default:
+		s, ok := v.(string)
+		if n, isNumber := v.(json.Number); isNumber {
+			// Numbers keep their text, leading zeros included.
+			s, ok = string(n), true
+		}
+		if !ok {
+			// Booleans and nested values keep their JSON text.
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			s = string(data)
+		}
+		binary.Write(&c.values, binary.LittleEndian, uint32(len(s)))
+		c.values.WriteString(s)
+	}
+	c.defined = append(c.defined, true)
+	return nil
+}
+
+// bitPack - packs bits LSB first, as booleans and 1 bit levels are.
+func bitPack(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return packed
+}
+
+// page - returns the data page of the buffered values: the definition
+// levels as one bit packed run of the RLE hybrid encoding, then the
+// PLAIN values.
+func (c *parquetColumn) page() []byte {
+	var levels thriftWriter
+	levels.varint(uint64((len(c.defined)+7)/8)<<1 | 1)
+	levels.buf.Write(bitPack(c.defined))
+
+	var page bytes.Buffer
+	binary.Write(&page, binary.LittleEndian, uint32(levels.buf.Len()))
+	page.Write(levels.buf.Bytes())
+	if c.typ == parquetBoolean {
+		page.Write(bitPack(c.bools))
+	} else {
+		page.Write(c.values.Bytes())
+	}
+	return page.Bytes()
+}
+
+func (c *parquetColumn) reset() {
+	c.defined = c.defined[:0]
+	c.bools = c.bools[:0]
+	c.values.Reset()
+}
+
+// parquetChunk - where a column chunk of a row group was written.
+type parquetChunk struct {
+	offset       int64
+	values       int64
+	uncompressed int64
+	compressed   int64
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	bytes  int64
+	chunks []parquetChunk
+}
+
+// parquetWriter - streams records as a Parquet file of optional flat
+// columns, one gzip compressed data page per column chunk.
+type parquetWriter struct {
+	w       io.Writer
+	offset  int64
+	columns []*parquetColumn
+	index   map[string]*parquetColumn
+	// strict rejects fields not in the schema, set if it was inferred.
+	strict bool
+	rows   int64
+	groups []parquetRowGroup
+	total  int64
+}
+
+func newParquetWriter(w io.Writer, fields []parquetField, strict bool) (*parquetWriter, error) {
+	p := &parquetWriter{w: w, index: make(map[string]*parquetColumn), strict: strict}
+	for _, f := range fields {
+		c := &parquetColumn{parquetField: f}
+		p.columns = append(p.columns, c)
+		p.index[f.name] = c
+	}
+	return p, p.write([]byte(parquetMagic))
+}
+
+func (p *parquetWriter) write(data []byte) error {
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	return err
+}
+
+// add - appends a record, missing fields being null.
+func (p *parquetWriter) add(record map[string]interface{}) error {
+	if p.strict {
+		for k := range record {
+			if p.index[k] == nil {
+				return fmt.Errorf("Field %q is not in the inferred schema, supply -parquet-schema", k)
+			}
+		}
+	}
+	for _, c := range p.columns {
+		if err := c.add(record[c.name]); err != nil {
+			return fmt.Errorf("Record %d: %v", p.total+p.rows+1, err)
+		}
+	}
+	p.rows++
+	return nil
+}
+
+// flush - writes the buffered rows as a row group.
+func (p *parquetWriter) flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: p.rows}
+	for _, c := range p.columns {
+		data := c.page()
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		var header thriftWriter
+		header.begin()
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(data)))
+		header.i32(3, int32(compressed.Len()))
+		header.structField(5)
+		header.i32(1, int32(len(c.defined)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.end()
+
+		chunk := parquetChunk{
+			offset:       p.offset,
+			values:       int64(len(c.defined)),
+			uncompressed: int64(header.buf.Len() + len(data)),
+			compressed:   int64(header.buf.Len() + compressed.Len()),
+		}
+		if err := p.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := p.write(compressed.Bytes()); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.bytes += chunk.uncompressed
+		c.reset()
+	}
+	p.groups = append(p.groups, group)
+	p.total += p.rows
+	p.rows = 0
+	return nil
+}
+
+// close - writes the last row group and the footer.
+func (p *parquetWriter) close() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	var t thriftWriter
+	t.begin()
+	t.i32(1, 1)
+	t.list(2, thriftStruct, len(p.columns)+1)
+	t.begin()
+	t.str(4, "schema")
+	t.i32(5, int32(len(p.columns)))
+	t.end()
+	for _, c := range p.columns {
+		t.begin()
+		t.i32(1, c.typ)
+		t.i32(3, parquetOptional)
+		t.str(4, c.name)
+		if c.typ == parquetByteArray {
+			t.i32(6, parquetUTF8)
+		}
+		t.end()
+	}
+	t.i64(3, p.total)
+	t.list(4, thriftStruct, len(p.groups))
+	for _, g := range p.groups {
+		t.begin()
+		t.list(1, thriftStruct, len(g.chunks))
+		for i, chunk := range g.chunks {
+			t.begin()
+			t.i64(2, chunk.offset)
+			t.structField(3)
+			t.i32(1, p.columns[i].typ)
+			t.list(2, thriftI32, 2)
+			t.elemI32(parquetPlain)
+			t.elemI32(parquetRLE)
+			t.list(3, thriftBinary, 1)
+			t.elemStr(p.columns[i].name)
+			t.i32(4, parquetGzip)
+			t.i64(5, chunk.values)
+			t.i64(6, chunk.uncompressed)
+			t.i64(7, chunk.compressed)
+			t.i64(9, chunk.offset)
+			t.end()
+			t.end()
+		}
+		t.i64(2, g.bytes)
+		t.i64(3, g.rows)
+		t.end()
+	}
+	t.str(6, "streams3 version "+toolVersion)
+	t.end()
+
+	if err := p.write(t.buf.Bytes()); err != nil {
+		return err
+	}
+	var footer [4]byte
+	binary.LittleEndian.PutUint32(footer[:], uint32(t.buf.Len()))
+	if err := p.write(footer[:]); err != nil {
+		return err
+	}
+	return p.write([]byte(parquetMagic))
+}
+
+// parquetInference - the narrowest column types holding the values of
+// the records added so far.
+type parquetInference struct {
+	kinds map[string]int
+}
+
+// Kinds of values seen in a column.
+const (
+	kindBool = 1 << iota
+	kindInt
+	kindFloat
+	kindOther
+)
+
+func (s *parquetInference) add(record map[string]interface{}) {
+	if s.kinds == nil {
+		s.kinds = make(map[string]int)
+	}
+	for k, v := range record {
+		switch v := v.(type) {
+		case nil:
+			// Null only columns are still columns, of strings.
+			s.kinds[k] |= 0
+		case bool:
+			s.kinds[k] |= kindBool
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				s.kinds[k] |= kindInt
+			} else {
+				s.kinds[k] |= kindFloat
+			}
+		default:
+			s.kinds[k] |= kindOther
+		}
+	}
+}
+
+// fields - returns the inferred columns. names fixes the column order,
+// else columns are sorted by name.
+func (s *parquetInference) fields(names []string) []parquetField {
+	if names == nil {
+		for k := range s.kinds {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+	}
+
+	fields := make([]parquetField, len(names))
+	for i, name := range names {
+		typ := int32(parquetByteArray)
+		switch s.kinds[name] {
+		case kindBool:
+			typ = parquetBoolean
+		case kindInt:
+			typ = parquetInt64
+		case kindFloat, kindInt | kindFloat:
+			typ = parquetDouble
+		}
+		fields[i] = parquetField{name: name, typ: typ}
+	}
+	return fields
+}
+
+// jsonNumber - matches the numbers JSON allows, without leading zeros.
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// csvValue - returns a CSV cell as the JSON value it looks like, empty
+// cells being null. Numbers with leading zeros, such as zip codes or
+// ids, are kept as text unless typed, when a schema sets the columns.
+func csvValue(cell string, typed bool) interface{} {
+	switch cell {
+	case "":
+		return nil
+	case "true", "false":
+		return cell == "true"
+	}
+	if jsonNumber.MatchString(cell) {
+		return json.Number(cell)
+	}
+	if _, err := json.Number(cell).Float64(); typed && err == nil {
+		return json.Number(cell)
+	}
+	return cell
+}
+
+// recordSource - returns the records of NDJSON or CSV input, the latter
+// along with its header names. typed CSV cells are numbers whenever
+// they can be.
+func recordSource(reader io.Reader, format string, typed bool) (func() (map[string]interface{}, error), []string, error) {
+	switch format {
+	case "ndjson":
+		dec := json.NewDecoder(reader)
+		dec.UseNumber()
+		return func() (map[string]interface{}, error) {
+			var record map[string]interface{}
+			err := dec.Decode(&record)
+			if err == nil && record == nil {
+				err = fmt.Errorf("Expected JSON objects, one per line")
+			}
+			return record, err
+		}, nil, nil
+	case "csv":
+		r := csv.NewReader(reader)
+		header, err := r.Read()
+		if err != nil {
+			return nil, nil, err
+		}
+		return func() (map[string]interface{}, error) {
+			row, err := r.Read()
+			if err != nil {
+				return nil, err
+			}
+			record := make(map[string]interface{}, len(row))
+			for i, cell := range row {
+				record[header[i]] = csvValue(cell, typed)
+			}
+			return record, nil
+		}, header, nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown record format %q, use ndjson or csv", format)
+	}
+}
+
+// parquetReader - returns NDJSON or CSV records of reader converted to
+// Parquet, in row groups of rowGroupRows. Without fields the schema is
+// inferred from all the records, spooled to a temporary file meanwhile.
+func parquetReader(reader io.Reader, format string, fields []parquetField, rowGroupRows int) io.Reader {
+	return pipeTransform(func(w io.Writer) error {
+		next, names, err := recordSource(reader, format, fields != nil)
+		if err != nil {
+			return err
+		}
+
+		strict := fields == nil
+		if strict {
+			spool, err := ioutil.TempFile("", "parquet-records-")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(spool.Name())
+			defer spool.Close()
+
+			var inferred parquetInference
+			bw := bufio.NewWriter(spool)
+			enc := json.NewEncoder(bw)
+			records := 0
+			for {
+				record, err := next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				inferred.add(record)
+				if err = enc.Encode(record); err != nil {
+					return err
+				}
+				records++
+			}
+			if records == 0 {
+				return fmt.Errorf("No records to infer a Parquet schema from")
+			}
+			if err = bw.Flush(); err != nil {
+				return err
+			}
+			if _, err = spool.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			fields = inferred.fields(names)
+			if next, _, err = recordSource(bufio.NewReader(spool), "ndjson", false); err != nil {
+				return err
+			}
+		}
+
+		p, err := newParquetWriter(w, fields, strict)
+		if err != nil {
+			return err
+		}
+		for {
+			if p.rows >= int64(rowGroupRows) {
+				if err = p.flush(); err != nil {
+					return err
+				}
+			}
+			record, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err = p.add(record); err != nil {
+				return err
+			}
+		}
+		return p.close()
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Policies of PART_LIMIT_POLICY, for streams of unknown size reaching
+// the most parts an upload has.
+const (
+	// partLimitFail - the upload fails before completing, instead of
+	// completing with the start of the stream only.
+	partLimitFail = "fail"
+	// partLimitGrow - the part size doubles every partGrowEvery parts,
+	// and with it the memory holding the parts being uploaded, up to
+	// PART_GROW_MEMORY.
+	partLimitGrow = "grow"
+	// partLimitRotate - the upload is completed and the stream continues
+	// in '<object>.000002' and so on.
+	partLimitRotate = "rotate"
+)
+
+// partGrowEvery - the parts after which partLimitGrow doubles the part
+// size, so that 10000 parts hold about 100 times more than with a
+// fixed part size.
+const partGrowEvery = 1000
+
+// maxPartSize - the largest part S3 accepts.
+const maxPartSize = 1024 * 1024 * 1024 * 5
+
+// partLimitPolicy - returns the policy of PART_LIMIT_POLICY, partLimitFail
+// by default.
+func partLimitPolicy() (string, error) {
+	switch v := os.Getenv("PART_LIMIT_POLICY"); v {
+	case "":
+		return partLimitFail, nil
+	case partLimitFail, partLimitGrow, partLimitRotate:
+		return v, nil
+	default:
+		return "", fmt.Errorf("Invalid PART_LIMIT_POLICY %q, expected fail, grow or rotate", v)
+	}
+}
+
+// partGrowthMeta - the metadata recording the largest part of an upload
+// growing its parts, so that its ETag can be computed again.
+const partGrowthMeta = "X-Amz-Meta-Part-Growth-Limit"
+
+// partGrowLimit - returns the largest part of an upload growing its
+// parts with parallel parts in flight, so that they hold at most
+// PART_GROW_MEMORY, 4GiB by default.
+func partGrowLimit(parallel int) (int64, error) {
+	memory := int64(4 * 1024 * 1024 * 1024)
+	if v := os.Getenv("PART_GROW_MEMORY"); v != "" {
+		var err error
+		if memory, err = strconv.ParseInt(v, 10, 64); err != nil || memory <= 0 {
+			return 0, fmt.Errorf("Invalid PART_GROW_MEMORY %q, expected a number of bytes", v)
+		}
+	}
+	limit := memory / int64(parallel)
+	if limit > maxPartSize {
+		limit = maxPartSize
+	}
+	return limit, nil
+}
+
+// grownPartSize - returns the size of part number of a stream growing
+// its parts from partSize, up to limit.
+func grownPartSize(partSize int64, number int, limit int64) int64 {
+	for i := partGrowEvery; i < number && partSize*2 <= limit; i += partGrowEvery {
+		partSize *= 2
+	}
+	return partSize
+}
+
+// rotatedName - returns the object the stream continues in after seq-1
+// uploads reached the part limit.
+func rotatedName(objectName string, seq int) string {
+	if seq == 1 {
+		return objectName
+	}
+	return fmt.Sprintf("%s.%06d", objectName, seq)
+}
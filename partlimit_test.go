@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+const mib = 1024 * 1024
+
+func TestGrownPartSize(t *testing.T) {
+	for _, tc := range []struct {
+		partSize int64
+		number   int
+		limit    int64
+		want     int64
+	}{
+		{5 * mib, 1, maxPartSize, 5 * mib},
+		{5 * mib, 1000, maxPartSize, 5 * mib},
+		{5 * mib, 1001, maxPartSize, 10 * mib},
+		{5 * mib, 2000, maxPartSize, 10 * mib},
+		{5 * mib, 2001, maxPartSize, 20 * mib},
+		{5 * mib, 10000, maxPartSize, 5 * mib << 9},
+		// Parts stop growing at the limit.
+		{5 * mib, 2001, 15 * mib, 10 * mib},
+		{5 * mib, 10000, 5 * mib, 5 * mib},
+		// Doubling past 5GiB is never done.
+		{maxPartSize / 2, 2001, maxPartSize, maxPartSize},
+		{maxPartSize, 10000, maxPartSize, maxPartSize},
+	} {
+		if got := grownPartSize(tc.partSize, tc.number, tc.limit); got != tc.want {
+			t.Errorf("grownPartSize(%d, %d, %d) = %d, want %d", tc.partSize, tc.number, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestPartGrowLimit(t *testing.T) {
+	defer os.Setenv("PART_GROW_MEMORY", os.Getenv("PART_GROW_MEMORY"))
+	for _, tc := range []struct {
+		memory   string
+		parallel int
+		want     int64
+		err      bool
+	}{
+		// 4GiB by default.
+		{"", 1, 4 * 1024 * mib, false},
+		{"", 4, 1024 * mib, false},
+		{"1073741824", 8, 128 * mib, false},
+		// Clamped to the largest part.
+		{"68719476736", 1, maxPartSize, false},
+		{"68719476736", 4, maxPartSize, false},
+		{"0", 1, 0, true},
+		{"-1", 1, 0, true},
+		{"4GiB", 1, 0, true},
+	} {
+		os.Setenv("PART_GROW_MEMORY", tc.memory)
+		got, err := partGrowLimit(tc.parallel)
+		if (err != nil) != tc.err {
+			t.Errorf("PART_GROW_MEMORY=%q: partGrowLimit(%d) error %v, want error %v", tc.memory, tc.parallel, err, tc.err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("PART_GROW_MEMORY=%q: partGrowLimit(%d) = %d, want %d", tc.memory, tc.parallel, got, tc.want)
+		}
+	}
+}
+
+func TestRotatedName(t *testing.T) {
+	for _, tc := range []struct {
+		seq  int
+		want string
+	}{
+		{1, "logs/app.log"},
+		{2, "logs/app.log.000002"},
+		{10, "logs/app.log.000010"},
+		{1000000, "logs/app.log.1000000"},
+	} {
+		if got := rotatedName("logs/app.log", tc.seq); got != tc.want {
+			t.Errorf("rotatedName(%q, %d) = %q, want %q", "logs/app.log", tc.seq, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// PlannedPart - a part of a multipart upload, by its place in the stream.
+type PlannedPart struct {
+	Number int   `json:"number"`
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// PartPlan - the parts of a multipart upload, in order. Uploads of the
+// same stream with the same plan have the same parts, and so the same
+// ETag.
+type PartPlan []PlannedPart
+
+// minPlannedPartSize - the smallest part S3 accepts but for the last.
+const minPlannedPartSize = 1024 * 1024 * 5
+
+// validate - checks the parts are numbered from 1 and follow each other
+// from offset 0, in sizes S3 accepts.
+func (p PartPlan) validate() error {
+	if len(p) == 0 {
+		return fmt.Errorf("Part plan has no parts")
+	}
+	if len(p) > maxPartsCount {
+		return fmt.Errorf("Part plan has %d parts, at most %d are allowed", len(p), maxPartsCount)
+	}
+	var offset int64
+	for i, part := range p {
+		if part.Number != i+1 {
+			return fmt.Errorf("Part %d of the plan is numbered %d", i+1, part.Number)
+		}
+		if part.Offset != offset {
+			return fmt.Errorf("Part %d starts at %d, expected %d", part.Number, part.Offset, offset)
+		}
+		if part.Size <= 0 {
+			return fmt.Errorf("Part %d has size %d", part.Number, part.Size)
+		}
+		if part.Size < minPlannedPartSize && i < len(p)-1 {
+			return fmt.Errorf("Part %d has size %d, all parts but the last need at least %d", part.Number, part.Size, minPlannedPartSize)
+		}
+		if part.Size > maxPartSize {
+			return fmt.Errorf("Part %d has size %d, at most %d are allowed", part.Number, part.Size, maxPartSize)
+		}
+		offset += part.Size
+	}
+	return nil
+}
+
+// fixedPlan - returns the plan of size bytes cut into parts of partSize.
+func fixedPlan(size, partSize int64) PartPlan {
+	var plan PartPlan
+	for offset := int64(0); offset < size; offset += partSize {
+		part := PlannedPart{Number: len(plan) + 1, Offset: offset, Size: partSize}
+		if offset+partSize > size {
+			part.Size = size - offset
+		}
+		plan = append(plan, part)
+	}
+	return plan
+}
+
+// planRecorder - rebuilds the plan followed by an upload from its
+// progress events.
+type planRecorder struct {
+	mu   sync.Mutex
+	plan PartPlan
+}
+
+func (r *planRecorder) progress(ev ProgressEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch ev.Type {
+	case UploadStarted:
+		// Restarted uploads start over.
+		r.plan = nil
+	case PartCompleted:
+		r.plan = append(r.plan, PlannedPart{Number: ev.PartNumber, Offset: ev.PartOffset, Size: ev.PartSize})
+	}
+}
+
+func (r *planRecorder) result() PartPlan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.Slice(r.plan, func(i, j int) bool { return r.plan[i].Number < r.plan[j].Number })
+	return r.plan
+}
+
+// PutStreamWithPlan - same as PutStream, cutting the stream into the
+// parts of plan, and returning the parts uploaded. With a nil plan the
+// parts are chosen as usual, and returned so they can be followed by
+// later uploads of the same stream.
+func PutStreamWithPlan(bucketName, objectName string, reader io.Reader, metaData map[string][]string, plan PartPlan) (n int64, used PartPlan, err error) {
+	if plan != nil {
+		if err = plan.validate(); err != nil {
+			return 0, nil, err
+		}
+	}
+	var recorder planRecorder
+	n, err = putStreamEnv(bucketName, objectName, reader, metaData, recorder.progress, plan)
+	return n, recorder.result(), err
+}
+
+// readPlan - reads a plan saved as JSON.
+func readPlan(file string) (PartPlan, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var plan PartPlan
+	if err = json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("Invalid part plan %s: %v", file, err)
+	}
+	return plan, plan.validate()
+}
+
+// writePlan - saves a plan as JSON.
+func writePlan(file string, plan PartPlan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// maxXattrMetadata - xattrs larger than this are not preserved, S3 user
+// metadata is limited to 2KB in total.
+const maxXattrMetadata = 1024
+
+// posixMetadata - adds the ownership and extended attributes of a file
+// to the mtime and permissions of fileMetadata.
+func posixMetadata(name string, info os.FileInfo) map[string][]string {
+	metaData := fileMetadata(info)
+	if uid, gid, ok := fileOwner(info); ok {
+		metaData["X-Amz-Meta-Uid"] = []string{strconv.Itoa(uid)}
+		metaData["X-Amz-Meta-Gid"] = []string{strconv.Itoa(gid)}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return metaData
+	}
+
+	xattrs, err := listXattrs(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "xattrs of", name, "not preserved:", err)
+		return metaData
+	}
+	if len(xattrs) == 0 {
+		return metaData
+	}
+	// Values are binary, JSON encodes them as base64.
+	data, _ := json.Marshal(xattrs)
+	if encoded := base64.StdEncoding.EncodeToString(data); len(encoded) <= maxXattrMetadata {
+		metaData["X-Amz-Meta-Xattrs"] = []string{encoded}
+	} else {
+		fmt.Fprintln(os.Stderr, "xattrs of", name, "too large, not preserved")
+	}
+	return metaData
+}
+
+// restoreAttributes - applies the attributes recorded in the metadata of
+// an object to the file it was downloaded to. Ownership can usually only
+// be restored by root, failures are reported but not fatal.
+func restoreAttributes(name string, metaData http.Header) error {
+	isLink := metaData.Get("X-Amz-Meta-Symlink-Target") != ""
+
+	if v := metaData.Get("X-Amz-Meta-Xattrs"); v != "" && !isLink {
+		var xattrs map[string][]byte
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err == nil {
+			err = json.Unmarshal(data, &xattrs)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid xattrs metadata: %v", err)
+		}
+		for attr, value := range xattrs {
+			if err = setXattr(name, attr, value); err != nil {
+				fmt.Fprintln(os.Stderr, "xattr", attr, "of", name, "not restored:", err)
+			}
+		}
+	}
+
+	if uid, gid := metaData.Get("X-Amz-Meta-Uid"), metaData.Get("X-Amz-Meta-Gid"); uid != "" && gid != "" {
+		u, uErr := strconv.Atoi(uid)
+		g, gErr := strconv.Atoi(gid)
+		if uErr != nil || gErr != nil {
+			return fmt.Errorf("Invalid ownership metadata %s:%s", uid, gid)
+		}
+		if err := os.Lchown(name, u, g); err != nil {
+			fmt.Fprintln(os.Stderr, "ownership of", name, "not restored:", err)
+		}
+	}
+	// Links have no permissions, and their times can't be set portably.
+	if isLink {
+		return nil
+	}
+
+	if v := metaData.Get("X-Amz-Meta-Mode"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid mode metadata %q", v)
+		}
+		if err = os.Chmod(name, os.FileMode(mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if v := metaData.Get("X-Amz-Meta-Mtime"); v != "" {
+		mtime, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return fmt.Errorf("Invalid mtime metadata %q", v)
+		}
+		if err = os.Chtimes(name, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
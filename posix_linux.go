@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+)
+
+// fileOwner - returns the uid and gid of a file.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// listXattrs - returns the extended attributes of a file.
+func listXattrs(name string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(name, nil)
+	if err != nil || size == 0 {
+		if err == syscall.ENOTSUP {
+			err = nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(name, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, attr := range bytes.Split(bytes.TrimRight(buf[:size], "\x00"), []byte{0}) {
+		n, err := syscall.Getxattr(name, string(attr), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(name, string(attr), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(attr)] = value[:n]
+	}
+	return xattrs, nil
+}
+
+// setXattr - sets an extended attribute of a file.
+func setXattr(name, attr string, value []byte) error {
+	return syscall.Setxattr(name, attr, value, 0)
+}
+
+// fileLinks - returns the identity and link count of a file.
+func fileLinks(info os.FileInfo) (id [2]uint64, nlink uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return id, 0, false
+	}
+	return [2]uint64{uint64(st.Dev), st.Ino}, uint64(st.Nlink), true
+}
+
+// mayBeSparse - returns true if fewer blocks are allocated to a file
+// than its size needs.
+func mayBeSparse(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < info.Size()
+}
+
+// Whence values of lseek(2) finding data and holes.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataRegions - returns the offsets and lengths of the data regions of a
+// file, holes being left out.
+func dataRegions(f *os.File, size int64) ([][2]int64, error) {
+	var regions [][2]int64
+	for off := int64(0); off < size; {
+		start, err := f.Seek(off, seekData)
+		if err == syscall.ENXIO {
+			// Only a hole is left.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, [2]int64{start, end - start})
+		off = end
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return regions, err
+}
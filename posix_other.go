@@ -0,0 +1,39 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// fileOwner - ownership is only preserved on Linux.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// listXattrs - xattrs are only preserved on Linux.
+func listXattrs(name string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// setXattr - xattrs are only restored on Linux.
+func setXattr(name, attr string, value []byte) error {
+	return errors.New("xattrs are not supported on this platform")
+}
+
+// fileLinks - hard links are only detected on Linux.
+func fileLinks(info os.FileInfo) (id [2]uint64, nlink uint64, ok bool) {
+	return id, 0, false
+}
+
+// mayBeSparse - sparse files are only detected on Linux.
+func mayBeSparse(info os.FileInfo) bool {
+	return false
+}
+
+// dataRegions - the whole file is data.
+func dataRegions(f *os.File, size int64) ([][2]int64, error) {
+	return [][2]int64{{0, size}}, nil
+}
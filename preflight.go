@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// preflightSuffix - appended to the object name for the probe upload,
+// so that key scoped policies apply to the probe as well.
+const preflightSuffix = ".preflight"
+
+// preflightPrefix - prefix of the probe objects completed by kmsPreflight,
+// which must not overwrite an object of the bucket.
+const preflightPrefix = ".preflight/"
+
+// isAccessDenied - returns true if the error is an access denied response.
+func isAccessDenied(err error) bool {
+	return errorCode(err) == "AccessDenied"
+}
+
+// preflight - verifies the permissions a streaming upload needs with a
+// probe multipart upload which is aborted right away, reporting every
+// missing permission at once.
+func preflight(c minio.Core, bucketName, objectName string, metaData map[string][]string) error {
+	probeName := objectName + preflightSuffix
+
+	uploadID, err := c.NewMultipartUpload(bucketName, probeName, metaData)
+	if err != nil {
+		err = wrapS3Error("NewMultipartUpload", err)
+		if isKMSError(err) {
+			return fmt.Errorf("Preflight failed, KMS key not usable for %s/%s: %v", bucketName, objectName, err)
+		}
+		if isAccessDenied(err) {
+			return fmt.Errorf("Preflight failed, missing s3:PutObject permission on %s/%s: %v",
+				bucketName, objectName, err)
+		}
+		return err
+	}
+
+	var missing []string
+	if _, err = c.ListObjectParts(bucketName, probeName, uploadID, 0, 1); err != nil {
+		if !isAccessDenied(err) {
+			return wrapS3Error("ListObjectParts", err)
+		}
+		missing = append(missing, "s3:ListMultipartUploadParts")
+	}
+
+	if err = c.AbortMultipartUpload(bucketName, probeName, uploadID); err != nil {
+		if !isAccessDenied(err) {
+			return wrapS3Error("AbortMultipartUpload", err)
+		}
+		missing = append(missing, "s3:AbortMultipartUpload")
+		fmt.Fprintln(os.Stderr, "preflight probe upload left behind", probeName, uploadID)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Preflight failed, missing %s permission on %s/%s",
+			strings.Join(missing, " and "), bucketName, objectName)
+	}
+	return nil
+}
+
+// preflightMain - implements the 'preflight [-bucket name] <object>' command.
+func preflightMain(args []string) error {
+	flags := flag.NewFlagSet("preflight", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to check")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: preflight [-bucket name] <object>")
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	metaData := envMetadata(map[string][]string{})
+	if err = preflight(c, *bucketName, flags.Arg(0), metaData); err != nil {
+		return err
+	}
+	if err = kmsPreflight(c, *bucketName, flags.Arg(0), metaData); err != nil {
+		return err
+	}
+	fmt.Println("Preflight OK")
+	return nil
+}
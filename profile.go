@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// partTiming - the stage durations of an uploaded part.
+type partTiming struct {
+	number int
+	size   int64
+	read   time.Duration
+	hash   time.Duration
+	upload time.Duration
+}
+
+// profiler - records the stage durations of the parts of an upload, for
+// '-profile-report'.
+type profiler struct {
+	mu          sync.Mutex
+	started     time.Time
+	finished    time.Time
+	readWorkers int
+	parts       []partTiming
+}
+
+func newProfiler() *profiler {
+	return &profiler{started: time.Now()}
+}
+
+// progress - a ProgressFunc recording part timings.
+func (p *profiler) progress(ev ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch ev.Type {
+	case UploadStarted:
+		// Restarted uploads start over.
+		p.started = ev.Time
+		p.readWorkers = ev.ReadWorkers
+		p.parts = nil
+	case PartCompleted:
+		p.parts = append(p.parts, partTiming{
+			number: ev.PartNumber,
+			size:   ev.PartSize,
+			read:   ev.ReadTime,
+			hash:   ev.HashTime,
+			upload: ev.UploadTime,
+		})
+	case Completed, Aborted:
+		p.finished = ev.Time
+	}
+}
+
+// stageStats - returns the total, median, 95th percentile and maximum of
+// a stage over the parts.
+func stageStats(parts []partTiming, stage func(partTiming) time.Duration) (total, p50, p95, max time.Duration) {
+	if len(parts) == 0 {
+		return 0, 0, 0, 0
+	}
+	d := make([]time.Duration, len(parts))
+	for i, part := range parts {
+		d[i] = stage(part)
+		total += d[i]
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	return total, d[len(d)/2], d[len(d)*95/100], d[len(d)-1]
+}
+
+// report - prints the stage statistics and which stage limited the
+// upload. Reading and hashing happen one part at a time ahead of the
+// uploads, unless the upload reported more read workers, and uploads
+// are spread over parallel workers, so a stage's share of wall time is
+// its total over the workers running it.
+func (p *profiler) report(w io.Writer, parallel int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wall := p.finished.Sub(p.started)
+	if p.finished.IsZero() {
+		wall = time.Since(p.started)
+	}
+	var bytes int64
+	for _, part := range p.parts {
+		bytes += part.size
+	}
+	fmt.Fprintf(w, "profile: %d parts, %d MiB in %s, %.2f MiB/s, %d parallel parts\n",
+		len(p.parts), bytes/(1024*1024), wall.Round(time.Millisecond), rate(bytes, wall), parallel)
+	if len(p.parts) == 0 || wall <= 0 {
+		return
+	}
+
+	readWorkers := p.readWorkers
+	if readWorkers < 1 {
+		readWorkers = 1
+	}
+	stages := []struct {
+		name    string
+		workers int
+		stage   func(partTiming) time.Duration
+	}{
+		{"reading", readWorkers, func(t partTiming) time.Duration { return t.read }},
+		{"hashing", readWorkers, func(t partTiming) time.Duration { return t.hash }},
+		{"uploading", parallel, func(t partTiming) time.Duration { return t.upload }},
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tTOTAL\tP50/PART\tP95/PART\tMAX/PART\tWALL%")
+	bottleneck, busiest := "", 0.0
+	for _, s := range stages {
+		total, p50, p95, max := stageStats(p.parts, s.stage)
+		busy := 100 * total.Seconds() / (wall.Seconds() * float64(s.workers))
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%.0f%%\n", s.name, total.Round(time.Millisecond),
+			p50.Round(time.Millisecond), p95.Round(time.Millisecond), max.Round(time.Millisecond), busy)
+		if busy > busiest {
+			bottleneck, busiest = s.name, busy
+		}
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "%s is the bottleneck at %.0f%% of wall time", bottleneck, busiest)
+	switch bottleneck {
+	case "reading":
+		fmt.Fprintln(w, ", the source can't deliver faster")
+	case "hashing":
+		if parallelHash() {
+			fmt.Fprintln(w, ", try more HASH_WORKERS, or fewer HASH_ALGORITHMS")
+		} else {
+			fmt.Fprintln(w, ", try PARALLEL_HASH=1, or fewer HASH_ALGORITHMS")
+		}
+	case "uploading":
+		fmt.Fprintln(w, ", try raising PARALLEL_PARTS")
+	}
+}
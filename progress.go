@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ProgressEventType - the kind of a ProgressEvent.
+type ProgressEventType int
+
+// Progress event types, in the order they occur during an upload.
+const (
+	// UploadStarted - a multipart upload was initiated.
+	UploadStarted ProgressEventType = iota
+	// PartStarted - a part was read and its upload is starting.
+	PartStarted
+	// PartCompleted - a part was uploaded.
+	PartCompleted
+	// Retry - a request is retried, Err holds the failure.
+	Retry
+	// Completed - the multipart upload was completed.
+	Completed
+	// Aborted - the upload failed and was given up, Err holds the failure.
+	Aborted
+	// ReadCompleted - the stream was read to its end and all its parts
+	// uploaded, the upload is about to be completed. Emitted before
+	// Completed, it is last to keep the values of the others.
+	ReadCompleted
+)
+
+func (t ProgressEventType) String() string {
+	switch t {
+	case UploadStarted:
+		return "UploadStarted"
+	case PartStarted:
+		return "PartStarted"
+	case PartCompleted:
+		return "PartCompleted"
+	case Retry:
+		return "Retry"
+	case Completed:
+		return "Completed"
+	case Aborted:
+		return "Aborted"
+	case ReadCompleted:
+		return "ReadCompleted"
+	}
+	return "Unknown"
+}
+
+// ProgressEvent - a typed event emitted while uploading a stream.
+type ProgressEvent struct {
+	Type     ProgressEventType
+	Time     time.Time
+	Bucket   string
+	Object   string
+	UploadID string
+
+	// Part number, size and offset in the stream, for part events.
+	PartNumber int
+	PartSize   int64
+	PartOffset int64
+
+	// Bytes uploaded so far in the current multipart upload.
+	Bytes int64
+
+	// ETag of the part and hex SHA-256 of its content, for PartCompleted
+	// events. SHA256 is empty if the part was not hashed with it. ETag of
+	// the object for Completed events of multipart uploads.
+	ETag   string
+	SHA256 string
+
+	// Time spent reading, hashing and uploading the part, for
+	// PartCompleted events, and summed over the parts for Completed
+	// events.
+	ReadTime   time.Duration
+	HashTime   time.Duration
+	UploadTime time.Duration
+
+	// Parts read and hashed at once, for UploadStarted events, one if
+	// zero.
+	ReadWorkers int
+
+	Err error
+}
+
+// ProgressFunc - receives progress events. Calls for the same upload
+// never happen concurrently.
+type ProgressFunc func(ProgressEvent)
+
+// ProgressChannel - returns a ProgressFunc sending all events to ch,
+// uploads block while ch is full.
+func ProgressChannel(ch chan<- ProgressEvent) ProgressFunc {
+	return func(ev ProgressEvent) {
+		ch <- ev
+	}
+}
+
+// multiProgress - returns a ProgressFunc calling all non-nil fns in order.
+func multiProgress(fns ...ProgressFunc) ProgressFunc {
+	var progress []ProgressFunc
+	for _, fn := range fns {
+		if fn != nil {
+			progress = append(progress, fn)
+		}
+	}
+	if len(progress) == 0 {
+		return nil
+	}
+	return func(ev ProgressEvent) {
+		for _, fn := range progress {
+			fn(ev)
+		}
+	}
+}
+
+// serialProgress - returns a ProgressFunc which may be called from
+// several goroutines, calling fn with one event at a time.
+func serialProgress(fn ProgressFunc) ProgressFunc {
+	if fn == nil {
+		return func(ProgressEvent) {}
+	}
+	var mu sync.Mutex
+	return func(ev ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn(ev)
+	}
+}
+
+// PutStreamWithProgress - same as PutStream, reporting progress to fn.
+func PutStreamWithProgress(bucketName, objectName string, reader io.Reader, metaData map[string][]string, fn ProgressFunc) (n int64, err error) {
+	return putStreamEnv(bucketName, objectName, reader, metaData, fn, nil)
+}
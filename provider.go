@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// Storage providers selected with '-provider'.
+const (
+	providerS3    = "s3"
+	providerGCS   = "gcs"
+	providerAzure = "azure"
+)
+
+var flagProvider = flag.String("provider", providerS3, "storage provider: s3, gcs, azure or file:///path")
+
+// isGCS - returns true when targeting the S3 compatible XML API of
+// Google Cloud Storage.
+func isGCS() bool {
+	return *flagProvider == providerGCS
+}
+
+// isAzure - returns true when targeting Azure Blob Storage.
+func isAzure() bool {
+	return *flagProvider == providerAzure
+}
+
+// isFile - returns true when writing to a local directory.
+func isFile() bool {
+	return strings.HasPrefix(*flagProvider, "file://")
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Symlink policies of 'put-dir'.
+const (
+	symlinkSkip     = "skip"
+	symlinkFollow   = "follow"
+	symlinkPreserve = "preserve"
+)
+
+// parseS3URL - splits 's3://bucket/prefix' into its bucket and prefix.
+func parseS3URL(s string) (bucketName, prefix string, err error) {
+	if !strings.HasPrefix(s, "s3://") {
+		return "", "", fmt.Errorf("Expected s3://bucket/prefix, got %q", s)
+	}
+	s = strings.TrimPrefix(s, "s3://")
+	if i := strings.Index(s, "/"); i >= 0 {
+		bucketName, prefix = s[:i], strings.TrimPrefix(s[i+1:], "/")
+	} else {
+		bucketName = s
+	}
+	if bucketName == "" {
+		return "", "", fmt.Errorf("Missing bucket in s3://%s", s)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return bucketName, prefix, nil
+}
+
+// parseS3Prefix - splits 's3://bucket/prefix' into its bucket and
+// prefix, kept as given so that 's3://b/log' matches 'log*'.
+func parseS3Prefix(s string) (bucketName, prefix string, err error) {
+	if !strings.HasPrefix(s, "s3://") {
+		return "", "", fmt.Errorf("Expected s3://bucket/prefix, got %q", s)
+	}
+	location := strings.TrimPrefix(s, "s3://")
+	bucketName = location
+	if i := strings.Index(location, "/"); i >= 0 {
+		bucketName, prefix = location[:i], location[i+1:]
+	}
+	if bucketName == "" {
+		return "", "", fmt.Errorf("Missing bucket in %s", s)
+	}
+	return bucketName, prefix, nil
+}
+
+// splitPatterns - returns the comma separated glob patterns of s.
+func splitPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// matchAny - returns true if the relative slash separated path, or its
+// base name, matches one of patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fileMetadata - returns the metadata preserving the mtime and
+// permissions of a file.
+func fileMetadata(info os.FileInfo) map[string][]string {
+	return map[string][]string{
+		"X-Amz-Meta-Mtime": {info.ModTime().UTC().Format(time.RFC3339Nano)},
+		"X-Amz-Meta-Mode":  {"0" + strconv.FormatUint(uint64(info.Mode().Perm()), 8)},
+	}
+}
+
+// putSmallFile - uploads a file in a single request.
+func putSmallFile(c minio.Core, bucketName, objectName, name string, metaData map[string][]string) (int64, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	if err = putObjectBytes(c, bucketName, objectName, data, metaData); err != nil {
+		return 0, wrapS3Error("PutObject", err)
+	}
+	return int64(len(data)), nil
+}
+
+// dirEntry - a file found by 'put-dir'.
+type dirEntry struct {
+	name     string
+	key      string
+	size     int64
+	sparse   bool
+	metaData map[string][]string
+}
+
+// putDirMain - implements the 'put-dir <dir> s3://bucket/prefix'
+// command, which uploads the files of a directory named after their
+// relative paths. Small files are uploaded in a single request, others
+// are streamed as multipart uploads. Sparse files are uploaded without
+// their holes and hard links as references to the first key uploaded.
+func putDirMain(args []string) error {
+	flags := flag.NewFlagSet("put-dir", flag.ExitOnError)
+	recursive := flags.Bool("recursive", false, "upload subdirectories too")
+	include := flags.String("include", "", "comma separated globs, only matching files are uploaded")
+	exclude := flags.String("exclude", "", "comma separated globs of files not uploaded")
+	symlinks := flags.String("symlinks", symlinkSkip, "symlink policy: skip, follow or preserve as empty objects")
+	singlePutMax := flags.Int64("single-put-max", 16*1024*1024, "largest file uploaded in a single request")
+	parallel := flags.Int("parallel", 4, "number of files uploaded at once")
+	posix := flags.Bool("posix", false, "also preserve ownership and xattrs as metadata")
+	flags.Parse(args)
+	if flags.NArg() != 2 || *parallel < 1 {
+		return fmt.Errorf("Usage: put-dir [-recursive] [-include globs] [-exclude globs] [-symlinks policy] <dir> s3://bucket/prefix")
+	}
+	switch *symlinks {
+	case symlinkSkip, symlinkFollow, symlinkPreserve:
+	default:
+		return fmt.Errorf("Unknown symlink policy %q", *symlinks)
+	}
+	root := flags.Arg(0)
+	bucketName, prefix, err := parseS3URL(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	metadataOf := func(name string, info os.FileInfo) map[string][]string {
+		if *posix {
+			return posixMetadata(name, info)
+		}
+		return fileMetadata(info)
+	}
+	includes, err := splitPatterns(*include)
+	if err != nil {
+		return err
+	}
+	excludes, err := splitPatterns(*exclude)
+	if err != nil {
+		return err
+	}
+
+	var entries []dirEntry
+	// Later links to a file are uploaded as references to its first key.
+	linked := make(map[[2]uint64]string)
+	err = filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel != "." && !*recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if (len(includes) > 0 && !matchAny(includes, rel)) || matchAny(excludes, rel) {
+			return nil
+		}
+
+		entry := dirEntry{name: name, key: prefix + rel}
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch *symlinks {
+			case symlinkSkip:
+				return nil
+			case symlinkPreserve:
+				target, err := os.Readlink(name)
+				if err != nil {
+					return err
+				}
+				entry.name = ""
+				entry.metaData = metadataOf(name, info)
+				entry.metaData["X-Amz-Meta-Symlink-Target"] = []string{target}
+				entries = append(entries, entry)
+				return nil
+			}
+			// Directory links are not followed, they may loop.
+			if info, err = os.Stat(name); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				fmt.Fprintln(os.Stderr, "not following directory link", name)
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		entry.size = info.Size()
+		entry.sparse = mayBeSparse(info)
+		entry.metaData = metadataOf(name, info)
+		if id, nlink, ok := fileLinks(info); ok && nlink > 1 {
+			if target, ok := linked[id]; ok {
+				entry.name = ""
+				entry.metaData["X-Amz-Meta-Hardlink-Target"] = []string{target}
+			} else {
+				linked[id] = entry.key
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	summary := batchSummary{Total: len(entries)}
+	enc := json.NewEncoder(os.Stdout)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan dirEntry)
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range work {
+				var n int64
+				var err error
+				switch {
+				case entry.name == "":
+					err = wrapS3Error("PutObject", putObjectBytes(c, bucketName, entry.key, nil, entry.metaData))
+				case entry.sparse:
+					n, err = putSparseFile(bucketName, entry.key, entry.name, entry.metaData)
+				case entry.size <= *singlePutMax:
+					n, err = putSmallFile(c, bucketName, entry.key, entry.name, entry.metaData)
+				default:
+					n, err = putFile(bucketName, entry.key, entry.name, entry.metaData)
+				}
+
+				mu.Lock()
+				result := multiResult{Object: entry.key, Size: n}
+				if err != nil {
+					summary.Failed++
+					result.Error = newErrorDetail(err)
+				} else {
+					summary.Uploaded++
+					summary.Bytes += n
+				}
+				enc.Encode(result)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, entry := range entries {
+		work <- entry
+	}
+	close(work)
+	wg.Wait()
+
+	summary.Seconds = time.Since(start).Seconds()
+	enc.Encode(summary)
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d files failed", summary.Failed, summary.Total)
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spoolJob - a stream waiting in the spool directory, its data being
+// stored next to it as '<id>.data'.
+type spoolJob struct {
+	ID          string    `json:"id"`
+	Bucket      string    `json:"bucket"`
+	Object      string    `json:"object"`
+	Enqueued    time.Time `json:"enqueued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// spool - a durable queue of streams in a local directory. Jobs appear
+// atomically once their data is synced, and are only removed after
+// their upload completed, so every stream is delivered at least once.
+type spool struct {
+	dir string
+}
+
+// failedDir - directory of the spool jobs are moved to once they can't
+// be delivered, they are queued again when moved back.
+const failedDir = "failed"
+
+// permanentCodes - error codes of deliveries which retrying won't fix.
+var permanentCodes = map[string]bool{
+	"NoSuchBucket":          true,
+	"AccessDenied":          true,
+	"InvalidBucketName":     true,
+	"InvalidAccessKeyId":    true,
+	"KeyTooLongError":       true,
+	"AllAccessDisabled":     true,
+	"InvalidObjectState":    true,
+	"MethodNotAllowed":      true,
+	"EntityTooLarge":        true,
+	"SignatureDoesNotMatch": true,
+}
+
+func (s spool) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// syncDir - syncs a directory, so that the entries renamed into it
+// survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cErr := d.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// writeSynced - writes a file through a synced temporary file, so it
+// either exists whole or not at all.
+func writeSynced(name string, r io.Reader) (int64, error) {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return n, err
+}
+
+// saveJob - stores the state of a job.
+func (s spool) saveJob(job spoolJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = writeSynced(s.path(job.ID, ".json"), bytes.NewReader(data))
+	return err
+}
+
+// enqueue - spools the stream for upload to bucketName/objectName.
+func (s spool) enqueue(bucketName, objectName string, r io.Reader) (spoolJob, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return spoolJob{}, err
+	}
+	now := time.Now().UTC()
+	// Ids sort in enqueue order.
+	job := spoolJob{
+		ID:       fmt.Sprintf("%s-%09d-%s", now.Format("20060102T150405Z"), now.Nanosecond(), hex.EncodeToString(suffix)),
+		Bucket:   bucketName,
+		Object:   objectName,
+		Enqueued: now,
+	}
+	if _, err := writeSynced(s.path(job.ID, ".data"), r); err != nil {
+		return spoolJob{}, err
+	}
+	if err := s.saveJob(job); err != nil {
+		os.Remove(s.path(job.ID, ".data"))
+		return spoolJob{}, err
+	}
+	return job, nil
+}
+
+// pending - returns the spooled jobs in enqueue order.
+func (s spool) pending() ([]spoolJob, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var jobs []spoolJob
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var job spoolJob
+		if err = json.Unmarshal(data, &job); err != nil {
+			return nil, fmt.Errorf("Spooled job %s unreadable: %v", name, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// ack - removes a delivered job, its state first so that a crash never
+// leaves a job without data.
+func (s spool) ack(job spoolJob) error {
+	if err := os.Remove(s.path(job.ID, ".json")); err != nil {
+		return err
+	}
+	return os.Remove(s.path(job.ID, ".data"))
+}
+
+// fail - moves a job which can't be delivered aside, its state first so
+// that a crash never leaves a queued job without data.
+func (s spool) fail(job spoolJob) error {
+	dir := filepath.Join(s.dir, failedDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, ext := range []string{".json", ".data"} {
+		if err := os.Rename(s.path(job.ID, ext), filepath.Join(dir, job.ID+ext)); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+// deliver - uploads a job, acking it on success and scheduling a retry
+// with exponential backoff otherwise. Jobs failing permanently, or more
+// than maxAttempts times if not 0, are moved aside.
+func (s spool) deliver(job spoolJob, maxBackoff time.Duration, maxAttempts int) error {
+	f, err := os.Open(s.path(job.ID, ".data"))
+	if err != nil {
+		return err
+	}
+	_, err = PutStream(job.Bucket, job.Object, f, map[string][]string{})
+	f.Close()
+	if err == nil {
+		fmt.Fprintln(os.Stderr, "delivered", job.ID, "to", job.Bucket+"/"+job.Object)
+		return s.ack(job)
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	if permanentCodes[errorCode(err)] || (maxAttempts > 0 && job.Attempts >= maxAttempts) {
+		fmt.Fprintln(os.Stderr, "delivery of", job.ID, "failed after", job.Attempts, "attempts, moved to", filepath.Join(s.dir, failedDir), ":", err)
+		if sErr := s.saveJob(job); sErr != nil {
+			return sErr
+		}
+		return s.fail(job)
+	}
+	backoff := time.Second << uint(job.Attempts)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	job.NextAttempt = time.Now().Add(backoff)
+	fmt.Fprintln(os.Stderr, "delivery of", job.ID, "failed, retrying in", backoff, ":", err)
+	return s.saveJob(job)
+}
+
+// drain - delivers the jobs that are due, oldest first.
+func (s spool) drain(maxBackoff time.Duration, maxAttempts int) error {
+	jobs, err := s.pending()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if time.Now().Before(job.NextAttempt) {
+			continue
+		}
+		if err = s.deliver(job, maxBackoff, maxAttempts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkedReader - reads a stream sent as chunks, each preceded by its
+// size as a hexadecimal line, and ended by a chunk of size 0. Streams
+// cut before their last chunk fail with io.ErrUnexpectedEOF, so that
+// those of producers dying mid-stream are never delivered.
+type chunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		line, err := c.r.ReadString('\n')
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("Invalid chunk size %q", strings.TrimSpace(line))
+		}
+		if size == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = size
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// acceptStreams - spools the streams sent to the socket, each preceded
+// by a '<bucket> <object>' line and sent as chunks, see chunkedReader,
+// and replies with the job id.
+func (s spool) acceptStreams(l net.Listener, bucketName string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "accept failed", err)
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			line, err := br.ReadString('\n')
+			if err != nil {
+				fmt.Fprintln(conn, "error", err)
+				return
+			}
+			fields := strings.Fields(line)
+			switch len(fields) {
+			case 1:
+				fields = []string{bucketName, fields[0]}
+			case 2:
+			default:
+				fmt.Fprintln(conn, "error expected '[bucket] object'")
+				return
+			}
+			// Closing the connection doesn't end the stream, the last
+			// chunk does.
+			job, err := s.enqueue(fields[0], fields[1], &chunkedReader{r: br})
+			if err != nil {
+				fmt.Fprintln(conn, "error", err)
+				return
+			}
+			fmt.Fprintln(conn, "ok", job.ID)
+		}(conn)
+	}
+}
+
+// enqueueMain - implements the 'enqueue -spool dir <object>' command,
+// which spools stdin for the queue worker and returns immediately.
+func enqueueMain(args []string) error {
+	flags := flag.NewFlagSet("enqueue", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	dir := flags.String("spool", "", "spool directory of the queue")
+	flags.Parse(args)
+	if *dir == "" || flags.NArg() != 1 {
+		return fmt.Errorf("Usage: enqueue -spool dir [-bucket name] <object>")
+	}
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		return err
+	}
+	job, err := spool{dir: *dir}.enqueue(*bucketName, flags.Arg(0), os.Stdin)
+	if err != nil {
+		return err
+	}
+	fmt.Println(job.ID)
+	return nil
+}
+
+// queueWorkerMain - implements the 'queue-worker' command, which
+// uploads spooled streams, retrying them across restarts, and
+// optionally accepts streams on a unix socket.
+func queueWorkerMain(args []string) error {
+	flags := flag.NewFlagSet("queue-worker", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket of streams sent to the socket without one")
+	dir := flags.String("spool", "", "spool directory of the queue")
+	socket := flags.String("socket", "", "unix socket accepting '[bucket] object' lines followed by a stream in chunks, each preceded by its size in hex, ended by a 0 size")
+	poll := flags.Duration("poll", 5*time.Second, "interval the spool is checked at")
+	maxBackoff := flags.Duration("max-backoff", 10*time.Minute, "longest delay between attempts of a job")
+	maxAttempts := flags.Int("max-attempts", 0, "attempts after which a job is moved to the failed directory of the spool, 0 for no limit")
+	once := flags.Bool("once", false, "exit once no job is due")
+	flags.Parse(args)
+	if *dir == "" || flags.NArg() != 0 {
+		return fmt.Errorf("Usage: queue-worker -spool dir [-socket path] [-bucket name]")
+	}
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		return err
+	}
+	s := spool{dir: *dir}
+
+	if *socket != "" {
+		os.Remove(*socket)
+		l, err := net.Listen("unix", *socket)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		// Anyone able to connect can upload with the credentials of the
+		// worker.
+		if err = os.Chmod(*socket, 0600); err != nil {
+			return err
+		}
+		go s.acceptStreams(l, *bucketName)
+	}
+
+	for {
+		if err := s.drain(*maxBackoff, *maxAttempts); err != nil {
+			return err
+		}
+		if *once {
+			return nil
+		}
+		time.Sleep(*poll)
+	}
+}
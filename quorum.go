@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// repairPrefix - prefix under which repair queue objects are stored.
+const repairPrefix = ".repair/"
+
+// repairEntry - records an object which did not reach all the sites
+// of a quorum write, drained later by the 'repair' command.
+type repairEntry struct {
+	Bucket  string    `json:"bucket"`
+	Object  string    `json:"object"`
+	Size    int64     `json:"size"`
+	Acked   []string  `json:"acked"`
+	Missing []string  `json:"missing"`
+	Created time.Time `json:"created"`
+}
+
+// errQuorumLost - returned when too many sites failed to satisfy the write quorum.
+var errQuorumLost = errors.New("Write quorum lost")
+
+// quorumWriter - writes to all its writers, writers failing on write
+// are dropped as long as at least quorum of them are still alive. A
+// site too far behind fails the write with the lagFail policy.
+type quorumWriter struct {
+	writers []fanoutWriter
+	alive   []bool
+	quorum  int
+	policy  string
+}
+
+func (q *quorumWriter) Write(p []byte) (int, error) {
+	live := 0
+	for i, w := range q.writers {
+		if !q.alive[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			if err == errSiteBehind {
+				if q.policy == lagFail {
+					return 0, err
+				}
+				// Its upload is aborted, and the site repaired later.
+				w.CloseWithError(err)
+			}
+			q.alive[i] = false
+			continue
+		}
+		live++
+	}
+	if live < q.quorum {
+		return 0, errQuorumLost
+	}
+	return len(p), nil
+}
+
+// Close - closes all alive writers, with err if not nil.
+func (q *quorumWriter) Close(err error) {
+	for i, w := range q.writers {
+		if q.alive[i] {
+			w.CloseWithError(err)
+		}
+	}
+}
+
+// writeQuorum - returns the configured write quorum for a number of sites,
+// defaults to a simple majority.
+func writeQuorum(sites int) (int, error) {
+	w := sites/2 + 1
+	if v := os.Getenv("QUORUM_WRITES"); v != "" {
+		var err error
+		if w, err = strconv.Atoi(v); err != nil {
+			return 0, err
+		}
+	}
+	if w < 1 || w > sites {
+		return 0, fmt.Errorf("Invalid write quorum %d for %d sites", w, sites)
+	}
+	return w, nil
+}
+
+// PutStreamQuorum - uploads the stream to all sites in QUORUM_SITES and
+// succeeds when at least QUORUM_WRITES of them acknowledge. Sites missing
+// the object are recorded in a repair queue object on every acked site.
+// With QUORUM_SPOOL, sites read the stream at their own pace, up to that
+// many bytes behind the fastest.
+func PutStreamQuorum(bucketName, objectName string, reader io.Reader, metaData map[string][]string) (n int64, err error) {
+	sites, err := parseSites(os.Getenv("QUORUM_SITES"))
+	if err != nil {
+		return 0, err
+	}
+
+	quorum, err := writeQuorum(len(sites))
+	if err != nil {
+		return 0, err
+	}
+	fanout, err := fanoutFromEnv()
+	if err != nil {
+		return 0, err
+	}
+	metaData = envMetadata(metaData)
+
+	cores := make([]minio.Core, len(sites))
+	for i, s := range sites {
+		if cores[i], err = s.core(); err != nil {
+			return 0, err
+		}
+	}
+
+	q := &quorumWriter{
+		writers: make([]fanoutWriter, len(sites)),
+		alive:   make([]bool, len(sites)),
+		quorum:  quorum,
+		policy:  fanout.policy,
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(sites))
+	for i := range sites {
+		pr, pw, err := fanout.pipe(sites[i].Address)
+		if err != nil {
+			q.Close(err)
+			wg.Wait()
+			return 0, err
+		}
+		q.writers[i] = pw
+		q.alive[i] = true
+
+		wg.Add(1)
+		go func(i int, pr fanoutReader) {
+			defer wg.Done()
+			e := singleEndpoint(cores[i])
+			var uploadID string
+			_, uploadID, errs[i] = putStream(e, bucketName, objectName, pr, metaData, nil, nil)
+			if errs[i] != nil {
+				fmt.Fprintln(os.Stderr, "site failed", sites[i].Address, errs[i])
+				// Unblock the writer for a site that gave up early.
+				pr.CloseWithError(errs[i])
+				// The site is repaired from a whole copy, its parts are
+				// of no use.
+				if uploadID != "" {
+					if aErr := e.backend().AbortMultipartUpload(bucketName, objectName, uploadID); aErr != nil {
+						fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", sites[i].Address, aErr)
+					}
+				}
+			}
+		}(i, pr)
+	}
+
+	n, err = io.Copy(q, reader)
+	q.Close(err)
+	wg.Wait()
+	if err != nil {
+		return n, err
+	}
+
+	var acked, missing []int
+	for i := range sites {
+		if errs[i] == nil {
+			acked = append(acked, i)
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	if len(acked) < quorum {
+		return n, errQuorumLost
+	}
+	if len(missing) == 0 {
+		return n, nil
+	}
+
+	entry := repairEntry{
+		Bucket:  bucketName,
+		Object:  objectName,
+		Size:    n,
+		Created: time.Now().UTC(),
+	}
+	for _, i := range acked {
+		entry.Acked = append(entry.Acked, sites[i].Address)
+	}
+	for _, i := range missing {
+		entry.Missing = append(entry.Missing, sites[i].Address)
+	}
+
+	// Record the repair entry on every acked site, any one of them
+	// surviving is enough for 'repair' to find it.
+	recorded := false
+	for _, i := range acked {
+		if rErr := writeRepairEntry(cores[i], entry); rErr != nil {
+			fmt.Fprintln(os.Stderr, "writeRepairEntry failed", sites[i].Address, rErr)
+			continue
+		}
+		recorded = true
+	}
+	if !recorded {
+		return n, fmt.Errorf("Unable to record repair entry for %s/%s", bucketName, objectName)
+	}
+	return n, nil
+}
+
+// repairObjectName - returns the repair queue object name for an entry.
+func repairObjectName(entry repairEntry) string {
+	sum := sha256.Sum256([]byte(entry.Bucket + "/" + entry.Object))
+	return fmt.Sprintf("%s%s-%d.json", repairPrefix, hex.EncodeToString(sum[:]), entry.Created.UnixNano())
+}
+
+// writeRepairEntry - saves a repair queue entry to the entry's bucket.
+func writeRepairEntry(c minio.Core, entry repairEntry) error {
+	return putJSON(c, entry.Bucket, repairObjectName(entry), entry)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// readerAtSource - returns the source as an io.ReaderAt and its current
+// offset, if parts can be read from it in any order.
+func readerAtSource(reader io.Reader) (io.ReaderAt, int64, bool) {
+	ra, ok := reader.(io.ReaderAt)
+	if !ok {
+		return nil, 0, false
+	}
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return nil, 0, false
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, false
+	}
+	return ra, start, true
+}
+
+// mapPart - memory maps a part of a file source with PARALLEL_HASH,
+// returning nil where it can't be mapped.
+func mapPart(reader io.Reader, offset, size int64) ([]byte, func() error) {
+	f, ok := reader.(*os.File)
+	if !ok || !parallelHash() {
+		return nil, nil
+	}
+	data, unmap, err := mmapRegion(f, offset, size)
+	if err != nil {
+		return nil, nil
+	}
+	return data, unmap
+}
+
+// faultIn - reads a byte of each page of a mapping, so that reading it
+// from disk is timed apart from hashing it. Fails with errDataFault if
+// the file was truncated under the mapping.
+func faultIn(data []byte) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			err = errDataFault
+		}
+	}()
+	var sum byte
+	for i := 0; i < len(data); i += os.Getpagesize() {
+		sum += data[i]
+	}
+	runtime.KeepAlive(sum)
+	return nil
+}
+
+// timedReader - an io.Reader summing the time spent reading r.
+type timedReader struct {
+	r    io.Reader
+	took time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	t.took += time.Since(start)
+	return n, err
+}
+
+// putStreamAt - uploads size bytes of reader from its current offset,
+// with workers hashing and uploading their own ranges of it. Parts are
+// read twice from the source instead of being buffered, so memory use
+// does not grow with PARALLEL_PARTS, and retries read them again. With
+// PARALLEL_HASH, parts of files are memory mapped to be hashed
+// concurrently, and read again if the file changes under the mapping.
+func putStreamAt(e *endpoints, bucketName, objectName string, reader io.Reader, size int64, metaData map[string][]string, progress ProgressFunc, plan PartPlan) (n int64, uploadID string, err error) {
+	source, start, _ := readerAtSource(reader)
+	if plan == nil {
+		// The parts of buffered streams of the same size, so ETags don't
+		// depend on the path.
+		_, partSize, _, err := e.partInfo(size)
+		if err != nil {
+			return 0, "", err
+		}
+		plan = fixedPlan(size, partSize)
+	}
+	if last := plan[len(plan)-1]; last.Offset+last.Size != size {
+		return 0, "", fmt.Errorf("Part plan covers %d bytes, the source has %d", last.Offset+last.Size, size)
+	}
+
+	err = e.initiate(func(b Backend) (err error) {
+		uploadID, err = b.NewMultipartUpload(bucketName, objectName, metaData)
+		return err
+	})
+	if err != nil {
+		err = wrapS3Error("NewMultipartUpload", err)
+		fmt.Fprintln(os.Stderr, "NewMultipartUpload failed", err)
+		return 0, "", err
+	}
+
+	wd, err := startWatchdog(uploadID)
+	if err != nil {
+		return 0, uploadID, err
+	}
+	defer wd.stop()
+
+	emit := func(ev ProgressEvent) {
+		ev.Time = time.Now()
+		ev.Bucket = bucketName
+		ev.Object = objectName
+		ev.UploadID = uploadID
+		wd.observe(ev)
+		progress(ev)
+	}
+	parallel, err := e.parallelParts()
+	if err != nil {
+		return 0, uploadID, err
+	}
+	// Each worker reads and hashes its own parts.
+	emit(ProgressEvent{Type: UploadStarted, ReadWorkers: parallel})
+
+	var (
+		mu        sync.Mutex
+		uploadErr error
+		parts     []minio.CompletePart
+		wg        sync.WaitGroup
+
+		// Time spent in each stage, summed over the parts.
+		readTime, hashTime, uploadTime time.Duration
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if uploadErr == nil {
+			uploadErr = err
+			fmt.Fprintln(os.Stderr, "PutObjectPart failed", err)
+		}
+	}
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr
+	}
+
+	jobs := make(chan PlannedPart)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range jobs {
+				if failed() != nil {
+					continue
+				}
+				offset := start + part.Offset
+
+				hashSums := make(map[string][]byte)
+				hashAlgos, err := partHashAlgos()
+				if err != nil {
+					fail(err)
+					continue
+				}
+				var partReadTime, partHashTime time.Duration
+				readStart := time.Now()
+				hashed := false
+				if partData, unmap := mapPart(reader, offset, part.Size); partData != nil {
+					err = faultIn(partData)
+					partReadTime = time.Since(readStart)
+					if err == nil {
+						err = hashBytes(hashAlgos, hashSums, partData)
+					}
+					partHashTime = time.Since(readStart) - partReadTime
+					unmap()
+					// Files truncated under the mapping are read instead.
+					if hashed = err == nil; !hashed {
+						fmt.Fprintln(os.Stderr, "part", part.Number, "changed while mapped, reading it instead")
+						if hashAlgos, err = partHashAlgos(); err != nil {
+							fail(err)
+							continue
+						}
+						hashSums = make(map[string][]byte)
+						readStart = time.Now()
+					}
+				}
+				if !hashed {
+					timed := &timedReader{r: io.NewSectionReader(source, offset, part.Size)}
+					read, err := hashCopyN(hashAlgos, hashSums, ioutil.Discard, timed, part.Size)
+					if err == nil && read != part.Size {
+						err = io.ErrUnexpectedEOF
+					}
+					if err != nil {
+						fail(err)
+						continue
+					}
+					partReadTime += timed.took
+					partHashTime += time.Since(readStart) - timed.took
+				}
+				// Parts are uploaded from the file, faults of a mapping
+				// can't be recovered from on the goroutines of the client.
+				partReader := func() io.Reader {
+					return io.NewSectionReader(source, offset, part.Size)
+				}
+
+				emit(ProgressEvent{Type: PartStarted, PartNumber: part.Number, PartSize: part.Size, PartOffset: part.Offset})
+				var attempt int
+				var lastErr error
+				var objPart minio.ObjectPart
+				uploadStart := time.Now()
+				err = e.do(func(b Backend) error {
+					if attempt++; attempt > 1 {
+						emit(ProgressEvent{Type: Retry, PartNumber: part.Number, PartSize: part.Size, PartOffset: part.Offset, Err: lastErr})
+					}
+					// Again if the watchdog restarted the part.
+					for {
+						generation := requestWatch.current(uploadID)
+						objPart, lastErr = b.PutObjectPart(bucketName, objectName, uploadID, part.Number,
+							part.Size, partReader(), hashSums["md5"], hashSums["sha256"])
+						if lastErr == nil || !requestWatch.cancelledSince(uploadID, generation) {
+							return lastErr
+						}
+						if lErr := e.limits.spendRetry(lastErr); lErr != nil {
+							return lErr
+						}
+						emit(ProgressEvent{Type: Retry, PartNumber: part.Number, PartSize: part.Size, PartOffset: part.Offset, Err: lastErr})
+					}
+				})
+				partUploadTime := time.Since(uploadStart)
+				if err != nil {
+					fail(wrapS3Error("PutObjectPart", err))
+					continue
+				}
+
+				mu.Lock()
+				parts = append(parts, minio.CompletePart{PartNumber: part.Number, ETag: objPart.ETag})
+				n += part.Size
+				uploaded := n
+				readTime += partReadTime
+				hashTime += partHashTime
+				uploadTime += partUploadTime
+				mu.Unlock()
+				emit(ProgressEvent{Type: PartCompleted, PartNumber: part.Number, PartSize: part.Size, PartOffset: part.Offset, Bytes: uploaded,
+					ReadTime: partReadTime, HashTime: partHashTime, UploadTime: partUploadTime,
+					ETag: objPart.ETag, SHA256: hex.EncodeToString(hashSums["sha256"])})
+			}
+		}()
+	}
+	for _, part := range plan {
+		if failed() != nil {
+			break
+		}
+		if err = e.limits.checkDeadline(); err != nil {
+			break
+		}
+		jobs <- part
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		err = failed()
+	}
+	if err != nil {
+		return n, uploadID, err
+	}
+
+	emit(ProgressEvent{Type: ReadCompleted, Bytes: n})
+	sort.Sort(completedParts(parts))
+	err = completeUpload(e, bucketName, objectName, uploadID, parts)
+	if err != nil {
+		err = wrapS3Error("CompleteMultipartUpload", err)
+		fmt.Fprintln(os.Stderr, "CompleteMultipartUpload failed", err)
+		return n, uploadID, err
+	}
+	emit(ProgressEvent{Type: Completed, Bytes: n, ETag: completedETag(parts), ReadTime: readTime, HashTime: hashTime, UploadTime: uploadTime})
+
+	// Leave the source read, as a sequential upload would.
+	_, err = reader.(io.Seeker).Seek(start+size, io.SeekStart)
+	return n, uploadID, err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// redactMask - replaces redacted values unless a rule says otherwise.
+const redactMask = "[REDACTED]"
+
+// builtinRedactions - patterns that can be named with -redact.
+var builtinRedactions = map[string]string{
+	"email":       `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"credit-card": `\b[2-6](?:\d[ -]?){11,17}\d\b`,
+	"token":       `(?i)\b(?:bearer\s+[A-Za-z0-9._~+/=-]+|(?:AKIA|ASIA)[A-Z0-9]{16}|gh[pousr]_[A-Za-z0-9]{36}|xox[baprs]-[A-Za-z0-9-]+)`,
+}
+
+// builtinChecks - validate the matches of builtin patterns, which are
+// only redacted if valid, so that ids and timestamps are kept.
+var builtinChecks = map[string]func([]byte) bool{
+	"credit-card": luhnValid,
+}
+
+// luhnValid - returns true if the digits of s pass the Luhn check of
+// card numbers.
+func luhnValid(s []byte) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// redactRule - a redaction rule, either a regexp applied to whole
+// records or the JSONPath of a field of NDJSON records such as
+// '$.user.email', whose value is replaced.
+type redactRule struct {
+	Pattern string `json:"pattern,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Replace string `json:"replace,omitempty"`
+
+	re    *regexp.Regexp
+	keys  []string
+	valid func([]byte) bool
+}
+
+// compile - validates the rule.
+func (r *redactRule) compile() error {
+	if r.Replace == "" {
+		r.Replace = redactMask
+	}
+	switch {
+	case r.Pattern != "" && r.Path == "":
+		var err error
+		r.re, err = regexp.Compile(r.Pattern)
+		return err
+	case r.Path != "" && r.Pattern == "":
+		path := strings.TrimPrefix(strings.TrimPrefix(r.Path, "$"), ".")
+		if path == "" {
+			return fmt.Errorf("Invalid redaction path %q", r.Path)
+		}
+		r.keys = strings.Split(path, ".")
+		return nil
+	}
+	return fmt.Errorf("Redaction rules need either a pattern or a path")
+}
+
+// redactor - redacts newline delimited records before upload.
+type redactor struct {
+	rules []*redactRule
+	// count is the number of values redacted so far.
+	count int64
+}
+
+// newRedactor - returns a redactor of the named builtin rules, comma
+// separated, and of the rules in the JSON file at rulesFile.
+func newRedactor(builtins, rulesFile string) (*redactor, error) {
+	r := &redactor{}
+	for _, name := range strings.Split(builtins, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		pattern, ok := builtinRedactions[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown redaction %q", name)
+		}
+		r.rules = append(r.rules, &redactRule{Pattern: pattern, valid: builtinChecks[name]})
+	}
+	if rulesFile != "" {
+		data, err := ioutil.ReadFile(rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		var rules []*redactRule
+		if err = json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("Invalid redaction rules %s: %v", rulesFile, err)
+		}
+		r.rules = append(r.rules, rules...)
+	}
+	for _, rule := range r.rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// redactions - returns the number of values redacted so far.
+func (r *redactor) redactions() int64 {
+	return atomic.LoadInt64(&r.count)
+}
+
+// apply - returns reader with the records redacted.
+func (r *redactor) apply(reader io.Reader) io.Reader {
+	return pipeTransform(func(w io.Writer) error {
+		br := bufio.NewReaderSize(reader, 64*1024)
+		bw := bufio.NewWriterSize(w, 64*1024)
+		for {
+			record, err := br.ReadBytes('\n')
+			if len(record) > 0 {
+				body := bytes.TrimRight(record, "\r\n")
+				eol := record[len(body):]
+				if _, wErr := bw.Write(append(r.redact(body), eol...)); wErr != nil {
+					return wErr
+				}
+			}
+			if err == io.EOF {
+				return bw.Flush()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// redact - returns the record redacted. Path rules only apply to records
+// that are JSON objects, which are re-encoded with sorted keys if one of
+// their values was redacted, and left as they are otherwise.
+func (r *redactor) redact(record []byte) []byte {
+	var doc map[string]interface{}
+	parsed, redacted := false, false
+	for _, rule := range r.rules {
+		if rule.re != nil {
+			continue
+		}
+		if !parsed {
+			// Numbers are kept as written, not as float64.
+			dec := json.NewDecoder(bytes.NewReader(record))
+			dec.UseNumber()
+			if dec.Decode(&doc) != nil {
+				break
+			}
+			parsed = true
+		}
+		if redactPath(doc, rule.keys, rule.Replace) {
+			atomic.AddInt64(&r.count, 1)
+			redacted = true
+		}
+	}
+	if redacted {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(doc); err == nil {
+			record = bytes.TrimRight(buf.Bytes(), "\n")
+		}
+	}
+
+	for _, rule := range r.rules {
+		if rule.re == nil {
+			continue
+		}
+		record = rule.re.ReplaceAllFunc(record, func(match []byte) []byte {
+			if rule.valid != nil && !rule.valid(match) {
+				return match
+			}
+			atomic.AddInt64(&r.count, 1)
+			return []byte(rule.Replace)
+		})
+	}
+	return record
+}
+
+// redactPath - replaces the value at keys, '*' matching every key or
+// array element, and returns true if any was.
+func redactPath(v interface{}, keys []string, replace string) bool {
+	key := keys[0]
+	redacted := false
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if key != "*" && k != key {
+				continue
+			}
+			if len(keys) == 1 {
+				node[k] = replace
+				redacted = true
+			} else if redactPath(child, keys[1:], replace) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		if key != "*" {
+			return false
+		}
+		for i, child := range node {
+			if len(keys) == 1 {
+				node[i] = replace
+				redacted = true
+			} else if redactPath(child, keys[1:], replace) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// divergence - an object which differs on one site from the reference copy.
+type divergence struct {
+	Object   string       `json:"object"`
+	Site     string       `json:"site"`
+	Reason   string       `json:"reason"`
+	Source   string       `json:"source"`
+	Repaired bool         `json:"repaired"`
+	Error    *errorDetail `json:"error,omitempty"`
+}
+
+// repairReport - JSON report printed by the 'repair' command.
+type repairReport struct {
+	Bucket      string       `json:"bucket"`
+	Prefix      string       `json:"prefix"`
+	DryRun      bool         `json:"dryRun"`
+	Queued      int          `json:"queued"`
+	Divergences []divergence `json:"divergences"`
+	Error       *errorDetail `json:"error,omitempty"`
+}
+
+// isInternalObject - returns true for objects this tool keeps for itself.
+func isInternalObject(objectName string) bool {
+	return strings.HasPrefix(objectName, ledgerPrefix) ||
+		strings.HasPrefix(objectName, repairPrefix) ||
+		strings.HasPrefix(objectName, statusPrefix) ||
+		strings.HasPrefix(objectName, kafkaPrefix) ||
+		strings.HasPrefix(objectName, tenantPrefix) ||
+		strings.HasPrefix(objectName, historyPrefix) ||
+		strings.HasPrefix(objectName, lockPrefix) ||
+		strings.HasPrefix(objectName, preflightPrefix) ||
+		isHistoryNDJSON(objectName) ||
+		objectName == bucketDefaultsName ||
+		objectName == bucketDefaultsName+signatureSuffix
+}
+
+// copyObject - streams an object from the site s, reached through src,
+// to another, counting the copied bytes into t which may be nil. The copy
+// is uploaded in the shape of the original, a single PUT or parts of the
+// same size, so both have the same ETag.
+func copyObject(s site, src, dst minio.Core, bucketName, objectName string, t *transfer) error {
+	reader, objInfo, err := src.GetObject(bucketName, objectName, minio.NewGetReqHeaders())
+	if err != nil {
+		return wrapS3Error("GetObject", err)
+	}
+	defer reader.Close()
+	t.setSize(objInfo.Size)
+
+	var partSize int64
+	if strings.Contains(objInfo.ETag, "-") {
+		if partSize, err = remotePartSize(s, bucketName, objectName, ""); err != nil {
+			return err
+		}
+	}
+
+	// Carry over content type and user metadata, decoded as putStream
+	// encodes it again.
+	metaData := map[string][]string{}
+	if objInfo.ContentType != "" {
+		metaData["Content-Type"] = []string{objInfo.ContentType}
+	}
+	for k := range objInfo.Metadata {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			metaData[k] = []string{metaValue(objInfo.Metadata, k)}
+		}
+	}
+
+	var n int64
+	if partSize == 0 {
+		var put minio.ObjectInfo
+		put, err = dst.PutObject(bucketName, objectName, objInfo.Size, t.wrap(reader), nil, nil, encodeMetadata(metaData))
+		err = wrapS3Error("PutObject", err)
+		n = put.Size
+	} else {
+		plan := fixedPlan(objInfo.Size, partSize)
+		n, _, err = putStream(singleEndpoint(dst), bucketName, objectName, t.wrap(reader), metaData, nil, plan)
+	}
+	if err != nil {
+		return err
+	}
+	if n != objInfo.Size {
+		return fmt.Errorf("Copied %d bytes of %s, expected %d", n, objectName, objInfo.Size)
+	}
+	return nil
+}
+
+// repairMain - implements the 'repair' command, which drains the repair
+// queue written by quorum writes and reconciles all objects under a prefix
+// across the sites in QUORUM_SITES.
+func repairMain(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to repair")
+	prefix := flags.String("prefix", "", "only reconcile objects under this prefix")
+	dryRun := flags.Bool("dry-run", false, "report divergences without copying")
+	tui := flags.Bool("tui", false, "show a dashboard of the active copies on stderr")
+	flags.Parse(args)
+
+	sites, err := parseSites(os.Getenv("QUORUM_SITES"))
+	if err != nil {
+		return err
+	}
+
+	cores := make([]minio.Core, len(sites))
+	siteIndex := make(map[string]int)
+	for i, s := range sites {
+		if cores[i], err = s.core(); err != nil {
+			return err
+		}
+		siteIndex[s.Address] = i
+	}
+
+	report := repairReport{
+		Bucket:      *bucketName,
+		Prefix:      *prefix,
+		DryRun:      *dryRun,
+		Divergences: []divergence{},
+	}
+
+	var dash *dashboard
+	if *tui && !*dryRun {
+		dash = newDashboard(os.Stderr, time.Second)
+	}
+
+	repair := func(objectName string, from, to int, reason string) {
+		d := divergence{
+			Object: objectName,
+			Site:   sites[to].Address,
+			Reason: reason,
+			Source: sites[from].Address,
+		}
+		if !*dryRun {
+			t := dash.add(objectName+" -> "+sites[to].Address, -1)
+			err := copyObject(sites[from], cores[from], cores[to], *bucketName, objectName, t)
+			dash.done(t, err)
+			if err != nil {
+				d.Error = newErrorDetail(err)
+			} else {
+				d.Repaired = true
+			}
+		}
+		report.Divergences = append(report.Divergences, d)
+	}
+
+	// Failures still print the report of the repairs made so far.
+	runErr := func() error {
+		// Drain the repair queue, entries may be present on several sites.
+		queued := make(map[string][]int)
+		for i := range sites {
+			doneCh := make(chan struct{})
+			for objInfo := range cores[i].Client.ListObjects(*bucketName, repairPrefix, true, doneCh) {
+				if objInfo.Err != nil {
+					close(doneCh)
+					return objInfo.Err
+				}
+				queued[objInfo.Key] = append(queued[objInfo.Key], i)
+			}
+			close(doneCh)
+		}
+		report.Queued = len(queued)
+
+		for queueName, holders := range queued {
+			var entry repairEntry
+			if err = getJSON(cores[holders[0]], *bucketName, queueName, &entry); err != nil {
+				return err
+			}
+
+			from := -1
+			for _, address := range entry.Acked {
+				if i, ok := siteIndex[address]; ok {
+					from = i
+					break
+				}
+			}
+			if from < 0 {
+				return fmt.Errorf("No configured site holds %s, acked by %v", entry.Object, entry.Acked)
+			}
+
+			done := true
+			for _, address := range entry.Missing {
+				to, ok := siteIndex[address]
+				if !ok {
+					fmt.Fprintln(os.Stderr, "site not configured, skipping", address)
+					done = false
+					continue
+				}
+				repair(entry.Object, from, to, "queued")
+				if !report.Divergences[len(report.Divergences)-1].Repaired {
+					done = false
+				}
+			}
+
+			// Remove the queue entry once every missing replica was repaired.
+			if done {
+				for _, i := range holders {
+					if err = cores[i].RemoveObject(*bucketName, queueName); err != nil {
+						fmt.Fprintln(os.Stderr, "RemoveObject failed", queueName, err)
+					}
+				}
+			}
+		}
+
+		// Reconcile everything under the prefix.
+		listings := make([]map[string]minio.ObjectInfo, len(sites))
+		keys := make(map[string]struct{})
+		for i := range sites {
+			listings[i] = make(map[string]minio.ObjectInfo)
+			doneCh := make(chan struct{})
+			for objInfo := range cores[i].Client.ListObjects(*bucketName, *prefix, true, doneCh) {
+				if objInfo.Err != nil {
+					close(doneCh)
+					return objInfo.Err
+				}
+				if isInternalObject(objInfo.Key) {
+					continue
+				}
+				listings[i][objInfo.Key] = objInfo
+				keys[objInfo.Key] = struct{}{}
+			}
+			close(doneCh)
+		}
+
+		for objectName := range keys {
+			// Group the sites holding the same content, the reference copy
+			// is that of the group holding most.
+			var groups [][]int
+			for i := range sites {
+				objInfo, ok := listings[i][objectName]
+				if !ok {
+					continue
+				}
+				found := false
+				for g, group := range groups {
+					j := group[0]
+					same, err := sameContent(sites[j], sites[i], cores[i], *bucketName, listings[j][objectName], objInfo)
+					if err != nil {
+						return err
+					}
+					if same {
+						groups[g], found = append(group, i), true
+						break
+					}
+				}
+				if !found {
+					groups = append(groups, []int{i})
+				}
+			}
+
+			best, tie := 0, false
+			for g := 1; g < len(groups); g++ {
+				switch {
+				case len(groups[g]) > len(groups[best]):
+					best, tie = g, false
+				case len(groups[g]) == len(groups[best]):
+					tie = true
+				}
+			}
+			if tie {
+				// No copy can be trusted over another.
+				err := fmt.Errorf("No content of %s is held by most sites", objectName)
+				for i := range sites {
+					report.Divergences = append(report.Divergences, divergence{
+						Object: objectName,
+						Site:   sites[i].Address,
+						Reason: "conflict",
+						Error:  newErrorDetail(err),
+					})
+				}
+				continue
+			}
+
+			from := groups[best][0]
+			reference := listings[from][objectName]
+			held := make(map[int]bool)
+			for _, i := range groups[best] {
+				held[i] = true
+			}
+			for i := range sites {
+				objInfo, ok := listings[i][objectName]
+				switch {
+				case held[i]:
+				case !ok:
+					repair(objectName, from, i, "missing")
+				case objInfo.Size != reference.Size:
+					repair(objectName, from, i, "size mismatch")
+				default:
+					repair(objectName, from, i, "content mismatch")
+				}
+			}
+		}
+		return nil
+	}()
+	if runErr != nil {
+		report.Error = newErrorDetail(runErr)
+	}
+
+	dash.stop()
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	if runErr != nil {
+		return runErr
+	}
+	for _, d := range report.Divergences {
+		if d.Error != nil {
+			return fmt.Errorf("Some objects could not be repaired")
+		}
+	}
+	return nil
+}
+
+// sameContent - returns true if the object a on the site sa and the
+// object b on sb, reached through cb, hold the same bytes. Copies of
+// other upload shapes are compared by their sha256 metadata, else b is
+// read to compute its ETag in the shape of a.
+func sameContent(sa, sb site, cb minio.Core, bucketName string, a, b minio.ObjectInfo) (bool, error) {
+	if a.Size != b.Size {
+		return false, nil
+	}
+	if a.ETag == b.ETag {
+		return true, nil
+	}
+	aMultipart, bMultipart := strings.Contains(a.ETag, "-"), strings.Contains(b.ETag, "-")
+	if !aMultipart && !bMultipart {
+		// Both are the MD5 of their content.
+		return false, nil
+	}
+
+	stA, err := statObject(sa, bucketName, a.Key, "")
+	if err != nil {
+		return false, err
+	}
+	stB, err := statObject(sb, bucketName, b.Key, "")
+	if err != nil {
+		return false, err
+	}
+	if sumA, sumB := stA.UserMetadata["sha256"], stB.UserMetadata["sha256"]; sumA != "" && sumB != "" {
+		return strings.EqualFold(sumA, sumB), nil
+	}
+
+	var partSize int64
+	if aMultipart {
+		if partSize, err = remotePartSize(sa, bucketName, a.Key, stA.VersionID); err != nil {
+			return false, err
+		}
+	}
+	headers := minio.NewGetReqHeaders()
+	headers.SetMatchETag(b.ETag)
+	reader, _, err := cb.GetObject(bucketName, b.Key, headers)
+	if err != nil {
+		return false, wrapS3Error("GetObject", err)
+	}
+	defer reader.Close()
+	etag, _, _, err := digestParts(reader, partSize, 0, nil)
+	if err != nil {
+		return false, err
+	}
+	return etag == a.ETag, nil
+}
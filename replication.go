@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// uploadedVersion - returns the version of an object with the given
+// ETag, the latest one if etag is empty, so that waits are for the
+// version uploaded even if the key was written again meanwhile.
+func uploadedVersion(s site, bucketName, objectName, etag string) (string, error) {
+	st, err := statObject(s, bucketName, objectName, "")
+	if err != nil {
+		return "", err
+	}
+	if etag == "" || st.ETag == etag {
+		return st.VersionID, nil
+	}
+	versions, err := objectVersions(s, bucketName, objectName)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range versions {
+		if !v.deleteMarker && strings.Trim(v.ETag, "\"") == etag {
+			return v.VersionID, nil
+		}
+	}
+	return "", fmt.Errorf("No version of %s/%s has ETag %s", bucketName, objectName, etag)
+}
+
+// waitReplicated - waits, polling every interval, until the replication
+// status of an object is COMPLETED. Fails if replication failed, if no
+// replication rule applies to the object, or after timeout if not 0.
+func waitReplicated(s site, bucketName, objectName, versionID string, interval, timeout time.Duration) error {
+	start := time.Now()
+	for {
+		st, err := statObject(s, bucketName, objectName, versionID)
+		if err != nil {
+			return err
+		}
+		switch st.ReplicaStatus {
+		// MinIO reported COMPLETE before following AWS.
+		case "COMPLETED", "COMPLETE":
+			fmt.Fprintf(os.Stderr, "Replicated %s/%s after %s\n", bucketName, objectName, time.Since(start).Round(time.Second))
+			return nil
+		case "FAILED":
+			return fmt.Errorf("Replication of %s/%s failed", bucketName, objectName)
+		case "REPLICA":
+			return fmt.Errorf("%s/%s is itself a replica, it is not replicated", bucketName, objectName)
+		case "":
+			return fmt.Errorf("%s/%s has no replication status, no replication rule applies to it", bucketName, objectName)
+		}
+		if timeout > 0 && time.Since(start) > timeout {
+			return fmt.Errorf("Replication of %s/%s still %s after %s", bucketName, objectName, st.ReplicaStatus, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// listedParts - returns the parts uploaded so far, by number.
+func listedParts(c minio.Core, bucketName, objectName, uploadID string) (map[int]minio.ObjectPart, error) {
+	parts := make(map[int]minio.ObjectPart)
+	marker := 0
+	for {
+		result, err := c.ListObjectParts(bucketName, objectName, uploadID, marker, 1000)
+		if err != nil {
+			return nil, wrapS3Error("ListObjectParts", err)
+		}
+		for _, part := range result.ObjectParts {
+			parts[part.PartNumber] = part
+		}
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// verifyJournal - returns where an interrupted upload can continue from,
+// after the leading parts of its journal which are listed with the same
+// ETag and size, and whose content still hashes the same in src. Parts
+// missing, out of order or without a content hash end the parts kept,
+// and are uploaded again. Parts listed with another ETag or size, or
+// whose content changed in src, fail the resume, as the parts kept would
+// not be those of src.
+func verifyJournal(c minio.Core, src io.ReaderAt, status uploadStatus) (*resumePoint, []journalPart, error) {
+	listed, err := listedParts(c, status.Bucket, status.Object, status.UploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	from := &resumePoint{parts: make(map[int]minio.ObjectPart), next: 1}
+	var verified []journalPart
+	for _, part := range status.Journal {
+		if part.Number != from.next || part.Offset != from.offset || part.SHA256 == "" {
+			break
+		}
+		uploaded, ok := listed[part.Number]
+		if !ok {
+			break
+		}
+		if strings.Trim(uploaded.ETag, "\"") != strings.Trim(part.ETag, "\"") || uploaded.Size != part.Size {
+			return nil, nil, fmt.Errorf("Part %d of upload %s is listed with ETag %s and %d bytes, the journal recorded %s and %d bytes, refusing to resume",
+				part.Number, status.UploadID, uploaded.ETag, uploaded.Size, part.ETag, part.Size)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, io.NewSectionReader(src, part.Offset, part.Size))
+		if err != nil {
+			return nil, nil, err
+		}
+		if n != part.Size || hex.EncodeToString(h.Sum(nil)) != part.SHA256 {
+			return nil, nil, fmt.Errorf("Source differs from part %d uploaded at offset %d, refusing to resume", part.Number, part.Offset)
+		}
+		from.parts[part.Number] = uploaded
+		from.next++
+		from.offset += part.Size
+		verified = append(verified, part)
+	}
+	return from, verified, nil
+}
+
+// resumeMain - implements the 'resume -status <upload-id|state-file> file'
+// command, which continues an interrupted upload of a file after the
+// parts of its journal verified intact.
+func resumeMain(args []string) error {
+	flags := flag.NewFlagSet("resume", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket holding the status object")
+	statusArg := flags.String("status", "", "upload id or status file of the interrupted upload")
+	flags.Parse(args)
+	if *statusArg == "" || flags.NArg() != 1 {
+		return fmt.Errorf("Usage: resume [-bucket name] -status <upload-id|state-file> file")
+	}
+	if os.Getenv("SCAN_URL") != "" {
+		return fmt.Errorf("Resumed uploads can't be scanned, the scanner would miss the parts kept")
+	}
+
+	status, err := loadStatus(*bucketName, *statusArg)
+	if err != nil {
+		return err
+	}
+	if status.UploadID == "" || status.State == stateCompleted {
+		return fmt.Errorf("Upload of %s/%s is %s, nothing to resume", status.Bucket, status.Object, status.State)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	from, verified, err := verifyJournal(e.core(), f, status)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "resuming upload %s after %d parts verified, at offset %d\n", status.UploadID, len(verified), from.offset)
+	if _, err = f.Seek(from.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var progress ProgressFunc
+	if sw := newStatusWriter(e.core(), status.Bucket, status.Object, f); sw != nil {
+		sw.resume(status.UploadID, verified)
+		defer func() { sw.finish(err) }()
+		progress = sw.progress
+	}
+	n, _, err := putParts(e, status.Bucket, status.Object, status.UploadID, f, serialProgress(progress), nil, from)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"object":        status.Object,
+		"uploadId":      status.UploadID,
+		"size":          n,
+		"partsVerified": len(verified),
+		"resumedAt":     from.offset,
+	})
+}
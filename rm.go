@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// deleteBatchSize - the most keys DeleteObjects accepts at once.
+const deleteBatchSize = 1000
+
+// objectID - an object, or one of its versions.
+type objectID struct {
+	Key       string `xml:"Key" json:"key"`
+	VersionID string `xml:"VersionId,omitempty" json:"versionId,omitempty"`
+}
+
+// deleteError - a key DeleteObjects failed to delete.
+type deleteError struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId"`
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+}
+
+// deleteObjects - deletes objects in batches with DeleteObjects, calling
+// progress after every batch with the number deleted so far. Returns
+// the keys that could not be deleted. mfa, the serial number and code of
+// an MFA device, is required to delete versions of MFA delete buckets.
+func deleteObjects(s site, bucketName string, objects []objectID, mfa string, progress func(deleted int)) ([]deleteError, error) {
+	var failed []deleteError
+	var deleted int
+	for len(objects) > 0 {
+		batch := objects
+		if len(batch) > deleteBatchSize {
+			batch = batch[:deleteBatchSize]
+		}
+		objects = objects[len(batch):]
+
+		body, err := xml.Marshal(struct {
+			XMLName xml.Name   `xml:"Delete"`
+			Quiet   bool       `xml:"Quiet"`
+			Objects []objectID `xml:"Object"`
+		}{Quiet: true, Objects: batch})
+		if err != nil {
+			return failed, err
+		}
+		md5Sum := md5.Sum(body)
+		header := http.Header{
+			"Content-Md5":  {base64.StdEncoding.EncodeToString(md5Sum[:])},
+			"Content-Type": {"application/xml"},
+		}
+		if mfa != "" {
+			header.Set("X-Amz-Mfa", mfa)
+		}
+		resp, err := siteRequest(s, "DeleteObjects", http.MethodPost, bucketName, "", url.Values{"delete": {""}}, header, body)
+		if err != nil {
+			return failed, err
+		}
+		var result struct {
+			Errors []deleteError `xml:"Error"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return failed, err
+		}
+
+		failed = append(failed, result.Errors...)
+		deleted += len(batch) - len(result.Errors)
+		if progress != nil {
+			progress(deleted)
+		}
+	}
+	return failed, nil
+}
+
+// rmTargets - returns the objects below a prefix, or their versions and
+// delete markers, last modified before cutoff if it is set.
+func rmTargets(s site, bucketName, prefix string, versions bool, cutoff time.Time) ([]objectID, error) {
+	var objects []objectID
+	keep := func(key string, modified time.Time) bool {
+		return !isInternalObject(key) && (cutoff.IsZero() || modified.Before(cutoff))
+	}
+	if !versions {
+		c, err := s.core()
+		if err != nil {
+			return nil, err
+		}
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		for objInfo := range c.Client.ListObjects(bucketName, prefix, true, doneCh) {
+			if objInfo.Err != nil {
+				return nil, objInfo.Err
+			}
+			if keep(objInfo.Key, objInfo.LastModified) {
+				objects = append(objects, objectID{Key: objInfo.Key})
+			}
+		}
+		return objects, nil
+	}
+
+	keyMarker, versionMarker := "", ""
+	for {
+		result, err := listObjectVersions(s, bucketName, prefix, "", keyMarker, versionMarker)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range append(result.Versions, result.DeleteMarkers...) {
+			if keep(v.Key, v.LastModified) {
+				objects = append(objects, objectID{Key: v.Key, VersionID: v.VersionID})
+			}
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		keyMarker, versionMarker = result.NextKeyMarker, result.NextVersionIDMarker
+	}
+}
+
+// rmSummary - the report of an 'rm' run, printed last.
+type rmSummary struct {
+	Matched int  `json:"matched"`
+	Deleted int  `json:"deleted"`
+	Failed  int  `json:"failed"`
+	DryRun  bool `json:"dryRun,omitempty"`
+}
+
+// rmMain - implements the 'rm s3://bucket/key' command, which deletes a
+// key, or with -recursive every object below a prefix, taken as a
+// directory: 's3://b/log' deletes 'log/...' but not 'logs/...'. With
+// -versions, all versions and delete markers are deleted for good.
+func rmMain(args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	recursive := flags.Bool("recursive", false, "delete every object below the prefix")
+	olderThan := flags.Duration("older-than", 0, "only delete objects last modified longer ago than this")
+	versions := flags.Bool("versions", false, "delete all versions and delete markers, not only the current versions")
+	versionID := flags.String("version-id", "", "delete this version of a single key")
+	dryRun := flags.Bool("dry-run", false, "only print what would be deleted")
+	mfa := flags.String("mfa", "", "'serial code' of the MFA device, to delete versions of MFA delete buckets")
+	wholeBucket := flags.Bool("whole-bucket", false, "allow -recursive without a prefix, deleting every object of the bucket")
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*versionID != "" && (*recursive || *versions)) {
+		return fmt.Errorf("Usage: rm [-recursive [-whole-bucket]] [-older-than d] [-versions | -version-id id] [-mfa 'serial code'] [-dry-run] s3://bucket/key")
+	}
+	if *mfa != "" {
+		if *versionID == "" && !*versions {
+			return fmt.Errorf("-mfa only applies to deleting versions, with -version-id or -versions")
+		}
+		if len(strings.Fields(*mfa)) != 2 {
+			return fmt.Errorf("Invalid -mfa %q, expected the device serial number and the code separated by a space", *mfa)
+		}
+	}
+	bucketName, prefix, err := parseS3Prefix(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	s := e.site()
+	// AWS refuses MFA tokens sent in the clear.
+	if *mfa != "" && !s.SSL {
+		return fmt.Errorf("-mfa requires SSL")
+	}
+
+	var cutoff time.Time
+	if *olderThan > 0 {
+		cutoff = time.Now().Add(-*olderThan)
+	}
+	var objects []objectID
+	if *recursive {
+		if prefix == "" && !*wholeBucket {
+			return fmt.Errorf("No prefix given, add -whole-bucket to delete every object of bucket %s", bucketName)
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if objects, err = rmTargets(s, bucketName, prefix, *versions, cutoff); err != nil {
+			return err
+		}
+	} else {
+		if prefix == "" {
+			return fmt.Errorf("Missing key, use -recursive to delete a whole bucket's objects")
+		}
+		old := true
+		if !cutoff.IsZero() {
+			objInfo, err := e.core().StatObject(bucketName, prefix)
+			if err != nil {
+				return wrapS3Error("StatObject", err)
+			}
+			old = objInfo.LastModified.Before(cutoff)
+		}
+		if old {
+			objects = []objectID{{Key: prefix, VersionID: *versionID}}
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	summary := rmSummary{Matched: len(objects), DryRun: *dryRun}
+	if *dryRun {
+		for _, o := range objects {
+			enc.Encode(o)
+		}
+		enc.Encode(summary)
+		return nil
+	}
+
+	failed, err := deleteObjects(s, bucketName, objects, strings.Join(strings.Fields(*mfa), " "), func(deleted int) {
+		fmt.Fprintf(os.Stderr, "deleted %d of %d\n", deleted, len(objects))
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range failed {
+		enc.Encode(multiResult{Object: f.Key, Error: &errorDetail{Message: f.Message, Operation: "DeleteObjects", Code: f.Code}})
+	}
+	summary.Failed = len(failed)
+	summary.Deleted = len(objects) - len(failed)
+	enc.Encode(summary)
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d objects not deleted", summary.Failed, summary.Matched)
+	}
+	return nil
+}
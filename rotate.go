@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// rotator - splits a stream into objects '<object>.000001', '.000002' and
+// so on, rotated by size and age. With a record delimiter, objects are
+// only cut right after a delimiter, partial records carry over to the
+// next object.
+type rotator struct {
+	bucketName string
+	objectName string
+	delimiter  []byte
+	maxBytes   int64
+	maxAge     time.Duration
+	// metaData of every object, such as its ACL.
+	metaData map[string][]string
+	// daily names objects after the hour they start in, if not nil.
+	daily *dailyLayout
+
+	seq  int
+	cur  *pipeUpload
+	tail []byte // last bytes written to cur, to find split delimiters
+	due  bool   // rotate at the next record boundary
+}
+
+// pipeUpload - an object uploaded from whatever is written to it.
+type pipeUpload struct {
+	name string
+	size int64
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func startPipeUpload(bucketName, objectName string, metaData map[string][]string) *pipeUpload {
+	pr, pw := io.Pipe()
+	u := &pipeUpload{name: objectName, pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := PutStream(bucketName, objectName, pr, metaData)
+		pr.CloseWithError(err)
+		u.done <- err
+	}()
+	return u
+}
+
+func (u *pipeUpload) Write(p []byte) (int, error) {
+	n, err := u.pw.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+// complete - ends the stream and waits for the upload.
+func (u *pipeUpload) complete() error {
+	u.pw.Close()
+	return <-u.done
+}
+
+// write - writes data, rotating objects as needed.
+func (r *rotator) write(data []byte) error {
+	for len(data) > 0 {
+		if r.cur == nil {
+			r.seq++
+			name := fmt.Sprintf("%s.%06d", r.objectName, r.seq)
+			if r.daily != nil {
+				name = r.daily.name(r.seq)
+			}
+			r.cur = startPipeUpload(r.bucketName, name, r.metaData)
+			r.tail = r.tail[:0]
+		}
+
+		n, rotate := len(data), false
+		full := r.maxBytes > 0 && r.cur.size+int64(n) >= r.maxBytes
+		switch {
+		case len(r.delimiter) == 0:
+			if full {
+				n, rotate = int(r.maxBytes-r.cur.size), true
+			}
+		case r.due || full:
+			// Cut after the first delimiter ending at or past the size
+			// limit, delimiters may start in the previous write.
+			prefix := r.tail
+			if len(prefix) == len(r.delimiter) {
+				prefix = prefix[1:]
+			}
+			buf := append(append([]byte{}, prefix...), data...)
+			from := 0
+			if !r.due {
+				from = len(prefix) + int(r.maxBytes-r.cur.size) - len(r.delimiter)
+				if from < 0 {
+					from = 0
+				}
+			}
+			if i := bytes.Index(buf[from:], r.delimiter); i >= 0 {
+				n, rotate = from+i+len(r.delimiter)-len(prefix), true
+			} else {
+				r.due = true
+			}
+		}
+
+		if _, err := r.cur.Write(data[:n]); err != nil {
+			return err
+		}
+		r.keepTail(data[:n])
+		data = data[n:]
+		if rotate {
+			if err := r.rotate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keepTail - remembers the last bytes written, as long as the delimiter.
+func (r *rotator) keepTail(written []byte) {
+	r.tail = append(r.tail, written...)
+	if len(r.tail) > len(r.delimiter) {
+		r.tail = r.tail[len(r.tail)-len(r.delimiter):]
+	}
+}
+
+// rotate - completes the current object.
+func (r *rotator) rotate() error {
+	if r.cur == nil {
+		return nil
+	}
+	u := r.cur
+	r.cur, r.due = nil, false
+	if err := u.complete(); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "uploaded", u.size, "bytes to", r.bucketName+"/"+u.name)
+	if r.daily != nil {
+		r.daily.add(u.name, u.size)
+		if r.daily.ending {
+			return r.endHour()
+		}
+	}
+	return nil
+}
+
+// timeUp - rotates on age, right away at a record boundary or else
+// after the current record.
+func (r *rotator) timeUp() error {
+	if r.cur == nil {
+		return nil
+	}
+	if len(r.delimiter) == 0 || bytes.Equal(r.tail, r.delimiter) {
+		return r.rotate()
+	}
+	r.due = true
+	return nil
+}
+
+// run - uploads reader until it ends.
+func (r *rotator) run(reader io.Reader) error {
+	type chunk struct {
+		data []byte
+		err  error
+	}
+	chunks := make(chan chunk)
+	go func() {
+		for {
+			buf := make([]byte, 1024*1024)
+			n, err := reader.Read(buf)
+			chunks <- chunk{buf[:n], err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var ticker <-chan time.Time
+	if r.maxAge > 0 {
+		t := time.NewTicker(r.maxAge)
+		defer t.Stop()
+		ticker = t.C
+	}
+	var hourEnd <-chan time.Time
+	if r.daily != nil {
+		seq, err := r.daily.startHour(r.bucketName, time.Now())
+		if err != nil {
+			return err
+		}
+		r.seq = seq
+		hourEnd = time.After(time.Until(r.daily.next()))
+	}
+	for {
+		select {
+		case c := <-chunks:
+			if err := r.write(c.data); err != nil {
+				return err
+			}
+			if c.err == io.EOF {
+				return r.rotate()
+			}
+			if c.err != nil {
+				if r.cur != nil {
+					r.cur.pw.CloseWithError(c.err)
+					<-r.cur.done
+				}
+				return c.err
+			}
+		case <-ticker:
+			if err := r.timeUp(); err != nil {
+				return err
+			}
+		case <-hourEnd:
+			next := r.daily.next().Add(time.Hour)
+			if err := r.hourUp(); err != nil {
+				return err
+			}
+			hourEnd = time.After(time.Until(next))
+		}
+	}
+}
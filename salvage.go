@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+
+	minio "github.com/minio/minio-go"
+)
+
+// partialSuffix - suffix of the objects salvaged parts are copied to.
+const partialSuffix = ".partial"
+
+// findUpload - returns the key of a multipart upload in progress.
+func findUpload(c minio.Core, bucketName, uploadID string) (string, error) {
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		result, err := c.ListMultipartUploads(bucketName, "", keyMarker, uploadIDMarker, "", 1000)
+		if err != nil {
+			return "", wrapS3Error("ListMultipartUploads", err)
+		}
+		for _, upload := range result.Uploads {
+			if upload.UploadID == uploadID {
+				return upload.Key, nil
+			}
+		}
+		if !result.IsTruncated {
+			return "", fmt.Errorf("No upload %s in progress in bucket %s", uploadID, bucketName)
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+}
+
+// salvageableParts - returns the parts of an upload from part 1 up to the
+// first one missing, as later parts would leave a hole in the object.
+func salvageableParts(c minio.Core, bucketName, objectName, uploadID string) ([]minio.ObjectPart, error) {
+	listed, err := listedParts(c, bucketName, objectName, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int, 0, len(listed))
+	for number := range listed {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	var parts []minio.ObjectPart
+	for i, number := range numbers {
+		if number != i+1 {
+			fmt.Fprintf(os.Stderr, "part %d is missing, %d later parts are not salvaged\n", i+1, len(numbers)-i)
+			break
+		}
+		parts = append(parts, listed[number])
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("Upload %s has no part 1 to salvage", uploadID)
+	}
+	return parts, nil
+}
+
+// bucketVersioned - returns true if versioning is enabled on a bucket.
+func bucketVersioned(s site, bucketName string) (bool, error) {
+	resp, err := siteRequest(s, "GetBucketVersioning", http.MethodGet, bucketName, "", url.Values{"versioning": {""}}, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Status string `xml:"Status"`
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if err = xml.Unmarshal(data, &result); err != nil {
+		return false, err
+	}
+	return result.Status == "Enabled", nil
+}
+
+// copyParts - copies the parts of an object version into a new object,
+// part by part, so that objects over the 5GiB limit of CopyObject are
+// copied too.
+func copyParts(s site, b Backend, bucketName, srcName, versionID, dstName string, parts []minio.ObjectPart, metaData map[string][]string) error {
+	uploadID, err := b.NewMultipartUpload(bucketName, dstName, metaData)
+	if err != nil {
+		return wrapS3Error("NewMultipartUpload", err)
+	}
+	source := "/" + bucketName + "/" + url.PathEscape(srcName)
+	if versionID != "" {
+		source += "?versionId=" + url.QueryEscape(versionID)
+	}
+	var completed []minio.CompletePart
+	var offset int64
+	for _, part := range parts {
+		query := url.Values{"partNumber": {strconv.Itoa(part.PartNumber)}, "uploadId": {uploadID}}
+		header := http.Header{
+			"X-Amz-Copy-Source":       {source},
+			"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+part.Size-1)},
+		}
+		resp, err := siteRequest(s, "UploadPartCopy", http.MethodPut, bucketName, dstName, query, header, nil)
+		if err == nil {
+			var result struct {
+				ETag string `xml:"ETag"`
+			}
+			data, rErr := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err = rErr; err == nil {
+				err = xml.Unmarshal(data, &result)
+			}
+			completed = append(completed, minio.CompletePart{PartNumber: part.PartNumber, ETag: result.ETag})
+		}
+		if err != nil {
+			if aErr := b.AbortMultipartUpload(bucketName, dstName, uploadID); aErr != nil {
+				fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+			}
+			return err
+		}
+		offset += part.Size
+	}
+	return wrapS3Error("CompleteMultipartUpload", b.CompleteMultipartUpload(bucketName, dstName, uploadID, completed))
+}
+
+// completeVersion - completes an upload, returning the version of the
+// object it created, empty in unversioned buckets. The version is taken
+// from the response, a stat of the key may see another writer's.
+func completeVersion(s site, bucketName, objectName, uploadID string, parts []minio.CompletePart) (string, error) {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+	resp, err := siteRequest(s, "CompleteMultipartUpload", http.MethodPost, bucketName, objectName,
+		url.Values{"uploadId": {uploadID}}, http.Header{"Content-Type": {"application/xml"}}, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// Failures after the 200 status are sent as an error document.
+	var result struct {
+		XMLName   xml.Name
+		Code      string `xml:"Code"`
+		Message   string `xml:"Message"`
+		RequestID string `xml:"RequestId"`
+	}
+	if err = xml.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	if result.XMLName.Local == "Error" {
+		return "", &S3Error{
+			Operation: "CompleteMultipartUpload",
+			Code:      result.Code,
+			Message:   result.Message,
+			Bucket:    bucketName,
+			Key:       objectName,
+			RequestID: result.RequestID,
+			Err:       errors.New(result.Code),
+		}
+	}
+	return resp.Header.Get("X-Amz-Version-Id"), nil
+}
+
+// completePartial - completes an upload with parts and moves the object
+// to '<object>.partial', returning its name. The upload can only be
+// completed under its own name, which must not destroy an object already
+// there, nor leave the partial object in its place.
+func completePartial(e *endpoints, bucketName, objectName, uploadID string, parts []minio.ObjectPart) (string, error) {
+	s := e.site()
+	completed := make([]minio.CompletePart, len(parts))
+	var size int64
+	for i, part := range parts {
+		completed[i] = minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag}
+		size += part.Size
+	}
+	if _, err := statObject(s, bucketName, objectName, ""); err == nil {
+		versioned, err := bucketVersioned(s, bucketName)
+		if err != nil {
+			return "", err
+		}
+		if !versioned {
+			return "", fmt.Errorf("%s exists and the bucket is not versioned, salvaging would overwrite it", objectName)
+		}
+	} else if code := errorCode(err); code != "404" && code != "NoSuchKey" && code != "NotFound" {
+		return "", err
+	}
+	target := objectName + partialSuffix
+
+	versionID, err := completeVersion(s, bucketName, objectName, uploadID, completed)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "completed upload %s with %d parts, %d bytes\n", uploadID, len(parts), size)
+
+	st, err := statObject(s, bucketName, objectName, versionID)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	if versionID != "" {
+		query.Set("versionId", versionID)
+	}
+	metaData := map[string][]string{
+		"X-Amz-Meta-Salvaged-Upload": {uploadID},
+		"X-Amz-Meta-Salvaged-Parts":  {strconv.Itoa(len(parts))},
+	}
+	if ct := st.ContentType; ct != "" {
+		metaData["Content-Type"] = []string{ct}
+	}
+	// The completed object is the only copy of the parts, it is kept
+	// if they can't be copied.
+	if err = copyParts(s, e.backend(), bucketName, objectName, versionID, target, parts, metaData); err != nil {
+		if versionID == "" {
+			return "", fmt.Errorf("Salvaged parts left in %s, copy to %s failed: %v", objectName, target, err)
+		}
+		return "", fmt.Errorf("Salvaged parts left in version %s of %s, copy to %s failed: %v", versionID, objectName, target, err)
+	}
+	resp, err := siteRequest(s, "DeleteObject", http.MethodDelete, bucketName, objectName, query, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("Salvaged to %s, but the completed %s was not removed: %v", target, objectName, err)
+	}
+	resp.Body.Close()
+	return target, nil
+}
+
+// salvageMain - implements the 'salvage <upload-id>' command, which
+// keeps the parts received by an upload that can't be completed, by
+// default as '<object>.partial', with -complete as the object itself.
+func salvageMain(args []string) error {
+	flags := flag.NewFlagSet("salvage", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket of the upload")
+	objectName := flags.String("object", "", "object of the upload, looked up among the uploads in progress by default")
+	complete := flags.Bool("complete", false, "complete the upload with the parts received instead of copying them to '<object>"+partialSuffix+"'")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: salvage [-bucket name] [-object key] [-complete] <upload-id>")
+	}
+	uploadID := flags.Arg(0)
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	c := e.core()
+	if *objectName == "" {
+		if *objectName, err = findUpload(c, *bucketName, uploadID); err != nil {
+			return err
+		}
+	}
+	parts, err := salvageableParts(c, *bucketName, *objectName, uploadID)
+	if err != nil {
+		return err
+	}
+	completed := make([]minio.CompletePart, len(parts))
+	var size int64
+	for i, part := range parts {
+		completed[i] = minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag}
+		size += part.Size
+	}
+
+	target := *objectName
+	if *complete {
+		err = e.do(func(b Backend) error {
+			return b.CompleteMultipartUpload(*bucketName, *objectName, uploadID, completed)
+		})
+		if err != nil {
+			return wrapS3Error("CompleteMultipartUpload", err)
+		}
+		fmt.Fprintf(os.Stderr, "completed upload %s with %d parts, %d bytes\n", uploadID, len(parts), size)
+	} else if target, err = completePartial(e, *bucketName, *objectName, uploadID, parts); err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"object":   target,
+		"uploadId": uploadID,
+		"parts":    len(parts),
+		"size":     size,
+	})
+}
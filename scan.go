@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// scanChunkSize - size of the chunks streams are sent to scanners in.
+// clamd limits the whole stream of a session, not its chunks, to its
+// StreamMaxLength (25MB by default), which must be raised to scan
+// larger uploads.
+const scanChunkSize = 1024 * 1024
+
+// scanError - returned when the scanner flagged the uploaded content.
+type scanError struct {
+	Object string
+	Threat string
+}
+
+func (e scanError) Error() string {
+	return fmt.Sprintf("Content scanner flagged %s: %s", e.Object, e.Threat)
+}
+
+// scanSession - a scan of one stream, sent part by part as it is read.
+type scanSession interface {
+	// write - sends the next bytes of the stream.
+	write(p []byte) error
+	// result - ends the stream and returns a scanError if it was flagged.
+	result() error
+	close()
+}
+
+// scanURL - returns the scanner set with SCAN_URL, as
+// 'clamd:///path/to/clamd.sock', 'clamd://host:3310' or
+// 'icap://host:1344/service'. Empty if streams are not scanned.
+func scanURL() (*url.URL, error) {
+	v := os.Getenv("SCAN_URL")
+	if v == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SCAN_URL: %v", err)
+	}
+	if u.Scheme != "clamd" && u.Scheme != "icap" {
+		return nil, fmt.Errorf("Unsupported SCAN_URL scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// newScanSession - starts scanning the stream of an object, nil if
+// SCAN_URL is unset.
+func newScanSession(objectName string) (scanSession, error) {
+	u, err := scanURL()
+	if err != nil || u == nil {
+		return nil, err
+	}
+
+	network, address := "tcp", u.Host
+	if u.Scheme == "clamd" && u.Host == "" {
+		network, address = "unix", u.Path
+	}
+	if u.Scheme == "icap" && u.Port() == "" {
+		address += ":1344"
+	}
+	conn, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Content scanner unreachable: %v", err)
+	}
+
+	if u.Scheme == "icap" {
+		return newICAPSession(conn, u, objectName)
+	}
+	// Null terminated commands, see clamd(8).
+	if _, err = io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &clamdSession{conn: conn, object: objectName}, nil
+}
+
+// clamdSession - a clamd INSTREAM scan.
+type clamdSession struct {
+	conn   net.Conn
+	object string
+}
+
+func (s *clamdSession) write(p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if n > scanChunkSize {
+			n = scanChunkSize
+		}
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		if _, err := s.conn.Write(size[:]); err != nil {
+			return err
+		}
+		if _, err := s.conn.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (s *clamdSession) result() error {
+	// A zero length chunk ends the stream.
+	if _, err := s.conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(s.conn).ReadString(0)
+	if err != nil {
+		return fmt.Errorf("Content scanner failed: %v", err)
+	}
+	// 'stream: OK', 'stream: Eicar-Signature FOUND' or '... ERROR'.
+	reply = strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), "\x00")
+	switch {
+	case reply == "OK":
+		return nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return scanError{Object: s.object, Threat: strings.TrimSuffix(reply, " FOUND")}
+	case strings.Contains(reply, "size limit exceeded"):
+		return fmt.Errorf("Content scanner failed: %s, raise StreamMaxLength of clamd", reply)
+	}
+	return fmt.Errorf("Content scanner failed: %s", reply)
+}
+
+func (s *clamdSession) close() {
+	s.conn.Close()
+}
+
+// icapSession - an ICAP RESPMOD scan, the stream being sent as the
+// chunked body of a response. Servers offering previews get an empty
+// one, and may answer before the body is sent.
+type icapSession struct {
+	conn   net.Conn
+	w      *bufio.Writer
+	tp     *textproto.Reader
+	object string
+	// done is set once the server answered without the body, verdict
+	// is then its answer.
+	done    bool
+	verdict error
+}
+
+func newICAPSession(conn net.Conn, u *url.URL, objectName string) (*icapSession, error) {
+	s := &icapSession{
+		conn:   conn,
+		w:      bufio.NewWriterSize(conn, scanChunkSize),
+		tp:     textproto.NewReader(bufio.NewReader(conn)),
+		object: objectName,
+	}
+	fail := func(err error) (*icapSession, error) {
+		conn.Close()
+		return nil, fmt.Errorf("Content scanner failed: %v", err)
+	}
+
+	fmt.Fprintf(s.w, "OPTIONS icap://%s%s ICAP/1.0\r\n", u.Host, u.Path)
+	fmt.Fprintf(s.w, "Host: %s\r\n", u.Hostname())
+	fmt.Fprintf(s.w, "Encapsulated: null-body=0\r\n\r\n")
+	if err := s.w.Flush(); err != nil {
+		return fail(err)
+	}
+	code, status, header, err := s.readResponse()
+	if err != nil {
+		return fail(err)
+	}
+	if code != "200" {
+		return fail(fmt.Errorf("OPTIONS: %s", status))
+	}
+	preview := header.Get("Preview") != ""
+
+	resHdr := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	fmt.Fprintf(s.w, "RESPMOD icap://%s%s ICAP/1.0\r\n", u.Host, u.Path)
+	fmt.Fprintf(s.w, "Host: %s\r\n", u.Hostname())
+	fmt.Fprintf(s.w, "Allow: 204\r\n")
+	if preview {
+		fmt.Fprintf(s.w, "Preview: 0\r\n")
+	}
+	fmt.Fprintf(s.w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHdr))
+	if _, err := s.w.WriteString(resHdr); err != nil {
+		return fail(err)
+	}
+	if !preview {
+		return s, nil
+	}
+
+	// The empty preview ends, the server continues or answers.
+	s.w.WriteString("0\r\n\r\n")
+	if err := s.w.Flush(); err != nil {
+		return fail(err)
+	}
+	if code, status, header, err = s.readResponse(); err != nil {
+		return fail(err)
+	}
+	if code != "100" {
+		s.done, s.verdict = true, s.judge(code, status, header)
+	}
+	return s, nil
+}
+
+// readResponse - reads the status code, status line and header of an
+// ICAP response.
+func (s *icapSession) readResponse() (code, status string, header textproto.MIMEHeader, err error) {
+	if status, err = s.tp.ReadLine(); err != nil {
+		return "", "", nil, err
+	}
+	if header, err = s.tp.ReadMIMEHeader(); err != nil && err != io.EOF {
+		return "", "", nil, err
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 {
+		return "", "", nil, fmt.Errorf("%q", status)
+	}
+	return fields[1], status, header, nil
+}
+
+// judge - returns the verdict of a RESPMOD response.
+func (s *icapSession) judge(code, status string, header textproto.MIMEHeader) error {
+	// 'ICAP/1.0 204 No Content' leaves the content unmodified.
+	switch code {
+	case "204":
+		return nil
+	case "200":
+		threat := header.Get("X-Infection-Found")
+		if threat == "" {
+			threat = header.Get("X-Violations-Found")
+		}
+		if threat == "" {
+			threat = "content modified by the scanner"
+		}
+		return scanError{Object: s.object, Threat: threat}
+	}
+	return fmt.Errorf("Content scanner failed: %s", status)
+}
+
+func (s *icapSession) write(p []byte) error {
+	if len(p) == 0 || s.done {
+		return nil
+	}
+	fmt.Fprintf(s.w, "%x\r\n", len(p))
+	s.w.Write(p)
+	_, err := s.w.WriteString("\r\n")
+	return err
+}
+
+func (s *icapSession) result() error {
+	if s.done {
+		return s.verdict
+	}
+	s.w.WriteString("0\r\n\r\n")
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	code, status, header, err := s.readResponse()
+	if err != nil {
+		return fmt.Errorf("Content scanner failed: %v", err)
+	}
+	return s.judge(code, status, header)
+}
+
+func (s *icapSession) close() {
+	s.conn.Close()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// selectCSVInput - CSV input serialization of a select request.
+type selectCSVInput struct {
+	FileHeaderInfo string `xml:"FileHeaderInfo"`
+	FieldDelimiter string `xml:"FieldDelimiter"`
+}
+
+// selectJSONInput - JSON input serialization of a select request.
+type selectJSONInput struct {
+	Type string `xml:"Type"`
+}
+
+// selectRequest - the body of a SelectObjectContent request.
+type selectRequest struct {
+	XMLName        xml.Name `xml:"SelectObjectContentRequest"`
+	Expression     string   `xml:"Expression"`
+	ExpressionType string   `xml:"ExpressionType"`
+	Input          struct {
+		CompressionType string           `xml:"CompressionType,omitempty"`
+		CSV             *selectCSVInput  `xml:"CSV,omitempty"`
+		JSON            *selectJSONInput `xml:"JSON,omitempty"`
+		Parquet         *struct{}        `xml:"Parquet,omitempty"`
+	} `xml:"InputSerialization"`
+	Output struct {
+		CSV  *struct{} `xml:"CSV,omitempty"`
+		JSON *struct {
+			RecordDelimiter string `xml:"RecordDelimiter"`
+		} `xml:"JSON,omitempty"`
+	} `xml:"OutputSerialization"`
+}
+
+// selectFormat - guesses the input format of an object from its name.
+func selectFormat(objectName string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(objectName, ".gz"), ".bz2")
+	switch path.Ext(name) {
+	case ".json", ".ndjson", ".jsonl":
+		return "json"
+	case ".parquet":
+		return "parquet"
+	default:
+		return "csv"
+	}
+}
+
+// selectCompression - guesses the compression of an object from its name.
+func selectCompression(objectName string) string {
+	switch path.Ext(objectName) {
+	case ".gz":
+		return "GZIP"
+	case ".bz2":
+		return "BZIP2"
+	default:
+		return "NONE"
+	}
+}
+
+// readEventMessage - reads one message of an AWS event stream, returning
+// its headers and payload.
+func readEventMessage(r io.Reader) (map[string]string, []byte, error) {
+	var prelude [12]byte
+	if _, err := io.ReadFull(r, prelude[:]); err != nil {
+		return nil, nil, err
+	}
+	total := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, nil, fmt.Errorf("Event stream prelude checksum mismatch")
+	}
+	if total < 16+headersLen {
+		return nil, nil, fmt.Errorf("Malformed event stream message")
+	}
+	msg := make([]byte, total-12)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(prelude[:])
+	crc.Write(msg[:len(msg)-4])
+	if crc.Sum32() != binary.BigEndian.Uint32(msg[len(msg)-4:]) {
+		return nil, nil, fmt.Errorf("Event stream message checksum mismatch")
+	}
+
+	headers := make(map[string]string)
+	h := msg[:headersLen]
+	for len(h) > 0 {
+		n := int(h[0])
+		if len(h) < 1+n+3 {
+			return nil, nil, fmt.Errorf("Malformed event stream header")
+		}
+		name := string(h[1 : 1+n])
+		// Only string values (type 7) are sent by S3 Select.
+		if h[1+n] != 7 {
+			return nil, nil, fmt.Errorf("Unexpected event stream header type %d", h[1+n])
+		}
+		h = h[2+n:]
+		vlen := int(binary.BigEndian.Uint16(h))
+		if len(h) < 2+vlen {
+			return nil, nil, fmt.Errorf("Malformed event stream header")
+		}
+		headers[name] = string(h[2 : 2+vlen])
+		h = h[2+vlen:]
+	}
+	return headers, msg[headersLen : len(msg)-4], nil
+}
+
+// selectObject - runs the request on an object, writing the records to w.
+// It fails unless the stream ends with an End event, as a cut stream
+// can't be told from a short result otherwise.
+func selectObject(s site, bucketName, objectName string, req selectRequest, w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(req); err != nil {
+		return err
+	}
+	query := url.Values{"select": {""}, "select-type": {"2"}}
+	header := http.Header{"Content-Type": {"application/xml"}}
+	resp, err := siteRequest(s, "SelectObjectContent", http.MethodPost, bucketName, objectName, query, header, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	for {
+		headers, payload, err := readEventMessage(r)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if headers[":message-type"] == "error" {
+			return &S3Error{
+				Operation: "SelectObjectContent",
+				Code:      headers[":error-code"],
+				Message:   headers[":error-message"],
+				Bucket:    bucketName,
+				Key:       objectName,
+			}
+		}
+		switch headers[":event-type"] {
+		case "Records":
+			if _, err = w.Write(payload); err != nil {
+				return err
+			}
+		case "End":
+			return nil
+		}
+	}
+}
+
+// selectMain - implements the 'select -sql query s3://bucket/key'
+// command, which runs S3 Select on a CSV, JSON or Parquet object and
+// streams the matching records to stdout.
+func selectMain(args []string) error {
+	flags := flag.NewFlagSet("select", flag.ExitOnError)
+	sql := flags.String("sql", "", "query, e.g. \"SELECT * FROM s3object s WHERE s.status = 'failed'\"")
+	input := flags.String("input", "", "input format: csv, json or parquet, guessed from the key if empty")
+	compression := flags.String("compression", "", "input compression: none, gzip or bzip2, guessed from the key if empty")
+	csvHeader := flags.String("csv-header", "use", "CSV header line: use, ignore or none")
+	delimiter := flags.String("delimiter", ",", "CSV field delimiter")
+	jsonType := flags.String("json-type", "lines", "JSON input: lines or document")
+	output := flags.String("output", "", "output format: csv or json, the input format if empty")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *sql == "" {
+		return fmt.Errorf("Usage: select -sql query [-input format] [-output format] s3://bucket/key")
+	}
+	bucketName, objectName, err := parseObjectURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	req := selectRequest{Expression: *sql, ExpressionType: "SQL"}
+	if *input == "" {
+		*input = selectFormat(objectName)
+	}
+	switch *input {
+	case "csv":
+		req.Input.CSV = &selectCSVInput{FileHeaderInfo: strings.ToUpper(*csvHeader), FieldDelimiter: *delimiter}
+	case "json":
+		req.Input.JSON = &selectJSONInput{Type: strings.ToUpper(*jsonType)}
+	case "parquet":
+		req.Input.Parquet = &struct{}{}
+	default:
+		return fmt.Errorf("Unknown input format %q", *input)
+	}
+	// Parquet is compressed internally, and takes no CompressionType.
+	if *input != "parquet" {
+		req.Input.CompressionType = strings.ToUpper(*compression)
+		if *compression == "" {
+			req.Input.CompressionType = selectCompression(objectName)
+		}
+	}
+	if *output == "" {
+		*output = *input
+	}
+	switch *output {
+	case "csv", "parquet":
+		req.Output.CSV = &struct{}{}
+	case "json":
+		req.Output.JSON = &struct {
+			RecordDelimiter string `xml:"RecordDelimiter"`
+		}{"\n"}
+	default:
+		return fmt.Errorf("Unknown output format %q", *output)
+	}
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	err = selectObject(e.site(), bucketName, objectName, req, w)
+	if fErr := w.Flush(); err == nil {
+		err = fErr
+	}
+	return err
+}
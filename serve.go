@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// tenantPrefix - prefix under which tenant usage is tracked.
+const tenantPrefix = ".tenants/"
+
+// errQuotaExceeded - returned by streams going over the storage quota.
+var errQuotaExceeded = errors.New("Storage quota exceeded")
+
+// tenant - a team allowed to upload with an API key, below its prefix.
+type tenant struct {
+	Name   string `json:"name"`
+	APIKey string `json:"api_key"`
+	Prefix string `json:"prefix"`
+	// MaxBytes is the storage quota, 0 for none.
+	MaxBytes int64 `json:"max_bytes"`
+	// RequestsPerMinute is the rate quota, 0 for none.
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// tenantUsage - the storage used by a tenant, as stored in the bucket.
+type tenantUsage struct {
+	Tenant  string    `json:"tenant"`
+	Bytes   int64     `json:"bytes"`
+	Objects int64     `json:"objects"`
+	Updated time.Time `json:"updated"`
+}
+
+// tenantState - the in memory state of a tenant.
+type tenantState struct {
+	mu     sync.Mutex
+	usage  *tenantUsage
+	window time.Time
+	count  int
+	// reserved is the storage held by uploads in flight.
+	reserved int64
+}
+
+// server - the 'serve' command, receiving streams over HTTP.
+type server struct {
+	c          minio.Core
+	bucketName string
+	tenants    []*tenant
+	states     map[string]*tenantState
+}
+
+// loadTenants - reads the JSON list of tenants at name.
+func loadTenants(name string) ([]*tenant, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []*tenant
+	if err = json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("Invalid tenants %s: %v", name, err)
+	}
+	seen := make(map[string]bool)
+	for _, t := range tenants {
+		if t.Name == "" || t.APIKey == "" || seen[t.Name] {
+			return nil, fmt.Errorf("Tenants need a unique name and an API key")
+		}
+		seen[t.Name] = true
+		// Prefixes are directories, tenants never share objects.
+		if t.Prefix = strings.Trim(t.Prefix, "/"); t.Prefix == "" || isInternalObject(t.Prefix+"/") {
+			return nil, fmt.Errorf("Tenant %s needs a prefix", t.Name)
+		}
+		t.Prefix += "/"
+	}
+	for _, t := range tenants {
+		for _, o := range tenants {
+			if t != o && strings.HasPrefix(t.Prefix, o.Prefix) {
+				return nil, fmt.Errorf("Prefixes of tenants %s and %s overlap", t.Name, o.Name)
+			}
+		}
+	}
+	return tenants, nil
+}
+
+// authenticate - returns the tenant of the API key of r, sent as a
+// bearer token or in X-Api-Key.
+func (s *server) authenticate(r *http.Request) *tenant {
+	key := r.Header.Get("X-Api-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return nil
+	}
+	for _, t := range s.tenants {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(t.APIKey)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// allow - counts a request against the rate quota of a tenant.
+func (s *server) allow(t *tenant) bool {
+	if t.RequestsPerMinute <= 0 {
+		return true
+	}
+	st := s.states[t.Name]
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if now := time.Now(); now.Sub(st.window) >= time.Minute {
+		st.window, st.count = now, 0
+	}
+	st.count++
+	return st.count <= t.RequestsPerMinute
+}
+
+// usage - returns the usage of a tenant, loading it on first use. The
+// caller holds the state lock.
+func (s *server) usage(t *tenant, st *tenantState) (*tenantUsage, error) {
+	if st.usage != nil {
+		return st.usage, nil
+	}
+	usage := &tenantUsage{Tenant: t.Name}
+	if err := getJSON(s.c, s.bucketName, tenantPrefix+t.Name+".json", usage); err != nil && !isNoSuchKey(err) {
+		return nil, err
+	}
+	st.usage = usage
+	return usage, nil
+}
+
+// reserve - reserves the storage of a tenant for an upload of size
+// bytes, -1 if unknown, replacing an object of size replaced, -1 if none.
+// Uploads of unknown size reserve all the storage left. Returns the bytes
+// reserved, which the upload may read and concurrent uploads can't use
+// until released or recorded, -1 if the tenant has no storage quota.
+func (s *server) reserve(t *tenant, size, replaced int64) (int64, error) {
+	if t.MaxBytes <= 0 {
+		return -1, nil
+	}
+	st := s.states[t.Name]
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	usage, err := s.usage(t, st)
+	if err != nil {
+		return 0, err
+	}
+	left := t.MaxBytes - usage.Bytes - st.reserved
+	if replaced > 0 {
+		left += replaced
+	}
+	if left < 0 {
+		left = 0
+	}
+	if size >= 0 && size < left {
+		left = size
+	}
+	st.reserved += left
+	return left, nil
+}
+
+// release - gives back the storage reserved by a failed upload.
+func (s *server) release(t *tenant, reserved int64) {
+	if reserved <= 0 {
+		return
+	}
+	st := s.states[t.Name]
+	st.mu.Lock()
+	st.reserved -= reserved
+	st.mu.Unlock()
+}
+
+// record - adds an upload of size bytes replacing an object of size
+// replaced, -1 if none, to the usage of a tenant, settling the storage
+// it reserved.
+func (s *server) record(t *tenant, reserved, size, replaced int64) error {
+	st := s.states[t.Name]
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if reserved > 0 {
+		st.reserved -= reserved
+	}
+	usage, err := s.usage(t, st)
+	if err != nil {
+		return err
+	}
+	usage.Bytes += size
+	usage.Objects++
+	if replaced >= 0 {
+		usage.Bytes -= replaced
+		usage.Objects--
+	}
+	usage.Updated = time.Now().UTC()
+	return putJSON(s.c, s.bucketName, tenantPrefix+t.Name+".json", usage)
+}
+
+// quotaReader - fails the stream once more than left bytes are read.
+type quotaReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	if q.left -= int64(n); q.left < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// httpError - replies with a JSON error.
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := s.authenticate(r)
+	if t == nil {
+		httpError(w, http.StatusUnauthorized, errors.New("Missing or unknown API key"))
+		return
+	}
+	if !s.allow(t) {
+		w.Header().Set("Retry-After", "60")
+		httpError(w, http.StatusTooManyRequests, errors.New("Rate quota exceeded"))
+		return
+	}
+
+	if r.URL.Path == "/usage" && r.Method == http.MethodGet {
+		st := s.states[t.Name]
+		st.mu.Lock()
+		usage, err := s.usage(t, st)
+		var body []byte
+		if err == nil {
+			body, err = json.Marshal(usage)
+		}
+		st.mu.Unlock()
+		if err != nil {
+			httpError(w, http.StatusBadGateway, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+		return
+	}
+	if r.Method != http.MethodPut {
+		httpError(w, http.StatusMethodNotAllowed, errors.New("Only PUT /<object> and GET /usage are supported"))
+		return
+	}
+
+	// Cleaned paths can't escape the tenant prefix.
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		httpError(w, http.StatusBadRequest, errors.New("Missing object name"))
+		return
+	}
+	objectName := t.Prefix + name
+	s.put(w, r, t, objectName)
+}
+
+// put - streams the request body to objectName within the quotas of t.
+// Concurrent uploads of a tenant each reserve their share of the storage
+// quota.
+func (s *server) put(w http.ResponseWriter, r *http.Request, t *tenant, objectName string) {
+	// Overwritten objects give their storage back.
+	replaced := int64(-1)
+	if objInfo, err := s.c.StatObject(s.bucketName, objectName); err == nil {
+		replaced = objInfo.Size
+	}
+
+	left, err := s.reserve(t, r.ContentLength, replaced)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, err)
+		return
+	}
+	if left >= 0 && r.ContentLength > left {
+		s.release(t, left)
+		httpError(w, http.StatusInsufficientStorage, errQuotaExceeded)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if left >= 0 {
+		body = &quotaReader{r: r.Body, left: left}
+	}
+	metaData := map[string][]string{"X-Amz-Meta-Tenant": {t.Name}}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		metaData["Content-Type"] = []string{ct}
+	}
+	n, err := PutStream(s.bucketName, objectName, body, metaData)
+	if err != nil {
+		s.release(t, left)
+		code := http.StatusBadGateway
+		if errors.Is(err, errQuotaExceeded) {
+			code = http.StatusInsufficientStorage
+		}
+		httpError(w, code, err)
+		return
+	}
+	if err = s.record(t, left, n, replaced); err != nil {
+		fmt.Fprintln(os.Stderr, "usage of tenant", t.Name, "not recorded:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"object": objectName, "size": n})
+}
+
+// serveMain - implements the 'serve' command, which receives streams
+// over HTTP on behalf of tenants authenticated by API key.
+func serveMain(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8080", "address to listen on")
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	tenantsFile := flags.String("tenants", "", "JSON list of tenants with name, api_key, prefix and quotas")
+	tlsCert := flags.String("tls-cert", "", "certificate to serve HTTPS with, API keys are otherwise sent in plaintext")
+	tlsKey := flags.String("tls-key", "", "private key of -tls-cert")
+	flags.Parse(args)
+	if *tenantsFile == "" || flags.NArg() != 0 {
+		return fmt.Errorf("Usage: serve -tenants file [-listen addr] [-bucket name] [-tls-cert file -tls-key file]")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("Both -tls-cert and -tls-key must be set, or neither")
+	}
+
+	tenants, err := loadTenants(*tenantsFile)
+	if err != nil {
+		return err
+	}
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	s := &server{c: c, bucketName: *bucketName, tenants: tenants, states: make(map[string]*tenantState)}
+	for _, t := range tenants {
+		s.states[t.Name] = &tenantState{}
+	}
+
+	fmt.Fprintln(os.Stderr, "serving", len(tenants), "tenants on", *listen)
+	if *tlsCert != "" {
+		return http.ListenAndServeTLS(*listen, *tlsCert, *tlsKey, s)
+	}
+	return http.ListenAndServe(*listen, s)
+}
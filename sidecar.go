@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// sidecarSuffix - suffix of the provenance sidecar of 'put -sidecar'.
+const sidecarSuffix = ".meta.json"
+
+// sidecarSource - describes what was read to upload an object.
+type sidecarSource struct {
+	Spec    string     `json:"spec"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"modTime,omitempty"`
+}
+
+// uploadSidecar - the provenance of an object, uploaded next to it as
+// '<object>.meta.json' so that consumers need not rely on its metadata,
+// limited to 2KiB.
+type uploadSidecar struct {
+	Bucket     string              `json:"bucket"`
+	Object     string              `json:"object"`
+	Size       int64               `json:"size"`
+	SHA256     string              `json:"sha256,omitempty"`
+	ETag       string              `json:"etag,omitempty"`
+	VersionID  string              `json:"versionId,omitempty"`
+	UploadID   string              `json:"uploadId,omitempty"`
+	Source     sidecarSource       `json:"source"`
+	Transforms []string            `json:"transforms"`
+	Metadata   map[string][]string `json:"metadata,omitempty"`
+
+	Started       time.Time `json:"started"`
+	Completed     time.Time `json:"completed"`
+	Seconds       float64   `json:"seconds"`
+	Parts         int       `json:"parts"`
+	Retries       int       `json:"retries"`
+	ReadSeconds   float64   `json:"readSeconds"`
+	HashSeconds   float64   `json:"hashSeconds"`
+	UploadSeconds float64   `json:"uploadSeconds"`
+
+	Host    string `json:"host"`
+	Version string `json:"toolVersion"`
+
+	mu     sync.Mutex
+	digest *hashingReader
+}
+
+// newUploadSidecar - starts recording the upload of the stream of spec,
+// returning the stream to upload instead of reader.
+func newUploadSidecar(bucketName, objectName, spec string, reader io.Reader) (*uploadSidecar, io.Reader, error) {
+	s := &uploadSidecar{
+		Bucket:     bucketName,
+		Object:     objectName,
+		Source:     sidecarSource{Spec: spec},
+		Transforms: []string{},
+		Started:    time.Now().UTC(),
+		Version:    toolVersion,
+	}
+	s.Host, _ = os.Hostname()
+	if isLocalPath(spec) && spec != "-" {
+		if info, err := os.Stat(spec); err == nil && info.Mode().IsRegular() {
+			mtime := info.ModTime().UTC()
+			s.Source.Size, s.Source.ModTime = info.Size(), &mtime
+		}
+	}
+	digest, reader, err := newHashingSource(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.digest = digest
+	return s, reader, nil
+}
+
+// progressFunc - returns the ProgressFunc recording the upload, nil
+// without a sidecar.
+func (s *uploadSidecar) progressFunc() ProgressFunc {
+	if s == nil {
+		return nil
+	}
+	return s.progress
+}
+
+func (s *uploadSidecar) progress(ev ProgressEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch ev.Type {
+	case UploadStarted:
+		s.UploadID = ev.UploadID
+	case PartCompleted:
+		s.Parts++
+	case Retry:
+		s.Retries++
+	case Completed:
+		s.ReadSeconds = ev.ReadTime.Seconds()
+		s.HashSeconds = ev.HashTime.Seconds()
+		s.UploadSeconds = ev.UploadTime.Seconds()
+	}
+}
+
+// save - uploads the sidecar of the object uploaded with metaData.
+func (s *uploadSidecar) save(c minio.Core, metaData map[string][]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Completed = time.Now().UTC()
+	s.Seconds = s.Completed.Sub(s.Started).Seconds()
+	s.Size = s.digest.n
+	s.SHA256 = s.digest.sum()
+	s.Metadata = metaData
+	if objInfo, err := c.StatObject(s.Bucket, s.Object); err == nil {
+		s.ETag = objInfo.ETag
+		s.VersionID = objInfo.Metadata.Get("X-Amz-Version-Id")
+	}
+	return putJSON(c, s.Bucket, s.Object+sidecarSuffix, s)
+}
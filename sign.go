@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// signatureSuffix - suffix of the detached signature object of an object.
+const signatureSuffix = ".sig"
+
+// signer - a 'gpg --detach-sign' process fed with the uploaded stream.
+type signer struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	out   bytes.Buffer
+}
+
+// startSigner - starts signing with the gpg key of the given id.
+func startSigner(keyID string) (*signer, error) {
+	s := &signer{cmd: exec.Command("gpg", "--batch", "--armor", "--detach-sign",
+		"--local-user", keyID, "--output", "-")}
+	s.cmd.Stdout = &s.out
+	s.cmd.Stderr = os.Stderr
+	var err error
+	if s.stdin, err = s.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err = s.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reader - returns reader, signing everything read from it.
+func (s *signer) reader(reader io.Reader) io.Reader {
+	return io.TeeReader(reader, s.stdin)
+}
+
+// finish - returns the armored signature of the stream.
+func (s *signer) finish() ([]byte, error) {
+	s.stdin.Close()
+	if err := s.cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("gpg signing failed: %v", err)
+	}
+	return s.out.Bytes(), nil
+}
+
+// kill - abandons the signature.
+func (s *signer) kill() {
+	s.stdin.Close()
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+// verifier - a 'gpg --verify' process checking a downloaded stream
+// against the detached signature of its object.
+type verifier struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	sigFile string
+}
+
+// startVerifier - fetches the signature of an object and starts
+// verifying against it.
+func startVerifier(c minio.Core, bucketName, objectName string) (*verifier, error) {
+	sig, err := getBytes(c, bucketName, objectName+signatureSuffix)
+	if err != nil {
+		return nil, wrapS3Error("GetObject", err)
+	}
+	f, err := ioutil.TempFile("", "streams3-sig")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(sig)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	v := &verifier{cmd: exec.Command("gpg", "--batch", "--verify", f.Name(), "-"), sigFile: f.Name()}
+	v.cmd.Stderr = os.Stderr
+	if v.stdin, err = v.cmd.StdinPipe(); err == nil {
+		err = v.cmd.Start()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return v, nil
+}
+
+// reader - returns reader, verifying everything read from it.
+func (v *verifier) reader(reader io.Reader) io.Reader {
+	return io.TeeReader(reader, v.stdin)
+}
+
+// finish - returns an error unless the stream matched the signature.
+func (v *verifier) finish() error {
+	defer os.Remove(v.sigFile)
+	v.stdin.Close()
+	if err := v.cmd.Wait(); err != nil {
+		return fmt.Errorf("Signature verification failed: %v", err)
+	}
+	return nil
+}
+
+// verifySignedBy - returns an error unless sig is a valid detached
+// signature of data made with the key of the given fingerprint, as any
+// key of the keyring is trusted by 'gpg --verify' itself.
+func verifySignedBy(data, sig []byte, fingerprint string) error {
+	dir, err := ioutil.TempDir("", "streams3-verify")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	dataFile, sigFile := filepath.Join(dir, "data"), filepath.Join(dir, "data.sig")
+	if err = ioutil.WriteFile(dataFile, data, 0600); err == nil {
+		err = ioutil.WriteFile(sigFile, sig, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	var status bytes.Buffer
+	cmd := exec.Command("gpg", "--batch", "--status-fd", "1", "--verify", sigFile, dataFile)
+	cmd.Stdout = &status
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("Signature verification failed: %v", err)
+	}
+	want := strings.ToUpper(strings.Join(strings.Fields(fingerprint), ""))
+	for _, line := range strings.Split(status.String(), "\n") {
+		// '[GNUPG:] VALIDSIG <fingerprint> ... <primary key fingerprint>'
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "VALIDSIG" {
+			continue
+		}
+		if fields[2] == want || fields[len(fields)-1] == want {
+			return nil
+		}
+		return fmt.Errorf("Signed by %s, not %s", fields[2], want)
+	}
+	return fmt.Errorf("Signature verification failed: no valid signature")
+}
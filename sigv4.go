@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SigV4 constants.
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4DateFormat = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// signingRegion - the region requests are signed for, from S3_REGION or
+// AWS_REGION, defaulting to 'us-east-1'.
+func signingRegion() string {
+	if v := os.Getenv("S3_REGION"); v != "" {
+		return v
+	}
+	if v := os.Getenv("AWS_REGION"); v != "" {
+		return v
+	}
+	return "us-east-1"
+}
+
+// hmacSHA256 - returns the HMAC-SHA256 of data with key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sha256Hex - returns the hex encoded SHA256 of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sigV4Key - derives the signing key for a day, region and service.
+func sigV4Key(secretKey string, t time.Time, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sigV4Scope - returns the credential scope of a signature.
+func sigV4Scope(t time.Time, region, service string) string {
+	return strings.Join([]string{t.Format("20060102"), region, service, "aws4_request"}, "/")
+}
+
+// sigV4Escape - URI encodes a query component as SigV4 expects.
+func sigV4Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// canonicalQuery - returns the sorted, encoded query string of u.
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, sigV4Escape(k)+"="+sigV4Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// signV4 - signs req in place with SigV4 at time t and returns the
+// signature. payloadHash is the hex SHA256 of the body, UNSIGNED-PAYLOAD
+// or STREAMING-AWS4-HMAC-SHA256-PAYLOAD.
+func signV4(req *http.Request, creds credentials, region string, t time.Time, payloadHash string) string {
+	return signV4Service(req, creds, region, "s3", t, payloadHash)
+}
+
+// signV4Service - signs req for service, such as 's3express'.
+func signV4Service(req *http.Request, creds credentials, region, service string, t time.Time, payloadHash string) string {
+	t = t.UTC()
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", t.Format(sigV4DateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	// Sign the host, content and all amz and goog headers.
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || strings.HasPrefix(lk, "x-goog-") || lk == "content-md5" || lk == "content-type" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := sigV4Scope(t, region, service)
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(sigV4DateFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(sigV4Key(creds.SecretKey, t, region, service), stringToSign))
+	req.Header.Set("Authorization", sigV4Algorithm+" Credential="+creds.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return signature
+}
+
+// sigV4Transport - an http.RoundTripper signing requests itself, used
+// for credentials the minio client cannot sign with such as temporary
+// credentials carrying a session token.
+type sigV4Transport struct {
+	base   http.RoundTripper
+	creds  credentials
+	region string
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Streaming uploads are signed chunk by chunk already.
+	if strings.HasPrefix(req.Header.Get("Authorization"), sigV4Algorithm) {
+		return t.base.RoundTrip(req)
+	}
+
+	creds := t.creds
+	if creds.expiring() {
+		// Temporary credentials come from the resolution chain.
+		refreshed, err := resolveCredentials()
+		if err != nil {
+			return nil, err
+		}
+		creds = refreshed
+	}
+
+	r := req.Clone(req.Context())
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" || payloadHash == streamingPayload {
+		// Integrity of the body is left to Content-MD5 and TLS.
+		payloadHash = unsignedPayload
+	}
+	signV4(r, creds, t.region, signingTime(), payloadHash)
+	return t.base.RoundTrip(r)
+}
+
+// credentialScope - returns the region and service of a SigV4 signed
+// request, false for other requests.
+func credentialScope(req *http.Request) (region, service string, ok bool) {
+	auth := req.Header.Get("Authorization")
+	i := strings.Index(auth, "Credential=")
+	if !strings.HasPrefix(auth, sigV4Algorithm) || i < 0 {
+		return "", "", false
+	}
+	scope := strings.SplitN(auth[i+len("Credential="):], ",", 2)[0]
+	// access key/date/region/service/aws4_request
+	parts := strings.Split(scope, "/")
+	if len(parts) != 5 {
+		return "", "", false
+	}
+	return parts[2], parts[3], true
+}
+
+// resignV4 - returns a copy of req, signed in its headers, signed again
+// with SigV4 at the corrected time, false if req can't be signed again.
+// Requests signed with SigV2 are signed with SigV4 instead.
+func resignV4(req *http.Request, creds credentials) (*http.Request, bool) {
+	// Directory bucket sessions are signed with their own credentials.
+	if req.Header.Get("X-Amz-S3session-Token") != "" {
+		return nil, false
+	}
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == streamingPayload {
+		return nil, false
+	}
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+	region, service, ok := credentialScope(req)
+	if !ok {
+		region, service = signingRegion(), "s3"
+	}
+	r := req.Clone(req.Context())
+	signV4Service(r, creds, region, service, signingTime(), payloadHash)
+	return r, true
+}
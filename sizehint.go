@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Policies of WithExpectedSize for streams deviating from their size.
+const (
+	SizeDeviationWarn = "warn"
+	SizeDeviationFail = "fail"
+)
+
+// sizeHint - the size a stream of unknown size is expected to have.
+type sizeHint struct {
+	expected  int64
+	tolerance float64
+	// fail aborts the upload of a deviating stream instead of warning.
+	fail bool
+}
+
+// newSizeHint - returns the size hint of the options, nil if none.
+func newSizeHint(o *Options) *sizeHint {
+	if o.ExpectedSize <= 0 {
+		return nil
+	}
+	return &sizeHint{expected: o.ExpectedSize, tolerance: o.SizeTolerance, fail: o.SizeDeviation == SizeDeviationFail}
+}
+
+// max - returns the largest size within the tolerance.
+func (h *sizeHint) max() int64 {
+	return h.expected + int64(float64(h.expected)*h.tolerance)
+}
+
+// planned - returns the size parts are planned for, the largest size
+// within the tolerance with a hint, else size.
+func (h *sizeHint) planned(size int64) int64 {
+	if h == nil {
+		return size
+	}
+	return h.max()
+}
+
+// over - returns an error once more than the tolerance was read with the
+// fail policy, so that the stream is not read further.
+func (h *sizeHint) over(n int64) error {
+	if h == nil || !h.fail || n <= h.max() {
+		return nil
+	}
+	return fmt.Errorf("Stream is over %d bytes, more than expected %d bytes within %g", n-1, h.expected, h.tolerance)
+}
+
+// check - returns an error with the fail policy if a stream of n bytes
+// deviates from the expected size beyond the tolerance, else warns.
+func (h *sizeHint) check(n int64) error {
+	if h == nil {
+		return nil
+	}
+	deviation := n - h.expected
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	if float64(deviation) <= float64(h.expected)*h.tolerance {
+		return nil
+	}
+	err := fmt.Errorf("Stream has %d bytes, expected %d bytes within %g", n, h.expected, h.tolerance)
+	if h.fail {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "warning:", err)
+	return nil
+}
+
+// bucketQuota - the hard quota of a MinIO bucket, with its usage.
+type bucketQuota struct {
+	Quota     int64  `json:"quota"`
+	QuotaType string `json:"quotatype"`
+	Size      int64  `json:"size"`
+}
+
+// checkQuota - fails if size more bytes would not fit in the hard quota
+// of the bucket, read with the MinIO admin API. Servers without the API
+// or buckets without a quota are not checked.
+func checkQuota(s site, bucketName string, size int64) error {
+	resp, err := siteRequest(s, "GetBucketQuota", http.MethodGet, "minio", "admin/v3/get-bucket-quota", url.Values{"bucket": {bucketName}}, nil, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bucket quota of", bucketName, "not checked:", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var quota bucketQuota
+	if err = json.Unmarshal(data, &quota); err != nil {
+		return fmt.Errorf("Invalid bucket quota of %s: %v", bucketName, err)
+	}
+	if quota.Quota <= 0 {
+		return nil
+	}
+	if quota.Size == 0 {
+		// Older servers only report the usage of all buckets.
+		if quota.Size, err = bucketUsage(s, bucketName); err != nil {
+			fmt.Fprintln(os.Stderr, "usage of", bucketName, "not checked against its quota:", err)
+			return nil
+		}
+	}
+	if quota.Size+size > quota.Quota {
+		return fmt.Errorf("Expected %d bytes don't fit in the quota of %s, %d of %d bytes used", size, bucketName, quota.Size, quota.Quota)
+	}
+	return nil
+}
+
+// bucketUsage - returns the bytes used by a MinIO bucket, as last
+// computed by the scanner of the server.
+func bucketUsage(s site, bucketName string) (int64, error) {
+	resp, err := siteRequest(s, "DataUsageInfo", http.MethodGet, "minio", "admin/v3/datausageinfo", url.Values{}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var usage struct {
+		Buckets map[string]struct {
+			Size int64 `json:"size"`
+		} `json:"bucketsUsageInfo"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return 0, err
+	}
+	return usage.Buckets[bucketName].Size, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Snapshot filesystems supported by 'send-snapshot'.
+const (
+	fsZFS   = "zfs"
+	fsBtrfs = "btrfs"
+)
+
+// snapshotID - returns the GUID of a ZFS snapshot, which stays the same
+// across send and receive, or the UUID of a btrfs snapshot subvolume.
+// Received btrfs subvolumes get a UUID of their own, they are identified
+// by the UUID they were received from instead.
+func snapshotID(fs, snapshot string) (string, error) {
+	switch fs {
+	case fsZFS:
+		out, err := exec.Command("zfs", "get", "-Hp", "-o", "value", "guid", snapshot).Output()
+		if err != nil {
+			return "", fmt.Errorf("zfs get guid %s failed: %v", snapshot, err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	case fsBtrfs:
+		out, err := exec.Command("btrfs", "subvolume", "show", snapshot).Output()
+		if err != nil {
+			return "", fmt.Errorf("btrfs subvolume show %s failed: %v", snapshot, err)
+		}
+		var uuid, receivedUUID string
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case strings.HasPrefix(line, "UUID:"):
+				uuid = strings.TrimSpace(strings.TrimPrefix(line, "UUID:"))
+			case strings.HasPrefix(line, "Received UUID:"):
+				receivedUUID = strings.TrimSpace(strings.TrimPrefix(line, "Received UUID:"))
+			}
+		}
+		// Subvolumes which were not received show '-'.
+		if receivedUUID != "" && receivedUUID != "-" {
+			return receivedUUID, nil
+		}
+		if uuid == "" {
+			return "", fmt.Errorf("No UUID for %s", snapshot)
+		}
+		return uuid, nil
+	}
+	return "", fmt.Errorf("Unknown filesystem %q", fs)
+}
+
+// sendCommand - returns the command sending a snapshot, incremental
+// from parent if set.
+func sendCommand(fs, snapshot, parent string) *exec.Cmd {
+	var args []string
+	if fs == fsZFS {
+		args = []string{"send"}
+		if parent != "" {
+			args = append(args, "-i", parent)
+		}
+		return exec.Command("zfs", append(args, snapshot)...)
+	}
+	args = []string{"send"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	return exec.Command("btrfs", append(args, snapshot)...)
+}
+
+// sendSnapshotMain - implements the 'send-snapshot' command, which
+// streams 'zfs send' or 'btrfs send' into an object named after the
+// snapshot GUID, recording the parent of incremental streams.
+func sendSnapshotMain(args []string) error {
+	flags := flag.NewFlagSet("send-snapshot", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	prefix := flags.String("prefix", "snapshots/", "prefix of the object names")
+	fs := flags.String("fs", fsZFS, "filesystem: zfs or btrfs")
+	parent := flags.String("i", "", "parent snapshot, sends an incremental stream")
+	compress := flags.Bool("compress", true, "gzip compress the stream")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: send-snapshot [-fs zfs|btrfs] [-i parent] [-bucket name] <snapshot>")
+	}
+	snapshot := flags.Arg(0)
+
+	id, err := snapshotID(*fs, snapshot)
+	if err != nil {
+		return err
+	}
+	metaData := map[string][]string{
+		"X-Amz-Meta-Snapshot-Fs":   {*fs},
+		"X-Amz-Meta-Snapshot-Name": {snapshot},
+		"X-Amz-Meta-Snapshot-Id":   {id},
+	}
+	if *parent != "" {
+		parentID, err := snapshotID(*fs, *parent)
+		if err != nil {
+			return err
+		}
+		metaData["X-Amz-Meta-Snapshot-Parent-Name"] = []string{*parent}
+		metaData["X-Amz-Meta-Snapshot-Parent-Id"] = []string{parentID}
+	}
+
+	key, err := encryptionKey()
+	if err != nil {
+		return err
+	}
+	t := transforms{compress: *compress, key: key}
+
+	cmd := sendCommand(*fs, snapshot, *parent)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	reader, err := t.apply(&cmdReader{ReadCloser: stdout, cmd: cmd}, metaData)
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	objectName := *prefix + *fs + "/" + id
+	n, err := PutStream(*bucketName, objectName, reader, metaData)
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "uploaded", n, "bytes to", *bucketName+"/"+objectName)
+	return nil
+}
+
+// recvSnapshotMain - implements the 'recv-snapshot' command, which
+// streams a snapshot object back into 'zfs receive' or 'btrfs receive'.
+func recvSnapshotMain(args []string) error {
+	flags := flag.NewFlagSet("recv-snapshot", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket to download from")
+	force := flags.Bool("F", false, "roll back the target dataset first, zfs only")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: recv-snapshot [-bucket name] [-F] <object> <dataset|directory>")
+	}
+	objectName, target := flags.Arg(0), flags.Arg(1)
+
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	object, objInfo, err := c.GetObject(*bucketName, objectName, minio.NewGetReqHeaders())
+	if err != nil {
+		return wrapS3Error("GetObject", err)
+	}
+	defer object.Close()
+
+	reader, err := undoTransforms(object, objInfo.Metadata)
+	if err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	switch fs := objInfo.Metadata.Get("X-Amz-Meta-Snapshot-Fs"); fs {
+	case fsZFS:
+		recvArgs := []string{"receive"}
+		if *force {
+			recvArgs = append(recvArgs, "-F")
+		}
+		cmd = exec.Command("zfs", append(recvArgs, target)...)
+	case fsBtrfs:
+		cmd = exec.Command("btrfs", "receive", target)
+	default:
+		return fmt.Errorf("Object %s is not a snapshot stream", objectName)
+	}
+	if parent := metaValue(objInfo.Metadata, "X-Amz-Meta-Snapshot-Parent-Name"); parent != "" {
+		fmt.Fprintln(os.Stderr, "incremental stream, requires parent", parent)
+	}
+	cmd.Stdin = reader
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxSparseMetadata - sparse files with longer region maps are uploaded
+// with their holes materialized, S3 user metadata is limited to 2KB.
+const maxSparseMetadata = 1536
+
+// formatRegions - encodes data regions as 'offset+length' pairs.
+func formatRegions(regions [][2]int64) string {
+	parts := make([]string, len(regions))
+	for i, r := range regions {
+		parts[i] = strconv.FormatInt(r[0], 10) + "+" + strconv.FormatInt(r[1], 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseRegions - decodes the data regions of formatRegions.
+func parseRegions(s string) ([][2]int64, error) {
+	var regions [][2]int64
+	if s == "" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		i := strings.Index(part, "+")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid sparse map %q", s)
+		}
+		off, oErr := strconv.ParseInt(part[:i], 10, 64)
+		length, lErr := strconv.ParseInt(part[i+1:], 10, 64)
+		if oErr != nil || lErr != nil || off < 0 || length < 0 {
+			return nil, fmt.Errorf("Invalid sparse map %q", s)
+		}
+		regions = append(regions, [2]int64{off, length})
+	}
+	return regions, nil
+}
+
+// putSparseFile - uploads only the data regions of a sparse file, their
+// map and the logical size being recorded in the metadata. Files that
+// turn out not to be sparse are uploaded as is.
+func putSparseFile(bucketName, objectName, name string, metaData map[string][]string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	regions, err := dataRegions(f, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	sparseMap := formatRegions(regions)
+	if len(regions) == 1 && regions[0] == [2]int64{0, info.Size()} || len(sparseMap) > maxSparseMetadata {
+		return PutStream(bucketName, objectName, f, metaData)
+	}
+
+	readers := make([]io.Reader, len(regions))
+	for i, r := range regions {
+		readers[i] = io.NewSectionReader(f, r[0], r[1])
+	}
+	metaData["X-Amz-Meta-Sparse-Map"] = []string{sparseMap}
+	metaData["X-Amz-Meta-Sparse-Size"] = []string{strconv.FormatInt(info.Size(), 10)}
+	return PutStream(bucketName, objectName, io.MultiReader(readers...), metaData)
+}
+
+// sparseReader - reads the logical content of a sparse object, with its
+// holes as zeros, for the destinations writeSparse can't write to.
+type sparseReader struct {
+	r       io.Reader
+	regions [][2]int64
+	size    int64
+	off     int64
+}
+
+// expandSparse - returns the reader of the logical content of an object
+// read from r, and its size. Objects not sparse are returned as is, those
+// of files with no data have an empty map and are told by their size.
+func expandSparse(r io.Reader, metaData http.Header, size int64) (io.Reader, int64, error) {
+	if metaData.Get("X-Amz-Meta-Sparse-Size") == "" {
+		return r, size, nil
+	}
+	regions, err := parseRegions(metaData.Get("X-Amz-Meta-Sparse-Map"))
+	if err != nil {
+		return nil, 0, err
+	}
+	logical, err := strconv.ParseInt(metaData.Get("X-Amz-Meta-Sparse-Size"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid sparse size %q", metaData.Get("X-Amz-Meta-Sparse-Size"))
+	}
+	return &sparseReader{r: r, regions: regions, size: logical}, logical, nil
+}
+
+func (s *sparseReader) Read(p []byte) (int, error) {
+	// Regions read are dropped.
+	for len(s.regions) > 0 && s.off >= s.regions[0][0]+s.regions[0][1] {
+		s.regions = s.regions[1:]
+	}
+	end := s.size
+	if len(s.regions) > 0 {
+		end = s.regions[0][0]
+	}
+	if s.off >= s.size && len(s.regions) == 0 {
+		return 0, io.EOF
+	}
+	if s.off < end {
+		// A hole.
+		if int64(len(p)) > end-s.off {
+			p = p[:end-s.off]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		s.off += int64(len(p))
+		return len(p), nil
+	}
+	if left := s.regions[0][0] + s.regions[0][1] - s.off; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := s.r.Read(p)
+	s.off += int64(n)
+	if err == io.EOF {
+		err = nil
+		if n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// writeSparse - writes the data regions of a sparse object to f,
+// leaving holes in between, and returns the bytes of data written.
+func writeSparse(f *os.File, reader io.Reader, metaData http.Header) (int64, error) {
+	regions, err := parseRegions(metaData.Get("X-Amz-Meta-Sparse-Map"))
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(metaData.Get("X-Amz-Meta-Sparse-Size"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid sparse size %q", metaData.Get("X-Amz-Meta-Sparse-Size"))
+	}
+	if err = f.Truncate(size); err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, r := range regions {
+		if _, err = f.Seek(r[0], io.SeekStart); err != nil {
+			return n, err
+		}
+		m, err := io.Copy(f, io.LimitReader(reader, r[1]))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m != r[1] {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseRegions(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want [][2]int64
+		err  bool
+	}{
+		{"", nil, false},
+		{"0+10", [][2]int64{{0, 10}}, false},
+		{"4096+4096,12288+0,16384+100", [][2]int64{{4096, 4096}, {12288, 0}, {16384, 100}}, false},
+		{"10", nil, true},
+		{"a+1", nil, true},
+		{"1+b", nil, true},
+		{"-1+1", nil, true},
+		{"1+-1", nil, true},
+		{"0+1,", nil, true},
+	} {
+		got, err := parseRegions(tc.s)
+		if (err != nil) != tc.err {
+			t.Errorf("parseRegions(%q) error %v, want error %v", tc.s, err, tc.err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("parseRegions(%q) = %v, want %v", tc.s, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("parseRegions(%q) = %v, want %v", tc.s, got, tc.want)
+				break
+			}
+		}
+		if !tc.err && formatRegions(got) != tc.s {
+			t.Errorf("formatRegions(parseRegions(%q)) = %q", tc.s, formatRegions(got))
+		}
+	}
+}
+
+// sparseObject - returns a file of size bytes with data in regions and
+// zeros elsewhere, and the object putSparseFile uploads of it.
+func sparseObject(size int64, regions [][2]int64) (file, object []byte, metaData http.Header) {
+	file = make([]byte, size)
+	for _, r := range regions {
+		for i := r[0]; i < r[0]+r[1]; i++ {
+			file[i] = byte(i%251) + 1
+		}
+		object = append(object, file[r[0]:r[0]+r[1]]...)
+	}
+	metaData = http.Header{}
+	metaData.Set("X-Amz-Meta-Sparse-Map", formatRegions(regions))
+	metaData.Set("X-Amz-Meta-Sparse-Size", strconv.FormatInt(size, 10))
+	return file, object, metaData
+}
+
+func TestExpandSparse(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		size    int64
+		regions [][2]int64
+	}{
+		{"leading hole", 1000, [][2]int64{{600, 400}}},
+		{"trailing hole", 1000, [][2]int64{{0, 300}}},
+		{"holes around", 1000, [][2]int64{{200, 300}}},
+		{"adjacent regions", 1000, [][2]int64{{100, 200}, {300, 200}, {500, 100}}},
+		{"zero length region", 1000, [][2]int64{{100, 100}, {500, 0}, {700, 100}}},
+		{"zero length region first", 1000, [][2]int64{{0, 0}, {700, 100}}},
+		{"all holes", 1000, nil},
+		{"no holes", 1000, [][2]int64{{0, 1000}}},
+	} {
+		file, object, metaData := sparseObject(tc.size, tc.regions)
+		// Reads of one byte stress the region boundaries.
+		for _, r := range []io.Reader{bytes.NewReader(object), iotest.OneByteReader(bytes.NewReader(object))} {
+			reader, size, err := expandSparse(r, metaData, int64(len(object)))
+			if err != nil {
+				t.Fatalf("%s: expandSparse: %v", tc.name, err)
+			}
+			if size != tc.size {
+				t.Errorf("%s: size %d, want %d", tc.name, size, tc.size)
+			}
+			got, err := ioutil.ReadAll(iotest.OneByteReader(reader))
+			if err != nil {
+				t.Errorf("%s: read: %v", tc.name, err)
+				continue
+			}
+			if !bytes.Equal(got, file) {
+				t.Errorf("%s: expanded content differs from the original file", tc.name)
+			}
+		}
+	}
+}
+
+func TestExpandSparseShortObject(t *testing.T) {
+	_, object, metaData := sparseObject(1000, [][2]int64{{100, 200}, {600, 200}})
+	reader, _, err := expandSparse(bytes.NewReader(object[:300]), metaData, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(reader); err != io.ErrUnexpectedEOF {
+		t.Errorf("read of a cut object: error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestExpandSparsePlain(t *testing.T) {
+	r := bytes.NewReader([]byte("plain"))
+	reader, size, err := expandSparse(r, http.Header{}, 5)
+	if err != nil || reader != io.Reader(r) || size != 5 {
+		t.Errorf("expandSparse of a plain object = %v, %d, %v, want it as is", reader, size, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// objectStat - what 'stat' reports of an object.
+type objectStat struct {
+	Bucket        string            `json:"bucket"`
+	Key           string            `json:"key"`
+	Size          int64             `json:"size"`
+	ETag          string            `json:"etag"`
+	LastModified  string            `json:"lastModified"`
+	ContentType   string            `json:"contentType,omitempty"`
+	Encoding      string            `json:"contentEncoding,omitempty"`
+	VersionID     string            `json:"versionId,omitempty"`
+	StorageClass  string            `json:"storageClass"`
+	Checksums     map[string]string `json:"checksums,omitempty"`
+	SSE           map[string]string `json:"sse,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	UserMetadata  map[string]string `json:"userMetadata,omitempty"`
+	Restore       string            `json:"restore,omitempty"`
+	ObjectLock    map[string]string `json:"objectLock,omitempty"`
+	ReplicaStatus string            `json:"replicationStatus,omitempty"`
+}
+
+// headerGroup - returns the headers with the given prefix, keyed by
+// the rest of their lower cased name.
+func headerGroup(header http.Header, prefix string) map[string]string {
+	group := make(map[string]string)
+	for k, v := range header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, prefix) && len(v) > 0 {
+			group[strings.TrimPrefix(strings.TrimPrefix(lk, prefix), "-")] = strings.Join(v, ",")
+		}
+	}
+	if len(group) == 0 {
+		return nil
+	}
+	return group
+}
+
+// getTags - returns the tags of an object.
+func getTags(s site, bucketName, objectName, versionID string) (map[string]string, error) {
+	query := url.Values{"tagging": {""}}
+	if versionID != "" {
+		query.Set("versionId", versionID)
+	}
+	resp, err := siteRequest(s, "GetObjectTagging", http.MethodGet, bucketName, objectName, query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Tags []struct {
+			Key   string `xml:"Key"`
+			Value string `xml:"Value"`
+		} `xml:"TagSet>Tag"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, t := range result.Tags {
+		tags[t.Key] = t.Value
+	}
+	return tags, nil
+}
+
+// statObject - heads an object, asking for its checksums too.
+func statObject(s site, bucketName, objectName, versionID string) (*objectStat, error) {
+	query := url.Values{}
+	if versionID != "" {
+		query.Set("versionId", versionID)
+	}
+	header := http.Header{"X-Amz-Checksum-Mode": {"ENABLED"}}
+	resp, err := siteRequest(s, "HeadObject", http.MethodHead, bucketName, objectName, query, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	h := resp.Header
+	size, _ := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	st := &objectStat{
+		Bucket:        bucketName,
+		Key:           objectName,
+		Size:          size,
+		ETag:          strings.Trim(h.Get("ETag"), "\""),
+		LastModified:  h.Get("Last-Modified"),
+		ContentType:   h.Get("Content-Type"),
+		Encoding:      h.Get("Content-Encoding"),
+		VersionID:     h.Get("X-Amz-Version-Id"),
+		StorageClass:  h.Get("X-Amz-Storage-Class"),
+		Checksums:     headerGroup(h, "x-amz-checksum-"),
+		SSE:           headerGroup(h, "x-amz-server-side-encryption"),
+		UserMetadata:  headerGroup(h, "x-amz-meta-"),
+		Restore:       h.Get("X-Amz-Restore"),
+		ObjectLock:    headerGroup(h, "x-amz-object-lock-"),
+		ReplicaStatus: h.Get("X-Amz-Replication-Status"),
+	}
+	for k, v := range st.UserMetadata {
+		st.UserMetadata[k] = decodeMetaValue(v)
+	}
+	// Standard objects don't carry their storage class.
+	if st.StorageClass == "" {
+		st.StorageClass = "STANDARD"
+	}
+	if sse := st.SSE; sse != nil {
+		if v, ok := sse[""]; ok {
+			sse["algorithm"] = v
+			delete(sse, "")
+		}
+	}
+
+	if h.Get("X-Amz-Tagging-Count") != "" {
+		if st.Tags, err = getTags(s, bucketName, objectName, versionID); err != nil {
+			fmt.Fprintln(os.Stderr, "tags not read:", err)
+		}
+	}
+	return st, nil
+}
+
+// printMap - prints the sorted entries of a map under a heading.
+func printMap(w *tabwriter.Writer, heading string, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s: %s\n", heading, k, m[k])
+		heading = ""
+	}
+}
+
+// statMain - implements the 'stat s3://bucket/key' command, which prints
+// the metadata of an object, including that attached by this tool.
+func statMain(args []string) error {
+	flags := flag.NewFlagSet("stat", flag.ExitOnError)
+	versionID := flags.String("version-id", "", "version to describe")
+	asJSON := flags.Bool("json", false, "print JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: stat [-version-id id] [-json] s3://bucket/key")
+	}
+	bucketName, objectName, err := parseObjectURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	e, err := newEndpoints()
+	if err != nil {
+		return err
+	}
+	if !e.s3() {
+		return fmt.Errorf("Not supported with provider %s", *flagProvider)
+	}
+	st, err := statObject(e.site(), bucketName, objectName, *versionID)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Key\t%s/%s\n", st.Bucket, st.Key)
+	fmt.Fprintf(w, "Size\t%d\n", st.Size)
+	fmt.Fprintf(w, "ETag\t%s\n", st.ETag)
+	fmt.Fprintf(w, "Last modified\t%s\n", st.LastModified)
+	fmt.Fprintf(w, "Storage class\t%s\n", st.StorageClass)
+	for _, f := range []struct{ name, value string }{
+		{"Content type", st.ContentType},
+		{"Content encoding", st.Encoding},
+		{"Version", st.VersionID},
+		{"Restore", st.Restore},
+		{"Replication", st.ReplicaStatus},
+	} {
+		if f.value != "" {
+			fmt.Fprintf(w, "%s\t%s\n", f.name, f.value)
+		}
+	}
+	printMap(w, "Checksums", st.Checksums)
+	printMap(w, "Encryption", st.SSE)
+	printMap(w, "Object lock", st.ObjectLock)
+	printMap(w, "Tags", st.Tags)
+	printMap(w, "Metadata", st.UserMetadata)
+	return w.Flush()
+}
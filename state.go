@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+// StateStore - a small key-value store for the state of resumable
+// operations, such as sync caches, upload status snapshots and the
+// idempotency ledger. Keys are slash separated paths.
+type StateStore interface {
+	// Get returns the value of key, nil if there is none.
+	Get(key string) ([]byte, error)
+	// Put sets the value of key.
+	Put(key string, value []byte) error
+	// Delete removes key, missing keys are not an error.
+	Delete(key string) error
+}
+
+// fileStore - a StateStore keeping every value in a file of a directory.
+type fileStore struct {
+	dir string
+}
+
+func (s fileStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s fileStore) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s fileStore) Put(key string, value []byte) error {
+	name := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	// Write and rename, so readers never see a partial value.
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, value, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (s fileStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// boltBucket - the bolt bucket holding all state.
+var boltBucket = []byte("state")
+
+// boltStore - a StateStore in a bolt database, a single file which only
+// one process can open at a time.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(name string) (*boltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(name, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("State store %s not opened: %v", name, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid during the transaction.
+		if v := tx.Bucket(boltBucket).Get([]byte(key)); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) Put(key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+// objectStore - a StateStore keeping every value in an object below a
+// prefix, shared by every host with access to the bucket.
+type objectStore struct {
+	c          minio.Core
+	bucketName string
+	prefix     string
+}
+
+func (s objectStore) Get(key string) ([]byte, error) {
+	data, err := getBytes(s.c, s.bucketName, s.prefix+key)
+	if isNoSuchKey(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapS3Error("GetObject", err)
+	}
+	return data, nil
+}
+
+func (s objectStore) Put(key string, value []byte) error {
+	return wrapS3Error("PutObject", putBytes(s.c, s.bucketName, s.prefix+key, value, "application/json"))
+}
+
+func (s objectStore) Delete(key string) error {
+	return wrapS3Error("RemoveObject", s.c.Client.RemoveObject(s.bucketName, s.prefix+key))
+}
+
+// prefixStore - a namespace of a StateStore.
+type prefixStore struct {
+	store  StateStore
+	prefix string
+}
+
+func (s prefixStore) Get(key string) ([]byte, error)     { return s.store.Get(s.prefix + key) }
+func (s prefixStore) Put(key string, value []byte) error { return s.store.Put(s.prefix+key, value) }
+func (s prefixStore) Delete(key string) error            { return s.store.Delete(s.prefix + key) }
+
+var (
+	stateOnce  sync.Once
+	stateErr   error
+	stateStore StateStore
+)
+
+// openStateStore - opens the store configured with STATE_STORE, once per
+// process, returns nil if none is configured. STATE_STORE is one of
+// 'file:///dir', 'bolt:///path/state.db' or 's3://bucket/prefix'.
+func openStateStore() (StateStore, error) {
+	stateOnce.Do(func() {
+		spec := os.Getenv("STATE_STORE")
+		if spec == "" {
+			return
+		}
+		u, err := url.Parse(spec)
+		if err != nil {
+			stateErr = fmt.Errorf("Invalid STATE_STORE %q: %v", spec, err)
+			return
+		}
+		switch u.Scheme {
+		case "file":
+			stateStore = fileStore{dir: u.Path}
+		case "bolt":
+			stateStore, stateErr = openBoltStore(u.Path)
+		case "s3":
+			c, err := newCore()
+			if err != nil {
+				stateErr = err
+				return
+			}
+			prefix := strings.TrimPrefix(u.Path, "/")
+			if prefix != "" && !strings.HasSuffix(prefix, "/") {
+				prefix += "/"
+			}
+			stateStore = objectStore{c: c, bucketName: u.Host, prefix: prefix}
+		default:
+			stateErr = fmt.Errorf("Unknown STATE_STORE %q, expected file://, bolt:// or s3://", spec)
+		}
+	})
+	return stateStore, stateErr
+}
+
+// stateNamespace - returns the namespace of a feature in the configured
+// StateStore, fallback if none is configured.
+func stateNamespace(namespace string, fallback StateStore) (StateStore, error) {
+	store, err := openStateStore()
+	if err != nil || store == nil {
+		return fallback, err
+	}
+	return prefixStore{store: store, prefix: namespace + "/"}, nil
+}
+
+// getStateJSON - reads the JSON value of key into v, returns false if
+// there is none.
+func getStateJSON(s StateStore, key string, v interface{}) (bool, error) {
+	data, err := s.Get(key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("State %s unreadable: %v", key, err)
+	}
+	return true, nil
+}
+
+// putStateJSON - sets the value of key to v as JSON.
+func putStateJSON(s StateStore, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(key, data)
+}
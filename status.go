@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// statusPrefix - prefix under which status objects are stored.
+const statusPrefix = ".status/"
+
+// Upload states recorded in status snapshots.
+const (
+	stateRunning   = "running"
+	stateCompleted = "completed"
+	stateFailed    = "failed"
+	// stateReadComplete - the stream was read to its end, the upload
+	// holds all of it and only remains to be completed.
+	stateReadComplete = "completed-reading"
+)
+
+// uploadStatus - a progress snapshot of an upload.
+type uploadStatus struct {
+	Bucket   string       `json:"bucket"`
+	Object   string       `json:"object"`
+	UploadID string       `json:"uploadId"`
+	State    string       `json:"state"`
+	Error    *errorDetail `json:"error,omitempty"`
+	Host     string       `json:"host"`
+	PID      int          `json:"pid"`
+	Started  time.Time    `json:"started"`
+	Updated  time.Time    `json:"updated"`
+	Bytes    int64        `json:"bytes"`
+	Parts    int          `json:"parts"`
+	// Size of the source, -1 if unknown.
+	Size int64 `json:"size"`
+	// Journal of the parts uploaded, in order, to verify them against
+	// before resuming.
+	Journal []journalPart `json:"journal,omitempty"`
+}
+
+// journalPart - a part of the journal of an upload, by its place in the
+// stream, content hash and ETag.
+type journalPart struct {
+	Number int    `json:"number"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	ETag   string `json:"etag"`
+}
+
+// statusWriter - periodically persists the status of an upload to
+// STATUS_FILE, with STATUS_OBJECT set to a status object in the bucket
+// and with STATE_STORE set to the state store.
+type statusWriter struct {
+	mu     sync.Mutex
+	status uploadStatus
+	file   string
+	c      *minio.Core
+	store  StateStore
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// newStatusWriter - returns a statusWriter for the upload, nil if
+// progress persistence is not configured.
+func newStatusWriter(c minio.Core, bucketName, objectName string, reader io.Reader) *statusWriter {
+	file := os.Getenv("STATUS_FILE")
+	toObject := os.Getenv("STATUS_OBJECT") > ""
+	store, err := stateNamespace("status", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "status not kept in the state store:", err)
+	}
+	if file == "" && !toObject && store == nil {
+		return nil
+	}
+
+	host, _ := os.Hostname()
+	s := &statusWriter{
+		file:  file,
+		store: store,
+		status: uploadStatus{
+			Bucket:  bucketName,
+			Object:  objectName,
+			State:   stateRunning,
+			Host:    host,
+			PID:     os.Getpid(),
+			Started: time.Now().UTC(),
+			Size:    sourceSize(reader),
+		},
+	}
+	if toObject {
+		s.c = &c
+	}
+	return s
+}
+
+// sourceSize - returns the size of regular file sources, -1 otherwise.
+func sourceSize(reader io.Reader) int64 {
+	f, ok := reader.(*os.File)
+	if !ok {
+		return -1
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return -1
+	}
+	return fi.Size()
+}
+
+// progress - a ProgressFunc updating the status.
+func (s *statusWriter) progress(ev ProgressEvent) {
+	switch ev.Type {
+	case UploadStarted:
+		s.start(ev.UploadID)
+	case PartCompleted:
+		s.mu.Lock()
+		s.status.Bytes = ev.Bytes
+		s.status.Parts++
+		s.status.Updated = ev.Time.UTC()
+		// Parts complete out of order when uploaded in parallel.
+		part := journalPart{Number: ev.PartNumber, Offset: ev.PartOffset, Size: ev.PartSize, SHA256: ev.SHA256, ETag: ev.ETag}
+		i := sort.Search(len(s.status.Journal), func(i int) bool { return s.status.Journal[i].Number >= part.Number })
+		s.status.Journal = append(s.status.Journal, journalPart{})
+		copy(s.status.Journal[i+1:], s.status.Journal[i:])
+		s.status.Journal[i] = part
+		s.mu.Unlock()
+	case ReadCompleted:
+		// Saved right away, as the proof that the upload can be
+		// completed if its writer dies before doing it.
+		s.mu.Lock()
+		s.status.State = stateReadComplete
+		s.status.Updated = ev.Time.UTC()
+		s.mu.Unlock()
+		s.save()
+	}
+}
+
+// start - records the upload id and starts persisting snapshots every
+// STATUS_INTERVAL (default 10s).
+func (s *statusWriter) start(uploadID string) {
+	s.resume(uploadID, nil)
+}
+
+// resume - same as start, for an upload continued after the parts of
+// journal.
+func (s *statusWriter) resume(uploadID string, journal []journalPart) {
+	interval := 10 * time.Second
+	if v := os.Getenv("STATUS_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			interval = d
+		}
+	}
+
+	// A restarted upload starts over from zero.
+	s.mu.Lock()
+	s.status.UploadID = uploadID
+	s.status.Bytes = 0
+	s.status.Parts = len(journal)
+	s.status.Journal = append([]journalPart(nil), journal...)
+	for _, part := range journal {
+		s.status.Bytes += part.Size
+	}
+	s.mu.Unlock()
+	s.save()
+
+	if s.stopCh != nil {
+		return
+	}
+	s.stopCh = make(chan struct{})
+	s.doneCh = make(chan struct{})
+	go func() {
+		defer close(s.doneCh)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+				s.save()
+			}
+		}
+	}()
+}
+
+// finish - stops the periodic snapshots and persists the final state.
+func (s *statusWriter) finish(err error) {
+	if s.stopCh != nil {
+		close(s.stopCh)
+		<-s.doneCh
+	}
+
+	s.mu.Lock()
+	s.status.State = stateCompleted
+	if err != nil {
+		s.status.State = stateFailed
+		s.status.Error = newErrorDetail(err)
+	}
+	s.status.Updated = time.Now().UTC()
+	s.mu.Unlock()
+	s.save()
+}
+
+// save - writes the current snapshot, failures are only logged so that
+// they never fail the upload itself.
+func (s *statusWriter) save() {
+	s.mu.Lock()
+	status := s.status
+	s.mu.Unlock()
+
+	if s.file != "" {
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err == nil {
+			// Write and rename, so readers never see a partial snapshot.
+			tmpFile := s.file + ".tmp"
+			if err = ioutil.WriteFile(tmpFile, data, 0644); err == nil {
+				err = os.Rename(tmpFile, s.file)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "status file update failed", err)
+		}
+	}
+	if s.c != nil && status.UploadID != "" {
+		if err := putJSON(*s.c, status.Bucket, statusPrefix+status.UploadID+".json", status); err != nil {
+			fmt.Fprintln(os.Stderr, "status object update failed", err)
+		}
+	}
+	if s.store != nil && status.UploadID != "" {
+		if err := putStateJSON(s.store, status.UploadID+".json", status); err != nil {
+			fmt.Fprintln(os.Stderr, "status state update failed", err)
+		}
+	}
+}
+
+// loadStatus - reads the status of an upload from a status file, or by
+// upload id from the state store or the status object in bucketName.
+func loadStatus(bucketName, arg string) (status uploadStatus, err error) {
+	if data, err := ioutil.ReadFile(filepath.Clean(arg)); err == nil {
+		err = json.Unmarshal(data, &status)
+		return status, err
+	}
+	store, err := stateNamespace("status", nil)
+	if err != nil {
+		return status, err
+	}
+	if store != nil {
+		found, err := getStateJSON(store, arg+".json", &status)
+		if found || err != nil {
+			return status, err
+		}
+	}
+	c, err := newCore()
+	if err != nil {
+		return status, err
+	}
+	err = getJSON(c, bucketName, statusPrefix+arg+".json", &status)
+	return status, err
+}
+
+// statusMain - implements the 'status <upload-id|state-file>' command.
+func statusMain(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	bucketName := flags.String("bucket", "stream-test", "bucket holding the status object")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: status [-bucket name] <upload-id|state-file>")
+	}
+	status, err := loadStatus(*bucketName, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	last := status.Updated
+	if last.IsZero() {
+		last = status.Started
+	}
+	elapsed := last.Sub(status.Started).Seconds()
+
+	fmt.Printf("Object:        %s/%s\n", status.Bucket, status.Object)
+	fmt.Printf("Upload ID:     %s\n", status.UploadID)
+	fmt.Printf("State:         %s\n", status.State)
+	if status.Error != nil {
+		fmt.Printf("Error:         %s\n", status.Error.Message)
+		if status.Error.RequestID != "" {
+			fmt.Printf("Request ID:    %s\n", status.Error.RequestID)
+		}
+	}
+	fmt.Printf("Host:          %s (pid %d)\n", status.Host, status.PID)
+	if status.Size > 0 {
+		fmt.Printf("Progress:      %d of %d bytes (%.1f%%)\n", status.Bytes, status.Size,
+			float64(status.Bytes)*100/float64(status.Size))
+	} else {
+		fmt.Printf("Progress:      %d bytes, total size unknown\n", status.Bytes)
+	}
+	fmt.Printf("Parts:         %d\n", status.Parts)
+	if elapsed > 0 {
+		fmt.Printf("Throughput:    %.2f MiB/s\n", float64(status.Bytes)/elapsed/(1024*1024))
+	}
+	fmt.Printf("Last activity: %s (%s ago)\n", last.Format(time.RFC3339),
+		time.Since(last).Truncate(time.Second))
+	return nil
+}
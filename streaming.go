@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Streaming SigV4 constants.
+const (
+	streamingPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingAlgorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+	// Size of every signed chunk but the last one.
+	streamingChunkSize = 64 * 1024
+	// sha256 of the empty string, part of every chunk's string to sign.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// streamingSignature - returns true if STREAMING_SIGNATURE is set, parts
+// are then streamed with chunk signatures, instead of being buffered and
+// hashed first: straight from sources with a known size, through a
+// spool file from others. Parts are then sent one at a time to a single
+// endpoint, PARALLEL_PARTS and LOAD_BALANCE are not supported.
+func streamingSignature() bool {
+	return os.Getenv("STREAMING_SIGNATURE") > ""
+}
+
+// streamingContentLength - returns the aws-chunked encoded length of size bytes.
+func streamingContentLength(size int64) int64 {
+	chunkLength := func(n int64) int64 {
+		return int64(len(strconv.FormatInt(n, 16))) + int64(len(";chunk-signature=")) + 64 + 2 + n + 2
+	}
+	full := size / streamingChunkSize
+	length := full * chunkLength(streamingChunkSize)
+	if rest := size % streamingChunkSize; rest > 0 {
+		length += chunkLength(rest)
+	}
+	// Final empty chunk.
+	return length + chunkLength(0)
+}
+
+// chunkSigner - an io.Reader encoding data as aws-chunked, every chunk
+// signed with the signature of the previous one.
+type chunkSigner struct {
+	data    io.Reader
+	key     []byte
+	date    string
+	scope   string
+	prevSig string
+	chunk   []byte
+	buf     bytes.Buffer
+	done    bool
+}
+
+func newChunkSigner(data io.Reader, creds credentials, region string, t time.Time, seedSignature string) *chunkSigner {
+	return &chunkSigner{
+		data:    data,
+		key:     sigV4Key(creds.SecretKey, t, region, "s3"),
+		date:    t.UTC().Format(sigV4DateFormat),
+		scope:   sigV4Scope(t.UTC(), region, "s3"),
+		prevSig: seedSignature,
+		chunk:   make([]byte, streamingChunkSize),
+	}
+}
+
+// signChunk - appends the signed encoding of chunk to the buffer.
+func (s *chunkSigner) signChunk(chunk []byte) {
+	stringToSign := strings.Join([]string{
+		streamingAlgorithm,
+		s.date,
+		s.scope,
+		s.prevSig,
+		emptySHA256,
+		sha256Hex(chunk),
+	}, "\n")
+	s.prevSig = hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+
+	s.buf.WriteString(strconv.FormatInt(int64(len(chunk)), 16))
+	s.buf.WriteString(";chunk-signature=" + s.prevSig + "\r\n")
+	s.buf.Write(chunk)
+	s.buf.WriteString("\r\n")
+}
+
+func (s *chunkSigner) Read(p []byte) (int, error) {
+	for s.buf.Len() == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(s.data, s.chunk)
+		if n > 0 {
+			s.signChunk(s.chunk[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.signChunk(nil)
+			s.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return s.buf.Read(p)
+}
+
+// s3EscapePath - URI encodes an object path as SigV4 expects, keeping
+// the slashes.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// objectURL - returns the URL of an object on the site, path style but
+// for the transfer acceleration endpoint which requires virtual hosts.
+func (s site) objectURL(bucketName, objectName string, query url.Values) *url.URL {
+	scheme := "http"
+	if s.SSL {
+		scheme = "https"
+	}
+	host := s.endpoint()
+	path := "/" + bucketName + "/" + objectName
+	if accelerate := s.accelerateEndpoint(); accelerate != "" {
+		host = bucketName + "." + accelerate
+		path = "/" + objectName
+	}
+	return &url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     path,
+		RawPath:  s3EscapePath(path),
+		RawQuery: query.Encode(),
+	}
+}
+
+// siteRequest - sends a signed request the minio client has no call
+// for, returning the response of a successful request.
+func siteRequest(s site, operation, method, bucketName, objectName string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(bucketName, objectName, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if *flagRequestPayer != "" {
+		req.Header.Set("X-Amz-Request-Payer", *flagRequestPayer)
+	}
+	if !s.anonymous() {
+		creds := credentials{AccessKey: s.AccessKey, SecretKey: s.SecretKey, SessionToken: s.SessionToken}
+		signV4(req, creds, signingRegion(), signingTime(), sha256Hex(body))
+	}
+
+	transport, err := s.transport()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, s3ErrorFromResponse(operation, resp)
+	}
+	return resp, nil
+}
+
+// s3ErrorFromResponse - decodes an S3 XML error response.
+func s3ErrorFromResponse(operation string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var errResp struct {
+		Code      string `xml:"Code"`
+		Message   string `xml:"Message"`
+		Bucket    string `xml:"BucketName"`
+		Key       string `xml:"Key"`
+		RequestID string `xml:"RequestId"`
+		HostID    string `xml:"HostId"`
+	}
+	if xml.Unmarshal(body, &errResp) != nil || errResp.Code == "" {
+		errResp.Code = strconv.Itoa(resp.StatusCode)
+		errResp.Message = resp.Status
+	}
+	if errResp.RequestID == "" {
+		errResp.RequestID = resp.Header.Get("X-Amz-Request-Id")
+	}
+	if errResp.RequestID == "" {
+		errResp.RequestID = resp.Header.Get("X-Ms-Request-Id")
+	}
+	return &S3Error{
+		Operation: operation,
+		Code:      errResp.Code,
+		Message:   errResp.Message,
+		Bucket:    errResp.Bucket,
+		Key:       errResp.Key,
+		RequestID: errResp.RequestID,
+		HostID:    errResp.HostID,
+		Err:       errors.New(resp.Status),
+	}
+}
+
+// putObjectPartStreaming - uploads size bytes of data as a part through
+// client, signing it chunk by chunk so nothing needs to be buffered or
+// hashed up front.
+func putObjectPartStreaming(client *http.Client, s site, bucketName, objectName, uploadID string, partNumber int, data io.Reader, size int64) (minio.ObjectPart, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(partNumber))
+	query.Set("uploadId", uploadID)
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(bucketName, objectName, query).String(), nil)
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+
+	creds := credentials{AccessKey: s.AccessKey, SecretKey: s.SecretKey, SessionToken: s.SessionToken}
+	region := signingRegion()
+	t := signingTime()
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	req.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(size, 10))
+	if *flagRequestPayer != "" {
+		req.Header.Set("X-Amz-Request-Payer", *flagRequestPayer)
+	}
+	req.ContentLength = streamingContentLength(size)
+	seed := signV4(req, creds, region, t, streamingPayload)
+	req.Body = ioutil.NopCloser(newChunkSigner(io.LimitReader(data, size), creds, region, t, seed))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return minio.ObjectPart{}, s3ErrorFromResponse("PutObjectPart", resp)
+	}
+
+	return minio.ObjectPart{
+		PartNumber:   partNumber,
+		ETag:         strings.Trim(resp.Header.Get("ETag"), "\""),
+		Size:         size,
+		LastModified: time.Now().UTC(),
+	}, nil
+}
+
+// spoolPart - copies up to partSize bytes of reader to spool, replacing
+// its content, and returns how many were copied.
+func spoolPart(spool *os.File, reader io.Reader, partSize int64) (int64, error) {
+	if err := spool.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.CopyN(spool, reader, partSize)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// putStreamStreaming - uploads size bytes of reader with a multipart
+// upload whose parts are streamed with chunk signatures, size is negative
+// if unknown. Failed parts are retried on the next endpoint if reader, or
+// the spool of the part, can seek back to their start.
+func putStreamStreaming(e *endpoints, bucketName, objectName string, reader io.Reader, size int64, metaData map[string][]string, progress ProgressFunc) (n int64, uploadID string, err error) {
+	parallel, err := e.parallelParts()
+	if err != nil {
+		return 0, "", err
+	}
+	if parallel > 1 || e.balance != "" {
+		return 0, "", fmt.Errorf("STREAMING_SIGNATURE uploads parts one at a time to a single endpoint, unset PARALLEL_PARTS or LOAD_BALANCE")
+	}
+
+	// Parts share the connections, and directory bucket sessions, of one
+	// client per site.
+	clients := make(map[string]*http.Client)
+	siteClient := func(s site) (*http.Client, error) {
+		if c, ok := clients[s.Address]; ok {
+			return c, nil
+		}
+		transport, err := s.transport()
+		if err != nil {
+			return nil, err
+		}
+		clients[s.Address] = &http.Client{Transport: transport}
+		return clients[s.Address], nil
+	}
+
+	err = e.initiate(func(b Backend) (err error) {
+		uploadID, err = b.NewMultipartUpload(bucketName, objectName, metaData)
+		return err
+	})
+	if err != nil {
+		err = wrapS3Error("NewMultipartUpload", err)
+		fmt.Fprintln(os.Stderr, "NewMultipartUpload failed", err)
+		return 0, "", err
+	}
+
+	emit := func(ev ProgressEvent) {
+		ev.Time = time.Now()
+		ev.Bucket = bucketName
+		ev.Object = objectName
+		ev.UploadID = uploadID
+		progress(ev)
+	}
+	emit(ProgressEvent{Type: UploadStarted})
+
+	if size < 0 {
+		size = -1
+	}
+	totalPartsCount, partSize, lastPartSize, err := e.partInfo(size)
+	if err != nil {
+		return 0, uploadID, err
+	}
+
+	// The length of each part is signed before it is sent, parts of
+	// streams of unknown size are spooled to a temporary file to learn
+	// it, instead of being buffered in memory.
+	var spool *os.File
+	if size < 0 {
+		if spool, err = ioutil.TempFile("", "streams3-part"); err != nil {
+			return 0, uploadID, err
+		}
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}()
+	}
+
+	var parts []minio.CompletePart
+	for partNumber := 1; partNumber <= totalPartsCount; partNumber++ {
+		prtSize := partSize
+		if partNumber == totalPartsCount {
+			prtSize = lastPartSize
+		}
+		source := reader
+		if spool != nil {
+			if prtSize, err = spoolPart(spool, reader, partSize); err != nil {
+				return n, uploadID, err
+			}
+			// Empty streams are uploaded as a single empty part.
+			if prtSize == 0 && partNumber > 1 {
+				break
+			}
+			source = io.NewSectionReader(spool, 0, prtSize)
+		}
+		emit(ProgressEvent{Type: PartStarted, PartNumber: partNumber, PartSize: prtSize, PartOffset: n})
+
+		var partStart int64
+		seeker, canSeek := source.(io.Seeker)
+		if canSeek {
+			if partStart, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+				return n, uploadID, err
+			}
+		}
+
+		var objPart minio.ObjectPart
+		for {
+			s := e.site()
+			var client *http.Client
+			if client, err = siteClient(s); err != nil {
+				return n, uploadID, err
+			}
+			objPart, err = putObjectPartStreaming(client, s, bucketName, objectName, uploadID, partNumber, source, prtSize)
+			if err == nil {
+				break
+			}
+			err = wrapS3Error("PutObjectPart", err)
+			if !canSeek || e.policy != failoverResume || !e.failover(err) {
+				fmt.Fprintln(os.Stderr, "PutObjectPart failed", err)
+				return n, uploadID, err
+			}
+			if lErr := e.limits.spendRetry(err); lErr != nil {
+				return n, uploadID, lErr
+			}
+			emit(ProgressEvent{Type: Retry, PartNumber: partNumber, PartSize: prtSize, PartOffset: n, Err: err})
+			if _, err = seeker.Seek(partStart, io.SeekStart); err != nil {
+				return n, uploadID, err
+			}
+		}
+
+		n += prtSize
+		parts = append(parts, minio.CompletePart{PartNumber: partNumber, ETag: objPart.ETag})
+		emit(ProgressEvent{Type: PartCompleted, PartNumber: partNumber, PartSize: prtSize, PartOffset: n - prtSize, Bytes: n, ETag: objPart.ETag})
+		if spool != nil && prtSize < partSize {
+			break
+		}
+		if spool != nil && partNumber == totalPartsCount {
+			if more, _ := io.ReadFull(reader, make([]byte, 1)); more > 0 {
+				return n, uploadID, fmt.Errorf("Stream is longer than %d parts, the most an upload has, of up to %d bytes: set a larger part size", maxPartsCount, partSize)
+			}
+		}
+	}
+
+	emit(ProgressEvent{Type: ReadCompleted, Bytes: n})
+	err = completeUpload(e, bucketName, objectName, uploadID, parts)
+	if err != nil {
+		err = wrapS3Error("CompleteMultipartUpload", err)
+		fmt.Fprintln(os.Stderr, "CompleteMultipartUpload failed", err)
+		return n, uploadID, err
+	}
+	emit(ProgressEvent{Type: Completed, Bytes: n, ETag: completedETag(parts)})
+	return n, uploadID, nil
+}
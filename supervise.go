@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Restart policies of supervised producers.
+const (
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+)
+
+// Producer states reported by the supervisor.
+const (
+	producerRunning = "running"
+	producerBackoff = "backoff"
+	producerExited  = "exited"
+	producerFailed  = "failed"
+)
+
+// producerConfig - a producer command of the supervisor configuration.
+type producerConfig struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	// Object is a text/template of the object of every run, given the
+	// Name, Run number, start Time and Host.
+	Object string `json:"object"`
+	// Restart is always, on-failure or never.
+	Restart string `json:"restart"`
+	// MaxRestarts stops restarting after that many restarts, 0 for no limit.
+	MaxRestarts int    `json:"max_restarts"`
+	Backoff     string `json:"backoff"`
+
+	object  *template.Template
+	backoff time.Duration
+}
+
+// producerStatus - the state of a producer, served as JSON on /health.
+type producerStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Runs      int       `json:"runs"`
+	Object    string    `json:"object,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Started   time.Time `json:"started,omitempty"`
+	LastExit  string    `json:"lastExit,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+	Uploaded  int64     `json:"uploadedBytes"`
+}
+
+// producerRun - the values of an object template.
+type producerRun struct {
+	Name string
+	Run  int
+	Time time.Time
+	Host string
+}
+
+// loadProducers - reads the JSON list of producers at name.
+func loadProducers(name string) ([]*producerConfig, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var producers []*producerConfig
+	if err = json.Unmarshal(data, &producers); err != nil {
+		return nil, fmt.Errorf("Invalid producers %s: %v", name, err)
+	}
+	seen := make(map[string]bool)
+	for _, p := range producers {
+		if p.Name == "" || len(p.Command) == 0 || p.Object == "" || seen[p.Name] {
+			return nil, fmt.Errorf("Producers need a unique name, a command and an object")
+		}
+		seen[p.Name] = true
+		if p.object, err = template.New(p.Name).Parse(p.Object); err != nil {
+			return nil, fmt.Errorf("Invalid object of producer %s: %v", p.Name, err)
+		}
+		switch p.Restart {
+		case "":
+			p.Restart = restartOnFailure
+		case restartAlways, restartOnFailure, restartNever:
+		default:
+			return nil, fmt.Errorf("Unknown restart policy %q of producer %s", p.Restart, p.Name)
+		}
+		p.backoff = 5 * time.Second
+		if p.Backoff != "" {
+			if p.backoff, err = time.ParseDuration(p.Backoff); err != nil {
+				return nil, fmt.Errorf("Invalid backoff of producer %s: %v", p.Name, err)
+			}
+		}
+	}
+	return producers, nil
+}
+
+// producer - a supervised producer and its status.
+type producer struct {
+	config *producerConfig
+	mu     sync.Mutex
+	status producerStatus
+	// bytes of the current run, updated atomically.
+	bytes int64
+}
+
+func (p *producer) snapshot() producerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.status
+	st.Bytes = atomic.LoadInt64(&p.bytes)
+	return st
+}
+
+func (p *producer) update(fn func(st *producerStatus)) {
+	p.mu.Lock()
+	fn(&p.status)
+	p.mu.Unlock()
+}
+
+// producerCounter - counts the bytes of a run. The end of its output
+// is only reported once the producer exited successfully, so that the
+// output of a crashed producer is never completed.
+type producerCounter struct {
+	io.Reader
+	p   *producer
+	cmd *exec.Cmd
+
+	waited bool
+	wErr   error
+}
+
+func (r *producerCounter) Read(b []byte) (int, error) {
+	if r.waited {
+		return 0, r.eof()
+	}
+	n, err := r.Reader.Read(b)
+	atomic.AddInt64(&r.p.bytes, int64(n))
+	if err == io.EOF {
+		r.waited, r.wErr = true, r.cmd.Wait()
+		err = r.eof()
+	}
+	return n, err
+}
+
+func (r *producerCounter) eof() error {
+	if r.wErr != nil {
+		return fmt.Errorf("Producer failed before the end of its output: %v", r.wErr)
+	}
+	return io.EOF
+}
+
+// runOnce - runs the producer once, uploading its stdout. A failed
+// upload kills the producer, as nothing reads its output anymore.
+func (p *producer) runOnce(bucketName string, run int) error {
+	host, _ := os.Hostname()
+	var name bytes.Buffer
+	err := p.config.object.Execute(&name, producerRun{Name: p.config.Name, Run: run, Time: time.Now().UTC(), Host: host})
+	if err != nil {
+		return err
+	}
+	objectName := name.String()
+
+	cmd := exec.Command(p.config.Command[0], p.config.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&p.bytes, 0)
+	p.update(func(st *producerStatus) {
+		st.State = producerRunning
+		st.Runs++
+		st.Object = objectName
+		st.Started = time.Now().UTC()
+	})
+	fmt.Fprintln(os.Stderr, "producer", p.config.Name, "started, uploading to", objectName)
+
+	metaData := map[string][]string{"X-Amz-Meta-Producer": {p.config.Name}}
+	counter := &producerCounter{Reader: stdout, p: p, cmd: cmd}
+	var uploadID, uploaded string
+	n, err := PutStreamWithProgress(bucketName, objectName, counter, metaData, func(ev ProgressEvent) {
+		uploadID, uploaded = ev.UploadID, ev.Object
+	})
+	if err != nil && uploadID != "" {
+		// Output can't be read again, so its parts are of no use.
+		if aErr := abortUpload(bucketName, uploaded, uploadID); aErr != nil {
+			fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+		}
+	}
+	wErr := counter.wErr
+	if !counter.waited {
+		if err != nil {
+			cmd.Process.Kill()
+		}
+		wErr = cmd.Wait()
+	}
+	p.update(func(st *producerStatus) {
+		// The bytes of the run move to Uploaded at once, as snapshots
+		// hold the same lock.
+		st.Uploaded += n
+		atomic.StoreInt64(&p.bytes, 0)
+		st.LastExit = "0"
+		if wErr != nil {
+			st.LastExit = wErr.Error()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("Upload of %s failed: %v", objectName, err)
+	}
+	return wErr
+}
+
+// run - runs the producer, restarting it per its policy.
+func (p *producer) run(bucketName string) {
+	for run := 1; ; run++ {
+		err := p.runOnce(bucketName, run)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "producer", p.config.Name, "failed:", err)
+		}
+		p.update(func(st *producerStatus) {
+			st.State = producerExited
+			if err != nil {
+				st.State = producerFailed
+				st.LastError = err.Error()
+			}
+		})
+
+		restarts := run - 1
+		switch {
+		case p.config.Restart == restartNever,
+			p.config.Restart == restartOnFailure && err == nil,
+			p.config.MaxRestarts > 0 && restarts >= p.config.MaxRestarts:
+			return
+		}
+		p.update(func(st *producerStatus) { st.State = producerBackoff })
+		time.Sleep(p.config.backoff)
+	}
+}
+
+// supervisor - serves the status of its producers.
+type supervisor struct {
+	producers []*producer
+}
+
+func (s *supervisor) statuses() []producerStatus {
+	statuses := make([]producerStatus, 0, len(s.producers))
+	for _, p := range s.producers {
+		statuses = append(statuses, p.snapshot())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// health - serves the producer statuses as JSON, with a 503 status if
+// any of them failed for good.
+func (s *supervisor) health(w http.ResponseWriter, r *http.Request) {
+	statuses := s.statuses()
+	code := http.StatusOK
+	for _, st := range statuses {
+		if st.State == producerFailed {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// metrics - serves the producer statuses in Prometheus text format.
+func (s *supervisor) metrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP streams3_producer_up Whether the producer is running.\n")
+	fmt.Fprintf(&buf, "# TYPE streams3_producer_up gauge\n")
+	statuses := s.statuses()
+	for _, st := range statuses {
+		up := 0
+		if st.State == producerRunning {
+			up = 1
+		}
+		fmt.Fprintf(&buf, "streams3_producer_up{producer=%q} %d\n", st.Name, up)
+	}
+	fmt.Fprintf(&buf, "# HELP streams3_producer_runs_total Runs of the producer.\n")
+	fmt.Fprintf(&buf, "# TYPE streams3_producer_runs_total counter\n")
+	for _, st := range statuses {
+		fmt.Fprintf(&buf, "streams3_producer_runs_total{producer=%q} %d\n", st.Name, st.Runs)
+	}
+	fmt.Fprintf(&buf, "# HELP streams3_producer_bytes_total Bytes uploaded from the producer.\n")
+	fmt.Fprintf(&buf, "# TYPE streams3_producer_bytes_total counter\n")
+	for _, st := range statuses {
+		fmt.Fprintf(&buf, "streams3_producer_bytes_total{producer=%q} %d\n", st.Name, st.Uploaded+st.Bytes)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// superviseMain - implements the 'supervise -config file' command, which
+// runs producer commands, uploading the stdout of every run to its own
+// object and restarting them per their policy. Their status is served
+// on /health and /metrics.
+func superviseMain(args []string) error {
+	flags := flag.NewFlagSet("supervise", flag.ExitOnError)
+	config := flags.String("config", "", "JSON list of producers with name, command, object template, restart, max_restarts and backoff")
+	bucketName := flags.String("bucket", "stream-test", "bucket to upload to")
+	listen := flags.String("listen", "", "address serving /health and /metrics")
+	flags.Parse(args)
+	if *config == "" || flags.NArg() != 0 {
+		return fmt.Errorf("Usage: supervise -config file [-bucket name] [-listen addr]")
+	}
+
+	configs, err := loadProducers(*config)
+	if err != nil {
+		return err
+	}
+	s := &supervisor{}
+	for _, c := range configs {
+		s.producers = append(s.producers, &producer{config: c, status: producerStatus{Name: c.Name}})
+	}
+	if *listen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", s.health)
+		mux.HandleFunc("/metrics", s.metrics)
+		fmt.Fprintln(os.Stderr, "serving producer status on", *listen)
+		go func() {
+			if err := http.ListenAndServe(*listen, mux); err != nil {
+				fmt.Fprintln(os.Stderr, "status listener failed", err)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range s.producers {
+		wg.Add(1)
+		go func(p *producer) {
+			defer wg.Done()
+			p.run(*bucketName)
+		}(p)
+	}
+	wg.Wait()
+
+	for _, st := range s.statuses() {
+		if st.State == producerFailed {
+			return fmt.Errorf("Producer %s failed: %s", st.Name, st.LastError)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// syncState - the state of a file when it was last synced.
+type syncState struct {
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	ETag   string    `json:"etag,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+}
+
+// syncCache - the states of the files of a directory synced to a prefix,
+// keyed by object name, so unchanged files are skipped without asking
+// the server.
+type syncCache struct {
+	Bucket string                `json:"bucket"`
+	Prefix string                `json:"prefix"`
+	Files  map[string]*syncState `json:"files"`
+
+	store StateStore
+	key   string
+	mu    sync.Mutex
+}
+
+// defaultSyncCache - returns where the cache of a directory and prefix
+// is kept, in the user cache directory unless STATE_STORE is set.
+func defaultSyncCache(dir, bucketName, prefix string) (StateStore, string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256([]byte(abs + "\x00" + bucketName + "\x00" + prefix))
+	store, err := stateNamespace("sync", fileStore{dir: filepath.Join(cacheDir, "streams3")})
+	return store, "sync-" + hex.EncodeToString(sum[:8]) + ".json", err
+}
+
+// loadSyncCache - reads the cache at key, empty if there is none yet.
+func loadSyncCache(store StateStore, key, bucketName, prefix string) (*syncCache, error) {
+	cache := &syncCache{Bucket: bucketName, Prefix: prefix, Files: make(map[string]*syncState), store: store, key: key}
+	if _, err := getStateJSON(store, key, cache); err != nil {
+		return nil, fmt.Errorf("Sync cache unreadable: %v", err)
+	}
+	if cache.Files == nil {
+		cache.Files = make(map[string]*syncState)
+	}
+	return cache, nil
+}
+
+// get - returns the cached state of an object, nil if unknown.
+func (c *syncCache) get(key string) *syncState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Files[key]
+}
+
+// set - records the state of an object.
+func (c *syncCache) set(key string, state *syncState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Files[key] = state
+}
+
+// save - writes the cache.
+func (c *syncCache) save() error {
+	c.mu.Lock()
+	data, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.store.Put(c.key, data)
+}
+
+// fileSHA256 - returns the hex sha256 of a local file.
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// localFile - a regular file found by 'sync'.
+type localFile struct {
+	name string
+	key  string
+	info os.FileInfo
+}
+
+// walkLocal - returns the regular files below dir, keyed below prefix.
+func walkLocal(dir, prefix string) ([]localFile, error) {
+	var files []localFile
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, localFile{name: name, key: prefix + filepath.ToSlash(rel), info: info})
+		return nil
+	})
+	return files, err
+}
+
+// syncer - the settings of the 'sync' command.
+type syncer struct {
+	c             minio.Core
+	dir           string
+	bucketName    string
+	prefix        string
+	checksum      bool
+	dryRun        bool
+	bidirectional bool
+	posix         bool
+	policy        string
+	cache         *syncCache
+	dash          *dashboard
+}
+
+// changed - returns true if a file differs from its cached state, along
+// with its sha256 when comparing content.
+func (s *syncer) changed(f localFile) (bool, string, error) {
+	cached := s.cache.get(f.key)
+	if !s.checksum {
+		return cached == nil || cached.Size != f.info.Size() || !cached.Mtime.Equal(f.info.ModTime()), "", nil
+	}
+	sum, err := fileSHA256(f.name)
+	if err != nil {
+		return false, "", err
+	}
+	return cached == nil || cached.SHA256 != sum, sum, nil
+}
+
+// push - uploads a changed file and records its new state.
+func (s *syncer) push(f localFile, sum string) (int64, error) {
+	metaData := fileMetadata(f.info)
+	if sum != "" {
+		metaData["X-Amz-Meta-Sha256"] = []string{sum}
+	}
+	file, err := os.Open(f.name)
+	if err != nil {
+		return 0, err
+	}
+	t := s.dash.add(f.key, f.info.Size())
+	// The ETag lets later runs tell if the object changed remotely.
+	var etag string
+	completed := func(ev ProgressEvent) {
+		if ev.Type == Completed {
+			etag = ev.ETag
+		}
+	}
+	n, err := PutStreamWithOptions(s.bucketName, f.key, file, WithMetadata(metaData), WithProgress(multiProgress(t.progress, completed)))
+	file.Close()
+	s.dash.done(t, err)
+	if err != nil {
+		return n, err
+	}
+
+	if etag == "" {
+		// Resumable uploads don't report it.
+		if objInfo, err := s.c.StatObject(s.bucketName, f.key); err == nil {
+			etag = objInfo.ETag
+		}
+	}
+	s.cache.set(f.key, &syncState{Size: f.info.Size(), Mtime: f.info.ModTime(), SHA256: sum, ETag: etag})
+	return n, nil
+}
+
+// Conflict policies of bidirectional syncs.
+const (
+	conflictNewerWins = "newer-wins"
+	conflictKeepBoth  = "keep-both"
+	conflictFail      = "fail"
+)
+
+// Sync actions.
+const (
+	syncPush     = "push"
+	syncPull     = "pull"
+	syncConflict = "conflict"
+	syncSkip     = "skip"
+)
+
+// syncAction - what a sync does to an object.
+type syncAction struct {
+	key    string
+	local  *localFile
+	remote *minio.ObjectInfo
+	sum    string
+	action string
+}
+
+// syncResult - the outcome of an action, printed as a JSON line.
+type syncResult struct {
+	Object string       `json:"object"`
+	Action string       `json:"action"`
+	Size   int64        `json:"size"`
+	Error  *errorDetail `json:"error,omitempty"`
+}
+
+// syncSummary - the report of a 'sync' run, printed last.
+type syncSummary struct {
+	Total      int     `json:"total"`
+	Uploaded   int     `json:"uploaded"`
+	Downloaded int     `json:"downloaded"`
+	Skipped    int     `json:"skipped"`
+	Conflicts  int     `json:"conflicts"`
+	Failed     int     `json:"failed"`
+	Bytes      int64   `json:"bytes"`
+	Seconds    float64 `json:"seconds"`
+}
+
+// remoteChanged - returns true if an object differs from its cached
+// state.
+func (s *syncer) remoteChanged(objInfo minio.ObjectInfo) bool {
+	cached := s.cache.get(objInfo.Key)
+	return cached == nil || cached.ETag != objInfo.ETag
+}
+
+// identical - returns true if a file has the content of an object, as
+// told by the sha256 recorded on upload or else a single part ETag. The
+// state of identical files is cached, as if they had been synced.
+func (s *syncer) identical(f localFile, sum string, objInfo minio.ObjectInfo) (bool, error) {
+	if f.info.Size() != objInfo.Size {
+		return false, nil
+	}
+	st, err := s.c.StatObject(s.bucketName, objInfo.Key)
+	if err != nil {
+		return false, err
+	}
+	var same bool
+	if remote := st.Metadata.Get("X-Amz-Meta-Sha256"); remote != "" {
+		if sum == "" {
+			if sum, err = fileSHA256(f.name); err != nil {
+				return false, err
+			}
+		}
+		same = sum == remote
+	} else if etag := strings.Trim(st.ETag, "\""); !strings.Contains(etag, "-") && st.Metadata.Get("X-Amz-Server-Side-Encryption") == "" {
+		file, err := os.Open(f.name)
+		if err != nil {
+			return false, err
+		}
+		local, err := MultipartETag(file, 0)
+		file.Close()
+		if err != nil {
+			return false, err
+		}
+		same = local == etag
+	}
+	if same {
+		s.cache.set(f.key, &syncState{Size: f.info.Size(), Mtime: f.info.ModTime(), ETag: objInfo.ETag, SHA256: sum})
+	}
+	return same, nil
+}
+
+// plan - returns the actions syncing the local files with the remote
+// objects, which are only listed by bidirectional syncs. Deletions are
+// not propagated in either direction.
+func (s *syncer) plan(files []localFile) ([]syncAction, error) {
+	remote := make(map[string]minio.ObjectInfo)
+	if s.bidirectional {
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		for objInfo := range s.c.Client.ListObjects(s.bucketName, s.prefix, true, doneCh) {
+			if objInfo.Err != nil {
+				return nil, objInfo.Err
+			}
+			if !isInternalObject(objInfo.Key) && !strings.HasSuffix(objInfo.Key, "/") {
+				remote[objInfo.Key] = objInfo
+			}
+		}
+	}
+
+	var actions []syncAction
+	for i := range files {
+		f := &files[i]
+		changed, sum, err := s.changed(*f)
+		if err != nil {
+			return nil, err
+		}
+		a := syncAction{key: f.key, local: f, sum: sum, action: syncSkip}
+		objInfo, ok := remote[f.key]
+		delete(remote, f.key)
+		switch {
+		case !ok:
+			if changed {
+				a.action = syncPush
+			}
+		case changed && s.remoteChanged(objInfo):
+			a.remote, a.action = &objInfo, syncConflict
+			// Without a cached state, as on a first run, files may
+			// already have been copied alike on both sides.
+			if s.cache.get(f.key) == nil {
+				same, err := s.identical(*f, sum, objInfo)
+				if err != nil {
+					return nil, err
+				}
+				if same {
+					a.remote, a.action = nil, syncSkip
+				}
+			}
+		case changed:
+			a.action = syncPush
+		case s.remoteChanged(objInfo):
+			a.remote, a.action = &objInfo, syncPull
+		}
+		actions = append(actions, a)
+	}
+	for key, objInfo := range remote {
+		objInfo := objInfo
+		a := syncAction{key: key, remote: &objInfo, action: syncSkip}
+		// Objects synced before and since deleted locally are left alone.
+		if s.remoteChanged(objInfo) {
+			a.action = syncPull
+		}
+		actions = append(actions, a)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].key < actions[j].key })
+	return actions, nil
+}
+
+// localName - returns the local file of an object.
+func (s *syncer) localName(key string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(key, s.prefix)), "/")
+	return filepath.Join(s.dir, filepath.FromSlash(rel))
+}
+
+// pull - downloads an object to name and records its new state.
+func (s *syncer) pull(key, name string) (int64, error) {
+	if err := makeParents(s.dir, name); err != nil {
+		return 0, err
+	}
+	t := s.dash.add(key, -1)
+	objInfo, err := getFile(s.c, s.bucketName, key, s.dir, name)
+	if err == nil {
+		t.setSize(objInfo.Size)
+		t.setBytes(objInfo.Size)
+	}
+	s.dash.done(t, err)
+	if err != nil {
+		return 0, err
+	}
+	if s.posix {
+		if err = restoreAttributes(name, objInfo.Metadata); err != nil {
+			return 0, err
+		}
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	state := &syncState{Size: info.Size(), Mtime: info.ModTime(), ETag: objInfo.ETag}
+	if s.checksum {
+		if state.SHA256, err = fileSHA256(name); err != nil {
+			return 0, err
+		}
+	}
+	if name == s.localName(key) {
+		s.cache.set(key, state)
+	}
+	return info.Size(), nil
+}
+
+// resolve - returns the action settling a conflict, as per the policy.
+func (s *syncer) resolve(a syncAction) string {
+	switch s.policy {
+	case conflictNewerWins:
+		if a.local.info.ModTime().After(a.remote.LastModified) {
+			return syncPush
+		}
+		return syncPull
+	case conflictKeepBoth:
+		return conflictKeepBoth
+	}
+	return syncConflict
+}
+
+// run - carries out an action, returning the action taken.
+func (s *syncer) run(a syncAction) (string, int64, error) {
+	action := a.action
+	if action == syncConflict {
+		action = s.resolve(a)
+	}
+	if s.dryRun || action == syncSkip || action == syncConflict {
+		return action, 0, nil
+	}
+
+	switch action {
+	case syncPush:
+		n, err := s.push(*a.local, a.sum)
+		return action, n, err
+	case syncPull:
+		n, err := s.pull(a.key, s.localName(a.key))
+		return action, n, err
+	}
+
+	// Keep both: the remote version is saved next to the local file with
+	// a suffix, and both are uploaded.
+	suffix := ".conflict-" + time.Now().UTC().Format("20060102T150405Z")
+	name := s.localName(a.key) + suffix
+	if _, err := s.pull(a.key, name); err != nil {
+		return action, 0, err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return action, 0, err
+	}
+	if _, err = s.push(localFile{name: name, key: a.key + suffix, info: info}, ""); err != nil {
+		return action, 0, err
+	}
+	n, err := s.push(*a.local, a.sum)
+	return action, n, err
+}
+
+// syncMain - implements the 'sync <dir> s3://bucket/prefix' command,
+// which uploads the files of a directory that changed since the last
+// run, as recorded in a local cache. With -bidirectional, objects that
+// changed remotely are downloaded too, and files changed on both sides
+// are settled as per -conflict.
+func syncMain(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	cacheFile := flags.String("cache", "", "cache of synced file states, in STATE_STORE or the user cache directory by default")
+	checksum := flags.Bool("checksum", false, "compare content digests instead of sizes and mtimes")
+	dryRun := flags.Bool("dry-run", false, "only print the actions and conflicts")
+	parallel := flags.Int("parallel", 4, "number of files synced at once")
+	bidirectional := flags.Bool("bidirectional", false, "also download objects changed remotely")
+	conflict := flags.String("conflict", conflictFail, "conflict policy: newer-wins, keep-both or fail")
+	posix := flags.Bool("posix", false, "restore mtime, permissions, ownership and xattrs of downloaded files")
+	tui := flags.Bool("tui", false, "show a dashboard of the active transfers on stderr")
+	flags.Parse(args)
+	if flags.NArg() != 2 || *parallel < 1 {
+		return fmt.Errorf("Usage: sync [-checksum] [-bidirectional] [-conflict policy] [-posix] [-tui] [-cache file] [-dry-run] <dir> s3://bucket/prefix")
+	}
+	switch *conflict {
+	case conflictNewerWins, conflictKeepBoth, conflictFail:
+	default:
+		return fmt.Errorf("Unknown conflict policy %q", *conflict)
+	}
+	dir := flags.Arg(0)
+	bucketName, prefix, err := parseS3URL(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	var store StateStore
+	var key string
+	if *cacheFile == "" {
+		if store, key, err = defaultSyncCache(dir, bucketName, prefix); err != nil {
+			return err
+		}
+	} else {
+		store, key = fileStore{dir: filepath.Dir(*cacheFile)}, filepath.Base(*cacheFile)
+	}
+	cache, err := loadSyncCache(store, key, bucketName, prefix)
+	if err != nil {
+		return err
+	}
+	c, err := newCore()
+	if err != nil {
+		return err
+	}
+	s := &syncer{
+		c:             c,
+		dir:           dir,
+		bucketName:    bucketName,
+		prefix:        prefix,
+		checksum:      *checksum,
+		dryRun:        *dryRun,
+		bidirectional: *bidirectional,
+		posix:         *posix,
+		policy:        *conflict,
+		cache:         cache,
+	}
+
+	files, err := walkLocal(dir, prefix)
+	if err != nil {
+		return err
+	}
+	actions, err := s.plan(files)
+	if err != nil {
+		return err
+	}
+
+	// The dashboard is drawn on stderr, stdout keeps the JSON results.
+	if *tui && !*dryRun {
+		s.dash = newDashboard(os.Stderr, time.Second)
+	}
+	start := time.Now()
+	summary := syncSummary{Total: len(actions)}
+	enc := json.NewEncoder(os.Stdout)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan syncAction)
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range work {
+				action, n, err := s.run(a)
+
+				mu.Lock()
+				result := syncResult{Object: a.key, Action: action, Size: n}
+				switch {
+				case err != nil:
+					summary.Failed++
+					result.Error = newErrorDetail(err)
+				case action == syncSkip:
+					summary.Skipped++
+				case action == syncConflict:
+					summary.Conflicts++
+				case action == syncPull:
+					summary.Downloaded++
+				default:
+					summary.Uploaded++
+				}
+				summary.Bytes += n
+				if action != syncSkip || err != nil {
+					enc.Encode(result)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, a := range actions {
+		work <- a
+	}
+	close(work)
+	wg.Wait()
+	s.dash.stop()
+
+	if !s.dryRun {
+		if err = cache.save(); err != nil {
+			return err
+		}
+	}
+	summary.Seconds = time.Since(start).Seconds()
+	enc.Encode(summary)
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d files failed", summary.Failed, summary.Total)
+	}
+	if summary.Conflicts > 0 && !s.dryRun {
+		return fmt.Errorf("%d files changed on both sides", summary.Conflicts)
+	}
+	return nil
+}
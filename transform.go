@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+)
+
+// Encrypted streams start with encryptMagic and an 8 byte random nonce
+// prefix, followed by AES-256-GCM sealed segments of encryptSegmentSize
+// plaintext bytes. Segment nonces are the prefix and a counter, the last
+// segment is authenticated as such so truncation is detected.
+const (
+	encryptMagic       = "S3SE1\n"
+	encryptSegmentSize = 64 * 1024
+)
+
+// pipeTransform - returns a reader of the output of fn, run on its own
+// goroutine writing to w.
+func pipeTransform(fn func(w io.Writer) error) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(fn(pw))
+	}()
+	return pr
+}
+
+// compressReader - returns reader gzip compressed.
+func compressReader(reader io.Reader) io.Reader {
+	return pipeTransform(func(w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		if _, err := io.Copy(zw, reader); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+// encryptionKey - returns the AES-256 key set as 64 hex digits with
+// ENCRYPTION_KEY, nil if unset.
+func encryptionKey() ([]byte, error) {
+	v := os.Getenv("ENCRYPTION_KEY")
+	if v == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(v)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("ENCRYPTION_KEY must be 64 hex digits")
+	}
+	return key, nil
+}
+
+// segmentNonce - returns the nonce of segment n.
+func segmentNonce(prefix []byte, n uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], n)
+	return nonce
+}
+
+// segmentAD - additional data marking the last segment.
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptReader - returns reader encrypted with key.
+func encryptReader(reader io.Reader, key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	if _, err = rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	return pipeTransform(func(w io.Writer) error {
+		if _, err := io.WriteString(w, encryptMagic); err != nil {
+			return err
+		}
+		if _, err := w.Write(prefix); err != nil {
+			return err
+		}
+
+		// Read one segment ahead to know which one is the last.
+		buf := make([]byte, encryptSegmentSize)
+		next := make([]byte, encryptSegmentSize)
+		n, err := io.ReadFull(reader, buf)
+		for counter := uint32(0); ; counter++ {
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			last := err != nil
+			var m int
+			if !last {
+				m, err = io.ReadFull(reader, next)
+				last = err == io.EOF
+			}
+			if _, wErr := w.Write(aead.Seal(nil, segmentNonce(prefix, counter), buf[:n], segmentAD(last))); wErr != nil {
+				return wErr
+			}
+			if last {
+				return nil
+			}
+			buf, next, n = next, buf, m
+		}
+	}), nil
+}
+
+// decryptReader - returns the plaintext of a stream made by encryptReader.
+func decryptReader(reader io.Reader, key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return pipeTransform(func(w io.Writer) error {
+		header := make([]byte, len(encryptMagic)+8)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		if string(header[:len(encryptMagic)]) != encryptMagic {
+			return errors.New("Not an encrypted stream")
+		}
+		prefix := header[len(encryptMagic):]
+
+		segmentSize := encryptSegmentSize + aead.Overhead()
+		buf := make([]byte, segmentSize)
+		for counter := uint32(0); ; counter++ {
+			n, err := io.ReadFull(reader, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				if err == io.EOF {
+					return io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			// A full segment may still be the last one.
+			plain, oErr := aead.Open(nil, segmentNonce(prefix, counter), buf[:n], segmentAD(false))
+			last := false
+			if oErr != nil {
+				if plain, oErr = aead.Open(nil, segmentNonce(prefix, counter), buf[:n], segmentAD(true)); oErr != nil {
+					return errors.New("Encrypted stream corrupted or wrong key")
+				}
+				last = true
+			}
+			if _, err := w.Write(plain); err != nil {
+				return err
+			}
+			if last {
+				return nil
+			}
+		}
+	}), nil
+}
+
+// transforms - the transforms applied to a stream before uploading.
+type transforms struct {
+	compress bool
+	key      []byte
+}
+
+// compressionMagic - magic bytes of compressed formats, by their
+// Content-Encoding name.
+var compressionMagic = []struct {
+	encoding string
+	magic    []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"bzip2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// detectCompression - returns the compression of the data starting
+// with head, empty if none is recognized.
+func detectCompression(head []byte) string {
+	for _, c := range compressionMagic {
+		if bytes.HasPrefix(head, c.magic) {
+			return c.encoding
+		}
+	}
+	return ""
+}
+
+// apply - returns reader transformed, recording the transforms in the
+// object metadata so that downloads can undo them. Input that is
+// already compressed is passed through as is.
+func (t transforms) apply(reader io.Reader, metaData map[string][]string) (io.Reader, error) {
+	var encoding string
+	if t.compress {
+		br := bufio.NewReader(reader)
+		// Short inputs return an error along with what there is.
+		head, _ := br.Peek(6)
+		reader = br
+		if encoding = detectCompression(head); encoding != "" {
+			fmt.Fprintln(os.Stderr, "input is already", encoding, "compressed, skipping compression")
+		} else {
+			reader = compressReader(reader)
+			metaData["X-Amz-Meta-Compression"] = []string{"gzip"}
+			encoding = "gzip"
+		}
+	}
+	// Encrypted data is not in any content encoding.
+	if encoding != "" && t.key == nil {
+		metaData["Content-Encoding"] = []string{encoding}
+	}
+	if t.key != nil {
+		var err error
+		if reader, err = encryptReader(reader, t.key); err != nil {
+			return nil, err
+		}
+		metaData["X-Amz-Meta-Encryption"] = []string{"aes-256-gcm-stream"}
+	}
+	return reader, nil
+}
+
+// decompressReader - returns reader decompressed from encoding. zstd and
+// xz have no decoder in the standard library and run the 'zstd' and 'xz'
+// tools instead.
+func decompressReader(reader io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "", "identity":
+		return reader, nil
+	case "gzip":
+		return gzip.NewReader(reader)
+	case "bzip2":
+		return bzip2.NewReader(reader), nil
+	case "zstd", "xz":
+		cmd := exec.Command(encoding, "-dc")
+		cmd.Stdin = reader
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &cmdReader{ReadCloser: stdout, cmd: cmd}, nil
+	}
+	return nil, fmt.Errorf("Unsupported compression %q", encoding)
+}
+
+// autoDecompress - decompresses reader as announced by contentEncoding,
+// or else as recognized from its magic bytes.
+func autoDecompress(reader io.Reader, contentEncoding string) (io.Reader, error) {
+	if contentEncoding != "" {
+		return decompressReader(reader, contentEncoding)
+	}
+	br := bufio.NewReader(reader)
+	head, _ := br.Peek(6)
+	return decompressReader(br, detectCompression(head))
+}
+
+// undoTransforms - returns the original stream of an object uploaded with
+// transforms, as recorded in its metadata.
+func undoTransforms(reader io.Reader, metaData http.Header) (io.Reader, error) {
+	if metaData.Get("X-Amz-Meta-Encryption") != "" {
+		key, err := encryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEY must be set to decrypt")
+		}
+		if reader, err = decryptReader(reader, key); err != nil {
+			return nil, err
+		}
+	}
+	if metaData.Get("X-Amz-Meta-Compression") == "gzip" {
+		zr, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		reader = zr
+	}
+	return reader, nil
+}
+
+// recordFilter - keeps or drops newline delimited records before upload.
+type recordFilter struct {
+	// keep, if set, drops records not matching it.
+	keep *regexp.Regexp
+	// drop, if set, drops records matching it.
+	drop *regexp.Regexp
+	// sample is the fraction of the remaining records kept, 1 keeps all.
+	sample float64
+}
+
+// apply - returns reader with the filtered records only.
+func (f recordFilter) apply(reader io.Reader) io.Reader {
+	return pipeTransform(func(w io.Writer) error {
+		br := bufio.NewReaderSize(reader, 64*1024)
+		bw := bufio.NewWriterSize(w, 64*1024)
+		for {
+			record, err := br.ReadBytes('\n')
+			if len(record) > 0 && f.match(bytes.TrimRight(record, "\r\n")) {
+				if _, wErr := bw.Write(record); wErr != nil {
+					return wErr
+				}
+			}
+			if err == io.EOF {
+				return bw.Flush()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// match - returns true if the record is kept.
+func (f recordFilter) match(record []byte) bool {
+	if f.keep != nil && !f.keep.Match(record) {
+		return false
+	}
+	if f.drop != nil && f.drop.Match(record) {
+		return false
+	}
+	return f.sample >= 1 || mathrand.Float64() < f.sample
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transfer - a single object transfer shown on the dashboard. All
+// methods are no-ops on a nil transfer.
+type transfer struct {
+	name    string
+	size    int64 // size and bytes are updated atomically.
+	bytes   int64
+	started time.Time
+	ended   time.Time
+	err     error
+}
+
+// countingReader - counts bytes read into a transfer.
+type countingReader struct {
+	io.Reader
+	t *transfer
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.t.bytes, int64(n))
+	return n, err
+}
+
+// setSize - sets the size once known.
+func (t *transfer) setSize(size int64) {
+	if t != nil {
+		atomic.StoreInt64(&t.size, size)
+	}
+}
+
+// setBytes - sets the bytes transferred so far.
+func (t *transfer) setBytes(n int64) {
+	if t != nil {
+		atomic.StoreInt64(&t.bytes, n)
+	}
+}
+
+// progress - a ProgressFunc counting the bytes of uploaded parts into
+// the transfer.
+func (t *transfer) progress(ev ProgressEvent) {
+	if ev.Type == PartCompleted || ev.Type == Completed {
+		t.setBytes(ev.Bytes)
+	}
+}
+
+// wrap - returns reader counting its bytes into the transfer.
+func (t *transfer) wrap(reader io.Reader) io.Reader {
+	if t == nil {
+		return reader
+	}
+	return countingReader{reader, t}
+}
+
+// dashboard - a terminal UI showing the active transfers of a
+// multi-object command, enabled with '-tui'. All methods are no-ops
+// on a nil dashboard.
+type dashboard struct {
+	mu        sync.Mutex
+	out       io.Writer
+	started   time.Time
+	transfers []*transfer
+	completed int
+	errors    int
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+}
+
+// newDashboard - starts a dashboard redrawn on out every interval.
+func newDashboard(out io.Writer, interval time.Duration) *dashboard {
+	d := &dashboard{
+		out:     out,
+		started: time.Now(),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go func() {
+		defer close(d.doneCh)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stopCh:
+				d.render()
+				return
+			case <-ticker.C:
+				d.render()
+			}
+		}
+	}()
+	return d
+}
+
+// add - registers a new active transfer, size is -1 if unknown.
+func (d *dashboard) add(name string, size int64) *transfer {
+	if d == nil {
+		return nil
+	}
+	t := &transfer{name: name, size: size, started: time.Now()}
+	d.mu.Lock()
+	d.transfers = append(d.transfers, t)
+	d.mu.Unlock()
+	return t
+}
+
+// done - marks a transfer as finished.
+func (d *dashboard) done(t *transfer, err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t.ended = time.Now()
+	t.err = err
+	if err != nil {
+		d.errors++
+	} else {
+		d.completed++
+	}
+}
+
+// stop - draws the final state and stops redrawing.
+func (d *dashboard) stop() {
+	if d == nil {
+		return
+	}
+	close(d.stopCh)
+	<-d.doneCh
+}
+
+// maxFinishedRows - number of finished transfers kept on screen.
+const maxFinishedRows = 5
+
+// render - redraws the whole dashboard.
+func (d *dashboard) render() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var b strings.Builder
+	// Move to the top left corner and clear the screen.
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "%-40s %-32s %10s %12s\n", "OBJECT", "PROGRESS", "MiB/s", "STATUS")
+
+	var total int64
+	var active, finished []*transfer
+	for _, t := range d.transfers {
+		total += atomic.LoadInt64(&t.bytes)
+		if t.ended.IsZero() {
+			active = append(active, t)
+		} else {
+			finished = append(finished, t)
+		}
+	}
+	if len(finished) > maxFinishedRows {
+		finished = finished[len(finished)-maxFinishedRows:]
+	}
+
+	for _, t := range append(active, finished...) {
+		n := atomic.LoadInt64(&t.bytes)
+		end := t.ended
+		status := "active"
+		if end.IsZero() {
+			end = time.Now()
+		} else if t.err != nil {
+			status = "error"
+		} else {
+			status = "done"
+		}
+		fmt.Fprintf(&b, "%-40s %-32s %10.2f %12s\n", truncateName(t.name, 40),
+			progressBar(n, atomic.LoadInt64(&t.size), 20), rate(n, end.Sub(t.started)), status)
+	}
+
+	fmt.Fprintf(&b, "\nactive: %d  completed: %d  errors: %d  total: %d MiB  throughput: %.2f MiB/s\n",
+		len(active), d.completed, d.errors, total/(1024*1024), rate(total, time.Since(d.started)))
+	io.WriteString(d.out, b.String())
+}
+
+// progressBar - renders n of size as a bar of width characters, followed
+// by the percentage. Unknown sizes only show the transferred bytes.
+func progressBar(n, size int64, width int) string {
+	if size <= 0 {
+		return fmt.Sprintf("%d MiB", n/(1024*1024))
+	}
+	filled := int(int64(width) * n / size)
+	if filled > width {
+		filled = width
+	}
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled),
+		strings.Repeat(".", width-filled), n*100/size)
+}
+
+// rate - returns the throughput in MiB/s.
+func rate(n int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / elapsed.Seconds() / (1024 * 1024)
+}
+
+// truncateName - shortens long names from the left, keeping the end.
+func truncateName(name string, width int) string {
+	if len(name) <= width {
+		return name
+	}
+	return "..." + name[len(name)-width+3:]
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var (
+	flagUserAgentSuffix = flag.String("user-agent-suffix", "", "appended to the User-Agent of every request, for storage access logs")
+	flagJobID           = flag.String("job-id", "", "job id sent in the User-Agent of every request and stored as x-amz-meta-job-id of uploads")
+)
+
+// userAgentSuffix - returns what is appended to the User-Agent of
+// requests, empty if nothing is.
+func userAgentSuffix() string {
+	var parts []string
+	if *flagUserAgentSuffix != "" {
+		parts = append(parts, *flagUserAgentSuffix)
+	}
+	if *flagJobID != "" {
+		parts = append(parts, "job/"+*flagJobID)
+	}
+	return strings.Join(parts, " ")
+}
+
+// jobMetadata - adds the job id to the metadata of an upload.
+func jobMetadata(metaData map[string][]string) map[string][]string {
+	if *flagJobID == "" {
+		return metaData
+	}
+	tagged := make(map[string][]string, len(metaData)+1)
+	for k, v := range metaData {
+		tagged[k] = v
+	}
+	tagged["X-Amz-Meta-Job-Id"] = []string{*flagJobID}
+	return tagged
+}
+
+// userAgentTransport - an http.RoundTripper appending a suffix to the
+// User-Agent of requests, so that S3 access logs and CloudTrail can
+// attribute them. The User-Agent is not signed, so it is added last.
+type userAgentTransport struct {
+	base   http.RoundTripper
+	suffix string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		r.Header.Set("User-Agent", ua+" "+t.suffix)
+	} else {
+		r.Header.Set("User-Agent", "streams3/"+toolVersion+" "+t.suffix)
+	}
+	return t.base.RoundTrip(r)
+}
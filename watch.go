@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// dirWatcher - the 'watch' command, uploading files once they stopped
+// changing for the debounce period.
+type dirWatcher struct {
+	dir         string
+	bucketName  string
+	prefix      string
+	recursive   bool
+	debounce    time.Duration
+	includes    []string
+	excludes    []string
+	deleteAfter bool
+
+	fsw *fsnotify.Watcher
+	sem chan struct{}
+
+	mu       sync.Mutex
+	enc      *json.Encoder
+	timers   map[string]*time.Timer
+	inflight map[string]bool
+	// dirty files changed while being uploaded, and are uploaded again.
+	dirty map[string]bool
+}
+
+// key - returns the object name of a file, and false for files that
+// are not uploaded.
+func (w *dirWatcher) key(name string) (string, bool) {
+	rel, err := filepath.Rel(w.dir, name)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if (len(w.includes) > 0 && !matchAny(w.includes, rel)) || matchAny(w.excludes, rel) {
+		return "", false
+	}
+	return w.prefix + rel, true
+}
+
+// addDir - watches a directory, and its subdirectories if recursive.
+func (w *dirWatcher) addDir(dir string) error {
+	if !w.recursive {
+		return w.fsw.Add(dir)
+	}
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		return w.fsw.Add(name)
+	})
+}
+
+// touch - (re)starts the debounce period of a file.
+func (w *dirWatcher) touch(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t, ok := w.timers[name]; ok {
+		t.Reset(w.debounce)
+		return
+	}
+	w.timers[name] = time.AfterFunc(w.debounce, func() { w.fire(name) })
+}
+
+// fire - uploads a file that stopped changing, unless it is being
+// uploaded already.
+func (w *dirWatcher) fire(name string) {
+	w.mu.Lock()
+	delete(w.timers, name)
+	if w.inflight[name] {
+		w.dirty[name] = true
+		w.mu.Unlock()
+		return
+	}
+	w.inflight[name] = true
+	w.mu.Unlock()
+
+	go w.upload(name)
+}
+
+// upload - uploads a file, and again if it changed meanwhile.
+func (w *dirWatcher) upload(name string) {
+	w.sem <- struct{}{}
+	n, key, err := w.put(name)
+	<-w.sem
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.inflight, name)
+	again := w.dirty[name]
+	delete(w.dirty, name)
+	if key != "" {
+		result := multiResult{Object: key, Size: n, Error: newErrorDetail(err)}
+		w.enc.Encode(result)
+	}
+	if again {
+		w.timers[name] = time.AfterFunc(w.debounce, func() { w.fire(name) })
+		return
+	}
+	if err == nil && key != "" && w.deleteAfter {
+		if err = os.Remove(name); err != nil {
+			fmt.Fprintln(os.Stderr, "removing", name, "failed:", err)
+		}
+	}
+}
+
+// put - uploads a regular file, returning an empty key if the file is
+// gone or not uploaded.
+func (w *dirWatcher) put(name string) (int64, string, error) {
+	info, err := os.Lstat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, "", nil
+	}
+	key, ok := w.key(name)
+	if !ok {
+		return 0, "", nil
+	}
+	n, err := putFile(w.bucketName, key, name, fileMetadata(info))
+	return n, key, err
+}
+
+// run - handles file system events until the watcher fails.
+func (w *dirWatcher) run() error {
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Has(fsnotify.Create) && w.recursive {
+				if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+					// Files created before the watch was added are
+					// picked up by walking the new directory.
+					if err = w.addDir(ev.Name); err != nil {
+						fmt.Fprintln(os.Stderr, "watching", ev.Name, "failed:", err)
+					}
+					w.touchAll(ev.Name)
+					continue
+				}
+			}
+			if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write) {
+				if _, ok := w.key(ev.Name); ok {
+					w.touch(ev.Name)
+				}
+			}
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// touchAll - schedules the upload of the files below dir.
+func (w *dirWatcher) touchAll(dir string) {
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && name != dir && !w.recursive {
+			return filepath.SkipDir
+		}
+		if _, ok := w.key(name); ok && info.Mode().IsRegular() {
+			w.touch(name)
+		}
+		return nil
+	})
+}
+
+// watchMain - implements the 'watch <dir> s3://bucket/prefix' command,
+// which uploads files written to a directory in near real time. Files
+// are uploaded once no write was seen for the debounce period, files
+// changing during their upload are uploaded again afterwards.
+func watchMain(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	recursive := flags.Bool("recursive", false, "watch subdirectories too")
+	debounce := flags.Duration("debounce", 2*time.Second, "upload files after no write for this long")
+	include := flags.String("include", "", "comma separated globs, only matching files are uploaded")
+	exclude := flags.String("exclude", "", "comma separated globs of files not uploaded")
+	existing := flags.Bool("existing", false, "also upload the files present at start")
+	deleteAfter := flags.Bool("delete-after", false, "remove files once uploaded, as spool directories need")
+	parallel := flags.Int("parallel", 4, "number of files uploaded at once")
+	flags.Parse(args)
+	if flags.NArg() != 2 || *parallel < 1 {
+		return fmt.Errorf("Usage: watch [-recursive] [-debounce d] [-include globs] [-exclude globs] <dir> s3://bucket/prefix")
+	}
+	bucketName, prefix, err := parseS3URL(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	w := &dirWatcher{
+		dir:         flags.Arg(0),
+		bucketName:  bucketName,
+		prefix:      prefix,
+		recursive:   *recursive,
+		debounce:    *debounce,
+		deleteAfter: *deleteAfter,
+		sem:         make(chan struct{}, *parallel),
+		enc:         json.NewEncoder(os.Stdout),
+		timers:      make(map[string]*time.Timer),
+		inflight:    make(map[string]bool),
+		dirty:       make(map[string]bool),
+	}
+	if w.includes, err = splitPatterns(*include); err != nil {
+		return err
+	}
+	if w.excludes, err = splitPatterns(*exclude); err != nil {
+		return err
+	}
+
+	if w.fsw, err = fsnotify.NewWatcher(); err != nil {
+		return err
+	}
+	defer w.fsw.Close()
+	if err = w.addDir(w.dir); err != nil {
+		return err
+	}
+	if *existing {
+		w.touchAll(w.dir)
+	}
+	fmt.Fprintln(os.Stderr, "watching", w.dir)
+	return w.run()
+}
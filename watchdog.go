@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// watchdogStall - returns how long an upload may go with parts in flight
+// and no byte of them sent before it is reported stalled, set with
+// WATCHDOG_STALL, 0 if the watchdog is disabled.
+func watchdogStall() (time.Duration, error) {
+	v := os.Getenv("WATCHDOG_STALL")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("Invalid WATCHDOG_STALL %q, expected a duration of at least 1s", v)
+	}
+	return d, nil
+}
+
+// httpWatch - the last response of the process and the part uploads in
+// flight, by upload, recorded while the watchdog is enabled.
+type httpWatch struct {
+	mu         sync.Mutex
+	lastOp     string
+	lastStatus int
+	lastErr    error
+	lastTime   time.Time
+	uploads    map[string]*uploadRequests
+}
+
+// uploadRequests - the part uploads of an upload in flight, cancelled
+// together when it stalls, and the bytes they sent.
+type uploadRequests struct {
+	inFlight   map[*http.Request]context.CancelFunc
+	generation int64
+	sent       int64
+}
+
+var requestWatch = &httpWatch{uploads: make(map[string]*uploadRequests)}
+
+// upload - returns the requests of an upload, with h.mu held.
+func (h *httpWatch) upload(uploadID string) *uploadRequests {
+	u := h.uploads[uploadID]
+	if u == nil {
+		u = &uploadRequests{inFlight: make(map[*http.Request]context.CancelFunc)}
+		h.uploads[uploadID] = u
+	}
+	return u
+}
+
+func (h *httpWatch) done(req *http.Request, resp *http.Response, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastOp = req.Method + " " + req.URL.Path
+	h.lastErr = err
+	h.lastStatus = 0
+	if resp != nil {
+		h.lastStatus = resp.StatusCode
+	}
+	h.lastTime = time.Now()
+}
+
+func (h *httpWatch) forget(uploadID string, req *http.Request) {
+	h.mu.Lock()
+	if u := h.uploads[uploadID]; u != nil {
+		delete(u.inFlight, req)
+	}
+	h.mu.Unlock()
+}
+
+// release - forgets an upload once done.
+func (h *httpWatch) release(uploadID string) {
+	h.mu.Lock()
+	delete(h.uploads, uploadID)
+	h.mu.Unlock()
+}
+
+// cancel - cancels the part uploads in flight of an upload, failing them
+// so that they are sent again over new connections. Other requests of
+// the process are left alone.
+func (h *httpWatch) cancel(uploadID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u := h.upload(uploadID)
+	u.generation++
+	n := len(u.inFlight)
+	for req, cancel := range u.inFlight {
+		cancel()
+		delete(u.inFlight, req)
+	}
+	return n
+}
+
+// current - returns the number of cancel calls of an upload so far.
+func (h *httpWatch) current(uploadID string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.upload(uploadID).generation
+}
+
+// cancelledSince - returns true if the requests of an upload were
+// cancelled since the generation returned by current.
+func (h *httpWatch) cancelledSince(uploadID string, generation int64) bool {
+	return h.current(uploadID) != generation
+}
+
+// sent - returns the bytes of parts sent so far for an upload.
+func (h *httpWatch) sent(uploadID string) int64 {
+	h.mu.Lock()
+	u := h.upload(uploadID)
+	h.mu.Unlock()
+	return atomic.LoadInt64(&u.sent)
+}
+
+// watchTransport - an http.RoundTripper recording its requests in the
+// requestWatch, keeping part uploads cancellable until their body is
+// closed and counting the bytes they send.
+type watchTransport struct {
+	base http.RoundTripper
+}
+
+func (t *watchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	uploadID := query.Get("uploadId")
+	if uploadID == "" || query.Get("partNumber") == "" || req.Method != http.MethodPut {
+		resp, err := t.base.RoundTrip(req)
+		requestWatch.done(req, resp, err)
+		return resp, err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	requestWatch.mu.Lock()
+	u := requestWatch.upload(uploadID)
+	u.inFlight[req] = cancel
+	requestWatch.mu.Unlock()
+	if req.Body != nil {
+		req.Body = &countedBody{ReadCloser: req.Body, n: &u.sent}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	requestWatch.done(req, resp, err)
+	if err != nil {
+		requestWatch.forget(uploadID, req)
+		cancel()
+		return nil, err
+	}
+	resp.Body = &watchedBody{ReadCloser: resp.Body, uploadID: uploadID, req: req, cancel: cancel}
+	return resp, nil
+}
+
+// countedBody - counts the bytes read from a request body into n.
+type countedBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+type watchedBody struct {
+	io.ReadCloser
+	uploadID string
+	req      *http.Request
+	cancel   context.CancelFunc
+	once     sync.Once
+}
+
+func (b *watchedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		requestWatch.forget(b.uploadID, b.req)
+		b.cancel()
+	})
+	return err
+}
+
+// watchdog - reports an upload whose parts in flight stopped sending,
+// with WATCHDOG_RESTART=1 restarting them too. Parts slower than the
+// stall period are not restarted as long as they send.
+type watchdog struct {
+	uploadID string
+	stall    time.Duration
+	restart  bool
+
+	mu        sync.Mutex
+	last      time.Time
+	lastSent  int64
+	completed int
+	inFlight  map[int]int64
+	stopCh    chan struct{}
+}
+
+// startWatchdog - starts watching an upload, nil if WATCHDOG_STALL is not
+// set. The events of the upload are passed to observe.
+func startWatchdog(uploadID string) (*watchdog, error) {
+	stall, err := watchdogStall()
+	if err != nil || stall == 0 {
+		return nil, err
+	}
+	w := &watchdog{
+		uploadID: uploadID,
+		stall:    stall,
+		restart:  os.Getenv("WATCHDOG_RESTART") == "1",
+		last:     time.Now(),
+		inFlight: make(map[int]int64),
+		stopCh:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// observe - accounts for a progress event of the upload.
+func (w *watchdog) observe(ev ProgressEvent) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch ev.Type {
+	case PartStarted:
+		if len(w.inFlight) == 0 {
+			// Time spent reading the source is not a stall.
+			w.last = time.Now()
+		}
+		w.inFlight[ev.PartNumber] = ev.PartSize
+	case PartCompleted:
+		delete(w.inFlight, ev.PartNumber)
+		w.completed++
+		w.last = time.Now()
+	}
+}
+
+// stop - stops watching the upload.
+func (w *watchdog) stop() {
+	if w != nil {
+		close(w.stopCh)
+		requestWatch.release(w.uploadID)
+	}
+}
+
+func (w *watchdog) run() {
+	ticker := time.NewTicker(w.stall / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+		}
+		sent := requestWatch.sent(w.uploadID)
+		w.mu.Lock()
+		if sent != w.lastSent {
+			w.lastSent, w.last = sent, time.Now()
+		}
+		stalled := len(w.inFlight) > 0 && time.Since(w.last) > w.stall
+		if stalled {
+			w.dump()
+			// Reported again after another stall period.
+			w.last = time.Now()
+		}
+		w.mu.Unlock()
+		if stalled && w.restart {
+			n := requestWatch.cancel(w.uploadID)
+			fmt.Fprintf(os.Stderr, "watchdog: restarted %d requests in flight of upload %s\n", n, w.uploadID)
+		}
+	}
+}
+
+// dump - writes the state of the stalled upload and the goroutines of the
+// process to stderr.
+func (w *watchdog) dump() {
+	var bytes int64
+	for _, size := range w.inFlight {
+		bytes += size
+	}
+	fmt.Fprintf(os.Stderr, "watchdog: upload %s stalled, nothing sent for %s, %d parts completed, %d parts in flight, %d bytes in flight\n",
+		w.uploadID, time.Since(w.last).Round(time.Second), w.completed, len(w.inFlight), bytes)
+
+	h := requestWatch
+	h.mu.Lock()
+	if h.lastTime.IsZero() {
+		fmt.Fprintln(os.Stderr, "watchdog: no HTTP response yet")
+	} else if h.lastErr != nil {
+		fmt.Fprintf(os.Stderr, "watchdog: last HTTP request %s failed %s ago: %v\n", h.lastOp, time.Since(h.lastTime).Round(time.Second), h.lastErr)
+	} else {
+		fmt.Fprintf(os.Stderr, "watchdog: last HTTP request %s returned %d %s ago\n", h.lastOp, h.lastStatus, time.Since(h.lastTime).Round(time.Second))
+	}
+	if u := h.uploads[w.uploadID]; u != nil {
+		fmt.Fprintf(os.Stderr, "watchdog: %d part requests of the upload in flight\n", len(u.inFlight))
+	}
+	h.mu.Unlock()
+
+	fmt.Fprintln(os.Stderr, "watchdog: goroutines")
+	pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// errWriterClosed - returned by writes to a closed ObjectWriter.
+var errWriterClosed = errors.New("Object writer closed")
+
+// copyBufferSize - size of the transfers of ReadFrom and WriteTo, a
+// divisor of the part sizes so that parts are filled by whole transfers.
+const copyBufferSize = 1024 * 1024 * 8
+
+// ObjectWriter - an io.WriteCloser uploading what is written to it as an
+// object. Writes block while the parts they fill are uploaded, and fail
+// once the upload failed.
+type ObjectWriter struct {
+	pw     *io.PipeWriter
+	doneCh chan struct{}
+
+	once sync.Once
+	n    int64
+	err  error
+
+	mu       sync.Mutex
+	uploadID string
+	aborted  bool
+}
+
+// NewObjectWriter - starts uploading an object from the writes to the
+// returned writer. Close completes the upload, CloseWithError aborts it.
+func NewObjectWriter(bucketName, objectName string, opts ...Option) (*ObjectWriter, error) {
+	o := NewOptions(opts...)
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	w := &ObjectWriter{pw: pw, doneCh: make(chan struct{})}
+	// The upload is kept to be aborted.
+	o.Progress = multiProgress(func(ev ProgressEvent) {
+		if ev.Type == UploadStarted {
+			w.mu.Lock()
+			w.uploadID = ev.UploadID
+			w.mu.Unlock()
+		}
+	}, o.Progress)
+	go func() {
+		defer close(w.doneCh)
+		w.n, w.err = putStreamOptions(bucketName, objectName, pr, o)
+		// Writes after a failed upload fail instead of blocking.
+		if w.err != nil {
+			pr.CloseWithError(w.err)
+		} else {
+			pr.CloseWithError(errWriterClosed)
+		}
+		w.mu.Lock()
+		uploadID, aborted := w.uploadID, w.aborted
+		w.mu.Unlock()
+		if w.err != nil && aborted && uploadID != "" {
+			if aErr := abortUpload(bucketName, objectName, uploadID); aErr != nil {
+				fmt.Fprintln(os.Stderr, "AbortMultipartUpload failed", aErr)
+			}
+		}
+	}()
+	return w, nil
+}
+
+// Write - writes p to the object.
+func (w *ObjectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// ReadFrom - writes everything read from r to the object, in transfers
+// of copyBufferSize instead of the small buffers of io.Copy.
+func (w *ObjectWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, copyBufferSize)
+	for {
+		nr, rErr := readFull(r, buf)
+		if nr > 0 {
+			nw, wErr := w.pw.Write(buf[:nr])
+			n += int64(nw)
+			if wErr != nil {
+				return n, wErr
+			}
+		}
+		if rErr == io.EOF {
+			return n, nil
+		}
+		if rErr != nil {
+			return n, rErr
+		}
+	}
+}
+
+// readFull - same as io.ReadFull, except that the end of r is always
+// io.EOF, with the bytes read before it, so that a source failing with
+// io.ErrUnexpectedEOF is not taken for the end of the stream.
+func readFull(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		nr, err := r.Read(buf[n:])
+		n += nr
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close - ends the stream and waits for the upload to complete.
+func (w *ObjectWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError - ends the stream, aborting the upload if err is not
+// nil, and waits for the upload to end. Returns the error of the upload.
+func (w *ObjectWriter) CloseWithError(err error) error {
+	w.once.Do(func() {
+		w.mu.Lock()
+		w.aborted = err != nil
+		w.mu.Unlock()
+		w.pw.CloseWithError(err)
+	})
+	<-w.doneCh
+	return w.err
+}
+
+// Size - returns the bytes uploaded, once closed.
+func (w *ObjectWriter) Size() int64 {
+	<-w.doneCh
+	return w.n
+}
+
+// PutStreamFrom - same as PutStream, with a source writing itself to
+// the object, such as a bytes.Buffer or an encoder implementing
+// io.WriterTo.
+func PutStreamFrom(bucketName, objectName string, src io.WriterTo, metaData map[string][]string) (n int64, err error) {
+	w, err := NewObjectWriter(bucketName, objectName, WithMetadata(metaData))
+	if err != nil {
+		return 0, err
+	}
+	if _, err = src.WriteTo(w); err != nil {
+		w.CloseWithError(err)
+		return 0, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	return w.Size(), nil
+}